@@ -0,0 +1,166 @@
+package blob
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ErrTooLarge 写入的数据超过大小上限
+var ErrTooLarge = errors.New("数据超过大小上限")
+
+// contentKeyPrefix 按内容寻址的对象键前缀
+const contentKeyPrefix = "sha256/"
+
+// BlobStore 邮件原文和附件的对象存储，对象写入后不再修改
+// 对象按内容的 SHA-256 寻址，相同内容只保存一份，同一个键可能被多封邮件和附件引用
+// Put 返回的键在调用方 Release 前保持占用，DeleteUnreferenced 与同一键的 Put 互斥且不删除被占用的对象，
+// 避免写入引用前对象被另一次清理删除
+type BlobStore interface {
+	// Put 从 r 流式写入对象，返回对象键和大小，成功时键被占用，调用方写入或放弃引用后必须调用 Release
+	// maxSize 大于0时超过上限返回 ErrTooLarge，出错时不保留任何数据
+	Put(r io.Reader, maxSize int64) (key string, size int64, err error)
+	// Release 释放 Put 对键的占用
+	Release(key string)
+	// Open 打开对象用于读取
+	Open(key string) (io.ReadSeekCloser, error)
+	// DeleteUnreferenced 键未被占用且 referenced 确认没有引用时删除对象
+	DeleteUnreferenced(key string, referenced func(key string) (bool, error)) error
+	// Delete 直接删除对象，对象不存在时不报错，仅用于确定不会再被引用的对象（如迁移后的来源对象）
+	Delete(key string) error
+}
+
+// keyGuard 进程内按对象键串行化写入和删除，并记录 Put 之后尚未 Release 的占用
+type keyGuard struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+	pins  map[string]int
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int // 持有或等待该锁的数量，为0时移除
+}
+
+// lock 锁定对象键，返回解锁函数
+func (g *keyGuard) lock(key string) func() {
+	g.mu.Lock()
+	if g.locks == nil {
+		g.locks = make(map[string]*keyLock)
+	}
+	l := g.locks[key]
+	if l == nil {
+		l = &keyLock{}
+		g.locks[key] = l
+	}
+	l.refs++
+	g.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		g.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(g.locks, key)
+		}
+		g.mu.Unlock()
+	}
+}
+
+func (g *keyGuard) pin(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.pins == nil {
+		g.pins = make(map[string]int)
+	}
+	g.pins[key]++
+}
+
+func (g *keyGuard) unpin(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.pins[key] <= 1 {
+		delete(g.pins, key)
+		return
+	}
+	g.pins[key]--
+}
+
+func (g *keyGuard) pinned(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.pins[key] > 0
+}
+
+// deleteUnreferenced 在对象键的锁内确认没有占用和引用后调用 del 删除
+func (g *keyGuard) deleteUnreferenced(key string, referenced func(key string) (bool, error), del func(key string) error) error {
+	unlock := g.lock(key)
+	defer unlock()
+	if g.pinned(key) {
+		return nil
+	}
+	inUse, err := referenced(key)
+	if err != nil || inUse {
+		return err
+	}
+	return del(key)
+}
+
+// IsContentKey 判断对象键是否按内容寻址，旧版本写入的对象键为日期目录加随机文件名
+func IsContentKey(key string) bool {
+	return strings.HasPrefix(key, contentKeyPrefix) && validKey(key)
+}
+
+// spool 将数据写入 dir 下的临时文件并计算 SHA-256，返回定位到开头的临时文件、对象键和大小
+// 调用方负责关闭并删除临时文件
+func spool(dir string, r io.Reader, maxSize int64) (*os.File, string, int64, error) {
+	tmp, err := os.CreateTemp(dir, "put-*")
+	if err != nil {
+		return nil, "", 0, err
+	}
+	fail := func(err error) (*os.File, string, int64, error) {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, "", 0, err
+	}
+
+	src := r
+	if maxSize > 0 {
+		src = io.LimitReader(r, maxSize+1)
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), src)
+	if err != nil {
+		return fail(err)
+	}
+	if maxSize > 0 && size > maxSize {
+		return fail(ErrTooLarge)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	return tmp, contentKey(hash.Sum(nil)), size, nil
+}
+
+// contentKey 生成对象键，如 sha256/9f/9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+func contentKey(sum []byte) string {
+	digest := hex.EncodeToString(sum)
+	return contentKeyPrefix + digest[:2] + "/" + digest
+}
+
+// validKey 对象键来自数据库，仍拒绝绝对路径和 ".." 以免越出存储目录
+func validKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
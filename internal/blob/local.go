@@ -0,0 +1,94 @@
+package blob
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// LocalStore 本地文件系统的对象存储
+// 对象先写入 tmp 目录，完整写入后再移动到最终位置，读取方不会看到写了一半的对象
+type LocalStore struct {
+	dir   string
+	guard keyGuard
+}
+
+// NewLocalStore 创建本地对象存储，目录不存在时自动创建
+func NewLocalStore(dir string) (*LocalStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "tmp"), 0755); err != nil {
+		return nil, fmt.Errorf("创建对象存储目录失败: %v", err)
+	}
+	return &LocalStore{dir: dir}, nil
+}
+
+// Put 从 r 流式写入对象，内容相同的对象已存在时直接返回其键
+func (s *LocalStore) Put(r io.Reader, maxSize int64) (string, int64, error) {
+	tmp, key, size, err := spool(filepath.Join(s.dir, "tmp"), r, maxSize)
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// 先占用再检查对象是否存在，检查之后对象不会被清理删除
+	unlock := s.guard.lock(key)
+	defer unlock()
+	s.guard.pin(key)
+	if err := s.write(tmp, key); err != nil {
+		s.guard.unpin(key)
+		return "", 0, err
+	}
+	return key, size, nil
+}
+
+// write 对象不存在时将暂存文件移动到最终位置
+func (s *LocalStore) write(tmp *os.File, key string) error {
+	path := s.path(key)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Release 释放 Put 对键的占用
+func (s *LocalStore) Release(key string) {
+	s.guard.unpin(key)
+}
+
+// Open 打开对象用于读取
+func (s *LocalStore) Open(key string) (io.ReadSeekCloser, error) {
+	if !validKey(key) {
+		return nil, fmt.Errorf("无效的对象键: %s", key)
+	}
+	return os.Open(s.path(key))
+}
+
+// DeleteUnreferenced 键未被占用且没有引用时删除对象
+func (s *LocalStore) DeleteUnreferenced(key string, referenced func(key string) (bool, error)) error {
+	return s.guard.deleteUnreferenced(key, referenced, s.Delete)
+}
+
+// Delete 删除对象，对象不存在时不报错
+func (s *LocalStore) Delete(key string) error {
+	if !validKey(key) {
+		return fmt.Errorf("无效的对象键: %s", key)
+	}
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
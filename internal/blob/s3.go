@@ -0,0 +1,102 @@
+package blob
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// S3Store S3兼容（MinIO、OSS等）的对象存储
+// 写入时先在本地临时目录计算 SHA-256 和大小，对象不存在时再上传，上传失败不会留下不完整的对象
+type S3Store struct {
+	client *minio.Client
+	bucket string
+	tmpDir string
+	guard  keyGuard
+}
+
+// NewS3Store 创建S3对象存储，tmpDir 为写入时的本地暂存目录，为空时使用系统临时目录
+func NewS3Store(client *minio.Client, bucket, tmpDir string) (*S3Store, error) {
+	if tmpDir != "" {
+		if err := os.MkdirAll(tmpDir, 0755); err != nil {
+			return nil, fmt.Errorf("创建对象存储暂存目录失败: %v", err)
+		}
+	}
+	return &S3Store{client: client, bucket: bucket, tmpDir: tmpDir}, nil
+}
+
+// Put 从 r 流式写入对象，内容相同的对象已存在时直接返回其键
+func (s *S3Store) Put(r io.Reader, maxSize int64) (string, int64, error) {
+	tmp, key, size, err := spool(s.tmpDir, r, maxSize)
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// 先占用再检查对象是否存在，检查之后对象不会被清理删除
+	unlock := s.guard.lock(key)
+	defer unlock()
+	s.guard.pin(key)
+	if err := s.write(tmp, key, size); err != nil {
+		s.guard.unpin(key)
+		return "", 0, err
+	}
+	return key, size, nil
+}
+
+// write 对象不存在时上传暂存文件
+func (s *S3Store) write(tmp *os.File, key string, size int64) error {
+	ctx := context.Background()
+	if _, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{}); err == nil {
+		return nil
+	} else if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		return err
+	}
+	_, err := s.client.PutObject(ctx, s.bucket, key, tmp, size, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	return err
+}
+
+// Release 释放 Put 对键的占用
+func (s *S3Store) Release(key string) {
+	s.guard.unpin(key)
+}
+
+// Open 打开对象用于读取，对象不存在时立即返回错误
+func (s *S3Store) Open(key string) (io.ReadSeekCloser, error) {
+	if !validKey(key) {
+		return nil, fmt.Errorf("无效的对象键: %s", key)
+	}
+	object, err := s.client.GetObject(context.Background(), s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject 不发起请求，Stat 确认对象存在
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		return nil, err
+	}
+	return object, nil
+}
+
+// DeleteUnreferenced 键未被占用且没有引用时删除对象
+func (s *S3Store) DeleteUnreferenced(key string, referenced func(key string) (bool, error)) error {
+	return s.guard.deleteUnreferenced(key, referenced, s.Delete)
+}
+
+// Delete 删除对象，对象不存在时不报错
+func (s *S3Store) Delete(key string) error {
+	if !validKey(key) {
+		return fmt.Errorf("无效的对象键: %s", key)
+	}
+	err := s.client.RemoveObject(context.Background(), s.bucket, key, minio.RemoveObjectOptions{})
+	if err != nil && minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		return err
+	}
+	return nil
+}
@@ -16,6 +16,9 @@ type Config struct {
 	Email     EmailConfig     `yaml:"email"`
 	SMTP      SMTPConfig      `yaml:"smtp"`    // 新增SMTP配置
 	IMAP      IMAPConfig      `yaml:"imap"`    // 新增IMAP配置
+	LMTP      LMTPConfig      `yaml:"lmtp"`    // LMTP投递配置
+	POP3      POP3Config      `yaml:"pop3"`    // POP3配置
+	Proxy     ProxyConfig     `yaml:"proxy"`   // PROXY protocol配置
 	SMS       SMSConfig       `yaml:"sms"`     // 新增SMS配置
 	Storage   StorageConfig   `yaml:"storage"` // 新增存储配置
 	Log       LogConfig       `yaml:"log"`
@@ -70,6 +73,7 @@ type MinioConfig struct {
 	SecretAccessKey string   `yaml:"secret_access_key"`
 	UseSSl          bool     `yaml:"use_ssl"`
 	Buckets         []string `yaml:"buckets"`
+	BlobBucket      string   `yaml:"blob_bucket"` // storage.type 为 s3 时保存邮件原文和附件的桶
 }
 
 // JWTConfig JWT配置
@@ -95,6 +99,8 @@ type SMTPConfig struct {
 	UseTLS      bool   `yaml:"use_tls"`
 	TLSCertPath string `yaml:"tls_cert_path"` // TLS证书路径
 	TLSKeyPath  string `yaml:"tls_key_path"`  // TLS密钥路径
+	// SubaddressSeparators 子地址分隔符，例如 "+" 或 "+-"
+	SubaddressSeparators string `yaml:"subaddress_separators"`
 }
 
 // AttachmentConfig 附件配置
@@ -177,6 +183,29 @@ type IMAPConfig struct {
 	UseTLS      bool   `yaml:"use_tls"`
 	TLSCertPath string `yaml:"tls_cert_path"` // TLS证书路径
 	TLSKeyPath  string `yaml:"tls_key_path"`  // TLS密钥路径
+	Compress    bool   `yaml:"compress"`      // 认证后允许 COMPRESS=DEFLATE 压缩连接，节省移动端流量
+}
+
+// LMTPConfig LMTP配置（部署在Postfix等MTA之后时使用）
+type LMTPConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Addr    string `yaml:"addr"` // TCP地址如 ":24"，或 "unix:/path/lmtp.sock"
+}
+
+// POP3Config POP3配置（供只支持POP3的旧设备收取INBOX）
+type POP3Config struct {
+	Enabled     bool   `yaml:"enabled"`
+	Port        int    `yaml:"port"`     // 明文端口（通常为110），配置证书时支持STLS，0表示不监听
+	TLSPort     int    `yaml:"tls_port"` // 隐式TLS端口（通常为995），0表示不监听
+	UseTLS      bool   `yaml:"use_tls"`
+	TLSCertPath string `yaml:"tls_cert_path"` // TLS证书路径
+	TLSKeyPath  string `yaml:"tls_key_path"`  // TLS密钥路径
+}
+
+// ProxyConfig PROXY protocol配置（SMTP/IMAP部署在HAProxy或负载均衡之后时使用）
+type ProxyConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	TrustedCIDRs []string `yaml:"trusted_cidrs"` // 允许发送PROXY头的来源网段
 }
 
 // SMSConfig SMS配置
@@ -190,8 +219,9 @@ type SMSConfig struct {
 
 // StorageConfig 存储配置
 type StorageConfig struct {
-	Type      string   `yaml:"type"` // local, oss, s3
+	Type      string   `yaml:"type"` // local, oss, s3；oss 和 s3 均使用 minio 配置的S3兼容存储
 	BasePath  string   `yaml:"base_path"`
+	BlobPath  string   `yaml:"blob_path"` // 邮件原文和附件存储目录，使用S3时作为上传前的暂存目录
 	MaxSize   int64    `yaml:"max_size"`
 	AllowExts []string `yaml:"allow_exts"`
 	CDNDomain string   `yaml:"cdn_domain"`
@@ -154,3 +154,14 @@ const (
 	DefaultSMTPSPort       = 465 // SMTP over SSL
 	DefaultTimeout         = 30  // 秒
 )
+
+// 邮件投递状态
+const (
+	EmailDeliveryBounced    = "bounced"    // 退信
+	EmailDeliveryComplained = "complained" // 被投诉为垃圾邮件
+)
+
+// 抑制原因
+const (
+	SuppressionReasonHardBounce = "hard_bounce" // 永久性退信
+)
@@ -0,0 +1,83 @@
+package event
+
+import (
+	"sync"
+
+	"github.com/rankgice/new-email/internal/model"
+)
+
+// Type 邮件事件类型
+type Type string
+
+const (
+	TypeNew     Type = "new"     // 文件夹中新增邮件
+	TypeFlags   Type = "flags"   // 邮件标志变更
+	TypeExpunge Type = "expunge" // 邮件从文件夹中移除
+)
+
+// Event 邮件变更事件，按文件夹和UID定位邮件
+type Event struct {
+	Type      Type
+	MailboxId int64
+	FolderId  int64
+	EmailId   int64
+	Uid       uint32
+	Flags     []string // 变更后的全部标志，仅 TypeFlags 使用
+	Origin    any      // 触发变更的来源（如IMAP会话），订阅方可据此跳过自身产生的通知
+}
+
+// EmailEvent 根据邮件记录构建事件
+func EmailEvent(eventType Type, email *model.Email) Event {
+	return Event{
+		Type:      eventType,
+		MailboxId: email.MailboxId,
+		FolderId:  email.FolderId,
+		EmailId:   email.Id,
+		Uid:       email.Uid,
+		Flags:     email.Flags(),
+	}
+}
+
+// Bus 进程内邮件事件总线
+// 事件在发布者的goroutine中同步分发，订阅方不能阻塞
+type Bus struct {
+	mu       sync.RWMutex
+	nextId   int
+	handlers map[int]func(Event)
+}
+
+// NewBus 创建事件总线
+func NewBus() *Bus {
+	return &Bus{
+		handlers: make(map[int]func(Event)),
+	}
+}
+
+// Subscribe 订阅全部事件，返回取消订阅的函数
+func (b *Bus) Subscribe(handler func(Event)) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.nextId
+	b.nextId++
+	b.handlers[id] = handler
+
+	return func() {
+		b.mu.Lock()
+		delete(b.handlers, id)
+		b.mu.Unlock()
+	}
+}
+
+// Publish 发布事件，总线为nil或事件缺少文件夹/UID时忽略
+func (b *Bus) Publish(e Event) {
+	if b == nil || e.FolderId == 0 || e.Uid == 0 {
+		return
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, handler := range b.handlers {
+		handler(e)
+	}
+}
@@ -1310,6 +1310,7 @@ func (h *AdminHandler) List(c *gin.Context) {
 			Nickname:    user.Nickname,
 			Status:      user.Status,
 			LastLoginAt: user.LastLoginAt,
+			Quota:       quotaResp(user.Quota),
 			CreatedAt:   user.CreatedAt,
 			UpdatedAt:   user.UpdatedAt,
 		}
@@ -1388,6 +1389,7 @@ func (h *AdminHandler) GetById(c *gin.Context) {
 			UserId:    mailbox.UserId,
 			Email:     mailbox.Email,
 			Status:    mailbox.Status,
+			Quota:     quotaResp(mailbox.Quota),
 			CreatedAt: mailbox.CreatedAt,
 			UpdatedAt: mailbox.UpdatedAt,
 		})
@@ -1415,6 +1417,7 @@ func (h *AdminHandler) GetById(c *gin.Context) {
 			Nickname:    user.Nickname,
 			Status:      user.Status,
 			LastLoginAt: user.LastLoginAt,
+			Quota:       quotaResp(user.Quota),
 			CreatedAt:   user.CreatedAt,
 			UpdatedAt:   user.UpdatedAt,
 		},
@@ -1478,6 +1481,8 @@ func (h *AdminHandler) Create(c *gin.Context) {
 		Nickname: req.Nickname,
 		Status:   req.Status,
 	}
+	user.QuotaBytes = req.QuotaBytes
+	user.QuotaMessages = req.QuotaMessages
 
 	if err := h.svcCtx.UserModel.Create(user); err != nil {
 		c.JSON(http.StatusInternalServerError, result.ErrorAdd.AddError(err))
@@ -1491,6 +1496,7 @@ func (h *AdminHandler) Create(c *gin.Context) {
 		Email:     user.Email,
 		Nickname:  user.Nickname,
 		Status:    user.Status,
+		Quota:     quotaResp(user.Quota),
 		CreatedAt: user.CreatedAt,
 		UpdatedAt: user.UpdatedAt,
 	}
@@ -1561,6 +1567,20 @@ func (h *AdminHandler) Update(c *gin.Context) {
 		return
 	}
 
+	// 更新存储配额，0表示不限制
+	if req.QuotaBytes != nil || req.QuotaMessages != nil {
+		if req.QuotaBytes != nil {
+			user.QuotaBytes = *req.QuotaBytes
+		}
+		if req.QuotaMessages != nil {
+			user.QuotaMessages = *req.QuotaMessages
+		}
+		if err := h.svcCtx.UserModel.SetQuota(user.Id, user.QuotaBytes, user.QuotaMessages); err != nil {
+			c.JSON(http.StatusInternalServerError, result.ErrorUpdate.AddError(err))
+			return
+		}
+	}
+
 	// 返回更新后的用户信息
 	resp := types.UserResp{
 		Id:          user.Id,
@@ -1569,6 +1589,7 @@ func (h *AdminHandler) Update(c *gin.Context) {
 		Nickname:    user.Nickname,
 		Status:      user.Status,
 		LastLoginAt: user.LastLoginAt,
+		Quota:       quotaResp(user.Quota),
 		CreatedAt:   user.CreatedAt,
 		UpdatedAt:   user.UpdatedAt,
 	}
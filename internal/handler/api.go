@@ -9,6 +9,7 @@ import (
 	"github.com/rankgice/new-email/internal/types"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -71,6 +72,10 @@ func (h *ApiHandler) GetEmail(c *gin.Context) {
 		c.JSON(http.StatusForbidden, result.ErrorSimpleResult("无权限查看此邮件"))
 		return
 	}
+	if err := loadEmailContent(h.svcCtx, email); err != nil {
+		c.JSON(http.StatusInternalServerError, result.ErrorSelect.AddError(err))
+		return
+	}
 
 	// 返回邮件详情
 	resp := types.EmailResp{
@@ -131,6 +136,17 @@ func (h *ApiHandler) SendEmail(c *gin.Context) {
 		mailbox = mailboxes[0]
 	}
 
+	// 检查抑制列表，已永久退信的地址默认拒绝发送
+	suppressed, err := findSuppressedRecipients(h.svcCtx, userId, &req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, result.ErrorSelect.AddError(err))
+		return
+	}
+	if len(suppressed) > 0 {
+		c.JSON(http.StatusBadRequest, result.ErrorSimpleResult("收件人在抑制列表中: "+strings.Join(suppressed, ", ")))
+		return
+	}
+
 	smtpConfig, err := buildSMTPConfig(h.svcCtx, mailbox)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, result.ErrorSimpleResult("邮箱凭据不可用于发信"))
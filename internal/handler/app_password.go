@@ -0,0 +1,167 @@
+package handler
+
+import (
+	"crypto/rand"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rankgice/new-email/internal/model"
+	"github.com/rankgice/new-email/internal/result"
+	"github.com/rankgice/new-email/internal/svc"
+	"github.com/rankgice/new-email/internal/types"
+	"github.com/rankgice/new-email/pkg/auth"
+)
+
+// appPasswordAlphabet 应用专用密码字符集，只用小写字母便于在手机上输入
+const appPasswordAlphabet = "abcdefghijklmnopqrstuvwxyz"
+
+// AppPasswordHandler 应用专用密码处理器
+type AppPasswordHandler struct {
+	svcCtx *svc.ServiceContext
+}
+
+// NewAppPasswordHandler 创建应用专用密码处理器
+func NewAppPasswordHandler(svcCtx *svc.ServiceContext) *AppPasswordHandler {
+	return &AppPasswordHandler{
+		svcCtx: svcCtx,
+	}
+}
+
+// List 邮箱的应用专用密码列表
+func (h *AppPasswordHandler) List(c *gin.Context) {
+	mailbox, ok := h.checkMailbox(c)
+	if !ok {
+		return
+	}
+
+	appPasswords, err := h.svcCtx.AppPasswordModel.GetByMailboxId(mailbox.Id)
+	if err != nil {
+		c.JSON(http.StatusOK, result.ErrorSelect.AddError(err))
+		return
+	}
+
+	list := make([]types.AppPasswordResp, 0, len(appPasswords))
+	for _, appPassword := range appPasswords {
+		list = append(list, types.AppPasswordResp{
+			Id:         appPassword.Id,
+			MailboxId:  appPassword.MailboxId,
+			Label:      appPassword.Label,
+			Hint:       appPassword.Hint,
+			Scope:      appPassword.Scope,
+			LastUsedAt: appPassword.LastUsedAt,
+			CreatedAt:  appPassword.CreatedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, result.SuccessResult(list))
+}
+
+// Create 生成应用专用密码，明文只在创建时返回一次
+func (h *AppPasswordHandler) Create(c *gin.Context) {
+	var req types.AppPasswordCreateReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusOK, result.ErrorBindingParam.AddError(err))
+		return
+	}
+
+	mailbox, ok := h.checkMailbox(c)
+	if !ok {
+		return
+	}
+
+	password, err := generateAppPassword()
+	if err != nil {
+		c.JSON(http.StatusOK, result.ErrorSimpleResult("生成应用专用密码失败"))
+		return
+	}
+	normalized := model.NormalizeAppPassword(password)
+	hashedPassword, err := auth.HashPassword(normalized)
+	if err != nil {
+		c.JSON(http.StatusOK, result.ErrorSimpleResult("密码加密失败"))
+		return
+	}
+
+	appPassword := &model.AppPassword{
+		MailboxId:    mailbox.Id,
+		UserId:       mailbox.UserId,
+		Label:        strings.TrimSpace(req.Label),
+		PasswordHash: hashedPassword,
+		Hint:         normalized[len(normalized)-4:],
+		Scope:        req.Scope,
+	}
+	if err := h.svcCtx.AppPasswordModel.Create(appPassword); err != nil {
+		c.JSON(http.StatusOK, result.ErrorAdd.AddError(err))
+		return
+	}
+
+	c.JSON(http.StatusOK, result.SuccessResult(types.AppPasswordCreateResp{
+		Id:        appPassword.Id,
+		MailboxId: appPassword.MailboxId,
+		Label:     appPassword.Label,
+		Password:  password,
+		Hint:      appPassword.Hint,
+		Scope:     appPassword.Scope,
+		CreatedAt: appPassword.CreatedAt,
+	}))
+}
+
+// Delete 吊销应用专用密码，使用它的客户端下次登录即失败
+func (h *AppPasswordHandler) Delete(c *gin.Context) {
+	mailbox, ok := h.checkMailbox(c)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(c.Param("passwordId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusOK, result.ErrorSimpleResult("无效的应用专用密码ID"))
+		return
+	}
+
+	appPassword, err := h.svcCtx.AppPasswordModel.GetById(id)
+	if err != nil {
+		c.JSON(http.StatusOK, result.ErrorSelect.AddError(err))
+		return
+	}
+	if appPassword == nil || appPassword.MailboxId != mailbox.Id {
+		c.JSON(http.StatusOK, result.ErrorSimpleResult("应用专用密码不存在"))
+		return
+	}
+
+	if err := h.svcCtx.AppPasswordModel.Delete(appPassword); err != nil {
+		c.JSON(http.StatusOK, result.ErrorDelete.AddError(err))
+		return
+	}
+
+	c.JSON(http.StatusOK, result.SimpleResult("吊销成功"))
+}
+
+// checkMailbox 根据路径参数获取属于当前用户的邮箱，失败时已写入响应
+func (h *AppPasswordHandler) checkMailbox(c *gin.Context) (*model.Mailbox, bool) {
+	mailboxId, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusOK, result.ErrorSimpleResult("无效的邮箱ID"))
+		return nil, false
+	}
+	return loadOwnedMailbox(c, h.svcCtx, mailboxId)
+}
+
+// generateAppPassword 生成16位随机小写字母，按4位一组以连字符分隔，如 abcd-efgh-ijkl-mnop
+func generateAppPassword() (string, error) {
+	var b strings.Builder
+	max := big.NewInt(int64(len(appPasswordAlphabet)))
+	for i := 0; i < 16; i++ {
+		if i > 0 && i%4 == 0 {
+			b.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(appPasswordAlphabet[n.Int64()])
+	}
+	return b.String(), nil
+}
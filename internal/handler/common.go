@@ -2,7 +2,9 @@ package handler
 
 import (
 	"crypto/rand"
+	"errors"
 	"fmt"
+	"github.com/rankgice/new-email/internal/blob"
 	"github.com/rankgice/new-email/internal/result"
 	"github.com/rankgice/new-email/internal/svc"
 	"github.com/rankgice/new-email/internal/types"
@@ -204,22 +206,22 @@ func (h *CommonHandler) Upload(c *gin.Context) {
 		return
 	}
 
-	// 使用存储服务上传文件
-	if h.svcCtx.ServiceManager.Storage == nil {
-		c.JSON(http.StatusInternalServerError, result.ErrorSimpleResult("存储服务未配置"))
-		return
-	}
-
-	fileInfo, err := h.svcCtx.ServiceManager.Storage.UploadFile(file, header, uploadType)
+	// 与邮件附件一样写入对象存储，相同内容只存一份
+	key, size, err := h.svcCtx.BlobStore.Put(file, maxSize)
 	if err != nil {
+		if errors.Is(err, blob.ErrTooLarge) {
+			c.JSON(http.StatusBadRequest, result.ErrorSimpleResult("文件大小超过限制"))
+			return
+		}
 		c.JSON(http.StatusInternalServerError, result.ErrorSimpleResult("文件上传失败: "+err.Error()))
 		return
 	}
+	h.svcCtx.BlobStore.Release(key)
 
 	resp := types.UploadResp{
-		Url:      fileInfo.URL,
-		Filename: fileInfo.Filename,
-		Size:     fileInfo.Size,
+		Url:      key,
+		Filename: header.Filename,
+		Size:     size,
 		Type:     uploadType,
 	}
 
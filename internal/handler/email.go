@@ -4,12 +4,14 @@ import (
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"github.com/rankgice/new-email/internal/event"
 	"github.com/rankgice/new-email/internal/middleware"
 	"github.com/rankgice/new-email/internal/model"
 	"github.com/rankgice/new-email/internal/result"
 	"github.com/rankgice/new-email/internal/service"
 	"github.com/rankgice/new-email/internal/svc"
 	"github.com/rankgice/new-email/internal/types"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -65,12 +67,14 @@ func (h *EmailHandler) List(c *gin.Context) {
 			CreatedAtStart: req.CreatedAtStart,
 			CreatedAtEnd:   req.CreatedAtEnd,
 		},
-		UserId:    currentUserId, // 设置当前用户ID
-		MailboxId: req.MailboxId, // 默认值
-		Subject:   req.Subject,
-		Direction: req.Direction,
-		FromEmail: req.FromEmail,
-		ToEmails:  req.ToEmail, // 使用ToEmails字段
+		UserId:       currentUserId, // 设置当前用户ID
+		MailboxId:    req.MailboxId, // 默认值
+		Subject:      req.Subject,
+		Direction:    req.Direction,
+		FromEmail:    req.FromEmail,
+		ToEmails:     req.ToEmail, // 使用ToEmails字段
+		ThreadId:     req.ThreadId,
+		Conversation: req.Conversation,
 	}
 
 	// 查询邮件列表
@@ -80,25 +84,42 @@ func (h *EmailHandler) List(c *gin.Context) {
 		return
 	}
 
+	// 按会话列出时附带每个会话的邮件数量
+	var threadCounts map[int64]int64
+	if req.Conversation {
+		threadIds := make([]int64, 0, len(emails))
+		for _, email := range emails {
+			threadIds = append(threadIds, email.ThreadId)
+		}
+		if threadCounts, err = h.svcCtx.EmailModel.ThreadCounts(threadIds); err != nil {
+			c.JSON(http.StatusOK, result.ErrorSelect.AddError(err))
+			return
+		}
+	}
+
 	// 转换为响应格式
 	var emailList []types.EmailResp
 	for _, email := range emails {
 		emailList = append(emailList, types.EmailResp{
-			Id:          email.Id,
-			UserId:      email.UserId, // 添加用户ID
-			MailboxId:   email.MailboxId,
-			Subject:     email.Subject,
-			FromEmail:   email.FromEmail,
-			ToEmail:     email.ToEmails,  // 使用ToEmails字段
-			CcEmail:     email.CcEmails,  // 使用CcEmails字段
-			BccEmail:    email.BccEmails, // 使用BccEmails字段
-			Content:     email.Content,
-			ContentType: email.ContentType,
-			Attachments: "", // Email模型中没有Attachments字段
-			Status:      0,  // Email模型中没有Status字段
-			Type:        "", // Email模型中没有Type字段
-			CreatedAt:   email.CreatedAt,
-			UpdatedAt:   email.UpdatedAt,
+			Id:             email.Id,
+			UserId:         email.UserId, // 添加用户ID
+			MailboxId:      email.MailboxId,
+			Subject:        email.Subject,
+			FromEmail:      email.FromEmail,
+			ToEmail:        email.ToEmails,  // 使用ToEmails字段
+			CcEmail:        email.CcEmails,  // 使用CcEmails字段
+			BccEmail:       email.BccEmails, // 使用BccEmails字段
+			Content:        email.Content,
+			ContentType:    email.ContentType,
+			Attachments:    "", // Email模型中没有Attachments字段
+			Status:         0,  // Email模型中没有Status字段
+			Type:           "", // Email模型中没有Type字段
+			DeliveryStatus: email.DeliveryStatus,
+			Flags:          email.Flags(),
+			ThreadId:       email.ThreadId,
+			ThreadCount:    threadCounts[email.ThreadId],
+			CreatedAt:      email.CreatedAt,
+			UpdatedAt:      email.UpdatedAt,
 		})
 	}
 
@@ -151,23 +172,29 @@ func (h *EmailHandler) GetById(c *gin.Context) {
 		c.JSON(http.StatusOK, result.ErrorSimpleResult("无权限查看此邮件"))
 		return
 	}
+	if err := loadEmailContent(h.svcCtx, email); err != nil {
+		c.JSON(http.StatusOK, result.ErrorSelect.AddError(err))
+		return
+	}
 
 	// 返回邮件详情
 	resp := types.EmailResp{
-		Id:          email.Id,
-		MailboxId:   email.MailboxId,
-		Subject:     email.Subject,
-		FromEmail:   email.FromEmail,
-		ToEmail:     email.ToEmails,  // 使用ToEmails字段
-		CcEmail:     email.CcEmails,  // 使用CcEmails字段
-		BccEmail:    email.BccEmails, // 使用BccEmails字段
-		Content:     email.Content,
-		ContentType: email.ContentType,
-		Attachments: "", // Email模型中没有Attachments字段
-		Status:      0,  // Email模型中没有Status字段
-		Type:        "", // Email模型中没有Type字段
-		CreatedAt:   email.CreatedAt,
-		UpdatedAt:   email.UpdatedAt,
+		Id:             email.Id,
+		MailboxId:      email.MailboxId,
+		Subject:        email.Subject,
+		FromEmail:      email.FromEmail,
+		ToEmail:        email.ToEmails,  // 使用ToEmails字段
+		CcEmail:        email.CcEmails,  // 使用CcEmails字段
+		BccEmail:       email.BccEmails, // 使用BccEmails字段
+		Content:        email.Content,
+		ContentType:    email.ContentType,
+		Attachments:    "", // Email模型中没有Attachments字段
+		Status:         0,  // Email模型中没有Status字段
+		Type:           "", // Email模型中没有Type字段
+		DeliveryStatus: email.DeliveryStatus,
+		Flags:          email.Flags(),
+		CreatedAt:      email.CreatedAt,
+		UpdatedAt:      email.UpdatedAt,
 	}
 
 	c.JSON(http.StatusOK, result.SuccessResult(resp))
@@ -212,6 +239,17 @@ func (h *EmailHandler) Send(c *gin.Context) {
 		return
 	}
 
+	// 检查抑制列表，已永久退信的地址默认拒绝发送
+	suppressed, err := findSuppressedRecipients(h.svcCtx, currentUserId, &req)
+	if err != nil {
+		c.JSON(http.StatusOK, result.ErrorSelect.AddError(err))
+		return
+	}
+	if len(suppressed) > 0 {
+		c.JSON(http.StatusOK, result.ErrorSimpleResult("收件人在抑制列表中: "+strings.Join(suppressed, ", ")))
+		return
+	}
+
 	// 调用邮件发送服务
 	smtpConfig, err := buildSMTPConfig(h.svcCtx, mailbox)
 	if err != nil {
@@ -340,6 +378,7 @@ func (h *EmailHandler) MarkRead(c *gin.Context) {
 		c.JSON(http.StatusOK, result.ErrorUpdate.AddError(err))
 		return
 	}
+	publishEmailEvent(h.svcCtx, event.TypeFlags, email)
 
 	c.JSON(http.StatusOK, result.SimpleResult("标记成功"))
 }
@@ -399,6 +438,8 @@ func (h *EmailHandler) MarkStar(c *gin.Context) {
 		c.JSON(http.StatusOK, result.ErrorUpdate.AddError(err))
 		return
 	}
+	email.IsStarred = req.IsStarred
+	publishEmailEvent(h.svcCtx, event.TypeFlags, email)
 
 	message := "取消星标成功"
 	if req.IsStarred {
@@ -407,6 +448,81 @@ func (h *EmailHandler) MarkStar(c *gin.Context) {
 	c.JSON(http.StatusOK, result.SimpleResult(message))
 }
 
+// UpdateFlags 修改邮件标志，支持添加、移除和替换
+func (h *EmailHandler) UpdateFlags(c *gin.Context) {
+	// 获取邮件ID
+	idStr := c.Param("id")
+	emailId, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		c.JSON(http.StatusOK, result.ErrorSimpleResult("无效的邮件ID"))
+		return
+	}
+
+	var req types.EmailFlagsReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusOK, result.ErrorBindingParam.AddError(err))
+		return
+	}
+
+	// 获取当前用户ID
+	currentUserId := middleware.GetCurrentUserId(c)
+	if currentUserId == 0 {
+		c.JSON(http.StatusOK, result.ErrorUnauthorized)
+		return
+	}
+
+	// 查询邮件
+	email, err := h.svcCtx.EmailModel.GetById(emailId)
+	if err != nil {
+		c.JSON(http.StatusOK, result.ErrorSelect.AddError(err))
+		return
+	}
+	if email == nil {
+		c.JSON(http.StatusOK, result.ErrorSimpleResult("邮件不存在"))
+		return
+	}
+
+	// 检查权限
+	mailbox, err := h.svcCtx.MailboxModel.GetById(email.MailboxId)
+	if err != nil {
+		c.JSON(http.StatusOK, result.ErrorSelect.AddError(err))
+		return
+	}
+	if mailbox == nil || mailbox.UserId != currentUserId {
+		c.JSON(http.StatusOK, result.ErrorSimpleResult("无权限操作此邮件"))
+		return
+	}
+
+	// 校验标志：只接受支持的系统标志和合法关键字
+	for _, flag := range req.Flags {
+		if strings.HasPrefix(flag, `\`) {
+			supported := false
+			for _, systemFlag := range model.SystemFlags {
+				if strings.EqualFold(flag, systemFlag) {
+					supported = true
+					break
+				}
+			}
+			if !supported {
+				c.JSON(http.StatusOK, result.ErrorSimpleResult("不支持的系统标志: "+flag))
+				return
+			}
+		} else if !model.IsValidKeyword(flag) {
+			c.JSON(http.StatusOK, result.ErrorSimpleResult("无效的关键字: "+flag))
+			return
+		}
+	}
+
+	email.ApplyFlags(model.FlagOp(req.Op), req.Flags)
+	if err := h.svcCtx.EmailModel.UpdateFlags(email); err != nil {
+		c.JSON(http.StatusOK, result.ErrorUpdate.AddError(err))
+		return
+	}
+	publishEmailEvent(h.svcCtx, event.TypeFlags, email)
+
+	c.JSON(http.StatusOK, result.SuccessResult(types.EmailFlagsResp{Flags: email.Flags()}))
+}
+
 // Delete 删除邮件
 func (h *EmailHandler) Delete(c *gin.Context) {
 	// 获取邮件ID
@@ -451,6 +567,7 @@ func (h *EmailHandler) Delete(c *gin.Context) {
 		c.JSON(http.StatusOK, result.ErrorDelete.AddError(err))
 		return
 	}
+	publishEmailEvent(h.svcCtx, event.TypeExpunge, email)
 
 	c.JSON(http.StatusOK, result.SimpleResult("删除成功"))
 }
@@ -529,6 +646,7 @@ func (h *EmailHandler) BatchOperation(c *gin.Context) {
 				failCount++
 				continue
 			}
+			publishEmailEvent(h.svcCtx, event.TypeExpunge, email)
 			successCount++
 		}
 
@@ -571,9 +689,24 @@ func (h *EmailHandler) BatchOperation(c *gin.Context) {
 				continue
 			}
 
-			// 移动邮件
-			email.MailboxId = req.TargetId
-			if err := h.svcCtx.EmailModel.Update(email); err != nil {
+			// 移动邮件，用量随之转移到目标邮箱
+			if email.MailboxId == req.TargetId {
+				successCount++
+				continue
+			}
+			// 同一用户的邮箱间移动不改变用户总用量，只检查目标邮箱配额
+			targetQuota, _, err := h.svcCtx.MailboxModel.GetQuota(req.TargetId)
+			if err != nil {
+				errors = append(errors, err.Error())
+				failCount++
+				continue
+			}
+			if !targetQuota.Allows(email.Size, 1) {
+				errors = append(errors, model.ErrQuotaExceeded.Error())
+				failCount++
+				continue
+			}
+			if err := h.svcCtx.EmailModel.MoveToMailbox(email, req.TargetId); err != nil {
 				errors = append(errors, err.Error())
 				failCount++
 				continue
@@ -620,7 +753,12 @@ func (h *EmailHandler) batchUpdateEmailStatus(emailId int64, userId int64, statu
 	updateData := map[string]interface{}{
 		"is_read": status == 1,
 	}
-	return h.svcCtx.EmailModel.MapUpdate(nil, emailId, updateData)
+	if err := h.svcCtx.EmailModel.MapUpdate(nil, emailId, updateData); err != nil {
+		return err
+	}
+	email.IsRead = status == 1
+	publishEmailEvent(h.svcCtx, event.TypeFlags, email)
+	return nil
 }
 
 // Export 导出邮件
@@ -714,6 +852,16 @@ func (h *EmailHandler) Export(c *gin.Context) {
 
 	filePath := filepath.Join(exportDir, fileName)
 
+	// 导出内容时读取保存在blob中的原文
+	if req.IncludeContent || req.Format == "eml" {
+		for _, email := range filteredEmails {
+			if err := loadEmailContent(h.svcCtx, email); err != nil {
+				c.JSON(http.StatusOK, result.ErrorSelect.AddError(err))
+				return
+			}
+		}
+	}
+
 	// 根据格式导出
 	var fileSize int64
 	switch req.Format {
@@ -967,6 +1115,57 @@ func (h *EmailHandler) Download(c *gin.Context) {
 	c.File(filePath)
 }
 
+// DownloadAttachment 下载邮件附件，附件数据从对象存储读取
+func (h *EmailHandler) DownloadAttachment(c *gin.Context) {
+	emailId, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusOK, result.ErrorSimpleResult("无效的邮件ID"))
+		return
+	}
+	attachmentId, err := strconv.ParseInt(c.Param("attachmentId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusOK, result.ErrorSimpleResult("无效的附件ID"))
+		return
+	}
+
+	currentUserId := middleware.GetCurrentUserId(c)
+	if currentUserId == 0 {
+		c.JSON(http.StatusOK, result.ErrorUnauthorized)
+		return
+	}
+
+	// 检查权限（只能下载自己邮件的附件）
+	email, err := h.svcCtx.EmailModel.GetById(emailId)
+	if err != nil {
+		c.JSON(http.StatusOK, result.ErrorSelect.AddError(err))
+		return
+	}
+	if email == nil || email.UserId != currentUserId {
+		c.JSON(http.StatusOK, result.ErrorSimpleResult("邮件不存在"))
+		return
+	}
+	attachment, err := h.svcCtx.EmailAttachmentModel.GetById(attachmentId)
+	if err != nil || attachment.EmailId != email.Id || attachment.FilePath == "" {
+		c.JSON(http.StatusOK, result.ErrorSimpleResult("附件不存在"))
+		return
+	}
+
+	r, err := h.svcCtx.BlobStore.Open(attachment.FilePath)
+	if err != nil {
+		c.JSON(http.StatusOK, result.ErrorSimpleResult("附件数据不存在"))
+		return
+	}
+	defer r.Close()
+
+	contentType := attachment.MimeType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.DataFromReader(http.StatusOK, attachment.FileSize, contentType, r, map[string]string{
+		"Content-Disposition": mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}),
+	})
+}
+
 // formatTimePtr 格式化时间指针
 func formatTimePtr(t *time.Time) string {
 	if t == nil {
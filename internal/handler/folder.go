@@ -0,0 +1,296 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rankgice/new-email/internal/event"
+	"github.com/rankgice/new-email/internal/model"
+	"github.com/rankgice/new-email/internal/result"
+	"github.com/rankgice/new-email/internal/svc"
+	"github.com/rankgice/new-email/internal/types"
+)
+
+// FolderHandler 文件夹处理器
+type FolderHandler struct {
+	svcCtx *svc.ServiceContext
+}
+
+// NewFolderHandler 创建文件夹处理器
+func NewFolderHandler(svcCtx *svc.ServiceContext) *FolderHandler {
+	return &FolderHandler{
+		svcCtx: svcCtx,
+	}
+}
+
+// List 邮箱下的文件夹列表，按完整路径排序
+func (h *FolderHandler) List(c *gin.Context) {
+	var req types.FolderListReq
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusOK, result.ErrorBindingParam.AddError(err))
+		return
+	}
+
+	if !h.checkMailbox(c, req.MailboxId) {
+		return
+	}
+
+	folders, err := h.svcCtx.FolderModel.GetByMailboxId(req.MailboxId)
+	if err != nil {
+		c.JSON(http.StatusOK, result.ErrorSelect.AddError(err))
+		return
+	}
+
+	paths := model.FolderPaths(folders)
+	folderList := make([]types.FolderResp, 0, len(folders))
+	for _, folder := range folders {
+		folderList = append(folderList, folderResp(folder, paths[folder.Id]))
+	}
+	sort.Slice(folderList, func(i, j int) bool {
+		return folderList[i].Path < folderList[j].Path
+	})
+
+	c.JSON(http.StatusOK, result.SuccessResult(folderList))
+}
+
+// Create 按完整路径创建文件夹
+func (h *FolderHandler) Create(c *gin.Context) {
+	var req types.FolderCreateReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusOK, result.ErrorBindingParam.AddError(err))
+		return
+	}
+	if req.SpecialUse != "" && !model.IsValidSpecialUse(req.SpecialUse) {
+		c.JSON(http.StatusOK, result.ErrorSimpleResult("不支持的特殊用途属性: "+req.SpecialUse))
+		return
+	}
+
+	if !h.checkMailbox(c, req.MailboxId) {
+		return
+	}
+
+	folder, err := h.svcCtx.FolderModel.CreatePath(req.MailboxId, req.Path, req.SpecialUse)
+	if err != nil {
+		h.writeFolderError(c, result.ErrorAdd, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, result.SuccessResult(h.folderResp(folder)))
+}
+
+// Update 重命名或移动文件夹，子文件夹随之移动
+func (h *FolderHandler) Update(c *gin.Context) {
+	var req types.FolderUpdateReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusOK, result.ErrorBindingParam.AddError(err))
+		return
+	}
+
+	folder, ok := h.checkFolder(c)
+	if !ok {
+		return
+	}
+	if folder.IsSystem {
+		c.JSON(http.StatusOK, result.ErrorSimpleResult("不能重命名系统文件夹"))
+		return
+	}
+
+	if err := h.svcCtx.FolderModel.MoveToPath(folder, req.Path); err != nil {
+		h.writeFolderError(c, result.ErrorUpdate, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, result.SuccessResult(h.folderResp(folder)))
+}
+
+// Delete 删除文件夹及其中的邮件，有子文件夹时需先删除子文件夹
+func (h *FolderHandler) Delete(c *gin.Context) {
+	folder, ok := h.checkFolder(c)
+	if !ok {
+		return
+	}
+	if folder.IsSystem {
+		c.JSON(http.StatusOK, result.ErrorSimpleResult("不能删除系统文件夹"))
+		return
+	}
+
+	emails, blobKeys, err := h.svcCtx.FolderModel.DeleteWithEmails(folder.Id)
+	if err != nil {
+		h.writeFolderError(c, result.ErrorDelete, err)
+		return
+	}
+	deleteBlobs(h.svcCtx, blobKeys)
+	// 从后往前通知，保证每条 EXPUNGE 的序号在发送时有效
+	for i := len(emails) - 1; i >= 0; i-- {
+		publishEmailEvent(h.svcCtx, event.TypeExpunge, emails[i])
+	}
+
+	c.JSON(http.StatusOK, result.SimpleResult("删除成功"))
+}
+
+// ListAcl 文件夹的授权列表
+func (h *FolderHandler) ListAcl(c *gin.Context) {
+	folder, ok := h.checkFolder(c)
+	if !ok {
+		return
+	}
+
+	acls, err := h.svcCtx.FolderAclModel.GetByFolderId(folder.Id)
+	if err != nil {
+		c.JSON(http.StatusOK, result.ErrorSelect.AddError(err))
+		return
+	}
+
+	aclList := make([]types.FolderAclResp, 0, len(acls))
+	for _, acl := range acls {
+		aclList = append(aclList, types.FolderAclResp{
+			Identifier: acl.Identifier,
+			Rights:     acl.Rights,
+			CreatedAt:  acl.CreatedAt,
+			UpdatedAt:  acl.UpdatedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, result.SuccessResult(aclList))
+}
+
+// SetAcl 将文件夹的权限授予其他邮箱或 anyone，权限为空时收回授权
+func (h *FolderHandler) SetAcl(c *gin.Context) {
+	var req types.FolderAclSetReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusOK, result.ErrorBindingParam.AddError(err))
+		return
+	}
+
+	folder, ok := h.checkFolder(c)
+	if !ok {
+		return
+	}
+
+	rights, err := model.NormalizeAclRights(req.Rights)
+	if err != nil {
+		c.JSON(http.StatusOK, result.ErrorSimpleResult(err.Error()+": "+req.Rights))
+		return
+	}
+	identifier, ok := h.checkAclIdentifier(c, folder, req.Identifier)
+	if !ok {
+		return
+	}
+
+	if err := h.svcCtx.FolderAclModel.Set(folder.Id, identifier, rights); err != nil {
+		c.JSON(http.StatusOK, result.ErrorUpdate.AddError(err))
+		return
+	}
+
+	c.JSON(http.StatusOK, result.SimpleResult("授权成功"))
+}
+
+// DeleteAcl 收回文件夹对某个邮箱或 anyone 的授权
+func (h *FolderHandler) DeleteAcl(c *gin.Context) {
+	folder, ok := h.checkFolder(c)
+	if !ok {
+		return
+	}
+
+	if err := h.svcCtx.FolderAclModel.Delete(folder.Id, c.Param("identifier")); err != nil {
+		c.JSON(http.StatusOK, result.ErrorDelete.AddError(err))
+		return
+	}
+
+	c.JSON(http.StatusOK, result.SimpleResult("已收回授权"))
+}
+
+// checkAclIdentifier 校验被授权对象：anyone 或文件夹所属邮箱以外的已有邮箱，返回规范化的标识符
+func (h *FolderHandler) checkAclIdentifier(c *gin.Context, folder *model.Folder, identifier string) (string, bool) {
+	identifier = strings.TrimSpace(identifier)
+	if strings.EqualFold(identifier, model.AclAnyone) {
+		return model.AclAnyone, true
+	}
+
+	grantee, err := h.svcCtx.MailboxModel.GetByEmail(identifier)
+	if err != nil {
+		c.JSON(http.StatusOK, result.ErrorSelect.AddError(err))
+		return "", false
+	}
+	if grantee == nil {
+		c.JSON(http.StatusOK, result.ErrorSimpleResult("被授权的邮箱不存在: "+identifier))
+		return "", false
+	}
+	if grantee.Id == folder.MailboxId {
+		c.JSON(http.StatusOK, result.ErrorSimpleResult("文件夹所属邮箱始终拥有全部权限"))
+		return "", false
+	}
+	return grantee.Email, true
+}
+
+// checkMailbox 检查邮箱存在且属于当前用户，失败时已写入响应
+func (h *FolderHandler) checkMailbox(c *gin.Context, mailboxId int64) bool {
+	_, ok := loadOwnedMailbox(c, h.svcCtx, mailboxId)
+	return ok
+}
+
+// checkFolder 根据路径参数获取文件夹并检查所属邮箱权限，失败时已写入响应
+func (h *FolderHandler) checkFolder(c *gin.Context) (*model.Folder, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusOK, result.ErrorSimpleResult("无效的文件夹ID"))
+		return nil, false
+	}
+
+	folder, err := h.svcCtx.FolderModel.GetById(id)
+	if err != nil {
+		c.JSON(http.StatusOK, result.ErrorSelect.AddError(err))
+		return nil, false
+	}
+	if folder == nil {
+		c.JSON(http.StatusOK, result.ErrorSimpleResult("文件夹不存在"))
+		return nil, false
+	}
+
+	if !h.checkMailbox(c, folder.MailboxId) {
+		return nil, false
+	}
+	return folder, true
+}
+
+// writeFolderError 将文件夹操作的业务错误转换为可读提示，其他错误使用默认错误码
+func (h *FolderHandler) writeFolderError(c *gin.Context, fallback *result.Result, err error) {
+	switch {
+	case errors.Is(err, model.ErrFolderExists),
+		errors.Is(err, model.ErrFolderPath),
+		errors.Is(err, model.ErrFolderHasChildren),
+		errors.Is(err, model.ErrFolderMoveInto):
+		c.JSON(http.StatusOK, result.ErrorSimpleResult(err.Error()))
+	default:
+		c.JSON(http.StatusOK, fallback.AddError(err))
+	}
+}
+
+// folderResp 构建单个文件夹的响应，完整路径按邮箱下全部文件夹计算
+func (h *FolderHandler) folderResp(folder *model.Folder) types.FolderResp {
+	path := folder.Name
+	if folders, err := h.svcCtx.FolderModel.GetByMailboxId(folder.MailboxId); err == nil {
+		if p, ok := model.FolderPaths(folders)[folder.Id]; ok {
+			path = p
+		}
+	}
+	return folderResp(folder, path)
+}
+
+func folderResp(folder *model.Folder, path string) types.FolderResp {
+	return types.FolderResp{
+		Id:         folder.Id,
+		MailboxId:  folder.MailboxId,
+		Name:       folder.Name,
+		Path:       path,
+		ParentId:   folder.ParentId,
+		IsSystem:   folder.IsSystem,
+		SpecialUse: folder.SpecialUse,
+		CreatedAt:  folder.CreatedAt,
+		UpdatedAt:  folder.UpdatedAt,
+	}
+}
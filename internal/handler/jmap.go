@@ -0,0 +1,740 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rankgice/new-email/internal/constant"
+	"github.com/rankgice/new-email/internal/event"
+	"github.com/rankgice/new-email/internal/middleware"
+	"github.com/rankgice/new-email/internal/model"
+	"github.com/rankgice/new-email/internal/svc"
+	"github.com/rankgice/new-email/internal/types"
+	"gorm.io/gorm"
+)
+
+// JMAP 请求限制
+const (
+	jmapMaxSizeRequest        = 10 << 20
+	jmapMaxConcurrentRequests = 4
+	jmapMaxCallsInRequest     = 16
+	jmapMaxObjectsInGet       = 500
+	jmapMaxObjectsInSet       = 500
+	jmapMaxQueryLimit         = 1000
+	jmapMinPingInterval       = 10
+	jmapMaxPingInterval       = 300
+)
+
+// JMAP 对象ID前缀，协议建议ID不以数字开头
+const (
+	jmapPrefixAccount    = 'A' // 账户，对应邮箱
+	jmapPrefixMailbox    = 'F' // Mailbox，对应文件夹
+	jmapPrefixEmail      = 'M' // 邮件
+	jmapPrefixThread     = 'T' // 会话
+	jmapPrefixBlob       = 'B' // 邮件原文或其中的正文部分
+	jmapPrefixIdentity   = 'I' // 发件身份，对应邮箱
+	jmapPrefixSubmission = 'S' // 邮件提交
+)
+
+// JmapHandler JMAP (RFC 8620/8621) 接口
+// 每个启用的邮箱是一个账户，与 EmailHandler、MailStorage 共用邮件模型；状态字符串由文件夹的修改序号得出
+// 响应格式由协议规定，不使用 result 包装
+type JmapHandler struct {
+	svcCtx *svc.ServiceContext
+}
+
+// NewJmapHandler 创建JMAP处理器
+func NewJmapHandler(svcCtx *svc.ServiceContext) *JmapHandler {
+	return &JmapHandler{
+		svcCtx: svcCtx,
+	}
+}
+
+// jmapError 方法级错误，作为 "error" 响应返回
+type jmapError struct {
+	Type        string
+	Description string
+}
+
+func (e *jmapError) Error() string {
+	return e.Type + ": " + e.Description
+}
+
+func newJmapError(errorType, description string) *jmapError {
+	return &jmapError{Type: errorType, Description: description}
+}
+
+// jmapCall 一次API请求内各方法调用共享的状态
+type jmapCall struct {
+	userId     int64
+	using      map[string]bool
+	createdIds map[string]string      // 创建ID到服务器ID的映射
+	responses  []types.JmapInvocation // 已完成调用的响应，供结果引用
+	implicit   []types.JmapInvocation // 当前方法附带的隐式响应
+}
+
+// resolveId 解析对象ID，"#creationId" 引用本次请求中创建的对象
+func (call *jmapCall) resolveId(prefix byte, id string) (int64, bool) {
+	if strings.HasPrefix(id, "#") {
+		created, ok := call.createdIds[id[1:]]
+		if !ok {
+			return 0, false
+		}
+		id = created
+	}
+	return parseJmapId(prefix, id)
+}
+
+// jmapMethod 方法实现及其所需的能力
+type jmapMethod struct {
+	capability string
+	handle     func(h *JmapHandler, call *jmapCall, args json.RawMessage) (interface{}, error)
+}
+
+// jmapMethods 支持的方法
+var jmapMethods = map[string]jmapMethod{
+	"Core/echo":           {types.JmapCapabilityCore, (*JmapHandler).coreEcho},
+	"Mailbox/get":         {types.JmapCapabilityMail, (*JmapHandler).mailboxGet},
+	"Mailbox/changes":     {types.JmapCapabilityMail, (*JmapHandler).mailboxChanges},
+	"Email/get":           {types.JmapCapabilityMail, (*JmapHandler).emailGet},
+	"Email/query":         {types.JmapCapabilityMail, (*JmapHandler).emailQuery},
+	"Email/changes":       {types.JmapCapabilityMail, (*JmapHandler).emailChanges},
+	"Email/set":           {types.JmapCapabilityMail, (*JmapHandler).emailSet},
+	"Identity/get":        {types.JmapCapabilitySubmission, (*JmapHandler).identityGet},
+	"EmailSubmission/set": {types.JmapCapabilitySubmission, (*JmapHandler).emailSubmissionSet},
+}
+
+// Session 获取JMAP会话资源
+func (h *JmapHandler) Session(c *gin.Context) {
+	currentUserId := middleware.GetCurrentUserId(c)
+	mailboxes, err := h.svcCtx.MailboxModel.GetActiveMailboxes(currentUserId)
+	if err != nil {
+		jmapProblem(c, http.StatusInternalServerError, "serverFail", err.Error())
+		return
+	}
+
+	base := jmapBaseURL(c)
+	session := types.JmapSession{
+		Capabilities: map[string]interface{}{
+			types.JmapCapabilityCore: types.JmapCoreCapability{
+				MaxSizeUpload:         0,
+				MaxConcurrentUpload:   1,
+				MaxSizeRequest:        jmapMaxSizeRequest,
+				MaxConcurrentRequests: jmapMaxConcurrentRequests,
+				MaxCallsInRequest:     jmapMaxCallsInRequest,
+				MaxObjectsInGet:       jmapMaxObjectsInGet,
+				MaxObjectsInSet:       jmapMaxObjectsInSet,
+				CollationAlgorithms:   []string{},
+			},
+			types.JmapCapabilityMail:       struct{}{},
+			types.JmapCapabilitySubmission: struct{}{},
+		},
+		Accounts:        make(map[string]*types.JmapAccount, len(mailboxes)),
+		PrimaryAccounts: make(map[string]string),
+		Username:        c.GetString("username"),
+		ApiUrl:          base + "/jmap/api",
+		DownloadUrl:     base + "/jmap/download/{accountId}/{blobId}/{name}?accept={type}",
+		UploadUrl:       base + "/jmap/upload/{accountId}/",
+		EventSourceUrl:  base + "/jmap/eventsource?types={types}&closeafter={closeafter}&ping={ping}",
+		State:           jmapSessionState(mailboxes),
+	}
+
+	// 邮件只能属于一个文件夹
+	maxMailboxesPerEmail := int64(1)
+	for _, mailbox := range mailboxes {
+		accountId := jmapId(jmapPrefixAccount, mailbox.Id)
+		session.Accounts[accountId] = &types.JmapAccount{
+			Name:       mailbox.Email,
+			IsPersonal: true,
+			IsReadOnly: false,
+			AccountCapabilities: map[string]interface{}{
+				types.JmapCapabilityMail: types.JmapMailCapability{
+					MaxMailboxesPerEmail:       &maxMailboxesPerEmail,
+					MaxSizeMailboxName:         255,
+					MaxSizeAttachmentsPerEmail: 0,
+					EmailQuerySortOptions:      jmapSortOptions(),
+					MayCreateTopLevelMailbox:   false,
+				},
+				types.JmapCapabilitySubmission: types.JmapSubmissionCapability{
+					MaxDelayedSend:       0,
+					SubmissionExtensions: map[string][]string{},
+				},
+			},
+		}
+		if len(session.PrimaryAccounts) == 0 {
+			session.PrimaryAccounts[types.JmapCapabilityMail] = accountId
+			session.PrimaryAccounts[types.JmapCapabilitySubmission] = accountId
+		}
+	}
+
+	c.JSON(http.StatusOK, session)
+}
+
+// WellKnown 服务发现 (RFC 8620 2.2)，重定向到会话资源
+func (h *JmapHandler) WellKnown(c *gin.Context) {
+	c.Redirect(http.StatusMovedPermanently, "/jmap/session")
+}
+
+// Api 处理JMAP API请求，按顺序执行各方法调用
+func (h *JmapHandler) Api(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, jmapMaxSizeRequest)
+
+	var req types.JmapRequest
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			jmapLimitProblem(c, "maxSizeRequest")
+			return
+		}
+		jmapProblem(c, http.StatusBadRequest, "notJSON", err.Error())
+		return
+	}
+	if req.Using == nil || req.MethodCalls == nil {
+		jmapProblem(c, http.StatusBadRequest, "notRequest", "缺少 using 或 methodCalls")
+		return
+	}
+	if len(req.MethodCalls) > jmapMaxCallsInRequest {
+		jmapLimitProblem(c, "maxCallsInRequest")
+		return
+	}
+
+	call := &jmapCall{
+		userId:     middleware.GetCurrentUserId(c),
+		using:      make(map[string]bool, len(req.Using)),
+		createdIds: make(map[string]string, len(req.CreatedIds)),
+	}
+	for _, capability := range req.Using {
+		switch capability {
+		case types.JmapCapabilityCore, types.JmapCapabilityMail, types.JmapCapabilitySubmission:
+			call.using[capability] = true
+		default:
+			jmapProblem(c, http.StatusBadRequest, "unknownCapability", "不支持的能力: "+capability)
+			return
+		}
+	}
+	for creationId, id := range req.CreatedIds {
+		call.createdIds[creationId] = id
+	}
+
+	for _, invocation := range req.MethodCalls {
+		call.implicit = nil
+		call.responses = append(call.responses, h.invoke(call, invocation))
+		for _, implicit := range call.implicit {
+			implicit.CallId = invocation.CallId
+			call.responses = append(call.responses, implicit)
+		}
+	}
+
+	mailboxes, err := h.svcCtx.MailboxModel.GetActiveMailboxes(call.userId)
+	if err != nil {
+		jmapProblem(c, http.StatusInternalServerError, "serverFail", err.Error())
+		return
+	}
+	resp := types.JmapResponse{
+		MethodResponses: call.responses,
+		SessionState:    jmapSessionState(mailboxes),
+	}
+	if req.CreatedIds != nil {
+		resp.CreatedIds = call.createdIds
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// invoke 执行单个方法调用，出错时返回 "error" 响应
+func (h *JmapHandler) invoke(call *jmapCall, invocation types.JmapInvocation) types.JmapInvocation {
+	fail := func(err *jmapError) types.JmapInvocation {
+		args, _ := json.Marshal(types.JmapMethodError{Type: err.Type, Description: err.Description})
+		return types.JmapInvocation{Name: "error", Args: args, CallId: invocation.CallId}
+	}
+
+	method, ok := jmapMethods[invocation.Name]
+	if !ok || !call.using[method.capability] {
+		return fail(newJmapError("unknownMethod", invocation.Name))
+	}
+	args, err := call.resolveReferences(invocation.Args)
+	if err != nil {
+		return fail(err)
+	}
+
+	result, handleErr := method.handle(h, call, args)
+	if handleErr != nil {
+		var methodErr *jmapError
+		if errors.As(handleErr, &methodErr) {
+			return fail(methodErr)
+		}
+		log.Printf("JMAP方法 %s 执行失败: %v", invocation.Name, handleErr)
+		return fail(newJmapError("serverFail", handleErr.Error()))
+	}
+
+	data, marshalErr := json.Marshal(result)
+	if marshalErr != nil {
+		return fail(newJmapError("serverFail", marshalErr.Error()))
+	}
+	return types.JmapInvocation{Name: invocation.Name, Args: data, CallId: invocation.CallId}
+}
+
+// resolveReferences 将以 # 开头的参数替换为所引用结果中 path 指向的值 (RFC 8620 3.7)
+func (call *jmapCall) resolveReferences(args json.RawMessage) (json.RawMessage, *jmapError) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(args, &fields); err != nil || fields == nil {
+		return nil, newJmapError("invalidArguments", "参数必须是对象")
+	}
+
+	resolved := false
+	for key, raw := range fields {
+		if !strings.HasPrefix(key, "#") {
+			continue
+		}
+		name := key[1:]
+		if _, ok := fields[name]; ok {
+			return nil, newJmapError("invalidArguments", "参数同时给出了值和引用: "+name)
+		}
+
+		var ref types.JmapResultReference
+		if err := json.Unmarshal(raw, &ref); err != nil {
+			return nil, newJmapError("invalidResultReference", err.Error())
+		}
+		var target *types.JmapInvocation
+		for i := range call.responses {
+			if call.responses[i].CallId == ref.ResultOf {
+				target = &call.responses[i]
+				break
+			}
+		}
+		if target == nil || target.Name != ref.Name {
+			return nil, newJmapError("invalidResultReference", "引用的结果不存在: "+ref.ResultOf+" "+ref.Name)
+		}
+
+		var value interface{}
+		if err := json.Unmarshal(target.Args, &value); err != nil {
+			return nil, newJmapError("invalidResultReference", err.Error())
+		}
+		value, err := jmapPointer(value, ref.Path)
+		if err != nil {
+			return nil, newJmapError("invalidResultReference", err.Error())
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, newJmapError("invalidResultReference", err.Error())
+		}
+		delete(fields, key)
+		fields[name] = data
+		resolved = true
+	}
+
+	if !resolved {
+		return args, nil
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, newJmapError("invalidArguments", err.Error())
+	}
+	return data, nil
+}
+
+// jmapPointer 按 JSON Pointer (RFC 6901) 取值，"*" 表示数组的每个元素，结果为数组时展开
+func jmapPointer(value interface{}, path string) (interface{}, error) {
+	if path == "" {
+		return value, nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("无效的路径: %s", path)
+	}
+	return jmapPointerTokens(value, strings.Split(path[1:], "/"))
+}
+
+func jmapPointerTokens(value interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	token := jmapUnescapePointer(tokens[0])
+
+	switch v := value.(type) {
+	case []interface{}:
+		if token == "*" {
+			items := make([]interface{}, 0, len(v))
+			for _, item := range v {
+				itemValue, err := jmapPointerTokens(item, tokens[1:])
+				if err != nil {
+					return nil, err
+				}
+				if list, ok := itemValue.([]interface{}); ok {
+					items = append(items, list...)
+				} else {
+					items = append(items, itemValue)
+				}
+			}
+			return items, nil
+		}
+		index, err := strconv.Atoi(token)
+		if err != nil || index < 0 || index >= len(v) {
+			return nil, fmt.Errorf("数组下标无效: %s", token)
+		}
+		return jmapPointerTokens(v[index], tokens[1:])
+	case map[string]interface{}:
+		item, ok := v[token]
+		if !ok {
+			return nil, fmt.Errorf("属性不存在: %s", token)
+		}
+		return jmapPointerTokens(item, tokens[1:])
+	}
+	return nil, fmt.Errorf("路径无法继续解析: %s", token)
+}
+
+// jmapUnescapePointer 还原 JSON Pointer 中转义的 / 和 ~
+func jmapUnescapePointer(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+}
+
+// coreEcho Core/echo 原样返回参数
+func (h *JmapHandler) coreEcho(call *jmapCall, args json.RawMessage) (interface{}, error) {
+	return args, nil
+}
+
+// account 解析账户ID，账户必须是当前用户启用的邮箱
+func (h *JmapHandler) account(call *jmapCall, accountId string) (*model.Mailbox, error) {
+	id, ok := parseJmapId(jmapPrefixAccount, accountId)
+	if !ok {
+		return nil, newJmapError("accountNotFound", accountId)
+	}
+	mailbox, err := h.svcCtx.MailboxModel.GetById(id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, newJmapError("accountNotFound", accountId)
+		}
+		return nil, err
+	}
+	if mailbox.UserId != call.userId || mailbox.Status != constant.StatusEnabled {
+		return nil, newJmapError("accountNotFound", accountId)
+	}
+	return mailbox, nil
+}
+
+// decodeJmapArgs 解析方法参数
+func decodeJmapArgs(args json.RawMessage, v interface{}) error {
+	if err := json.Unmarshal(args, v); err != nil {
+		return newJmapError("invalidArguments", err.Error())
+	}
+	return nil
+}
+
+// jmapId 生成带前缀的对象ID
+func jmapId(prefix byte, id int64) string {
+	return string(prefix) + strconv.FormatInt(id, 10)
+}
+
+// parseJmapId 解析带前缀的对象ID
+func parseJmapId(prefix byte, id string) (int64, bool) {
+	if len(id) < 2 || id[0] != prefix {
+		return 0, false
+	}
+	value, err := strconv.ParseInt(id[1:], 10, 64)
+	if err != nil || value <= 0 {
+		return 0, false
+	}
+	return value, true
+}
+
+// jmapEmailState 邮件的同步状态：已分配的最大邮件ID和邮箱各文件夹的修改序号
+// 序列化为 "maxId:folderId.modseq:..."，ID大于 maxId 的邮件为之后新增
+type jmapEmailState struct {
+	maxId   int64
+	modSeqs map[int64]int64
+}
+
+func (s jmapEmailState) String() string {
+	folderIds := make([]int64, 0, len(s.modSeqs))
+	for folderId := range s.modSeqs {
+		folderIds = append(folderIds, folderId)
+	}
+	sort.Slice(folderIds, func(i, j int) bool { return folderIds[i] < folderIds[j] })
+
+	var b strings.Builder
+	b.WriteString(strconv.FormatInt(s.maxId, 10))
+	for _, folderId := range folderIds {
+		fmt.Fprintf(&b, ":%d.%d", folderId, s.modSeqs[folderId])
+	}
+	return b.String()
+}
+
+// parseJmapEmailState 解析邮件同步状态
+func parseJmapEmailState(state string) (jmapEmailState, bool) {
+	parts := strings.Split(state, ":")
+	maxId, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || maxId < 0 {
+		return jmapEmailState{}, false
+	}
+	s := jmapEmailState{maxId: maxId, modSeqs: make(map[int64]int64, len(parts)-1)}
+	for _, part := range parts[1:] {
+		folder, modSeq, ok := strings.Cut(part, ".")
+		if !ok {
+			return jmapEmailState{}, false
+		}
+		folderId, err1 := strconv.ParseInt(folder, 10, 64)
+		value, err2 := strconv.ParseInt(modSeq, 10, 64)
+		if err1 != nil || err2 != nil || folderId <= 0 || value < 0 {
+			return jmapEmailState{}, false
+		}
+		s.modSeqs[folderId] = value
+	}
+	return s, true
+}
+
+// emailState 获取邮箱当前的邮件同步状态，先读最大ID再读修改序号，期间新增的邮件只会被重复报告
+func (h *JmapHandler) emailState(mailboxId int64) (jmapEmailState, error) {
+	maxId, err := h.svcCtx.EmailModel.MaxId(mailboxId)
+	if err != nil {
+		return jmapEmailState{}, err
+	}
+	modSeqs, err := h.svcCtx.FolderModel.FolderModSeqs(mailboxId)
+	if err != nil {
+		return jmapEmailState{}, err
+	}
+	return jmapEmailState{maxId: maxId, modSeqs: modSeqs}, nil
+}
+
+// mailboxState Mailbox 状态：邮件状态（影响邮件计数）加上文件夹名称、层级和用途的摘要
+func (h *JmapHandler) mailboxState(folders []*model.Folder, emailState jmapEmailState) string {
+	sorted := append([]*model.Folder(nil), folders...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Id < sorted[j].Id })
+
+	hash := fnv.New64a()
+	hash.Write([]byte(emailState.String()))
+	for _, folder := range sorted {
+		parentId := int64(0)
+		if folder.ParentId != nil {
+			parentId = *folder.ParentId
+		}
+		fmt.Fprintf(hash, "|%d/%d/%s/%s", folder.Id, parentId, folder.Name, folder.SpecialUse)
+	}
+	return strconv.FormatUint(hash.Sum64(), 36)
+}
+
+// jmapSessionState 会话状态，账户列表变化时改变
+func jmapSessionState(mailboxes []*model.Mailbox) string {
+	hash := fnv.New64a()
+	for _, mailbox := range mailboxes {
+		fmt.Fprintf(hash, "%d/%s|", mailbox.Id, mailbox.Email)
+	}
+	return strconv.FormatUint(hash.Sum64(), 36)
+}
+
+// EventSource 通过 Server-Sent Events 推送账户的状态变更 (RFC 8620 7.3)
+func (h *JmapHandler) EventSource(c *gin.Context) {
+	currentUserId := middleware.GetCurrentUserId(c)
+	mailboxes, err := h.svcCtx.MailboxModel.GetActiveMailboxes(currentUserId)
+	if err != nil {
+		jmapProblem(c, http.StatusInternalServerError, "serverFail", err.Error())
+		return
+	}
+
+	wanted := make(map[string]bool)
+	for _, typeName := range strings.Split(c.DefaultQuery("types", "*"), ",") {
+		wanted[strings.TrimSpace(typeName)] = true
+	}
+	closeAfterState := c.Query("closeafter") == "state"
+	ping, err := strconv.Atoi(c.DefaultQuery("ping", "0"))
+	if err != nil || ping < 0 {
+		jmapProblem(c, http.StatusBadRequest, "invalidArguments", "无效的 ping 参数")
+		return
+	}
+	if ping > 0 && ping < jmapMinPingInterval {
+		ping = jmapMinPingInterval
+	}
+	if ping > jmapMaxPingInterval {
+		ping = jmapMaxPingInterval
+	}
+
+	accounts := make(map[int64]bool, len(mailboxes))
+	for _, mailbox := range mailboxes {
+		accounts[mailbox.Id] = true
+	}
+
+	// 事件在发布者的goroutine中同步分发，这里只记录变更的账户并唤醒推送循环
+	var mu sync.Mutex
+	pending := make(map[int64]bool)
+	notify := make(chan struct{}, 1)
+	unsubscribe := h.svcCtx.EventBus.Subscribe(func(e event.Event) {
+		if !accounts[e.MailboxId] {
+			return
+		}
+		mu.Lock()
+		pending[e.MailboxId] = true
+		mu.Unlock()
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+	})
+	defer unsubscribe()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	var tick <-chan time.Time
+	if ping > 0 {
+		ticker := time.NewTicker(time.Duration(ping) * time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-tick:
+			fmt.Fprintf(c.Writer, "event: ping\ndata: {\"interval\":%d}\n\n", ping)
+			c.Writer.Flush()
+		case <-notify:
+			mu.Lock()
+			changed := pending
+			pending = make(map[int64]bool)
+			mu.Unlock()
+
+			stateChange := types.JmapStateChange{Type: "StateChange", Changed: make(map[string]map[string]string)}
+			for mailboxId := range changed {
+				states, err := h.typeStates(mailboxId, wanted)
+				if err != nil {
+					log.Printf("JMAP推送获取状态失败: %v", err)
+					continue
+				}
+				if len(states) > 0 {
+					stateChange.Changed[jmapId(jmapPrefixAccount, mailboxId)] = states
+				}
+			}
+			if len(stateChange.Changed) == 0 {
+				continue
+			}
+
+			data, _ := json.Marshal(stateChange)
+			fmt.Fprintf(c.Writer, "event: state\ndata: %s\n\n", data)
+			c.Writer.Flush()
+			if closeAfterState {
+				return
+			}
+		}
+	}
+}
+
+// typeStates 获取账户中订阅类型的当前状态
+func (h *JmapHandler) typeStates(mailboxId int64, wanted map[string]bool) (map[string]string, error) {
+	emailState, err := h.emailState(mailboxId)
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]string)
+	if wanted["*"] || wanted["Email"] {
+		states["Email"] = emailState.String()
+	}
+	if wanted["*"] || wanted["Mailbox"] {
+		folders, err := h.svcCtx.FolderModel.GetByMailboxId(mailboxId)
+		if err != nil {
+			return nil, err
+		}
+		states["Mailbox"] = h.mailboxState(folders, emailState)
+	}
+	return states, nil
+}
+
+// Download 下载邮件原文或其中的正文部分、附件
+func (h *JmapHandler) Download(c *gin.Context) {
+	call := &jmapCall{userId: middleware.GetCurrentUserId(c)}
+	mailbox, err := h.account(call, c.Param("accountId"))
+	if err != nil {
+		jmapProblem(c, http.StatusNotFound, "notFound", "账户不存在")
+		return
+	}
+
+	blobId := c.Param("blobId")
+	emailPart, partId, _ := strings.Cut(blobId, "-")
+	emailId, ok := parseJmapId(jmapPrefixBlob, emailPart)
+	if !ok {
+		jmapProblem(c, http.StatusNotFound, "notFound", "blob不存在")
+		return
+	}
+	emails, err := h.svcCtx.EmailModel.GetByMailboxIdAndIds(mailbox.Id, []int64{emailId})
+	if err != nil {
+		jmapProblem(c, http.StatusInternalServerError, "serverFail", err.Error())
+		return
+	}
+	if len(emails) == 0 {
+		jmapProblem(c, http.StatusNotFound, "notFound", "blob不存在")
+		return
+	}
+
+	if err := loadEmailContent(h.svcCtx, emails[0]); err != nil {
+		jmapProblem(c, http.StatusInternalServerError, "serverFail", err.Error())
+		return
+	}
+
+	var data []byte
+	contentType := "message/rfc822"
+	if partId == "" {
+		data = jmapRawMessage(emails[0])
+	} else {
+		part := parseJmapEmailBody(emails[0]).part(partId)
+		if part == nil {
+			jmapProblem(c, http.StatusNotFound, "notFound", "blob不存在")
+			return
+		}
+		data, contentType = part.data, part.contentType
+	}
+	if accept := c.Query("accept"); accept != "" {
+		contentType = accept
+	}
+
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": c.Param("name")}))
+	c.Header("Cache-Control", "private, immutable, max-age=31536000")
+	c.Data(http.StatusOK, contentType, data)
+}
+
+// Upload 暂不支持上传，会话资源中 maxSizeUpload 为0
+func (h *JmapHandler) Upload(c *gin.Context) {
+	jmapLimitProblem(c, "maxSizeUpload")
+}
+
+// jmapBaseURL 根据请求推断对外的服务地址
+func jmapBaseURL(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	} else if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+// jmapProblem 返回请求级错误
+func jmapProblem(c *gin.Context, status int, problemType, detail string) {
+	c.Header("Content-Type", "application/problem+json")
+	c.JSON(status, types.JmapProblem{
+		Type:   "urn:ietf:params:jmap:error:" + problemType,
+		Status: status,
+		Detail: detail,
+	})
+}
+
+// jmapLimitProblem 返回超出服务器限制的请求级错误
+func jmapLimitProblem(c *gin.Context, limit string) {
+	c.Header("Content-Type", "application/problem+json")
+	c.JSON(http.StatusBadRequest, types.JmapProblem{
+		Type:   "urn:ietf:params:jmap:error:limit",
+		Status: http.StatusBadRequest,
+		Detail: "超出服务器限制: " + limit,
+		Limit:  limit,
+	})
+}
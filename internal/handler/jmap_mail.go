@@ -0,0 +1,1404 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"github.com/rankgice/new-email/internal/event"
+	"github.com/rankgice/new-email/internal/model"
+	"github.com/rankgice/new-email/internal/service"
+	"github.com/rankgice/new-email/internal/svc"
+	"github.com/rankgice/new-email/internal/types"
+	"gorm.io/gorm"
+)
+
+// jmapEmailProperties Email 对象支持的属性，未指定 properties 时全部返回
+var jmapEmailProperties = []string{
+	"id", "blobId", "threadId", "mailboxIds", "keywords", "size", "receivedAt",
+	"messageId", "inReplyTo", "references", "sender", "from", "to", "cc", "bcc",
+	"replyTo", "subject", "sentAt", "hasAttachment", "preview",
+	"bodyValues", "textBody", "htmlBody", "attachments",
+}
+
+// jmapSystemKeywords JMAP 关键字与 IMAP 系统标志的对应关系 (RFC 8621 4.1.1)
+var jmapSystemKeywords = map[string]string{
+	"$seen":     model.FlagSeen,
+	"$flagged":  model.FlagFlagged,
+	"$answered": model.FlagAnswered,
+	"$draft":    model.FlagDraft,
+}
+
+// jmapPreviewLength 邮件预览的最大字符数
+const jmapPreviewLength = 256
+
+// mailboxGet Mailbox/get 返回账户的文件夹
+func (h *JmapHandler) mailboxGet(call *jmapCall, args json.RawMessage) (interface{}, error) {
+	var req types.JmapGetReq
+	if err := decodeJmapArgs(args, &req); err != nil {
+		return nil, err
+	}
+	mailbox, err := h.account(call, req.AccountId)
+	if err != nil {
+		return nil, err
+	}
+
+	folders, err := h.svcCtx.FolderModel.GetByMailboxId(mailbox.Id)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := h.svcCtx.EmailModel.FolderCounts(mailbox.Id)
+	if err != nil {
+		return nil, err
+	}
+	emailState, err := h.emailState(mailbox.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	byId := make(map[string]*types.JmapMailbox, len(folders))
+	var all []string
+	for _, folder := range folders {
+		jmapMailbox := &types.JmapMailbox{
+			Id:   jmapId(jmapPrefixMailbox, folder.Id),
+			Name: folder.Name,
+			Role: jmapMailboxRole(folder),
+			MyRights: types.JmapMailboxRights{
+				MayReadItems:   true,
+				MayAddItems:    true,
+				MayRemoveItems: true,
+				MaySetSeen:     true,
+				MaySetKeywords: true,
+				MayCreateChild: true,
+				MayRename:      !folder.IsSystem,
+				MayDelete:      !folder.IsSystem,
+				MaySubmit:      true,
+			},
+			IsSubscribed: true,
+		}
+		if folder.ParentId != nil {
+			parentId := jmapId(jmapPrefixMailbox, *folder.ParentId)
+			jmapMailbox.ParentId = &parentId
+		}
+		if count, ok := counts[folder.Id]; ok {
+			jmapMailbox.TotalEmails = count.Total
+			jmapMailbox.UnreadEmails = count.Unread
+			jmapMailbox.TotalThreads = count.Threads
+			jmapMailbox.UnreadThreads = count.UnreadThreads
+		}
+		byId[jmapMailbox.Id] = jmapMailbox
+		all = append(all, jmapMailbox.Id)
+	}
+
+	ids := all
+	if req.Ids != nil {
+		ids = *req.Ids
+		if len(ids) > jmapMaxObjectsInGet {
+			return nil, newJmapError("requestTooLarge", "ids 超过 maxObjectsInGet")
+		}
+	}
+
+	resp := types.JmapGetResp{
+		AccountId: req.AccountId,
+		State:     h.mailboxState(folders, emailState),
+		List:      []interface{}{},
+		NotFound:  []string{},
+	}
+	for _, id := range ids {
+		jmapMailbox, ok := byId[id]
+		if !ok {
+			resp.NotFound = append(resp.NotFound, id)
+			continue
+		}
+		obj, err := jmapSelectProperties(jmapMailbox, req.Properties)
+		if err != nil {
+			return nil, err
+		}
+		resp.List = append(resp.List, obj)
+	}
+	return resp, nil
+}
+
+// mailboxChanges Mailbox/changes 不保存文件夹的变更历史，状态变化时要求客户端重新获取
+func (h *JmapHandler) mailboxChanges(call *jmapCall, args json.RawMessage) (interface{}, error) {
+	var req types.JmapChangesReq
+	if err := decodeJmapArgs(args, &req); err != nil {
+		return nil, err
+	}
+	mailbox, err := h.account(call, req.AccountId)
+	if err != nil {
+		return nil, err
+	}
+	folders, err := h.svcCtx.FolderModel.GetByMailboxId(mailbox.Id)
+	if err != nil {
+		return nil, err
+	}
+	emailState, err := h.emailState(mailbox.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	state := h.mailboxState(folders, emailState)
+	if req.SinceState != state {
+		return nil, newJmapError("cannotCalculateChanges", "文件夹已变化，请重新获取")
+	}
+	return types.JmapChangesResp{
+		AccountId: req.AccountId,
+		OldState:  state,
+		NewState:  state,
+		Created:   []string{},
+		Updated:   []string{},
+		Destroyed: []string{},
+	}, nil
+}
+
+// jmapMailboxRole 根据文件夹名称和特殊用途确定 Mailbox 角色
+func jmapMailboxRole(folder *model.Folder) *string {
+	role := ""
+	if folder.ParentId == nil && strings.EqualFold(folder.Name, "INBOX") {
+		role = "inbox"
+	} else if folder.SpecialUse != "" {
+		role = strings.ToLower(strings.TrimPrefix(folder.SpecialUse, `\`))
+	}
+	if role == "" {
+		return nil
+	}
+	return &role
+}
+
+// jmapSelectProperties 只保留请求的属性，id 总是返回
+func jmapSelectProperties(obj interface{}, properties []string) (interface{}, error) {
+	if properties == nil {
+		return obj, nil
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	selected := map[string]interface{}{"id": fields["id"]}
+	for _, property := range properties {
+		value, ok := fields[property]
+		if !ok {
+			return nil, newJmapError("invalidArguments", "未知属性: "+property)
+		}
+		selected[property] = value
+	}
+	return selected, nil
+}
+
+// emailGet Email/get 获取邮件
+func (h *JmapHandler) emailGet(call *jmapCall, args json.RawMessage) (interface{}, error) {
+	var req types.JmapEmailGetReq
+	if err := decodeJmapArgs(args, &req); err != nil {
+		return nil, err
+	}
+	mailbox, err := h.account(call, req.AccountId)
+	if err != nil {
+		return nil, err
+	}
+
+	properties := req.Properties
+	if properties == nil {
+		properties = jmapEmailProperties
+	}
+	for _, property := range properties {
+		if !jmapIsEmailProperty(property) {
+			return nil, newJmapError("invalidArguments", "未知属性: "+property)
+		}
+	}
+
+	var ids []string
+	if req.Ids != nil {
+		ids = *req.Ids
+	} else {
+		refs, err := h.svcCtx.EmailModel.Query(mailbox.Id, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range refs {
+			ids = append(ids, jmapId(jmapPrefixEmail, ref.Id))
+		}
+	}
+	if len(ids) > jmapMaxObjectsInGet {
+		return nil, newJmapError("requestTooLarge", "ids 超过 maxObjectsInGet")
+	}
+
+	emailIds := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		if emailId, ok := call.resolveId(jmapPrefixEmail, id); ok {
+			emailIds = append(emailIds, emailId)
+		}
+	}
+	emails, err := h.svcCtx.EmailModel.GetByMailboxIdAndIds(mailbox.Id, emailIds)
+	if err != nil {
+		return nil, err
+	}
+	byId := make(map[int64]*model.Email, len(emails))
+	for _, email := range emails {
+		byId[email.Id] = email
+	}
+
+	state, err := h.emailState(mailbox.Id)
+	if err != nil {
+		return nil, err
+	}
+	resp := types.JmapGetResp{
+		AccountId: req.AccountId,
+		State:     state.String(),
+		List:      []interface{}{},
+		NotFound:  []string{},
+	}
+	for _, id := range ids {
+		emailId, _ := call.resolveId(jmapPrefixEmail, id)
+		email, ok := byId[emailId]
+		if !ok {
+			resp.NotFound = append(resp.NotFound, id)
+			continue
+		}
+		resp.List = append(resp.List, jmapEmailObject(h.svcCtx, email, properties, &req))
+	}
+	return resp, nil
+}
+
+// jmapIsEmailProperty 判断是否为支持的 Email 属性，header:* 形式的属性返回null
+func jmapIsEmailProperty(property string) bool {
+	if strings.HasPrefix(property, "header:") {
+		return true
+	}
+	for _, p := range jmapEmailProperties {
+		if p == property {
+			return true
+		}
+	}
+	return false
+}
+
+// jmapEmailObject 将邮件转换为 Email 对象，只包含请求的属性
+// 只有请求正文相关属性时才读取保存在blob中的原文
+func jmapEmailObject(svcCtx *svc.ServiceContext, email *model.Email, properties []string, req *types.JmapEmailGetReq) map[string]interface{} {
+	var body *jmapEmailBody
+	getBody := func() *jmapEmailBody {
+		if body == nil {
+			if err := loadEmailContent(svcCtx, email); err != nil {
+				log.Printf("⚠️  读取邮件原文失败 (ID: %d): %v", email.Id, err)
+			}
+			body = parseJmapEmailBody(email)
+		}
+		return body
+	}
+
+	obj := map[string]interface{}{"id": jmapId(jmapPrefixEmail, email.Id)}
+	for _, property := range properties {
+		switch property {
+		case "id":
+		case "blobId":
+			obj[property] = jmapId(jmapPrefixBlob, email.Id)
+		case "threadId":
+			obj[property] = jmapId(jmapPrefixThread, jmapThreadId(email))
+		case "mailboxIds":
+			obj[property] = map[string]bool{jmapId(jmapPrefixMailbox, email.FolderId): true}
+		case "keywords":
+			obj[property] = jmapKeywords(email)
+		case "size":
+			obj[property] = email.Size
+		case "receivedAt":
+			obj[property] = jmapReceivedAt(email).UTC().Format(time.RFC3339)
+		case "sentAt":
+			if email.SentAt != nil {
+				obj[property] = email.SentAt.Format(time.RFC3339)
+			} else {
+				obj[property] = nil
+			}
+		case "messageId":
+			obj[property] = jmapMessageIds(normalizeMessageID(email.MessageId))
+		case "inReplyTo":
+			obj[property] = jmapMessageIds(email.InReplyTo)
+		case "references":
+			obj[property] = jmapMessageIds(email.References)
+		case "from":
+			from := jmapAddresses([]string{email.FromEmail})
+			if len(from) == 1 && email.FromName != "" {
+				from[0].Name = &email.FromName
+			}
+			obj[property] = from
+		case "to":
+			obj[property] = jmapAddresses(email.ToEmails)
+		case "cc":
+			obj[property] = jmapAddresses(email.CcEmails)
+		case "bcc":
+			obj[property] = jmapAddresses(email.BccEmails)
+		case "replyTo":
+			obj[property] = jmapAddresses([]string{email.ReplyTo})
+		case "subject":
+			obj[property] = email.Subject
+		case "hasAttachment":
+			obj[property] = len(getBody().attachments) > 0
+		case "preview":
+			obj[property] = getBody().preview()
+		case "textBody":
+			obj[property] = getBody().bodyParts(email.Id, getBody().textParts())
+		case "htmlBody":
+			obj[property] = getBody().bodyParts(email.Id, getBody().htmlParts())
+		case "attachments":
+			obj[property] = getBody().bodyParts(email.Id, getBody().attachments)
+		case "bodyValues":
+			obj[property] = getBody().bodyValues(req)
+		default:
+			obj[property] = nil
+		}
+	}
+	return obj
+}
+
+// jmapThreadId 升级前的邮件没有会话ID，各自作为独立会话
+func jmapThreadId(email *model.Email) int64 {
+	if email.ThreadId != 0 {
+		return email.ThreadId
+	}
+	return email.Id
+}
+
+// jmapReceivedAt 邮件的接收时间，缺失时使用创建时间
+func jmapReceivedAt(email *model.Email) time.Time {
+	if email.ReceivedAt != nil {
+		return *email.ReceivedAt
+	}
+	return email.CreatedAt
+}
+
+// jmapMessageIds 解析消息ID列表，为空时返回null
+func jmapMessageIds(value string) []string {
+	ids := model.ParseMessageIdList(value)
+	if len(ids) == 0 {
+		return nil
+	}
+	return ids
+}
+
+// jmapKeywords 将邮件标志转换为 JMAP 关键字，\Deleted 没有对应的关键字
+func jmapKeywords(email *model.Email) map[string]bool {
+	keywords := make(map[string]bool)
+	for _, flag := range email.Flags() {
+		if !strings.HasPrefix(flag, `\`) {
+			keywords[strings.ToLower(flag)] = true
+			continue
+		}
+		for keyword, systemFlag := range jmapSystemKeywords {
+			if strings.EqualFold(flag, systemFlag) {
+				keywords[keyword] = true
+			}
+		}
+	}
+	return keywords
+}
+
+// jmapKeywordFlag 将 JMAP 关键字转换为邮件标志，不合法时返回空字符串
+func jmapKeywordFlag(keyword string) string {
+	if flag, ok := jmapSystemKeywords[strings.ToLower(keyword)]; ok {
+		return flag
+	}
+	if model.IsValidKeyword(keyword) {
+		return keyword
+	}
+	return ""
+}
+
+// jmapAddresses 解析邮件地址，支持 "Name <addr>" 形式，列表为空时返回null
+func jmapAddresses(values []string) []types.JmapEmailAddress {
+	var addresses []types.JmapEmailAddress
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		address := types.JmapEmailAddress{Email: value}
+		if parsed, err := mail.ParseAddress(value); err == nil {
+			address.Email = parsed.Address
+			if parsed.Name != "" {
+				name := parsed.Name
+				address.Name = &name
+			}
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
+
+// jmapAddressStrings 取出 JMAP 地址中的邮箱地址
+func jmapAddressStrings(addresses []types.JmapEmailAddress) []string {
+	var values []string
+	for _, address := range addresses {
+		if email := strings.TrimSpace(address.Email); email != "" {
+			values = append(values, email)
+		}
+	}
+	return values
+}
+
+// jmapBodyPart 邮件正文中的一个部分，partId 为 1 纯文本、2 HTML、3 起为附件
+type jmapBodyPart struct {
+	partId      string
+	contentType string
+	name        string
+	disposition string
+	data        []byte
+}
+
+// jmapEmailBody 解析后的邮件正文
+type jmapEmailBody struct {
+	text        *jmapBodyPart
+	html        *jmapBodyPart
+	attachments []*jmapBodyPart
+}
+
+// parseJmapEmailBody 解析邮件内容：原始报文按 MIME 解析，否则按 ContentType 作为纯文本或HTML
+func parseJmapEmailBody(email *model.Email) *jmapEmailBody {
+	body := &jmapEmailBody{}
+	var text, html string
+
+	parsed := false
+	if hasRawMessageHeader(email.Content) {
+		if message, err := service.NewMessageParser().ParseMessage(strings.NewReader(email.Content)); err == nil {
+			parsed = true
+			text, html = message.TextBody, message.HTMLBody
+			for i, attachment := range message.Attachments {
+				contentType, _, err := mime.ParseMediaType(attachment.ContentType)
+				if err != nil {
+					contentType = "application/octet-stream"
+				}
+				body.attachments = append(body.attachments, &jmapBodyPart{
+					partId:      strconv.Itoa(i + 3),
+					contentType: contentType,
+					name:        attachment.Filename,
+					disposition: "attachment",
+					data:        attachment.Data,
+				})
+			}
+		}
+	}
+	if !parsed {
+		if strings.Contains(strings.ToLower(email.ContentType), "html") {
+			html = email.Content
+		} else {
+			text = email.Content
+		}
+	}
+
+	if text != "" {
+		body.text = &jmapBodyPart{partId: "1", contentType: "text/plain", data: []byte(text)}
+	}
+	if html != "" {
+		body.html = &jmapBodyPart{partId: "2", contentType: "text/html", data: []byte(html)}
+	}
+	return body
+}
+
+// part 根据 partId 查找正文部分
+func (b *jmapEmailBody) part(partId string) *jmapBodyPart {
+	for _, part := range append([]*jmapBodyPart{b.text, b.html}, b.attachments...) {
+		if part != nil && part.partId == partId {
+			return part
+		}
+	}
+	return nil
+}
+
+// textParts 纯文本正文，没有纯文本时使用HTML
+func (b *jmapEmailBody) textParts() []*jmapBodyPart {
+	if b.text != nil {
+		return []*jmapBodyPart{b.text}
+	}
+	if b.html != nil {
+		return []*jmapBodyPart{b.html}
+	}
+	return nil
+}
+
+// htmlParts HTML正文，没有HTML时使用纯文本
+func (b *jmapEmailBody) htmlParts() []*jmapBodyPart {
+	if b.html != nil {
+		return []*jmapBodyPart{b.html}
+	}
+	return b.textParts()
+}
+
+// bodyParts 转换为 EmailBodyPart 列表
+func (b *jmapEmailBody) bodyParts(emailId int64, parts []*jmapBodyPart) []types.JmapEmailBodyPart {
+	result := make([]types.JmapEmailBodyPart, 0, len(parts))
+	for _, part := range parts {
+		partId := part.partId
+		blobId := jmapId(jmapPrefixBlob, emailId) + "-" + part.partId
+		bodyPart := types.JmapEmailBodyPart{
+			PartId: &partId,
+			BlobId: &blobId,
+			Size:   int64(len(part.data)),
+			Type:   part.contentType,
+		}
+		if strings.HasPrefix(part.contentType, "text/") {
+			charset := "utf-8"
+			bodyPart.Charset = &charset
+		}
+		if part.name != "" {
+			name := part.name
+			bodyPart.Name = &name
+		}
+		if part.disposition != "" {
+			disposition := part.disposition
+			bodyPart.Disposition = &disposition
+		}
+		result = append(result, bodyPart)
+	}
+	return result
+}
+
+// bodyValues 按请求返回正文部分的文本内容
+func (b *jmapEmailBody) bodyValues(req *types.JmapEmailGetReq) map[string]types.JmapEmailBodyValue {
+	values := make(map[string]types.JmapEmailBodyValue)
+	add := func(parts []*jmapBodyPart) {
+		for _, part := range parts {
+			value := string(part.data)
+			truncated := false
+			if req.MaxBodyValueBytes > 0 && len(value) > req.MaxBodyValueBytes {
+				value = truncateUTF8(value, req.MaxBodyValueBytes)
+				truncated = true
+			}
+			values[part.partId] = types.JmapEmailBodyValue{Value: value, IsTruncated: truncated}
+		}
+	}
+	if req.FetchTextBodyValues || req.FetchAllBodyValues {
+		add(b.textParts())
+	}
+	if req.FetchHTMLBodyValues || req.FetchAllBodyValues {
+		add(b.htmlParts())
+	}
+	return values
+}
+
+// preview 正文开头的纯文本摘要
+func (b *jmapEmailBody) preview() string {
+	parsed := &service.ParsedMessage{}
+	if b.text != nil {
+		parsed.TextBody = string(b.text.data)
+	}
+	if b.html != nil {
+		parsed.HTMLBody = string(b.html.data)
+	}
+	text := strings.Join(strings.Fields(service.NewMessageParser().ExtractTextContent(parsed)), " ")
+	if utf8.RuneCountInString(text) > jmapPreviewLength {
+		text = string([]rune(text)[:jmapPreviewLength])
+	}
+	return text
+}
+
+// truncateUTF8 截断到不超过 n 字节，不拆分多字节字符
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// jmapRawHeaderFields 判断内容是否为原始报文时检查的邮件头
+var jmapRawHeaderFields = []string{
+	"From", "Date", "Message-Id", "Mime-Version", "Content-Type",
+	"Received", "Return-Path", "Subject", "To",
+}
+
+// hasRawMessageHeader 判断存储内容是否以合法的邮件头开始
+func hasRawMessageHeader(content string) bool {
+	header, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(content)))
+	if err != nil {
+		return false
+	}
+	for _, key := range jmapRawHeaderFields {
+		if header.Has(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// jmapRawMessage 获取邮件原文，内容不是原始报文时根据邮件字段构建
+func jmapRawMessage(email *model.Email) []byte {
+	if hasRawMessageHeader(email.Content) {
+		return []byte(email.Content)
+	}
+
+	var h mail.Header
+	if email.SentAt != nil {
+		h.SetDate(*email.SentAt)
+	} else {
+		h.SetDate(jmapReceivedAt(email))
+	}
+	h.SetSubject(email.Subject)
+	if email.FromEmail != "" {
+		h.SetAddressList("From", []*mail.Address{{Name: email.FromName, Address: email.FromEmail}})
+	}
+	for key, values := range map[string][]string{"To": email.ToEmails, "Cc": email.CcEmails} {
+		var addresses []*mail.Address
+		for _, address := range jmapAddresses(values) {
+			addresses = append(addresses, &mail.Address{Address: address.Email})
+		}
+		if len(addresses) > 0 {
+			h.SetAddressList(key, addresses)
+		}
+	}
+	if email.ReplyTo != "" {
+		h.Set("Reply-To", email.ReplyTo)
+	}
+	if messageId := normalizeMessageID(email.MessageId); messageId != "" {
+		h.SetMessageID(messageId)
+	}
+	if ids := model.ParseMessageIdList(email.InReplyTo); len(ids) > 0 {
+		h.SetMsgIDList("In-Reply-To", ids)
+	}
+	if ids := model.ParseMessageIdList(email.References); len(ids) > 0 {
+		h.SetMsgIDList("References", ids)
+	}
+	h.Set("Mime-Version", "1.0")
+	contentType := normalizeEmailContentType(email.ContentType)
+	if contentType == "text/plain" || contentType == "text/html" {
+		h.SetContentType(contentType, map[string]string{"charset": "utf-8"})
+	} else {
+		h.SetContentType("text/html", map[string]string{"charset": "utf-8"})
+	}
+	h.Set("Content-Transfer-Encoding", "8bit")
+
+	var buf bytes.Buffer
+	if err := textproto.WriteHeader(&buf, h.Header.Header); err != nil {
+		return []byte(email.Content)
+	}
+	content := email.Content
+	if !strings.Contains(content, "\r\n") {
+		content = strings.ReplaceAll(content, "\n", "\r\n")
+	}
+	buf.WriteString(content)
+	return buf.Bytes()
+}
+
+// emailQuery Email/query 按条件查询邮件ID
+func (h *JmapHandler) emailQuery(call *jmapCall, args json.RawMessage) (interface{}, error) {
+	var req types.JmapEmailQueryReq
+	if err := decodeJmapArgs(args, &req); err != nil {
+		return nil, err
+	}
+	mailbox, err := h.account(call, req.AccountId)
+	if err != nil {
+		return nil, err
+	}
+
+	filter, err := jmapEmailFilter(req.Filter)
+	if err != nil {
+		return nil, err
+	}
+	sorts := make([]model.EmailSort, 0, len(req.Sort))
+	for _, comparator := range req.Sort {
+		if _, ok := model.EmailSortProperties[comparator.Property]; !ok {
+			return nil, newJmapError("unsupportedSort", "不支持的排序字段: "+comparator.Property)
+		}
+		sorts = append(sorts, model.EmailSort{
+			Property:  comparator.Property,
+			Ascending: comparator.IsAscending == nil || *comparator.IsAscending,
+		})
+	}
+
+	state, err := h.emailState(mailbox.Id)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := h.svcCtx.EmailModel.Query(mailbox.Id, filter, sorts)
+	if err != nil {
+		if errors.Is(err, model.ErrEmailFilter) {
+			return nil, newJmapError("unsupportedFilter", err.Error())
+		}
+		return nil, err
+	}
+
+	if req.CollapseThreads {
+		seen := make(map[int64]bool)
+		collapsed := refs[:0]
+		for _, ref := range refs {
+			threadId := ref.ThreadId
+			if threadId == 0 {
+				threadId = ref.Id
+			}
+			if !seen[threadId] {
+				seen[threadId] = true
+				collapsed = append(collapsed, ref)
+			}
+		}
+		refs = collapsed
+	}
+
+	total := len(refs)
+	position := req.Position
+	if req.Anchor != "" {
+		anchorId, _ := call.resolveId(jmapPrefixEmail, req.Anchor)
+		index := -1
+		for i, ref := range refs {
+			if ref.Id == anchorId {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return nil, newJmapError("anchorNotFound", req.Anchor)
+		}
+		position = index + req.AnchorOffset
+		if position < 0 {
+			position = 0
+		}
+	} else if position < 0 {
+		position += total
+		if position < 0 {
+			position = 0
+		}
+	}
+	if position > total {
+		position = total
+	}
+
+	limit := jmapMaxQueryLimit
+	var limitResp *int
+	if req.Limit != nil {
+		if *req.Limit < 0 {
+			return nil, newJmapError("invalidArguments", "limit 不能为负数")
+		}
+		if *req.Limit < limit {
+			limit = *req.Limit
+		} else if *req.Limit > limit {
+			limitResp = &limit
+		}
+	} else if total-position > limit {
+		limitResp = &limit
+	}
+	end := position + limit
+	if end > total {
+		end = total
+	}
+
+	resp := types.JmapQueryResp{
+		AccountId:           req.AccountId,
+		QueryState:          state.String(),
+		CanCalculateChanges: false,
+		Position:            position,
+		Ids:                 make([]string, 0, end-position),
+		Limit:               limitResp,
+	}
+	for _, ref := range refs[position:end] {
+		resp.Ids = append(resp.Ids, jmapId(jmapPrefixEmail, ref.Id))
+	}
+	if req.CalculateTotal {
+		resp.Total = &total
+	}
+	return resp, nil
+}
+
+// jmapEmailFilter 将 FilterOperator/FilterCondition 转换为邮件查询条件
+func jmapEmailFilter(raw json.RawMessage) (*model.EmailFilter, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, newJmapError("invalidArguments", "filter 必须是对象")
+	}
+
+	invalid := func(key string) error {
+		return newJmapError("invalidArguments", "filter 参数无效: "+key)
+	}
+
+	filter := &model.EmailFilter{}
+	if operator, ok := fields["operator"]; ok {
+		if err := json.Unmarshal(operator, &filter.Operator); err != nil {
+			return nil, invalid("operator")
+		}
+		switch filter.Operator {
+		case model.EmailFilterAnd, model.EmailFilterOr, model.EmailFilterNot:
+		default:
+			return nil, newJmapError("unsupportedFilter", "不支持的运算符: "+filter.Operator)
+		}
+		var conditions []json.RawMessage
+		if err := json.Unmarshal(fields["conditions"], &conditions); err != nil {
+			return nil, invalid("conditions")
+		}
+		for _, condition := range conditions {
+			sub, err := jmapEmailFilter(condition)
+			if err != nil {
+				return nil, err
+			}
+			if sub != nil {
+				filter.Conditions = append(filter.Conditions, sub)
+			}
+		}
+		return filter, nil
+	}
+
+	for key, value := range fields {
+		var err error
+		switch key {
+		case "inMailbox":
+			var id string
+			if err = json.Unmarshal(value, &id); err == nil {
+				// 不存在的文件夹没有邮件
+				filter.InFolder, _ = parseJmapId(jmapPrefixMailbox, id)
+				if filter.InFolder == 0 {
+					filter.InFolder = -1
+				}
+			}
+		case "inMailboxOtherThan":
+			var ids []string
+			if err = json.Unmarshal(value, &ids); err == nil {
+				for _, id := range ids {
+					if folderId, ok := parseJmapId(jmapPrefixMailbox, id); ok {
+						filter.NotInFolders = append(filter.NotInFolders, folderId)
+					}
+				}
+			}
+		case "before":
+			err = json.Unmarshal(value, &filter.Before)
+		case "after":
+			err = json.Unmarshal(value, &filter.After)
+		case "minSize":
+			err = json.Unmarshal(value, &filter.MinSize)
+		case "maxSize":
+			err = json.Unmarshal(value, &filter.MaxSize)
+		case "from":
+			err = json.Unmarshal(value, &filter.From)
+		case "to":
+			err = json.Unmarshal(value, &filter.To)
+		case "cc":
+			err = json.Unmarshal(value, &filter.Cc)
+		case "bcc":
+			err = json.Unmarshal(value, &filter.Bcc)
+		case "subject":
+			err = json.Unmarshal(value, &filter.Subject)
+		case "body":
+			err = json.Unmarshal(value, &filter.Body)
+		case "text":
+			err = json.Unmarshal(value, &filter.Text)
+		case "hasKeyword", "notKeyword":
+			var keyword string
+			if err = json.Unmarshal(value, &keyword); err == nil {
+				flag := jmapKeywordFlag(keyword)
+				if flag == "" {
+					return nil, invalid(key)
+				}
+				if key == "hasKeyword" {
+					filter.HasFlag = flag
+				} else {
+					filter.NotFlag = flag
+				}
+			}
+		default:
+			return nil, newJmapError("unsupportedFilter", "不支持的查询条件: "+key)
+		}
+		if err != nil {
+			return nil, invalid(key)
+		}
+	}
+	return filter, nil
+}
+
+// jmapSortOptions 支持的排序字段
+func jmapSortOptions() []string {
+	options := make([]string, 0, len(model.EmailSortProperties))
+	for property := range model.EmailSortProperties {
+		options = append(options, property)
+	}
+	sort.Strings(options)
+	return options
+}
+
+// emailChanges Email/changes 根据各文件夹修改序号和墓碑计算变更
+func (h *JmapHandler) emailChanges(call *jmapCall, args json.RawMessage) (interface{}, error) {
+	var req types.JmapChangesReq
+	if err := decodeJmapArgs(args, &req); err != nil {
+		return nil, err
+	}
+	if req.MaxChanges < 0 {
+		return nil, newJmapError("invalidArguments", "maxChanges 不能为负数")
+	}
+	mailbox, err := h.account(call, req.AccountId)
+	if err != nil {
+		return nil, err
+	}
+
+	since, ok := parseJmapEmailState(req.SinceState)
+	if !ok {
+		return nil, newJmapError("cannotCalculateChanges", "无效的状态: "+req.SinceState)
+	}
+	current, err := h.emailState(mailbox.Id)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := h.svcCtx.EmailModel.Changes(mailbox.Id, since.modSeqs, current.modSeqs)
+	if err != nil {
+		if errors.Is(err, model.ErrModSeqState) {
+			return nil, newJmapError("cannotCalculateChanges", err.Error())
+		}
+		return nil, err
+	}
+
+	newState, hasMore := current, false
+	if req.MaxChanges > 0 {
+		if changes, newState, hasMore, err = limitJmapChanges(changes, since, current, req.MaxChanges); err != nil {
+			return nil, err
+		}
+	}
+
+	var ids []int64
+	seen := make(map[int64]bool)
+	for _, change := range changes {
+		if !seen[change.EmailId] {
+			seen[change.EmailId] = true
+			ids = append(ids, change.EmailId)
+		}
+	}
+	existing, err := h.svcCtx.EmailModel.ExistingIds(mailbox.Id, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := types.JmapChangesResp{
+		AccountId:      req.AccountId,
+		OldState:       req.SinceState,
+		NewState:       newState.String(),
+		HasMoreChanges: hasMore,
+		Created:        []string{},
+		Updated:        []string{},
+		Destroyed:      []string{},
+	}
+	for _, id := range ids {
+		// ID大于旧状态最大ID的邮件是之后新增的，已删除的不必告知客户端
+		isNew := id > since.maxId
+		switch {
+		case existing[id] && isNew:
+			resp.Created = append(resp.Created, jmapId(jmapPrefixEmail, id))
+		case existing[id]:
+			resp.Updated = append(resp.Updated, jmapId(jmapPrefixEmail, id))
+		case !isNew:
+			resp.Destroyed = append(resp.Destroyed, jmapId(jmapPrefixEmail, id))
+		}
+	}
+	return resp, nil
+}
+
+// limitJmapChanges 按 (文件夹, 修改序号) 分组截取不超过 maxChanges 封邮件的变更，并返回对应的中间状态
+// 同一修改序号的变更不能拆开，第一组就超出时无法计算
+func limitJmapChanges(changes []*model.EmailChange, since, until jmapEmailState, maxChanges int) ([]*model.EmailChange, jmapEmailState, bool, error) {
+	seen := make(map[int64]bool)
+	end := 0
+	for end < len(changes) {
+		groupEnd := end
+		var groupIds []int64
+		for groupEnd < len(changes) &&
+			changes[groupEnd].FolderId == changes[end].FolderId &&
+			changes[groupEnd].ModSeq == changes[end].ModSeq {
+			if !seen[changes[groupEnd].EmailId] {
+				groupIds = append(groupIds, changes[groupEnd].EmailId)
+			}
+			groupEnd++
+		}
+		if len(seen)+len(groupIds) > maxChanges {
+			break
+		}
+		for _, id := range groupIds {
+			seen[id] = true
+		}
+		end = groupEnd
+	}
+	if end == len(changes) {
+		return changes, until, false, nil
+	}
+	if end == 0 {
+		return nil, jmapEmailState{}, false, newJmapError("cannotCalculateChanges", "单次变更的邮件数超过 maxChanges")
+	}
+
+	// 已处理完的文件夹取新状态，处理到一半的文件夹取最后一组的序号，其余保持旧状态
+	last := changes[end-1]
+	state := jmapEmailState{maxId: since.maxId, modSeqs: make(map[int64]int64)}
+	for folderId, modSeq := range since.modSeqs {
+		if folderId > last.FolderId {
+			state.modSeqs[folderId] = modSeq
+		}
+	}
+	for folderId, modSeq := range until.modSeqs {
+		if folderId < last.FolderId {
+			state.modSeqs[folderId] = modSeq
+		}
+	}
+	state.modSeqs[last.FolderId] = last.ModSeq
+	return changes[:end], state, true, nil
+}
+
+// emailSet Email/set 创建草稿、修改关键字和所在文件夹、永久删除邮件
+func (h *JmapHandler) emailSet(call *jmapCall, args json.RawMessage) (interface{}, error) {
+	var req types.JmapSetReq
+	if err := decodeJmapArgs(args, &req); err != nil {
+		return nil, err
+	}
+	mailbox, err := h.account(call, req.AccountId)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Create)+len(req.Update)+len(req.Destroy) > jmapMaxObjectsInSet {
+		return nil, newJmapError("requestTooLarge", "对象数超过 maxObjectsInSet")
+	}
+
+	oldState, err := h.emailState(mailbox.Id)
+	if err != nil {
+		return nil, err
+	}
+	if req.IfInState != "" && req.IfInState != oldState.String() {
+		return nil, newJmapError("stateMismatch", "状态已变化")
+	}
+
+	resp := types.JmapSetResp{AccountId: req.AccountId, OldState: oldState.String()}
+
+	creationIds := make([]string, 0, len(req.Create))
+	for creationId := range req.Create {
+		creationIds = append(creationIds, creationId)
+	}
+	sort.Strings(creationIds)
+	for _, creationId := range creationIds {
+		email, setErr := h.createEmail(mailbox, req.Create[creationId])
+		if setErr != nil {
+			if resp.NotCreated == nil {
+				resp.NotCreated = make(map[string]*types.JmapSetError)
+			}
+			resp.NotCreated[creationId] = setErr
+			continue
+		}
+		if resp.Created == nil {
+			resp.Created = make(map[string]interface{})
+		}
+		resp.Created[creationId] = map[string]interface{}{
+			"id":       jmapId(jmapPrefixEmail, email.Id),
+			"blobId":   jmapId(jmapPrefixBlob, email.Id),
+			"threadId": jmapId(jmapPrefixThread, jmapThreadId(email)),
+			"size":     email.Size,
+		}
+		call.createdIds[creationId] = jmapId(jmapPrefixEmail, email.Id)
+	}
+
+	for id, patch := range req.Update {
+		if setErr := h.updateEmail(call, mailbox, id, patch); setErr != nil {
+			if resp.NotUpdated == nil {
+				resp.NotUpdated = make(map[string]*types.JmapSetError)
+			}
+			resp.NotUpdated[id] = setErr
+			continue
+		}
+		if resp.Updated == nil {
+			resp.Updated = make(map[string]interface{})
+		}
+		resp.Updated[id] = nil
+	}
+
+	for _, id := range req.Destroy {
+		if setErr := h.destroyEmail(call, mailbox, id); setErr != nil {
+			if resp.NotDestroyed == nil {
+				resp.NotDestroyed = make(map[string]*types.JmapSetError)
+			}
+			resp.NotDestroyed[id] = setErr
+			continue
+		}
+		resp.Destroyed = append(resp.Destroyed, id)
+	}
+
+	newState, err := h.emailState(mailbox.Id)
+	if err != nil {
+		return nil, err
+	}
+	resp.NewState = newState.String()
+	return resp, nil
+}
+
+// jmapSetError 创建 SetError
+func jmapSetError(errorType, description string, properties ...string) *types.JmapSetError {
+	return &types.JmapSetError{Type: errorType, Description: description, Properties: properties}
+}
+
+// createEmail 在指定文件夹中创建邮件，正文取自 bodyValues，不支持上传的附件
+func (h *JmapHandler) createEmail(mailbox *model.Mailbox, raw json.RawMessage) (*model.Email, *types.JmapSetError) {
+	var obj types.JmapEmailCreate
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, jmapSetError("invalidProperties", err.Error())
+	}
+
+	folder, setErr := h.singleFolder(mailbox, obj.MailboxIds)
+	if setErr != nil {
+		return nil, setErr
+	}
+	if len(obj.Attachments) > 0 {
+		return nil, jmapSetError("invalidProperties", "不支持附件", "attachments")
+	}
+
+	content, contentType := "", "text/plain"
+	for _, candidate := range []struct {
+		property    string
+		parts       []types.JmapEmailBodyPart
+		contentType string
+	}{
+		{"htmlBody", obj.HtmlBody, "text/html"},
+		{"textBody", obj.TextBody, "text/plain"},
+	} {
+		if len(candidate.parts) == 0 {
+			continue
+		}
+		part := candidate.parts[0]
+		if len(candidate.parts) > 1 || part.PartId == nil || part.BlobId != nil {
+			return nil, jmapSetError("invalidProperties", "正文只能是 bodyValues 中的单个部分", candidate.property)
+		}
+		value, ok := obj.BodyValues[*part.PartId]
+		if !ok {
+			return nil, jmapSetError("invalidProperties", "bodyValues 中缺少正文部分: "+*part.PartId, candidate.property)
+		}
+		content, contentType = value.Value, candidate.contentType
+		break
+	}
+
+	email := &model.Email{
+		UserId:      mailbox.UserId,
+		MailboxId:   mailbox.Id,
+		FolderId:    folder.Id,
+		Subject:     obj.Subject,
+		FromEmail:   mailbox.Email,
+		ToEmails:    jmapAddressStrings(obj.To),
+		CcEmails:    jmapAddressStrings(obj.Cc),
+		BccEmails:   jmapAddressStrings(obj.Bcc),
+		Content:     content,
+		ContentType: contentType,
+		Direction:   "sent",
+		SentAt:      obj.SentAt,
+		ReceivedAt:  obj.ReceivedAt,
+	}
+	if len(obj.From) > 0 {
+		email.FromEmail = obj.From[0].Email
+		if obj.From[0].Name != nil {
+			email.FromName = *obj.From[0].Name
+		}
+	}
+	if replyTo := jmapAddressStrings(obj.ReplyTo); len(replyTo) > 0 {
+		email.ReplyTo = replyTo[0]
+	}
+	if email.ReceivedAt == nil {
+		now := time.Now()
+		email.ReceivedAt = &now
+	}
+	if len(obj.MessageId) > 0 {
+		email.MessageId = normalizeMessageID(obj.MessageId[0])
+	} else {
+		email.MessageId = jmapMessageId(mailbox.Email)
+	}
+	if len(obj.InReplyTo) > 0 {
+		email.InReplyTo = normalizeMessageID(obj.InReplyTo[0])
+	}
+	if len(obj.References) > 0 {
+		references := make([]string, 0, len(obj.References))
+		for _, id := range obj.References {
+			references = append(references, "<"+normalizeMessageID(id)+">")
+		}
+		email.References = strings.Join(references, " ")
+	}
+
+	flags, setErr := jmapKeywordFlags(obj.Keywords)
+	if setErr != nil {
+		return nil, setErr
+	}
+	email.ApplyFlags(model.FlagOpAdd, flags)
+
+	if err := h.svcCtx.MailboxModel.CheckQuota(mailbox.Id, int64(len(content)), 1); err != nil {
+		if errors.Is(err, model.ErrQuotaExceeded) {
+			return nil, jmapSetError("overQuota", err.Error())
+		}
+		return nil, jmapSetError("serverFail", err.Error())
+	}
+	if err := h.svcCtx.EmailModel.Create(email); err != nil {
+		return nil, jmapSetError("serverFail", err.Error())
+	}
+	publishEmailEvent(h.svcCtx, event.TypeNew, email)
+	return email, nil
+}
+
+// jmapMessageId 为新建的邮件生成消息ID
+func jmapMessageId(address string) string {
+	domain := "localhost"
+	if at := strings.LastIndex(address, "@"); at >= 0 {
+		domain = address[at+1:]
+	}
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + ".jmap@" + domain
+}
+
+// jmapKeywordFlags 将关键字集合转换为邮件标志
+func jmapKeywordFlags(keywords map[string]bool) ([]string, *types.JmapSetError) {
+	var flags []string
+	for keyword, value := range keywords {
+		if !value {
+			return nil, jmapSetError("invalidProperties", "关键字的值必须为true", "keywords")
+		}
+		flag := jmapKeywordFlag(keyword)
+		if flag == "" {
+			return nil, jmapSetError("invalidProperties", "无效的关键字: "+keyword, "keywords")
+		}
+		flags = append(flags, flag)
+	}
+	return flags, nil
+}
+
+// singleFolder 解析 mailboxIds，邮件只能属于账户中的一个文件夹
+func (h *JmapHandler) singleFolder(mailbox *model.Mailbox, mailboxIds map[string]bool) (*model.Folder, *types.JmapSetError) {
+	var ids []string
+	for id, value := range mailboxIds {
+		if value {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) != 1 {
+		return nil, jmapSetError("invalidProperties", "邮件必须且只能属于一个文件夹", "mailboxIds")
+	}
+	folderId, ok := parseJmapId(jmapPrefixMailbox, ids[0])
+	if !ok {
+		return nil, jmapSetError("invalidProperties", "文件夹不存在: "+ids[0], "mailboxIds")
+	}
+	folder, err := h.svcCtx.FolderModel.GetById(folderId)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, jmapSetError("serverFail", err.Error())
+	}
+	if folder == nil || folder.MailboxId != mailbox.Id {
+		return nil, jmapSetError("invalidProperties", "文件夹不存在: "+ids[0], "mailboxIds")
+	}
+	return folder, nil
+}
+
+// accountEmail 获取账户中的邮件
+func (h *JmapHandler) accountEmail(call *jmapCall, mailbox *model.Mailbox, id string) (*model.Email, *types.JmapSetError) {
+	emailId, ok := call.resolveId(jmapPrefixEmail, id)
+	if !ok {
+		return nil, jmapSetError("notFound", "")
+	}
+	emails, err := h.svcCtx.EmailModel.GetByMailboxIdAndIds(mailbox.Id, []int64{emailId})
+	if err != nil {
+		return nil, jmapSetError("serverFail", err.Error())
+	}
+	if len(emails) == 0 {
+		return nil, jmapSetError("notFound", "")
+	}
+	return emails[0], nil
+}
+
+// updateEmail 按 PatchObject 修改邮件的关键字和所在文件夹
+func (h *JmapHandler) updateEmail(call *jmapCall, mailbox *model.Mailbox, id string, patch map[string]json.RawMessage) *types.JmapSetError {
+	email, setErr := h.accountEmail(call, mailbox, id)
+	if setErr != nil {
+		return setErr
+	}
+
+	flagsChanged := false
+	mailboxIds := map[string]bool{jmapId(jmapPrefixMailbox, email.FolderId): true}
+	for path, value := range patch {
+		switch {
+		case path == "keywords":
+			var keywords map[string]bool
+			if err := json.Unmarshal(value, &keywords); err != nil {
+				return jmapSetError("invalidProperties", err.Error(), path)
+			}
+			flags, setErr := jmapKeywordFlags(keywords)
+			if setErr != nil {
+				return setErr
+			}
+			// \Deleted 没有对应的关键字，替换时保留
+			if email.IsDeleted {
+				flags = append(flags, model.FlagDeleted)
+			}
+			email.ApplyFlags(model.FlagOpReplace, flags)
+			flagsChanged = true
+		case strings.HasPrefix(path, "keywords/"):
+			keyword := jmapUnescapePointer(strings.TrimPrefix(path, "keywords/"))
+			flag := jmapKeywordFlag(keyword)
+			if flag == "" {
+				return jmapSetError("invalidProperties", "无效的关键字: "+keyword, path)
+			}
+			if string(value) == "true" {
+				email.ApplyFlags(model.FlagOpAdd, []string{flag})
+			} else if string(value) == "null" {
+				email.ApplyFlags(model.FlagOpRemove, []string{flag})
+			} else {
+				return jmapSetError("invalidPatch", "关键字的值必须为true或null", path)
+			}
+			flagsChanged = true
+		case path == "mailboxIds":
+			mailboxIds = nil
+			if err := json.Unmarshal(value, &mailboxIds); err != nil {
+				return jmapSetError("invalidProperties", err.Error(), path)
+			}
+		case strings.HasPrefix(path, "mailboxIds/"):
+			mailboxId := jmapUnescapePointer(strings.TrimPrefix(path, "mailboxIds/"))
+			if string(value) == "true" {
+				mailboxIds[mailboxId] = true
+			} else if string(value) == "null" {
+				delete(mailboxIds, mailboxId)
+			} else {
+				return jmapSetError("invalidPatch", "mailboxIds 的值必须为true或null", path)
+			}
+		default:
+			return jmapSetError("invalidProperties", "不支持修改的属性: "+path, path)
+		}
+	}
+
+	folder, setErr := h.singleFolder(mailbox, mailboxIds)
+	if setErr != nil {
+		return setErr
+	}
+
+	if flagsChanged {
+		if err := h.svcCtx.EmailModel.UpdateFlags(email); err != nil {
+			return jmapSetError("serverFail", err.Error())
+		}
+		publishEmailEvent(h.svcCtx, event.TypeFlags, email)
+	}
+	if folder.Id != email.FolderId {
+		uid, err := h.svcCtx.EmailModel.MoveToFolder(email.Id, folder.Id)
+		if err != nil {
+			return jmapSetError("serverFail", err.Error())
+		}
+		publishEmailEvent(h.svcCtx, event.TypeExpunge, email)
+		email.FolderId, email.Uid = folder.Id, uid
+		publishEmailEvent(h.svcCtx, event.TypeNew, email)
+	}
+	return nil
+}
+
+// destroyEmail 永久删除邮件并清理不再被引用的原文和附件
+func (h *JmapHandler) destroyEmail(call *jmapCall, mailbox *model.Mailbox, id string) *types.JmapSetError {
+	email, setErr := h.accountEmail(call, mailbox, id)
+	if setErr != nil {
+		return setErr
+	}
+	blobKeys, err := h.svcCtx.EmailModel.Expunge([]int64{email.Id})
+	if err != nil {
+		return jmapSetError("serverFail", err.Error())
+	}
+	deleteBlobs(h.svcCtx, blobKeys)
+	publishEmailEvent(h.svcCtx, event.TypeExpunge, email)
+	return nil
+}
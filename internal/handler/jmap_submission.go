@@ -0,0 +1,223 @@
+package handler
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rankgice/new-email/internal/model"
+	"github.com/rankgice/new-email/internal/service"
+	"github.com/rankgice/new-email/internal/types"
+)
+
+// 发件身份不可修改、提交记录不保存，状态固定
+const (
+	jmapIdentityState   = "1"
+	jmapSubmissionState = "1"
+)
+
+// identityGet Identity/get 返回账户邮箱对应的发件身份
+func (h *JmapHandler) identityGet(call *jmapCall, args json.RawMessage) (interface{}, error) {
+	var req types.JmapGetReq
+	if err := decodeJmapArgs(args, &req); err != nil {
+		return nil, err
+	}
+	mailbox, err := h.account(call, req.AccountId)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &types.JmapIdentity{
+		Id:    jmapId(jmapPrefixIdentity, mailbox.Id),
+		Email: mailbox.Email,
+	}
+	resp := types.JmapGetResp{
+		AccountId: req.AccountId,
+		State:     jmapIdentityState,
+		List:      []interface{}{},
+		NotFound:  []string{},
+	}
+	ids := []string{identity.Id}
+	if req.Ids != nil {
+		ids = *req.Ids
+	}
+	for _, id := range ids {
+		if id != identity.Id {
+			resp.NotFound = append(resp.NotFound, id)
+			continue
+		}
+		obj, err := jmapSelectProperties(identity, req.Properties)
+		if err != nil {
+			return nil, err
+		}
+		resp.List = append(resp.List, obj)
+	}
+	return resp, nil
+}
+
+// emailSubmissionSet EmailSubmission/set 立即发送邮件，提交记录不保存
+// 发送成功后按 onSuccessUpdateEmail/onSuccessDestroyEmail 修改邮件，并附带隐式的 Email/set 响应
+func (h *JmapHandler) emailSubmissionSet(call *jmapCall, args json.RawMessage) (interface{}, error) {
+	var req types.JmapEmailSubmissionSetReq
+	if err := decodeJmapArgs(args, &req); err != nil {
+		return nil, err
+	}
+	mailbox, err := h.account(call, req.AccountId)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Create) > jmapMaxObjectsInSet {
+		return nil, newJmapError("requestTooLarge", "对象数超过 maxObjectsInSet")
+	}
+
+	if req.IfInState != "" && req.IfInState != jmapSubmissionState {
+		return nil, newJmapError("stateMismatch", "状态已变化")
+	}
+	resp := types.JmapSetResp{AccountId: req.AccountId, OldState: jmapSubmissionState, NewState: jmapSubmissionState}
+
+	creationIds := make([]string, 0, len(req.Create))
+	for creationId := range req.Create {
+		creationIds = append(creationIds, creationId)
+	}
+	sort.Strings(creationIds)
+
+	// 提交ID（含 #creationId）到邮件ID的映射，供 onSuccess* 引用
+	submittedEmails := make(map[string]string)
+	for _, creationId := range creationIds {
+		email, setErr := h.submitEmail(call, mailbox, req.Create[creationId])
+		if setErr != nil {
+			if resp.NotCreated == nil {
+				resp.NotCreated = make(map[string]*types.JmapSetError)
+			}
+			resp.NotCreated[creationId] = setErr
+			continue
+		}
+
+		now := time.Now()
+		submissionId := jmapId(jmapPrefixSubmission, email.Id) + "-" + strconv.FormatInt(now.UnixNano(), 36)
+		if resp.Created == nil {
+			resp.Created = make(map[string]interface{})
+		}
+		resp.Created[creationId] = map[string]interface{}{
+			"id":         submissionId,
+			"undoStatus": "final",
+			"sendAt":     now.UTC().Format(time.RFC3339),
+		}
+		call.createdIds[creationId] = submissionId
+		submittedEmails["#"+creationId] = jmapId(jmapPrefixEmail, email.Id)
+		submittedEmails[submissionId] = jmapId(jmapPrefixEmail, email.Id)
+	}
+	for id := range req.Update {
+		if resp.NotUpdated == nil {
+			resp.NotUpdated = make(map[string]*types.JmapSetError)
+		}
+		resp.NotUpdated[id] = jmapSetError("notFound", "")
+	}
+	for _, id := range req.Destroy {
+		if resp.NotDestroyed == nil {
+			resp.NotDestroyed = make(map[string]*types.JmapSetError)
+		}
+		resp.NotDestroyed[id] = jmapSetError("notFound", "")
+	}
+
+	emailSet := types.JmapSetReq{AccountId: req.AccountId}
+	for id, patch := range req.OnSuccessUpdateEmail {
+		if emailId, ok := submittedEmails[id]; ok {
+			if emailSet.Update == nil {
+				emailSet.Update = make(map[string]map[string]json.RawMessage)
+			}
+			emailSet.Update[emailId] = patch
+		}
+	}
+	for _, id := range req.OnSuccessDestroyEmail {
+		if emailId, ok := submittedEmails[id]; ok {
+			emailSet.Destroy = append(emailSet.Destroy, emailId)
+		}
+	}
+	if len(emailSet.Update) > 0 || len(emailSet.Destroy) > 0 {
+		setArgs, err := json.Marshal(emailSet)
+		if err != nil {
+			return nil, err
+		}
+		setResp, err := h.emailSet(call, setArgs)
+		if err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(setResp)
+		if err != nil {
+			return nil, err
+		}
+		call.implicit = append(call.implicit, types.JmapInvocation{Name: "Email/set", Args: data})
+	}
+	return resp, nil
+}
+
+// submitEmail 通过SMTP发送账户中的邮件，发件人为账户邮箱，收件人取邮件的收件人、抄送和密送
+func (h *JmapHandler) submitEmail(call *jmapCall, mailbox *model.Mailbox, raw json.RawMessage) (*model.Email, *types.JmapSetError) {
+	var obj types.JmapEmailSubmissionCreate
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, jmapSetError("invalidProperties", err.Error())
+	}
+	if obj.IdentityId != jmapId(jmapPrefixIdentity, mailbox.Id) {
+		return nil, jmapSetError("invalidProperties", "发件身份不存在", "identityId")
+	}
+	if len(obj.Envelope) > 0 && string(obj.Envelope) != "null" {
+		return nil, jmapSetError("invalidProperties", "不支持自定义信封", "envelope")
+	}
+	email, setErr := h.accountEmail(call, mailbox, obj.EmailId)
+	if setErr != nil {
+		return nil, jmapSetError("invalidProperties", "邮件不存在", "emailId")
+	}
+
+	sendReq := &types.EmailSendReq{
+		ToEmail:  email.ToEmails,
+		CcEmail:  email.CcEmails,
+		BccEmail: email.BccEmails,
+	}
+	if len(sendReq.ToEmail)+len(sendReq.CcEmail)+len(sendReq.BccEmail) == 0 {
+		return nil, jmapSetError("noRecipients", "邮件没有收件人")
+	}
+	suppressed, err := findSuppressedRecipients(h.svcCtx, mailbox.UserId, sendReq)
+	if err != nil {
+		return nil, jmapSetError("serverFail", err.Error())
+	}
+	if len(suppressed) > 0 {
+		return nil, jmapSetError("forbiddenToSend", "收件人在抑制列表中: "+strings.Join(suppressed, ", "))
+	}
+
+	smtpConfig, err := buildSMTPConfig(h.svcCtx, mailbox)
+	if err != nil {
+		return nil, jmapSetError("forbiddenToSend", "邮箱凭据不可用于发信")
+	}
+
+	if err := loadEmailContent(h.svcCtx, email); err != nil {
+		return nil, jmapSetError("serverFail", err.Error())
+	}
+	body := parseJmapEmailBody(email)
+	message := service.EmailMessage{
+		From:    mailbox.Email,
+		To:      email.ToEmails,
+		Cc:      email.CcEmails,
+		Bcc:     email.BccEmails,
+		Subject: email.Subject,
+	}
+	if body.html != nil {
+		message.Body, message.ContentType = string(body.html.data), "text/html"
+	} else if body.text != nil {
+		message.Body, message.ContentType = string(body.text.data), "text/plain"
+	}
+	for _, attachment := range body.attachments {
+		message.Attachments = append(message.Attachments, service.EmailAttachment{
+			Filename:    attachment.name,
+			ContentType: attachment.contentType,
+			Data:        attachment.data,
+		})
+	}
+
+	if err := service.NewSMTPService(smtpConfig).SendEmail(message); err != nil {
+		return nil, jmapSetError("forbiddenToSend", "邮件发送失败: "+err.Error())
+	}
+	return email, nil
+}
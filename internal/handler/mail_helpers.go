@@ -1,12 +1,16 @@
 package handler
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
 	"strings"
 	"time"
 
+	"github.com/rankgice/new-email/internal/event"
 	"github.com/rankgice/new-email/internal/model"
 	"github.com/rankgice/new-email/internal/service"
 	"github.com/rankgice/new-email/internal/svc"
@@ -237,16 +241,59 @@ func decodeEmailAttachments(attachments []types.AttachmentData) ([]service.Email
 	return decoded, nil
 }
 
-func persistEmailAttachments(svcCtx *svc.ServiceContext, emailId int64, attachments []types.AttachmentData) error {
+// storeEmailAttachments 将附件数据写入对象存储，返回待保存的附件记录，相同内容的附件只存一份
+// 调用方保存附件记录后需调用 releaseEmailAttachments 释放对象的占用
+func storeEmailAttachments(svcCtx *svc.ServiceContext, attachments []types.AttachmentData) ([]*model.EmailAttachment, error) {
+	records := make([]*model.EmailAttachment, 0, len(attachments))
 	for _, attachment := range attachments {
-		if err := svcCtx.EmailAttachmentModel.Create(&model.EmailAttachment{
-			EmailId:   emailId,
+		data, err := base64.StdEncoding.DecodeString(attachment.Data)
+		if err != nil {
+			return nil, fmt.Errorf("decode attachment %s: %w", attachment.Filename, err)
+		}
+		key, size, err := svcCtx.BlobStore.Put(bytes.NewReader(data), 0)
+		if err != nil {
+			releaseEmailAttachments(svcCtx, records)
+			return nil, fmt.Errorf("store attachment %s: %w", attachment.Filename, err)
+		}
+		records = append(records, &model.EmailAttachment{
 			Filename:  attachment.Filename,
-			FilePath:  "",
-			FileSize:  attachment.Size,
+			FilePath:  key,
+			FileSize:  size,
 			MimeType:  attachment.ContentType,
 			CreatedAt: time.Now(),
-		}); err != nil {
+		})
+	}
+	return records, nil
+}
+
+// releaseEmailAttachments 附件记录保存结束后释放对象的占用，记录保存失败时删除不再被引用的附件数据
+func releaseEmailAttachments(svcCtx *svc.ServiceContext, records []*model.EmailAttachment) {
+	keys := make([]string, 0, len(records))
+	for _, record := range records {
+		svcCtx.BlobStore.Release(record.FilePath)
+		keys = append(keys, record.FilePath)
+	}
+	deleteBlobs(svcCtx, keys)
+}
+
+// deleteBlobs 删除不再被引用的邮件原文和附件，删除前在对象键的锁内重新确认没有引用
+func deleteBlobs(svcCtx *svc.ServiceContext, keys []string) {
+	for _, key := range keys {
+		if err := svcCtx.BlobStore.DeleteUnreferenced(key, svcCtx.EmailModel.BlobReferenced); err != nil {
+			log.Printf("⚠️  清理对象失败: %s, %v", key, err)
+		}
+	}
+}
+
+func persistEmailAttachments(svcCtx *svc.ServiceContext, emailId int64, attachments []types.AttachmentData) error {
+	records, err := storeEmailAttachments(svcCtx, attachments)
+	if err != nil {
+		return err
+	}
+	defer releaseEmailAttachments(svcCtx, records)
+	for _, record := range records {
+		record.EmailId = emailId
+		if err := svcCtx.EmailAttachmentModel.Create(record); err != nil {
 			return err
 		}
 	}
@@ -254,9 +301,28 @@ func persistEmailAttachments(svcCtx *svc.ServiceContext, emailId int64, attachme
 	return nil
 }
 
+// findSuppressedRecipients 返回请求收件人中已被用户抑制的地址，请求要求忽略抑制列表时返回空
+func findSuppressedRecipients(svcCtx *svc.ServiceContext, userId int64, req *types.EmailSendReq) ([]string, error) {
+	if req.IgnoreSuppression {
+		return nil, nil
+	}
+
+	recipients := make([]string, 0, len(req.ToEmail)+len(req.CcEmail)+len(req.BccEmail))
+	recipients = append(recipients, req.ToEmail...)
+	recipients = append(recipients, req.CcEmail...)
+	recipients = append(recipients, req.BccEmail...)
+
+	return svcCtx.SuppressionModel.GetSuppressedEmails(userId, recipients)
+}
+
 func persistSentEmailRecord(svcCtx *svc.ServiceContext, userId int64, mailbox *model.Mailbox, req *types.EmailSendReq, sentAt time.Time) (*model.Email, error) {
+	attachments, err := storeEmailAttachments(svcCtx, req.Attachments)
+	if err != nil {
+		return nil, err
+	}
+
 	var emailRecord *model.Email
-	err := svcCtx.DB.Transaction(func(tx *gorm.DB) error {
+	err = svcCtx.DB.Transaction(func(tx *gorm.DB) error {
 		folderModel := model.NewFolderModel(tx)
 		sentFolder, err := folderModel.GetByMailboxIdAndName(mailbox.Id, "Sent", nil)
 		if err != nil {
@@ -294,24 +360,20 @@ func persistSentEmailRecord(svcCtx *svc.ServiceContext, userId int64, mailbox *m
 		}
 
 		attachmentModel := model.NewEmailAttachmentModel(tx)
-		for _, attachment := range req.Attachments {
-			if err := attachmentModel.Create(&model.EmailAttachment{
-				EmailId:   emailRecord.Id,
-				Filename:  attachment.Filename,
-				FilePath:  "",
-				FileSize:  attachment.Size,
-				MimeType:  attachment.ContentType,
-				CreatedAt: time.Now(),
-			}); err != nil {
+		for _, attachment := range attachments {
+			attachment.EmailId = emailRecord.Id
+			if err := attachmentModel.Create(attachment); err != nil {
 				return err
 			}
 		}
 
 		return nil
 	})
+	releaseEmailAttachments(svcCtx, attachments)
 	if err != nil {
 		return nil, err
 	}
+	publishEmailEvent(svcCtx, event.TypeNew, emailRecord)
 
 	return emailRecord, nil
 }
@@ -334,6 +396,7 @@ func persistReceivedEmail(svcCtx *svc.ServiceContext, mailbox *model.Mailbox, im
 		MailboxId:   mailbox.Id,
 		FolderId:    inboxFolder.Id,
 		MessageId:   normalizedIMAPMessageID(imapEmail),
+		InReplyTo:   normalizeMessageID(imapEmail.InReplyTo),
 		Subject:     imapEmail.Subject,
 		FromEmail:   imapEmail.From,
 		ToEmails:    imapEmail.To,
@@ -349,6 +412,40 @@ func persistReceivedEmail(svcCtx *svc.ServiceContext, mailbox *model.Mailbox, im
 	if err := svcCtx.EmailModel.Create(email); err != nil {
 		return nil, err
 	}
+	publishEmailEvent(svcCtx, event.TypeNew, email)
 
 	return email, nil
 }
+
+// quotaResp 转换存储配额和用量
+// loadEmailContent 原文保存在blob中的邮件按需读取原文到 Content，列表等不需要内容的接口不读取
+func loadEmailContent(svcCtx *svc.ServiceContext, email *model.Email) error {
+	if email.BlobKey == "" || email.Content != "" {
+		return nil
+	}
+	r, err := svcCtx.BlobStore.Open(email.BlobKey)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	email.Content = string(data)
+	return nil
+}
+
+func quotaResp(quota model.Quota) types.QuotaResp {
+	return types.QuotaResp{
+		QuotaBytes:    quota.QuotaBytes,
+		QuotaMessages: quota.QuotaMessages,
+		UsedBytes:     quota.UsedBytes,
+		UsedMessages:  quota.UsedMessages,
+	}
+}
+
+// publishEmailEvent 通知IMAP会话和JMAP推送邮件已变更
+func publishEmailEvent(svcCtx *svc.ServiceContext, eventType event.Type, email *model.Email) {
+	svcCtx.EventBus.Publish(event.EmailEvent(eventType, email))
+}
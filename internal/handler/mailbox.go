@@ -2,12 +2,15 @@ package handler
 
 import (
 	"fmt"
+	"github.com/rankgice/new-email/internal/event"
 	"github.com/rankgice/new-email/internal/middleware"
 	"github.com/rankgice/new-email/internal/model"
 	"github.com/rankgice/new-email/internal/result"
 	"github.com/rankgice/new-email/internal/service"
 	"github.com/rankgice/new-email/internal/svc"
 	"github.com/rankgice/new-email/internal/types"
+	"github.com/rankgice/new-email/pkg/auth"
+	"log"
 	"net/http"
 	"strconv"
 	"time"
@@ -87,15 +90,17 @@ func (h *MailboxHandler) List(c *gin.Context) {
 	var mailboxList []types.MailboxResp
 	for _, mailbox := range mailboxes {
 		mailboxList = append(mailboxList, types.MailboxResp{
-			Id:          mailbox.Id,
-			UserId:      mailbox.UserId,
-			DomainId:    mailbox.DomainId,
-			Email:       mailbox.Email,
-			AutoReceive: mailbox.AutoReceive,
-			Status:      mailbox.Status,
-			LastSyncAt:  mailbox.LastSyncAt,
-			CreatedAt:   mailbox.CreatedAt,
-			UpdatedAt:   mailbox.UpdatedAt,
+			Id:               mailbox.Id,
+			UserId:           mailbox.UserId,
+			DomainId:         mailbox.DomainId,
+			Email:            mailbox.Email,
+			AutoReceive:      mailbox.AutoReceive,
+			Status:           mailbox.Status,
+			SubaddressFolder: mailbox.SubaddressFolder,
+			LastSyncAt:       mailbox.LastSyncAt,
+			Quota:            quotaResp(mailbox.Quota),
+			CreatedAt:        mailbox.CreatedAt,
+			UpdatedAt:        mailbox.UpdatedAt,
 		})
 	}
 
@@ -164,15 +169,26 @@ func (h *MailboxHandler) Create(c *gin.Context) {
 		c.JSON(http.StatusOK, result.ErrorSimpleResult("域名未启用"))
 		return
 	}
+	// 生成IMAP/SMTP的SCRAM-SHA-256凭据
+	scramVerifier, err := auth.GenerateScramSHA256(req.Password)
+	if err != nil {
+		c.JSON(http.StatusOK, result.ErrorSimpleResult("生成SCRAM凭据失败"))
+		return
+	}
+
 	// 创建邮箱
 	mailbox := &model.Mailbox{
-		UserId:      currentUserId,
-		DomainId:    domainId,
-		Email:       req.Email,
-		Password:    req.Password,
-		AutoReceive: req.AutoReceive,
-		Status:      req.Status,
-	}
+		UserId:           currentUserId,
+		DomainId:         domainId,
+		Email:            req.Email,
+		Password:         req.Password,
+		ScramSha256:      scramVerifier,
+		AutoReceive:      req.AutoReceive,
+		Status:           req.Status,
+		SubaddressFolder: req.SubaddressFolder,
+	}
+	mailbox.QuotaBytes = req.QuotaBytes
+	mailbox.QuotaMessages = req.QuotaMessages
 
 	if err := h.svcCtx.MailboxModel.Create(mailbox); err != nil {
 		c.JSON(http.StatusOK, result.ErrorAdd.AddError(err))
@@ -255,10 +271,23 @@ func (h *MailboxHandler) Update(c *gin.Context) {
 		updateData["email"] = req.Email
 	}
 	if req.Password != "" {
+		scramVerifier, err := auth.GenerateScramSHA256(req.Password)
+		if err != nil {
+			c.JSON(http.StatusOK, result.ErrorSimpleResult("生成SCRAM凭据失败"))
+			return
+		}
 		updateData["password"] = req.Password
+		updateData["scram_sha256"] = scramVerifier
 	}
 	updateData["auto_receive"] = req.AutoReceive
 	updateData["status"] = req.Status
+	updateData["subaddress_folder"] = req.SubaddressFolder
+	if req.QuotaBytes != nil {
+		updateData["quota_bytes"] = *req.QuotaBytes
+	}
+	if req.QuotaMessages != nil {
+		updateData["quota_messages"] = *req.QuotaMessages
+	}
 
 	// 更新邮箱信息
 	if err := h.svcCtx.MailboxModel.MapUpdate(nil, req.Id, updateData); err != nil {
@@ -313,6 +342,11 @@ func (h *MailboxHandler) Delete(c *gin.Context) {
 		return
 	}
 
+	// 收回其他邮箱共享给它的文件夹
+	if err := h.svcCtx.FolderAclModel.DeleteByIdentifier(mailbox.Email); err != nil {
+		log.Printf("清理邮箱 %s 的文件夹授权失败: %v", mailbox.Email, err)
+	}
+
 	c.JSON(http.StatusOK, result.SimpleResult("删除成功"))
 }
 
@@ -510,6 +544,8 @@ func (h *MailboxHandler) Sync(c *gin.Context) {
 				errorCount++
 				continue
 			}
+			existing.IsRead = imapEmail.IsRead
+			publishEmailEvent(h.svcCtx, event.TypeFlags, existing)
 			syncCount++
 			continue
 		}
@@ -581,15 +617,17 @@ func (h *MailboxHandler) GetById(c *gin.Context) {
 	}
 
 	resp := types.MailboxResp{
-		Id:          mailbox.Id,
-		UserId:      mailbox.UserId,
-		DomainId:    mailbox.DomainId,
-		Email:       mailbox.Email,
-		AutoReceive: mailbox.AutoReceive,
-		Status:      mailbox.Status,
-		LastSyncAt:  mailbox.LastSyncAt,
-		CreatedAt:   mailbox.CreatedAt,
-		UpdatedAt:   mailbox.UpdatedAt,
+		Id:               mailbox.Id,
+		UserId:           mailbox.UserId,
+		DomainId:         mailbox.DomainId,
+		Email:            mailbox.Email,
+		AutoReceive:      mailbox.AutoReceive,
+		Status:           mailbox.Status,
+		SubaddressFolder: mailbox.SubaddressFolder,
+		LastSyncAt:       mailbox.LastSyncAt,
+		Quota:            quotaResp(mailbox.Quota),
+		CreatedAt:        mailbox.CreatedAt,
+		UpdatedAt:        mailbox.UpdatedAt,
 	}
 
 	c.JSON(http.StatusOK, result.SuccessResult(resp))
@@ -624,10 +662,52 @@ func (h *MailboxHandler) GetStats(c *gin.Context) {
 		return
 	}
 
+	// 用户及各邮箱的存储用量
+	user, err := h.svcCtx.UserModel.GetById(currentUserId)
+	if err != nil {
+		c.JSON(http.StatusOK, result.ErrorSelect.AddError(err))
+		return
+	}
+
 	resp := types.MailboxStatsResp{
 		TotalMailboxes:  int64(len(totalMailboxes)),
 		ActiveMailboxes: int64(len(activeMailboxes)),
+		Mailboxes:       make([]types.MailboxUsageResp, 0, len(totalMailboxes)),
+	}
+	if user != nil {
+		resp.Quota = quotaResp(user.Quota)
+	}
+	for _, mailbox := range totalMailboxes {
+		resp.Mailboxes = append(resp.Mailboxes, types.MailboxUsageResp{
+			Id:    mailbox.Id,
+			Email: mailbox.Email,
+			Quota: quotaResp(mailbox.Quota),
+		})
 	}
 
 	c.JSON(http.StatusOK, result.SuccessResult(resp))
 }
+
+// loadOwnedMailbox 获取属于当前用户的邮箱，失败时已写入响应
+func loadOwnedMailbox(c *gin.Context, svcCtx *svc.ServiceContext, mailboxId int64) (*model.Mailbox, bool) {
+	currentUserId := middleware.GetCurrentUserId(c)
+	if currentUserId == 0 {
+		c.JSON(http.StatusOK, result.ErrorUnauthorized)
+		return nil, false
+	}
+
+	mailbox, err := svcCtx.MailboxModel.GetById(mailboxId)
+	if err != nil {
+		c.JSON(http.StatusOK, result.ErrorSelect.AddError(err))
+		return nil, false
+	}
+	if mailbox == nil {
+		c.JSON(http.StatusOK, result.ErrorSimpleResult("邮箱不存在"))
+		return nil, false
+	}
+	if mailbox.UserId != currentUserId {
+		c.JSON(http.StatusOK, result.ErrorSimpleResult("无权限操作此邮箱"))
+		return nil, false
+	}
+	return mailbox, true
+}
@@ -0,0 +1,267 @@
+package localSasl
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+	"github.com/rankgice/new-email/pkg/auth"
+)
+
+// SASL mechanism names for SCRAM-SHA-256, as described in RFC 7677.
+const (
+	ScramSHA256     = "SCRAM-SHA-256"
+	ScramSHA256Plus = "SCRAM-SHA-256-PLUS"
+)
+
+// Looks up the stored SCRAM credential of an user.
+type ScramCredentialLookup func(username string) (*auth.ScramCredential, error)
+
+// Called once the client proof has been verified.
+type ScramAuthenticator func(username string) error
+
+// Returns the channel binding data of the given type ("tls-unique",
+// "tls-exporter") for the current connection, or nil if unavailable.
+type ChannelBinding func(cbType string) []byte
+
+var errScramInvalid = errors.New("scram: invalid client message")
+
+type scramState int
+
+const (
+	scramWaitingFirst scramState = iota
+	scramWaitingFinal
+	scramWaitingAck
+	scramDone
+)
+
+type scramServer struct {
+	state        scramState
+	lookup       ScramCredentialLookup
+	authenticate ScramAuthenticator
+	binding      ChannelBinding
+	plus         bool
+
+	username        string
+	gs2Header       string
+	cbType          string
+	nonce           string
+	clientFirstBare string
+	serverFirst     string
+	credential      *auth.ScramCredential
+}
+
+// A server implementation of the SCRAM-SHA-256 and SCRAM-SHA-256-PLUS
+// authentication mechanisms, as described in RFC 5802 and RFC 7677.
+//
+// plus selects SCRAM-SHA-256-PLUS, which requires channel binding. binding may
+// be nil when the connection is not protected by TLS; otherwise clients
+// claiming the server does not support channel binding are rejected to
+// prevent downgrade attacks.
+//
+// The server-final message is sent as a challenge followed by an empty client
+// response, since the go-smtp and go-imap servers drop data sent along with
+// the final success response.
+func NewScramSHA256Server(lookup ScramCredentialLookup, authenticator ScramAuthenticator, binding ChannelBinding, plus bool) sasl.Server {
+	return &scramServer{
+		lookup:       lookup,
+		authenticate: authenticator,
+		binding:      binding,
+		plus:         plus,
+	}
+}
+
+func (a *scramServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	switch a.state {
+	case scramWaitingFirst:
+		if len(response) == 0 {
+			// Ask for the client-first message
+			return []byte{}, false, nil
+		}
+		challenge, err = a.handleClientFirst(string(response))
+	case scramWaitingFinal:
+		challenge, err = a.handleClientFinal(string(response))
+	case scramWaitingAck:
+		if len(response) != 0 {
+			return nil, true, sasl.ErrUnexpectedClientResponse
+		}
+		if err := a.authenticate(a.username); err != nil {
+			return nil, true, err
+		}
+		a.state = scramDone
+		return nil, true, nil
+	default:
+		return nil, true, sasl.ErrUnexpectedClientResponse
+	}
+
+	if err != nil {
+		a.state = scramDone
+		return nil, true, err
+	}
+	a.state++
+	return challenge, false, nil
+}
+
+func (a *scramServer) handleClientFirst(msg string) ([]byte, error) {
+	// gs2-header = gs2-cbind-flag "," [ authzid ] ","
+	cbFlag, rest, ok := strings.Cut(msg, ",")
+	if !ok {
+		return nil, errScramInvalid
+	}
+	authzid, bare, ok := strings.Cut(rest, ",")
+	if !ok {
+		return nil, errScramInvalid
+	}
+	a.gs2Header = cbFlag + "," + authzid + ","
+	a.clientFirstBare = bare
+
+	switch {
+	case cbFlag == "n":
+		if a.plus {
+			return nil, errors.New("scram: channel binding required")
+		}
+	case cbFlag == "y":
+		// The client supports channel binding but thinks we don't
+		if a.binding != nil {
+			return nil, errors.New("scram: channel binding downgrade detected")
+		}
+	case strings.HasPrefix(cbFlag, "p="):
+		if !a.plus || a.binding == nil {
+			return nil, errors.New("scram: channel binding not supported")
+		}
+		a.cbType = strings.TrimPrefix(cbFlag, "p=")
+		if a.binding(a.cbType) == nil {
+			return nil, errors.New("scram: unsupported channel binding type " + a.cbType)
+		}
+	default:
+		return nil, errScramInvalid
+	}
+
+	attrs, err := parseScramAttributes(bare)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := attrs["m"]; ok {
+		return nil, errors.New("scram: unsupported mandatory extension")
+	}
+	username, err := decodeSaslName(attrs["n"])
+	if err != nil || username == "" {
+		return nil, errScramInvalid
+	}
+	if authzid != "" {
+		if !strings.HasPrefix(authzid, "a=") {
+			return nil, errScramInvalid
+		}
+		identity, err := decodeSaslName(strings.TrimPrefix(authzid, "a="))
+		if err != nil || identity != username {
+			return nil, errors.New("scram: authorization identity not supported")
+		}
+	}
+	clientNonce := attrs["r"]
+	if clientNonce == "" {
+		return nil, errScramInvalid
+	}
+
+	credential, err := a.lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	a.username = username
+	a.credential = credential
+
+	serverNonce := make([]byte, 18)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, err
+	}
+	a.nonce = clientNonce + base64.RawStdEncoding.EncodeToString(serverNonce)
+	a.serverFirst = "r=" + a.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(credential.Salt) +
+		",i=" + strconv.Itoa(credential.Iterations)
+	return []byte(a.serverFirst), nil
+}
+
+func (a *scramServer) handleClientFinal(msg string) ([]byte, error) {
+	withoutProof, proofAttr, ok := cutLast(msg, ",p=")
+	if !ok {
+		return nil, errScramInvalid
+	}
+	attrs, err := parseScramAttributes(withoutProof)
+	if err != nil {
+		return nil, err
+	}
+
+	cbInput := []byte(a.gs2Header)
+	if a.cbType != "" {
+		cbInput = append(cbInput, a.binding(a.cbType)...)
+	}
+	if attrs["c"] != base64.StdEncoding.EncodeToString(cbInput) {
+		return nil, errors.New("scram: channel binding mismatch")
+	}
+	if attrs["r"] != a.nonce {
+		return nil, errors.New("scram: nonce mismatch")
+	}
+
+	proof, err := base64.StdEncoding.DecodeString(proofAttr)
+	if err != nil || len(proof) != sha256.Size {
+		return nil, errScramInvalid
+	}
+
+	authMessage := []byte(a.clientFirstBare + "," + a.serverFirst + "," + withoutProof)
+	clientSignature := auth.ScramHMAC(a.credential.StoredKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if !hmac.Equal(storedKey[:], a.credential.StoredKey) {
+		return nil, errors.New("scram: invalid credentials")
+	}
+
+	serverSignature := auth.ScramHMAC(a.credential.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+// parseScramAttributes parses a comma-separated list of "k=v" attributes.
+func parseScramAttributes(s string) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for _, field := range strings.Split(s, ",") {
+		if len(field) < 2 || field[1] != '=' {
+			return nil, errScramInvalid
+		}
+		attrs[field[:1]] = field[2:]
+	}
+	return attrs, nil
+}
+
+// decodeSaslName decodes "=2C" and "=3D" in a saslname, as per RFC 5802.
+func decodeSaslName(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '=' {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(s[i:], "=2C"):
+			b.WriteByte(',')
+		case strings.HasPrefix(s[i:], "=3D"):
+			b.WriteByte('=')
+		default:
+			return "", errScramInvalid
+		}
+		i += 2
+	}
+	return b.String(), nil
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
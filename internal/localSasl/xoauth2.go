@@ -0,0 +1,82 @@
+package localSasl
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+)
+
+// The XOAUTH2 mechanism name.
+const XOAuth2 = "XOAUTH2"
+
+// Authenticates users with an username and an OAuth 2.0 bearer token.
+type XOAuth2Authenticator func(username, token string) error
+
+type xoauth2Server struct {
+	done         bool
+	failErr      error
+	authenticate XOAuth2Authenticator
+}
+
+// A server implementation of the XOAUTH2 authentication mechanism, as used by
+// Gmail and Outlook. The initial response is
+// "user=" username ^A "auth=Bearer " token ^A ^A.
+//
+// On failure an error status is sent as a JSON challenge, and the exchange
+// ends after the client answers with an empty response.
+func NewXOAuth2Server(authenticator XOAuth2Authenticator) sasl.Server {
+	return &xoauth2Server{authenticate: authenticator}
+}
+
+func (a *xoauth2Server) fail(err error) ([]byte, bool, error) {
+	blob, _ := json.Marshal(sasl.OAuthBearerError{
+		Status:  "401",
+		Schemes: "bearer",
+	})
+	a.failErr = err
+	return blob, false, nil
+}
+
+func (a *xoauth2Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	if a.failErr != nil {
+		return nil, true, a.failErr
+	}
+	if a.done {
+		return nil, true, sasl.ErrUnexpectedClientResponse
+	}
+
+	// Generate empty challenge.
+	if response == nil {
+		return []byte{}, false, nil
+	}
+	a.done = true
+
+	var username, token string
+	for _, field := range bytes.Split(response, []byte{0x01}) {
+		key, value, ok := strings.Cut(string(field), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "user":
+			username = value
+		case "auth":
+			const prefix = "bearer "
+			if !strings.HasPrefix(strings.ToLower(value), prefix) {
+				return a.fail(errors.New("xoauth2: unsupported token type"))
+			}
+			token = value[len(prefix):]
+		}
+	}
+	if username == "" || token == "" {
+		return a.fail(errors.New("xoauth2: invalid response"))
+	}
+
+	if err := a.authenticate(username, token); err != nil {
+		return a.fail(err)
+	}
+	return nil, true, nil
+}
@@ -0,0 +1,295 @@
+package mailserver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/rankgice/new-email/internal/constant"
+	"github.com/rankgice/new-email/internal/model"
+)
+
+// verpTagPrefix VERP退信地址的子地址标签前缀，alice+bounce-123@domain 对应已发送邮件ID 123
+const verpTagPrefix = "bounce-"
+
+// deliveryReport multipart/report 报告：DSN退信 (RFC 3464) 或 ARF投诉 (RFC 5965)
+type deliveryReport struct {
+	feedback          bool              // true为ARF投诉报告，false为DSN退信报告
+	feedbackType      string            // ARF投诉类型，如 abuse
+	originalMessageID string            // 原始邮件的Message-ID
+	failed            []reportRecipient // DSN中投递失败的收件人
+	complained        []string          // ARF中被投诉的收件人
+}
+
+// reportRecipient DSN中的单个收件人状态
+type reportRecipient struct {
+	address    string
+	status     string // 增强状态码，如 5.1.1
+	diagnostic string
+}
+
+// hard 是否为永久性失败
+func (r reportRecipient) hard() bool {
+	return strings.HasPrefix(r.status, "5")
+}
+
+// parseDeliveryReport 解析退信或投诉报告，非报告邮件返回nil
+// body 为邮件头之后的正文，报告中只有状态和原始邮件头等分段会读入内存
+func parseDeliveryReport(header message.Header, body io.Reader) *deliveryReport {
+	mediaType, params, err := header.ContentType()
+	if err != nil || mediaType != "multipart/report" {
+		return nil
+	}
+
+	reportType := strings.ToLower(params["report-type"])
+	if reportType != "delivery-status" && reportType != "feedback-report" {
+		return nil
+	}
+
+	entity, err := message.New(header, body)
+	if err != nil && !message.IsUnknownCharset(err) {
+		log.Printf("⚠️  解析报告邮件失败: %v", err)
+		return nil
+	}
+	mr := entity.MultipartReader()
+	if mr == nil {
+		return nil
+	}
+
+	report := &deliveryReport{feedback: reportType == "feedback-report"}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("⚠️  读取报告邮件分段失败: %v", err)
+			break
+		}
+
+		partType, _, _ := part.Header.ContentType()
+		data, err := io.ReadAll(part.Body)
+		if err != nil {
+			continue
+		}
+
+		switch partType {
+		case "message/delivery-status", "message/global-delivery-status":
+			report.failed = append(report.failed, parseDeliveryStatus(data)...)
+		case "message/feedback-report":
+			fields := readReportFields(data)
+			if len(fields) > 0 {
+				report.feedbackType = strings.ToLower(fields[0].Get("Feedback-Type"))
+				for _, rcpt := range fields[0].Values("Original-Rcpt-To") {
+					report.complained = append(report.complained, strings.Trim(strings.TrimSpace(rcpt), "<>"))
+				}
+			}
+		case "message/rfc822", "message/global", "text/rfc822-headers", "message/rfc822-headers", "message/global-headers":
+			if report.originalMessageID == "" {
+				if fields := readReportFields(data); len(fields) > 0 {
+					report.originalMessageID = normalizeStoredMessageID(fields[0].Get("Message-Id"))
+				}
+			}
+		}
+	}
+
+	return report
+}
+
+// parseDeliveryStatus 解析 message/delivery-status 正文，返回Action为failed的收件人
+// 第一组字段为报文级字段，其后每组为一个收件人
+func parseDeliveryStatus(data []byte) []reportRecipient {
+	groups := readReportFields(data)
+	if len(groups) < 2 {
+		return nil
+	}
+
+	var failed []reportRecipient
+	for _, fields := range groups[1:] {
+		if !strings.EqualFold(strings.TrimSpace(fields.Get("Action")), "failed") {
+			continue
+		}
+		address := reportAddress(fields.Get("Final-Recipient"))
+		if address == "" {
+			address = reportAddress(fields.Get("Original-Recipient"))
+		}
+		if address == "" {
+			continue
+		}
+		failed = append(failed, reportRecipient{
+			address:    address,
+			status:     strings.TrimSpace(fields.Get("Status")),
+			diagnostic: strings.TrimSpace(fields.Get("Diagnostic-Code")),
+		})
+	}
+	return failed
+}
+
+// readReportFields 按空行分组读取报告中的头部字段
+func readReportFields(data []byte) []textproto.MIMEHeader {
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+
+	var groups []textproto.MIMEHeader
+	for {
+		fields, err := reader.ReadMIMEHeader()
+		if len(fields) > 0 {
+			groups = append(groups, fields)
+		}
+		if err != nil {
+			break
+		}
+	}
+	return groups
+}
+
+// reportAddress 提取 "rfc822; user@example.com" 形式字段中的地址
+func reportAddress(value string) string {
+	if _, addr, ok := strings.Cut(value, ";"); ok {
+		value = addr
+	}
+	return strings.ToLower(strings.Trim(strings.TrimSpace(value), "<>"))
+}
+
+// verpAddress 为已发送邮件生成VERP退信地址，本地部分超长时返回原地址
+func (s *MailStorage) verpAddress(address string, emailId int64) string {
+	at := strings.LastIndex(address, "@")
+	if at <= 0 || emailId <= 0 {
+		return address
+	}
+
+	separator := "+"
+	if s.subaddressSeparators != "" {
+		separator = s.subaddressSeparators[:1]
+	}
+
+	local := address[:at] + separator + verpTagPrefix + strconv.FormatInt(emailId, 10)
+	if len(local) > 64 {
+		return address
+	}
+	return local + address[at:]
+}
+
+// isVERPTag 判断子地址标签是否为VERP退信标签
+func isVERPTag(tag string) bool {
+	_, ok := parseVERPTag(tag)
+	return ok
+}
+
+// parseVERPTag 从VERP标签中解析已发送邮件ID
+func parseVERPTag(tag string) (int64, bool) {
+	idStr, ok := strings.CutPrefix(strings.ToLower(tag), verpTagPrefix)
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+// processDeliveryReport 将退信/投诉报告关联到原始已发送邮件
+// 通过VERP地址或原始Message-ID定位邮件，更新投递状态并将永久退信地址加入抑制列表
+func (s *MailStorage) processDeliveryReport(recipients []string, report *deliveryReport) {
+	for _, rcpt := range recipients {
+		mailbox, tag, err := s.resolveRecipient(rcpt)
+		if err != nil || mailbox == nil {
+			continue
+		}
+
+		sent, err := s.findReportedEmails(mailbox, tag, report.originalMessageID)
+		if err != nil {
+			log.Printf("❌ 关联退信报告失败: %v", err)
+			continue
+		}
+		if len(sent) == 0 {
+			log.Printf("⚠️  未找到报告对应的已发送邮件: 邮箱=%s, Message-ID=%s", mailbox.Email, report.originalMessageID)
+			continue
+		}
+
+		for _, email := range sent {
+			if err := s.applyDeliveryReport(mailbox, email, report); err != nil {
+				log.Printf("❌ 处理退信报告失败 (邮件ID: %d): %v", email.Id, err)
+			}
+		}
+	}
+}
+
+// findReportedEmails 查找报告对应的已发送邮件，优先使用VERP标签
+func (s *MailStorage) findReportedEmails(mailbox *model.Mailbox, tag, messageID string) ([]*model.Email, error) {
+	var result []*model.Email
+
+	if id, ok := parseVERPTag(tag); ok {
+		email, err := s.emailModel.GetById(id)
+		if err == nil && email.MailboxId == mailbox.Id && email.Direction == constant.EmailDirectionSent {
+			result = append(result, email)
+		}
+	}
+
+	if len(result) == 0 && messageID != "" {
+		email, err := s.emailModel.GetByMailboxIdMessageIdAndDirection(mailbox.Id, messageID, constant.EmailDirectionSent)
+		if err != nil {
+			return nil, err
+		}
+		if email != nil {
+			result = append(result, email)
+		}
+	}
+
+	return result, nil
+}
+
+// applyDeliveryReport 更新邮件投递状态，永久退信的收件人加入抑制列表
+// 只处理原邮件中确实存在的收件人，避免伪造的报告抑制任意地址
+func (s *MailStorage) applyDeliveryReport(mailbox *model.Mailbox, email *model.Email, report *deliveryReport) error {
+	if report.feedback {
+		log.Printf("🚫 收到投诉报告 (%s): 邮件ID=%d, 收件人=%v", report.feedbackType, email.Id, report.complained)
+		return s.emailModel.UpdateDeliveryStatus(email.Id, constant.EmailDeliveryComplained)
+	}
+
+	if len(report.failed) == 0 {
+		return nil
+	}
+
+	originalRecipients := make(map[string]bool)
+	for _, list := range [][]string{email.ToEmails, email.CcEmails, email.BccEmails} {
+		for _, addr := range list {
+			originalRecipients[strings.ToLower(strings.TrimSpace(addr))] = true
+		}
+	}
+
+	suppressionModel := model.NewSuppressionModel(s.db)
+	for _, rcpt := range report.failed {
+		log.Printf("📭 收到退信: 邮件ID=%d, 收件人=%s, 状态=%s", email.Id, rcpt.address, rcpt.status)
+		if !rcpt.hard() || !originalRecipients[rcpt.address] {
+			continue
+		}
+		if err := suppressionModel.Add(&model.Suppression{
+			UserId:  mailbox.UserId,
+			Email:   rcpt.address,
+			Reason:  constant.SuppressionReasonHardBounce,
+			Detail:  truncateReportDetail(fmt.Sprintf("%s %s", rcpt.status, rcpt.diagnostic)),
+			EmailId: email.Id,
+		}); err != nil {
+			return err
+		}
+		log.Printf("⛔ 已加入抑制列表: %s (用户ID: %d)", rcpt.address, mailbox.UserId)
+	}
+
+	return s.emailModel.UpdateDeliveryStatus(email.Id, constant.EmailDeliveryBounced)
+}
+
+// truncateReportDetail 截断退信详情以适应字段长度
+func truncateReportDetail(detail string) string {
+	detail = strings.TrimSpace(detail)
+	if len(detail) > 500 {
+		detail = detail[:500]
+	}
+	return detail
+}
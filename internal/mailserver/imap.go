@@ -7,6 +7,7 @@ import (
 	"log"
 	"net"
 
+	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapserver"
 )
 
@@ -19,27 +20,43 @@ type IMAPServer struct {
 	listener  net.Listener
 	useTLS    bool
 	tlsConfig *tls.Config
+	proxy     *ProxyProtocolPolicy // PROXY protocol策略，nil表示未启用
+	compress  bool                 // 是否支持 COMPRESS=DEFLATE
 }
 
 // NewIMAPServer 创建IMAP服务器
 func NewIMAPServer(config Config, storage *MailStorage) *IMAPServer {
 	options := &imapserver.Options{
 		NewSession: func(conn *imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
-			session := NewIMAPSession(storage)
+			session := NewIMAPSession(storage, conn)
+			// 连接层实现的扩展命令在该会话上执行
+			if ic, ok := conn.NetConn().(*imapConn); ok {
+				ic.session = session
+			}
 			greeting := &imapserver.GreetingData{
 				PreAuth: false, // 需要认证
 			}
 			return session, greeting, nil
 		},
+		// 在 IMAP4rev1 默认能力（含 IDLE、UNSELECT）之上声明会话实现的扩展
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1:        {},
+			imap.CapUIDPlus:          {},
+			imap.CapBinary:           {},
+			imap.CapMove:             {},
+			imap.CapESearch:          {},
+			imap.CapSearchRes:        {},
+			imap.CapChildren:         {},
+			imap.CapSpecialUse:       {},
+			imap.CapCreateSpecialUse: {},
+			imap.CapNamespace:        {},
+		},
 	}
 
 	tlsConfig, useTLS := loadOptionalTLSConfig("IMAP服务器", config.IMAPUseTLS, config.IMAPTLSCertPath, config.IMAPTLSKeyPath)
-	if tlsConfig != nil {
-		options.TLSConfig = tlsConfig
-		options.InsecureAuth = false
-	} else {
-		options.InsecureAuth = true
-	}
+	// 连接层包在TLS连接之外，imapserver 无法识别 *tls.Conn，因此不设置 TLSConfig（不提供 STARTTLS）；
+	// 启用TLS时所有连接都来自隐式TLS监听器，直接允许认证
+	options.InsecureAuth = true
 
 	server := imapserver.New(options)
 
@@ -50,6 +67,7 @@ func NewIMAPServer(config Config, storage *MailStorage) *IMAPServer {
 		server:    server,
 		useTLS:    useTLS,
 		tlsConfig: tlsConfig,
+		compress:  config.IMAPCompress,
 	}
 }
 
@@ -69,15 +87,17 @@ func (s *IMAPServer) Start(ctx context.Context) error {
 		log.Printf("⚠️ IMAP服务器 (非TLS) 启动成功，监听端口: %d", s.port)
 	}
 
+	// PROXY头位于TLS握手之前，需先于TLS解析
+	listener := s.proxy.wrapListener(s.listener)
+
 	// 在goroutine中启动服务器
 	go func() {
-		var serveErr error
 		if s.useTLS {
-			tlsListener := tls.NewListener(s.listener, s.tlsConfig)
-			serveErr = s.server.Serve(tlsListener)
-		} else {
-			serveErr = s.server.Serve(s.listener)
+			listener = tls.NewListener(listener, s.tlsConfig)
 		}
+		// 连接层扩展（含压缩）作用于TLS之内的明文IMAP流
+		listener = &imapListener{Listener: listener, compress: s.compress}
+		serveErr := s.server.Serve(listener)
 
 		if serveErr != nil && serveErr != net.ErrClosed {
 			log.Printf("IMAP服务器运行错误: %v", serveErr)
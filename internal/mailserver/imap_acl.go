@@ -0,0 +1,523 @@
+package mailserver
+
+import (
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/rankgice/new-email/internal/model"
+)
+
+// 共享文件夹的命名空间 (RFC 2342)
+// 其他邮箱直接授权给当前邮箱的文件夹显示为 "Other Users/<邮箱地址>/<路径>"
+// 授权给 anyone 的文件夹显示为 "Shared/<邮箱地址>/<路径>"
+const (
+	otherUsersNamespace = "Other Users"
+	sharedNamespace     = "Shared"
+)
+
+func noPermError() error {
+	return &imap.Error{
+		Type: imap.StatusResponseTypeNo,
+		Code: imap.ResponseCodeNoPerm,
+		Text: "Permission denied",
+	}
+}
+
+// Namespace 返回个人、其他用户和共享命名空间
+func (s *IMAPSession) Namespace() (*imap.NamespaceData, error) {
+	return &imap.NamespaceData{
+		Personal: []imap.NamespaceDescriptor{{Prefix: "", Delim: '/'}},
+		Other:    []imap.NamespaceDescriptor{{Prefix: otherUsersNamespace + "/", Delim: '/'}},
+		Shared:   []imap.NamespaceDescriptor{{Prefix: sharedNamespace + "/", Delim: '/'}},
+	}, nil
+}
+
+// folderRef 解析后的IMAP文件夹名称
+type folderRef struct {
+	owner     *model.Mailbox // 文件夹所属邮箱
+	namespace string         // 共享命名空间，个人文件夹为空
+	path      string         // 所属邮箱内的路径
+}
+
+// name 返回文件夹在当前会话中的IMAP名称
+func (r *folderRef) name() string {
+	if r.namespace == "" {
+		return r.path
+	}
+	return r.namespace + "/" + r.owner.Email + "/" + r.path
+}
+
+// parseFolderName 解析IMAP文件夹名称，共享命名空间下的名称定位到其他邮箱的文件夹
+// 命名空间本身及 "<命名空间>/<邮箱地址>" 层级不是真实文件夹，返回nil
+func (s *IMAPSession) parseFolderName(name string) (*folderRef, error) {
+	for _, namespace := range []string{otherUsersNamespace, sharedNamespace} {
+		if !strings.HasPrefix(name, namespace+"/") {
+			continue
+		}
+		email, path, ok := strings.Cut(strings.TrimPrefix(name, namespace+"/"), "/")
+		if !ok || path == "" || strings.EqualFold(email, s.mailbox.Email) {
+			return nil, nil
+		}
+		owner, err := s.storage.findMailboxByEmail(email)
+		if err != nil || owner == nil {
+			return nil, err
+		}
+		return &folderRef{owner: owner, namespace: namespace, path: path}, nil
+	}
+	if name == otherUsersNamespace || name == sharedNamespace {
+		return nil, nil
+	}
+	return &folderRef{owner: s.mailbox, path: name}, nil
+}
+
+// folderRights 计算当前邮箱在文件夹上的权限：自己的文件夹拥有全部权限，
+// 其他邮箱的文件夹为直接授权与 anyone 授权之和，且必须在相应命名空间下有授权才可见
+func (s *IMAPSession) folderRights(folder *model.Folder, namespace string) (string, error) {
+	if folder.MailboxId == s.mailbox.Id {
+		return model.AclAllRights, nil
+	}
+	direct, anyone, err := s.storage.folderAclModel.Rights(folder.Id, s.mailbox.Email)
+	if err != nil {
+		return "", err
+	}
+	if (namespace == otherUsersNamespace && direct == "") || (namespace == sharedNamespace && anyone == "") {
+		return "", nil
+	}
+	return model.MergeAclRights(direct, anyone), nil
+}
+
+// lookupFolder 根据IMAP名称获取文件夹及当前邮箱的权限
+// 文件夹不存在或没有 l 权限时返回nil，不暴露其他邮箱文件夹的存在
+func (s *IMAPSession) lookupFolder(name string) (*model.Folder, string, error) {
+	ref, err := s.parseFolderName(name)
+	if err != nil || ref == nil {
+		return nil, "", err
+	}
+	folder, err := s.storage.folderModel.GetByPath(ref.owner.Id, ref.path)
+	if err != nil || folder == nil {
+		return nil, "", err
+	}
+	rights, err := s.folderRights(folder, ref.namespace)
+	if err != nil {
+		return nil, "", err
+	}
+	if !model.HasAclRights(rights, model.AclRightLookup) {
+		return nil, "", nil
+	}
+	return folder, rights, nil
+}
+
+// flagRight 返回修改标志所需的权限：\Seen 需要 s，\Deleted 需要 t，其余标志需要 w
+func flagRight(flag string) string {
+	switch {
+	case strings.EqualFold(flag, model.FlagSeen):
+		return model.AclRightSeen
+	case strings.EqualFold(flag, model.FlagDeleted):
+		return model.AclRightDeleteMsg
+	}
+	return model.AclRightWrite
+}
+
+// permittedFlags 过滤掉没有权限修改的标志
+func permittedFlags(flags []string, rights string) []string {
+	permitted := make([]string, 0, len(flags))
+	for _, flag := range flags {
+		if model.HasAclRights(rights, flagRight(flag)) {
+			permitted = append(permitted, flag)
+		}
+	}
+	return permitted
+}
+
+// permanentFlags 返回当前权限下可以永久保存的标志
+func permanentFlags(flags []imap.Flag, rights string) []imap.Flag {
+	permanent := make([]imap.Flag, 0, len(flags)+1)
+	for _, flag := range flags {
+		if model.HasAclRights(rights, flagRight(string(flag))) {
+			permanent = append(permanent, flag)
+		}
+	}
+	if model.HasAclRights(rights, model.AclRightWrite) {
+		permanent = append(permanent, imap.FlagWildcard)
+	}
+	return permanent
+}
+
+// listEntry LIST 输出的一个文件夹或命名空间层级
+type listEntry struct {
+	name        string
+	folder      *model.Folder // 命名空间层级为nil，输出 \Noselect
+	rights      string
+	hasChildren bool
+}
+
+// listEntries 返回当前邮箱可见的全部文件夹，包括其他邮箱共享的文件夹及其上级命名空间层级
+func (s *IMAPSession) listEntries() ([]*listEntry, error) {
+	folders, err := s.storage.folderModel.GetByMailboxId(s.mailbox.Id)
+	if err != nil {
+		return nil, err
+	}
+	entries := folderListEntries(folders, func(folder *model.Folder) (string, string) {
+		return "", model.AclAllRights
+	})
+
+	shared, err := s.sharedListEntries()
+	if err != nil {
+		return nil, err
+	}
+	entries = append(entries, shared...)
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+	return entries, nil
+}
+
+// sharedListEntries 返回其他邮箱授权给当前邮箱（直接或 anyone）且有 l 权限的文件夹
+func (s *IMAPSession) sharedListEntries() ([]*listEntry, error) {
+	acls, err := s.storage.folderAclModel.GetGranted(s.mailbox.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	direct := make(map[int64]string)
+	anyone := make(map[int64]string)
+	for _, acl := range acls {
+		if acl.Identifier == model.AclAnyone {
+			anyone[acl.FolderId] = acl.Rights
+		} else {
+			direct[acl.FolderId] = acl.Rights
+		}
+	}
+
+	// 按所属邮箱分组，路径需要该邮箱的完整文件夹树
+	owners := make(map[int64]bool)
+	for _, acl := range acls {
+		folder, err := s.storage.folderModel.GetById(acl.FolderId)
+		if err != nil {
+			return nil, err
+		}
+		if folder == nil || folder.MailboxId == s.mailbox.Id {
+			continue
+		}
+		owners[folder.MailboxId] = true
+	}
+
+	var entries []*listEntry
+	for ownerId := range owners {
+		owner, err := s.storage.mailboxModel.GetById(ownerId)
+		if err != nil {
+			log.Printf("获取共享文件夹所属邮箱失败 (ID: %d): %v", ownerId, err)
+			continue
+		}
+		folders, err := s.storage.folderModel.GetByMailboxId(ownerId)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, namespace := range []string{otherUsersNamespace, sharedNamespace} {
+			granted := direct
+			if namespace == sharedNamespace {
+				granted = anyone
+			}
+			prefix := namespace + "/" + owner.Email + "/"
+			visible := folderListEntries(folders, func(folder *model.Folder) (string, string) {
+				if _, ok := granted[folder.Id]; !ok {
+					return "", ""
+				}
+				return prefix, model.MergeAclRights(direct[folder.Id], anyone[folder.Id])
+			})
+			if len(visible) == 0 {
+				continue
+			}
+			entries = append(entries, visible...)
+			entries = append(entries, &listEntry{name: namespace + "/" + owner.Email, hasChildren: true})
+			if !hasListEntry(entries, namespace) {
+				entries = append(entries, &listEntry{name: namespace, hasChildren: true})
+			}
+		}
+	}
+	return entries, nil
+}
+
+// folderListEntries 将邮箱的文件夹树转换为LIST条目，visible 返回名称前缀和权限，
+// 没有 l 权限的文件夹不输出，也不计入上级的 \HasChildren
+func folderListEntries(folders []*model.Folder, visible func(folder *model.Folder) (prefix string, rights string)) []*listEntry {
+	paths := model.FolderPaths(folders)
+	byId := make(map[int64]*listEntry)
+	var entries []*listEntry
+	for _, folder := range folders {
+		prefix, rights := visible(folder)
+		if !model.HasAclRights(rights, model.AclRightLookup) {
+			continue
+		}
+		entry := &listEntry{name: prefix + paths[folder.Id], folder: folder, rights: rights}
+		byId[folder.Id] = entry
+		entries = append(entries, entry)
+	}
+	for _, entry := range entries {
+		if entry.folder.ParentId == nil {
+			continue
+		}
+		if parent, ok := byId[*entry.folder.ParentId]; ok {
+			parent.hasChildren = true
+		}
+	}
+	return entries
+}
+
+func hasListEntry(entries []*listEntry, name string) bool {
+	for _, entry := range entries {
+		if entry.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// sharedParent 获取共享命名空间下新文件夹位置的上级文件夹，要求当前邮箱对其有 k 权限
+// 其他邮箱的顶层不允许创建文件夹
+func (s *IMAPSession) sharedParent(ref *folderRef) (*model.Folder, error) {
+	i := strings.LastIndex(ref.path, "/")
+	if i <= 0 {
+		return nil, noPermError()
+	}
+	parentRef := *ref
+	parentRef.path = ref.path[:i]
+	parent, rights, err := s.lookupFolder(parentRef.name())
+	if err != nil {
+		return nil, err
+	}
+	if parent == nil || !model.HasAclRights(rights, model.AclRightCreate) {
+		return nil, noPermError()
+	}
+	return parent, nil
+}
+
+// inheritFolderAcl 在共享命名空间下创建的文件夹继承上级文件夹的ACL，创建者因此仍能访问
+func (s *IMAPSession) inheritFolderAcl(parent, folder *model.Folder) error {
+	acls, err := s.storage.folderAclModel.GetByFolderId(parent.Id)
+	if err != nil {
+		return err
+	}
+	for _, acl := range acls {
+		if err := s.storage.folderAclModel.Set(folder.Id, acl.Identifier, acl.Rights); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ACL（RFC 4314）命令在连接层实现，直接读写 folder_acl：SETACL/DELETEACL/GETACL/LISTRIGHTS
+// 需要 a 权限，MYRIGHTS 只需文件夹可见。文件夹所属邮箱始终拥有全部权限，不能修改；不支持否定权限。
+
+// setAcl SETACL <文件夹> <标识符> <[+|-]权限>
+func (c *imapConn) setAcl(tag string, args []string) string {
+	if len(args) != 3 {
+		return tag + " BAD Expected mailbox, identifier and rights"
+	}
+	s := c.session
+	folder, err := s.aclFolder(decodeMailboxName(args[0]), model.AclRightAdminister)
+	if err != nil {
+		return statusResponse(tag, err)
+	}
+	identifier, err := s.aclIdentifier(folder, args[1])
+	if err != nil {
+		return statusResponse(tag, err)
+	}
+
+	modification, rights := imap.RightModificationReplace, args[2]
+	if rights != "" && (rights[0] == '+' || rights[0] == '-') {
+		modification, rights = imap.RightModification(rights[0]), rights[1:]
+	}
+	rights, err = model.NormalizeAclRights(rights)
+	if err != nil {
+		return tag + " BAD Invalid rights"
+	}
+	if modification != imap.RightModificationReplace {
+		current, err := s.aclRights(folder, identifier)
+		if err != nil {
+			return statusResponse(tag, err)
+		}
+		if modification == imap.RightModificationAdd {
+			rights = model.MergeAclRights(current, rights)
+		} else {
+			rights = string(imap.RightSet(current).Remove(imap.RightSet(rights)))
+		}
+	}
+
+	if err := s.storage.folderAclModel.Set(folder.Id, identifier, rights); err != nil {
+		return statusResponse(tag, err)
+	}
+	log.Printf("🔐 IMAP设置文件夹权限: 文件夹=%d, %s=%s, 操作者=%s", folder.Id, identifier, rights, s.username)
+	return tag + " OK SETACL completed"
+}
+
+// deleteAcl DELETEACL <文件夹> <标识符>
+func (c *imapConn) deleteAcl(tag string, args []string) string {
+	if len(args) != 2 {
+		return tag + " BAD Expected mailbox and identifier"
+	}
+	s := c.session
+	folder, err := s.aclFolder(decodeMailboxName(args[0]), model.AclRightAdminister)
+	if err != nil {
+		return statusResponse(tag, err)
+	}
+	identifier, err := s.aclIdentifier(folder, args[1])
+	if err != nil {
+		return statusResponse(tag, err)
+	}
+	if err := s.storage.folderAclModel.Delete(folder.Id, identifier); err != nil {
+		return statusResponse(tag, err)
+	}
+	log.Printf("🔐 IMAP收回文件夹权限: 文件夹=%d, %s, 操作者=%s", folder.Id, identifier, s.username)
+	return tag + " OK DELETEACL completed"
+}
+
+// getAcl GETACL <文件夹>，所属邮箱以全部权限列在最前
+func (c *imapConn) getAcl(tag string, args []string) string {
+	if len(args) != 1 {
+		return tag + " BAD Expected mailbox name"
+	}
+	s := c.session
+	name := decodeMailboxName(args[0])
+	folder, err := s.aclFolder(name, model.AclRightAdminister)
+	if err != nil {
+		return statusResponse(tag, err)
+	}
+	owner, err := s.folderOwner(folder)
+	if err != nil {
+		return statusResponse(tag, err)
+	}
+	acls, err := s.storage.folderAclModel.GetByFolderId(folder.Id)
+	if err != nil {
+		return statusResponse(tag, err)
+	}
+
+	resp := "* ACL " + c.mailboxName(name) + " " + quoteIMAPString(owner.Email) + " " + model.AclAllRights
+	for _, acl := range acls {
+		resp += " " + quoteIMAPString(acl.Identifier) + " " + aclRightsString(acl.Rights)
+	}
+	return resp + "\r\n" + tag + " OK GETACL completed"
+}
+
+// listRights LISTRIGHTS <文件夹> <标识符>，各权限可以单独授予，没有必须授予的权限
+func (c *imapConn) listRights(tag string, args []string) string {
+	if len(args) != 2 {
+		return tag + " BAD Expected mailbox and identifier"
+	}
+	s := c.session
+	name := decodeMailboxName(args[0])
+	folder, err := s.aclFolder(name, model.AclRightAdminister)
+	if err != nil {
+		return statusResponse(tag, err)
+	}
+	owner, err := s.folderOwner(folder)
+	if err != nil {
+		return statusResponse(tag, err)
+	}
+
+	resp := "* LISTRIGHTS " + c.mailboxName(name) + " " + quoteIMAPString(args[1])
+	if strings.EqualFold(args[1], owner.Email) {
+		resp += " " + model.AclAllRights
+	} else {
+		resp += ` ""`
+		for _, right := range model.AclAllRights {
+			resp += " " + string(right)
+		}
+	}
+	return resp + "\r\n" + tag + " OK LISTRIGHTS completed"
+}
+
+// myRights MYRIGHTS <文件夹>
+func (c *imapConn) myRights(tag string, args []string) string {
+	if len(args) != 1 {
+		return tag + " BAD Expected mailbox name"
+	}
+	s := c.session
+	name := decodeMailboxName(args[0])
+	folder, rights, err := s.lookupFolder(name)
+	if err != nil {
+		return statusResponse(tag, err)
+	}
+	if folder == nil {
+		return statusResponse(tag, noSuchMailboxError())
+	}
+	return "* MYRIGHTS " + c.mailboxName(name) + " " + aclRightsString(rights) + "\r\n" + tag + " OK MYRIGHTS completed"
+}
+
+// aclFolder 获取要求当前邮箱具有 need 权限的文件夹
+func (s *IMAPSession) aclFolder(name, need string) (*model.Folder, error) {
+	folder, rights, err := s.lookupFolder(name)
+	if err != nil {
+		return nil, err
+	}
+	if folder == nil {
+		return nil, noSuchMailboxError()
+	}
+	if !model.HasAclRights(rights, need) {
+		return nil, noPermError()
+	}
+	return folder, nil
+}
+
+// folderOwner 获取文件夹所属的邮箱
+func (s *IMAPSession) folderOwner(folder *model.Folder) (*model.Mailbox, error) {
+	if folder.MailboxId == s.mailbox.Id {
+		return s.mailbox, nil
+	}
+	return s.storage.mailboxModel.GetById(folder.MailboxId)
+}
+
+// aclIdentifier 校验ACL标识符：anyone 或其他已存在的邮箱，返回规范化的标识符
+func (s *IMAPSession) aclIdentifier(folder *model.Folder, identifier string) (string, error) {
+	if strings.EqualFold(identifier, model.AclAnyone) {
+		return model.AclAnyone, nil
+	}
+	if strings.HasPrefix(identifier, "-") {
+		return "", aclCannotError("Negative rights are not supported")
+	}
+	grantee, err := s.storage.findMailboxByEmail(identifier)
+	if err != nil {
+		return "", err
+	}
+	if grantee == nil {
+		return "", aclCannotError("No such identifier")
+	}
+	if grantee.Id == folder.MailboxId {
+		return "", aclCannotError("The mailbox owner always has all rights")
+	}
+	return grantee.Email, nil
+}
+
+// aclRights 获取标识符在文件夹上当前被授予的权限
+func (s *IMAPSession) aclRights(folder *model.Folder, identifier string) (string, error) {
+	acls, err := s.storage.folderAclModel.GetByFolderId(folder.Id)
+	if err != nil {
+		return "", err
+	}
+	for _, acl := range acls {
+		if acl.Identifier == identifier {
+			return acl.Rights, nil
+		}
+	}
+	return "", nil
+}
+
+// aclRightsString 输出权限，没有权限时为空字符串
+func aclRightsString(rights string) string {
+	if rights == "" {
+		return `""`
+	}
+	return rights
+}
+
+func aclCannotError(text string) error {
+	return &imap.Error{
+		Type: imap.StatusResponseTypeNo,
+		Code: imap.ResponseCodeCannot,
+		Text: text,
+	}
+}
@@ -0,0 +1,42 @@
+package mailserver
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"log"
+	"strings"
+)
+
+// COMPRESS=DEFLATE（RFC 4978）由 imapConn 在连接层实现：自行应答 COMPRESS 命令后
+// 切换到 deflate 流，之后的读写均经过压缩。
+
+const imapCompressCap = "COMPRESS=DEFLATE"
+
+// handleCompress 应答 COMPRESS 命令，成功时切换读写流，调用时持有 mu
+// rest 为同一次读取中该行之后的数据，作为解压流的开头
+func (c *imapConn) handleCompress(tag string, fields []string, rest []byte) (handled, switched bool, err error) {
+	var resp string
+	switch {
+	case !c.authenticated:
+		resp = tag + " BAD COMPRESS requires authentication"
+	case c.writer != nil:
+		resp = tag + " NO [COMPRESSIONACTIVE] DEFLATE active via COMPRESS"
+	case len(fields) != 3 || !strings.EqualFold(fields[2], "DEFLATE"):
+		resp = tag + " BAD Unsupported compression mechanism"
+	default:
+		if _, err := io.WriteString(c.Conn, tag+" OK DEFLATE active\r\n"); err != nil {
+			return true, false, err
+		}
+		writer, err := flate.NewWriter(c.Conn, flate.DefaultCompression)
+		if err != nil {
+			return true, false, err
+		}
+		c.writer = writer
+		c.reader = flate.NewReader(io.MultiReader(bytes.NewReader(append([]byte(nil), rest...)), c.Conn))
+		c.first = true
+		log.Printf("🗜️ IMAP连接启用DEFLATE压缩: %s", c.RemoteAddr())
+		return true, true, nil
+	}
+	return true, false, c.send([]byte(resp + "\r\n"))
+}
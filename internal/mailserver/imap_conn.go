@@ -0,0 +1,514 @@
+package mailserver
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/emersion/go-imap/utf7"
+)
+
+// imapserver 只分发固定的一组命令，也只宣告它认识的能力，未知命令一律返回 BAD。
+// 它不支持的扩展（COMPRESS、QUOTA、ACL 等）在连接层实现：imapConn 按行跟踪客户端命令
+// （跳过字面量），这些扩展的命令连同字面量一起收下，在关联的会话上执行后直接写出响应，
+// 不交给 imapserver；认证状态从 LOGIN/AUTHENTICATE 的 OK 响应得知，能力列表在认证后的
+// CAPABILITY 响应中补充。
+
+const (
+	// imapConnMaxLine 单行缓存上限，超出后不再识别该行中的命令和字面量之外的内容
+	imapConnMaxLine = 8192
+	// imapConnLineTail 超长行保留的尾部长度，足以识别行尾的 {n+}
+	imapConnLineTail = 32
+	// imapConnMaxCommand 连接层执行的命令（含字面量）的长度上限
+	imapConnMaxCommand = 8192
+)
+
+// imapConnCommands 在连接层执行的命令
+var imapConnCommands = map[string]func(c *imapConn, tag string, args []string) string{
+	"GETQUOTA":     (*imapConn).getQuota,
+	"GETQUOTAROOT": (*imapConn).getQuotaRoot,
+	"SETQUOTA":     (*imapConn).setQuota,
+	"SETACL":       (*imapConn).setAcl,
+	"DELETEACL":    (*imapConn).deleteAcl,
+	"GETACL":       (*imapConn).getAcl,
+	"LISTRIGHTS":   (*imapConn).listRights,
+	"MYRIGHTS":     (*imapConn).myRights,
+}
+
+// imapConnCaps 认证后补充宣告的连接层扩展能力
+var imapConnCaps = []string{"QUOTA", "QUOTA=RES-STORAGE", "QUOTA=RES-MESSAGE", "ACL", "RIGHTS=texk", "SORT", "THREAD=ORDEREDSUBJECT", "THREAD=REFERENCES"}
+
+// imapListener 为每个连接提供连接层扩展的监听器
+type imapListener struct {
+	net.Listener
+	compress bool // 是否支持 COMPRESS=DEFLATE
+}
+
+// Accept 接受连接并包装为 imapConn
+func (l *imapListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &imapConn{Conn: conn, reader: conn, first: true, compress: l.compress}, nil
+}
+
+// imapConn 在连接层实现扩展命令的 IMAP 连接
+// 读取在 imapserver 的读循环中进行；写入可能来自 IDLE 推送，状态由 mu 保护
+type imapConn struct {
+	net.Conn
+	compress bool         // 是否支持 COMPRESS=DEFLATE
+	session  *IMAPSession // 创建会话时关联，连接层命令在该会话上执行
+
+	// 读取状态
+	reader      io.Reader // 启用压缩后为 flate 解压流
+	line        []byte    // 尚未交给 imapserver 的当前行
+	first       bool      // 当前行是否为命令首行
+	literal     int64     // 剩余的字面量字节数
+	out         []byte    // 已处理、待交给 imapserver 的数据
+	pending     []byte    // 下一条命令起的数据，待 imapserver 处理完当前命令后再处理
+	intercepted []byte    // 正在接收的连接层命令，非nil时数据不交给 imapserver
+	overflow    bool      // 连接层命令超出长度上限，剩余数据丢弃后返回 BAD
+
+	mu            sync.Mutex
+	tag           string // 当前命令的标签
+	command       string // 当前命令名（大写）
+	authenticated bool
+	utf8Accept    bool          // 客户端已 ENABLE UTF8=ACCEPT，文件夹名称不再使用修改版UTF-7
+	writer        *flate.Writer // 启用压缩后非nil
+	sort          *sortRequest  // 当前命令由 SORT/THREAD 改写为 SEARCH 时非nil
+}
+
+// Read 返回客户端数据，连接层命令在此处理而不交给 imapserver
+func (c *imapConn) Read(b []byte) (int, error) {
+	for len(c.out) == 0 {
+		if len(c.pending) > 0 {
+			data := c.pending
+			c.pending = nil
+			if err := c.process(data); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		buf := make([]byte, 4096)
+		n, err := c.reader.Read(buf)
+		if n > 0 {
+			if procErr := c.process(buf[:n]); procErr != nil {
+				return 0, procErr
+			}
+		}
+		if err != nil {
+			if len(c.out) > 0 {
+				break
+			}
+			return 0, err
+		}
+	}
+	n := copy(b, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+// process 按行处理客户端数据，字面量原样透传
+// 每次最多处理到一条命令结束，使写入响应时 tag/command 仍对应当前命令
+func (c *imapConn) process(data []byte) error {
+	for len(data) > 0 {
+		if c.literal > 0 {
+			n := int64(len(data))
+			if n > c.literal {
+				n = c.literal
+			}
+			switch {
+			case c.overflow:
+			case c.intercepted != nil:
+				c.intercepted = append(c.intercepted, data[:n]...)
+			default:
+				c.out = append(c.out, data[:n]...)
+			}
+			c.literal -= n
+			data = data[n:]
+			continue
+		}
+
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			c.line = append(c.line, data...)
+			if len(c.line) > imapConnMaxLine {
+				// 超长行直接透传，仅保留尾部用于识别字面量
+				// 连接层命令超长时丢弃，结束后返回 BAD
+				cut := len(c.line) - imapConnLineTail
+				if c.intercepted != nil {
+					c.overflow = true
+				} else {
+					c.out = append(c.out, c.line[:cut]...)
+				}
+				c.line = append(c.line[:0], c.line[cut:]...)
+				c.first = false
+			}
+			return nil
+		}
+		c.line = append(c.line, data[:i+1]...)
+		data = data[i+1:]
+
+		line := c.line
+		c.line = nil
+		if c.intercepted != nil {
+			if err := c.interceptLine(line); err != nil {
+				return err
+			}
+			continue
+		}
+		if c.first {
+			line = c.rewriteSortCommand(line)
+			handled, switched, err := c.handleCommand(line, data)
+			if err != nil {
+				return err
+			}
+			if switched {
+				// 之后的数据均已压缩，剩余部分已交给解压流
+				return nil
+			}
+			if handled {
+				continue
+			}
+		}
+		c.out = append(c.out, line...)
+		if size, ok := parseLineLiteral(line); ok {
+			c.literal = size
+			c.first = false
+			continue
+		}
+		c.first = true
+		if len(data) > 0 {
+			c.pending = append([]byte(nil), data...)
+		}
+		return nil
+	}
+	return nil
+}
+
+// handleCommand 记录命令首行的标签和命令名，连接层实现的命令不交给 imapserver
+// rest 为同一次读取中该行之后的数据，启用压缩时作为解压流的开头
+func (c *imapConn) handleCommand(line, rest []byte) (handled, switched bool, err error) {
+	fields := strings.Fields(string(line))
+	// 单个词的行是 IDLE 的 DONE 或认证过程中的响应，不是新命令
+	if len(fields) < 2 {
+		return false, false, nil
+	}
+	tag, command := fields[0], strings.ToUpper(fields[1])
+
+	if _, ok := imapConnCommands[command]; ok {
+		c.intercepted = []byte{}
+		return true, false, c.interceptLine(line)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch command {
+	case "COMPRESS":
+		if c.compress {
+			return c.handleCompress(tag, fields, rest)
+		}
+	case "ENABLE":
+		// imapserver 在认证后支持 UTF8=ACCEPT，启用后文件夹名称直接使用UTF-8
+		for _, capability := range fields[2:] {
+			if strings.EqualFold(capability, "UTF8=ACCEPT") && c.authenticated {
+				c.utf8Accept = true
+			}
+		}
+	}
+	c.tag, c.command = tag, command
+	return false, false, nil
+}
+
+// rewriteSortCommand 将 SORT/THREAD 命令首行改写为 SEARCH，并记录排序请求供 Search 和写入响应时使用
+func (c *imapConn) rewriteSortCommand(line []byte) []byte {
+	req, rewritten := parseSortCommand(line)
+	c.mu.Lock()
+	c.sort = req
+	c.mu.Unlock()
+	if req == nil {
+		return line
+	}
+	return rewritten
+}
+
+// interceptLine 收集连接层命令的一行，行尾有字面量时继续接收，否则执行命令
+func (c *imapConn) interceptLine(line []byte) error {
+	if len(c.intercepted)+len(line) > imapConnMaxCommand {
+		c.overflow = true
+	}
+	if !c.overflow {
+		c.intercepted = append(c.intercepted, line...)
+	}
+	if size, ok := parseLineLiteral(line); ok {
+		if c.overflow || int64(len(c.intercepted))+size > imapConnMaxCommand {
+			c.overflow = true
+			if !isNonSyncLiteral(line) {
+				// 同步字面量可以不发送继续请求，直接结束命令
+				return c.finishIntercepted()
+			}
+		} else if !isNonSyncLiteral(line) {
+			if err := c.writeResponse("+ Ready for literal data"); err != nil {
+				return err
+			}
+		}
+		c.literal = size
+		return nil
+	}
+	return c.finishIntercepted()
+}
+
+// finishIntercepted 连接层命令接收完毕，执行并写出响应
+func (c *imapConn) finishIntercepted() error {
+	command, overflow := c.intercepted, c.overflow
+	c.intercepted, c.overflow = nil, false
+	c.first = true
+
+	tag, name, args, errText := parseIMAPCommand(command)
+	if overflow {
+		errText = "Command line too long"
+	}
+	if errText != "" {
+		return c.writeResponse(tag + " BAD " + errText)
+	}
+	c.mu.Lock()
+	authenticated := c.authenticated
+	c.mu.Unlock()
+	if !authenticated || c.session == nil || !c.session.authenticated {
+		return c.writeResponse(tag + " NO Not authenticated")
+	}
+	return c.writeResponse(imapConnCommands[name](c, tag, args))
+}
+
+// writeResponse 写出连接层命令的响应行，不做能力补充
+func (c *imapConn) writeResponse(resp string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.send([]byte(resp + "\r\n"))
+}
+
+// Write 发送服务器响应，启用压缩后每次写入都同步刷新
+func (c *imapConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeLocked(b)
+}
+
+// writeLocked 在持有 mu 时写入 imapserver 的响应，认证成功后向能力列表补充连接层扩展
+func (c *imapConn) writeLocked(b []byte) (int, error) {
+	data := b
+	if c.sort != nil {
+		data = c.sortResponse(b)
+	}
+	switch c.command {
+	case "LOGIN", "AUTHENTICATE":
+		// imapserver 在认证成功的 OK 响应中附带 [CAPABILITY ...]
+		if !c.authenticated && hasTaggedOK(b, c.tag) {
+			c.authenticated = true
+			data = appendCapability(b, "[CAPABILITY ", "]", c.caps())
+		}
+	case "CAPABILITY":
+		if c.authenticated {
+			data = appendCapability(b, "* CAPABILITY ", "\r\n", c.caps())
+		}
+	}
+	if err := c.send(data); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// sortResponse 在持有 mu 时把 SEARCH 的响应替换为 SORT/THREAD 的响应，带标签的响应行结束该命令
+func (c *imapConn) sortResponse(b []byte) []byte {
+	switch {
+	case bytes.HasPrefix(b, []byte("* SEARCH")), bytes.HasPrefix(b, []byte("* ESEARCH")):
+		if c.sort.result == "" {
+			return b
+		}
+		return []byte(c.sort.result + "\r\n")
+	case bytes.HasPrefix(b, []byte(c.tag+" ")):
+		name := c.sort.name
+		c.sort = nil
+		return bytes.Replace(b, []byte(" SEARCH completed"), []byte(" "+name+" completed"), 1)
+	}
+	return b
+}
+
+// send 在持有 mu 时写入数据，启用压缩后写入 deflate 流并刷新
+func (c *imapConn) send(data []byte) error {
+	if c.writer == nil {
+		_, err := c.Conn.Write(data)
+		return err
+	}
+	if _, err := c.writer.Write(data); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+// caps 返回认证后补充宣告的能力
+func (c *imapConn) caps() []string {
+	if c.compress {
+		return append([]string{imapCompressCap}, imapConnCaps...)
+	}
+	return imapConnCaps
+}
+
+// hasTaggedOK 判断数据中是否有指定标签的 OK 响应行
+func hasTaggedOK(data []byte, tag string) bool {
+	if tag == "" {
+		return false
+	}
+	prefix := []byte(tag + " OK")
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if bytes.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendCapability 在以 start 开头的能力列表的 end 之前插入 caps
+func appendCapability(data []byte, start, end string, caps []string) []byte {
+	i := bytes.Index(data, []byte(start))
+	if i < 0 {
+		return data
+	}
+	j := bytes.Index(data[i:], []byte(end))
+	if j < 0 {
+		return data
+	}
+	j += i
+	extra := " " + strings.Join(caps, " ")
+	result := make([]byte, 0, len(data)+len(extra))
+	result = append(result, data[:j]...)
+	result = append(result, extra...)
+	return append(result, data[j:]...)
+}
+
+// parseLineLiteral 解析行尾的字面量长度 {n}、{n+} 或 ~{n}
+func parseLineLiteral(line []byte) (int64, bool) {
+	line = bytes.TrimRight(line, "\r\n")
+	if !bytes.HasSuffix(line, []byte("}")) {
+		return 0, false
+	}
+	i := bytes.LastIndexByte(line, '{')
+	if i < 0 {
+		return 0, false
+	}
+	digits := strings.TrimSuffix(string(line[i+1:len(line)-1]), "+")
+	size, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || size < 0 {
+		return 0, false
+	}
+	return size, true
+}
+
+// isNonSyncLiteral 行尾的字面量是否为 {n+}，客户端不等待继续请求
+func isNonSyncLiteral(line []byte) bool {
+	return bytes.HasSuffix(bytes.TrimRight(line, "\r\n"), []byte("+}"))
+}
+
+// parseIMAPCommand 解析连接层命令的标签、命令名和参数，参数可以是原子、带引号的字符串或字面量
+// 无法解析时 errText 为 BAD 响应的说明
+func parseIMAPCommand(data []byte) (tag, name string, args []string, errText string) {
+	var tokens []string
+	for len(data) > 0 {
+		switch data[0] {
+		case ' ', '\r', '\n':
+			data = data[1:]
+		case '"':
+			var b strings.Builder
+			i := 1
+			for ; i < len(data) && data[i] != '"'; i++ {
+				if data[i] == '\\' && i+1 < len(data) {
+					i++
+				}
+				b.WriteByte(data[i])
+			}
+			if i >= len(data) {
+				return firstToken(tokens), "", nil, "Unterminated quoted string"
+			}
+			tokens = append(tokens, b.String())
+			data = data[i+1:]
+		case '{':
+			end := bytes.IndexByte(data, '\n')
+			if end < 0 {
+				return firstToken(tokens), "", nil, "Invalid literal"
+			}
+			size, ok := parseLineLiteral(data[:end+1])
+			if !ok || int64(len(data)-end-1) < size {
+				return firstToken(tokens), "", nil, "Invalid literal"
+			}
+			data = data[end+1:]
+			tokens = append(tokens, string(data[:size]))
+			data = data[size:]
+		default:
+			i := bytes.IndexAny(data, " \r\n")
+			if i < 0 {
+				i = len(data)
+			}
+			tokens = append(tokens, string(data[:i]))
+			data = data[i:]
+		}
+	}
+	if len(tokens) < 2 {
+		return firstToken(tokens), "", nil, "Missing command"
+	}
+	return tokens[0], strings.ToUpper(tokens[1]), tokens[2:], ""
+}
+
+func firstToken(tokens []string) string {
+	if len(tokens) == 0 {
+		return "*"
+	}
+	return tokens[0]
+}
+
+// decodeMailboxName 解码客户端发送的文件夹名称，INBOX 不区分大小写
+// 客户端启用 UTF8=ACCEPT 后可能直接发送UTF-8名称
+func decodeMailboxName(name string) string {
+	if strings.EqualFold(name, "INBOX") {
+		return "INBOX"
+	}
+	decoded, err := utf7.Encoding.NewDecoder().String(name)
+	if err != nil && utf8.ValidString(name) {
+		return name
+	}
+	return decoded
+}
+
+// mailboxName 编码响应中的文件夹名称
+func (c *imapConn) mailboxName(name string) string {
+	if strings.EqualFold(name, "INBOX") {
+		return "INBOX"
+	}
+	c.mu.Lock()
+	utf8Accept := c.utf8Accept
+	c.mu.Unlock()
+	if !utf8Accept {
+		if encoded, err := utf7.Encoding.NewEncoder().String(name); err == nil {
+			name = encoded
+		}
+	}
+	return quoteIMAPString(name)
+}
+
+// quoteIMAPString 将字符串编码为带引号的字符串
+func quoteIMAPString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// unwrapIMAPConn 返回 imapConn 包装的原始连接，用于判断TLS
+func unwrapIMAPConn(conn net.Conn) net.Conn {
+	if ic, ok := conn.(*imapConn); ok {
+		return ic.Conn
+	}
+	return conn
+}
@@ -0,0 +1,243 @@
+package mailserver
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"github.com/rankgice/new-email/internal/model"
+)
+
+// rawMessage 返回邮件的原始 RFC 5322 报文，BODYSTRUCTURE、BODY[section] 和 BINARY[] 均由它解析
+// SMTP/APPEND 收到的邮件直接使用存储的原文，Web端发送的邮件只存了正文，按邮件元数据补齐邮件头
+func rawMessage(m *StoredMail) []byte {
+	if model.HasRawHeader(m.Body) {
+		return []byte(m.Body)
+	}
+
+	var h mail.Header
+	h.SetDate(m.Received)
+	h.SetSubject(m.Subject)
+	if m.From != "" {
+		h.SetAddressList("From", []*mail.Address{{Address: m.From}})
+	}
+	if to := mailAddresses(m.To); len(to) > 0 {
+		h.SetAddressList("To", to)
+	}
+	if cc := mailAddresses(m.Cc); len(cc) > 0 {
+		h.SetAddressList("Cc", cc)
+	}
+	if m.MessageID != "" {
+		h.SetMessageID(m.MessageID)
+	}
+	h.Set("Mime-Version", "1.0")
+
+	contentType := m.ContentType
+	switch strings.ToLower(contentType) {
+	case "", "text", "plain":
+		contentType = "text/plain"
+	case "html":
+		contentType = "text/html"
+	}
+	h.SetContentType(contentType, map[string]string{"charset": "utf-8"})
+	h.Set("Content-Transfer-Encoding", "8bit")
+
+	var buf bytes.Buffer
+	if err := textproto.WriteHeader(&buf, h.Header.Header); err != nil {
+		return []byte(m.Body)
+	}
+	body := m.Body
+	if !strings.Contains(body, "\r\n") {
+		body = strings.ReplaceAll(body, "\n", "\r\n")
+	}
+	buf.WriteString(body)
+	return buf.Bytes()
+}
+
+// mailAddresses 将邮箱地址列表转换为邮件头地址
+func mailAddresses(emails []string) []*mail.Address {
+	addresses := make([]*mail.Address, 0, len(emails))
+	for _, email := range emails {
+		if email = strings.TrimSpace(email); email != "" {
+			addresses = append(addresses, &mail.Address{Address: email})
+		}
+	}
+	return addresses
+}
+
+// maxHeaderBytes 从原文读取邮件头时的上限，超出部分不视为邮件头
+const maxHeaderBytes = 1 << 20
+
+// readMessageHeader 读取原始报文开头的邮件头（含结尾空行），正文不会读入内存
+func readMessageHeader(r io.Reader) (string, error) {
+	br := bufio.NewReader(io.LimitReader(r, maxHeaderBytes))
+	var header strings.Builder
+	for {
+		line, err := br.ReadString('\n')
+		header.WriteString(line)
+		if err == io.EOF {
+			return header.String(), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if strings.TrimRight(line, "\r\n") == "" {
+			return header.String(), nil
+		}
+	}
+}
+
+// byteMessage 内存中构建的原始报文
+type byteMessage struct {
+	*bytes.Reader
+}
+
+func (byteMessage) Close() error { return nil }
+
+// openMessage 打开邮件的原始报文：原文保存在blob中时直接读取文件，否则按 rawMessage 构建
+func (s *MailStorage) openMessage(m *StoredMail) (io.ReadSeekCloser, error) {
+	if m.BlobKey == "" {
+		return byteMessage{bytes.NewReader(rawMessage(m))}, nil
+	}
+	return s.blobs.Open(m.BlobKey)
+}
+
+// messageSize 返回原始报文的大小，blob中的原文直接使用保存的大小
+func messageSize(m *StoredMail) int64 {
+	if m.BlobKey != "" {
+		return int64(m.Size)
+	}
+	return int64(len(rawMessage(m)))
+}
+
+// contentMatcher 返回在blob原文中搜索的匹配器，供一次搜索使用
+// 每封邮件对同一组片段只扫描一次，NOT/OR 中重复出现的条件直接复用结果
+func (s *MailStorage) contentMatcher() model.SearchContentMatcher {
+	results := make(map[string]map[int64]bool)
+	return func(keys map[int64]string, parts ...string) ([]int64, error) {
+		cacheKey := strings.Join(parts, "\x00")
+		cached := results[cacheKey]
+		if cached == nil {
+			cached = make(map[int64]bool)
+			results[cacheKey] = cached
+		}
+		ids := []int64{}
+		for id, key := range keys {
+			found, ok := cached[id]
+			if !ok {
+				r, err := s.blobs.Open(key)
+				if err != nil {
+					log.Printf("❌ 打开邮件原文失败 (ID: %d): %v", id, err)
+					continue
+				}
+				found, err = containsInOrder(r, parts)
+				r.Close()
+				if err != nil {
+					return nil, err
+				}
+				cached[id] = found
+			}
+			if found {
+				ids = append(ids, id)
+			}
+		}
+		return ids, nil
+	}
+}
+
+// containsInOrder 流式判断数据是否依次包含各片段，与 SQLite 的 LIKE 一致对ASCII字母不区分大小写
+func containsInOrder(r io.Reader, parts []string) (bool, error) {
+	buf := make([]byte, 32*1024)
+	var window []byte
+	for len(parts) > 0 {
+		pattern := lowerASCII([]byte(parts[0]))
+		if i := bytes.Index(window, pattern); i >= 0 {
+			window = window[i+len(pattern):]
+			parts = parts[1:]
+			continue
+		}
+		// 只保留可能与后续数据拼成匹配的尾部
+		if keep := len(pattern) - 1; len(window) > keep {
+			window = append(window[:0:0], window[len(window)-keep:]...)
+		}
+		n, err := r.Read(buf)
+		window = append(window, lowerASCII(buf[:n])...)
+		if err == io.EOF && n == 0 {
+			return false, nil
+		}
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// lowerASCII 将ASCII大写字母转为小写，其他字节不变
+func lowerASCII(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		out[i] = c
+	}
+	return out
+}
+
+// rawMessageCache 在一次 FETCH 中保持单封邮件的原始报文打开，避免每个数据项重复打开或构建
+type rawMessageCache struct {
+	storage *MailStorage
+	mail    *StoredMail
+	r       io.ReadSeekCloser
+}
+
+// reader 返回定位到报文开头的读取器，打开失败时视为空报文
+func (c *rawMessageCache) reader() io.ReadSeeker {
+	if c.r == nil {
+		r, err := c.storage.openMessage(c.mail)
+		if err != nil {
+			log.Printf("❌ 打开邮件原文失败 (ID: %d): %v", c.mail.ID, err)
+			r = byteMessage{bytes.NewReader(nil)}
+		}
+		c.r = r
+	}
+	c.r.Seek(0, io.SeekStart)
+	return c.r
+}
+
+func (c *rawMessageCache) size() int64 {
+	size, _ := c.reader().Seek(0, io.SeekEnd)
+	return size
+}
+
+// headerSize 返回邮件头（含结尾空行）的字节数
+func (c *rawMessageCache) headerSize() int64 {
+	header, _ := readMessageHeader(c.reader())
+	return int64(len(header))
+}
+
+// date 返回 Date 邮件头的时间，邮件头缺失时使用接收时间，无法解析时返回零值
+func (c *rawMessageCache) date() time.Time {
+	header, err := textproto.ReadHeader(bufio.NewReader(io.LimitReader(c.reader(), maxHeaderBytes)))
+	if err != nil || !header.Has("Date") {
+		return c.mail.Received
+	}
+	date, err := (&mail.Header{Header: message.Header{Header: header}}).Date()
+	if err != nil {
+		return time.Time{}
+	}
+	return date
+}
+
+func (c *rawMessageCache) close() {
+	if c.r != nil {
+		c.r.Close()
+		c.r = nil
+	}
+}
@@ -0,0 +1,104 @@
+package mailserver
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/rankgice/new-email/internal/model"
+)
+
+// QUOTA（RFC 9208）在连接层实现：每个邮箱是一个配额根，根名称为邮箱地址，
+// 资源 STORAGE（KB）和 MESSAGE 取邮箱的配额和用量，配额为0表示不限制，不列出该资源。
+// 配额只能由管理员通过 REST API 修改，SETQUOTA 返回 NO。
+
+// getQuota GETQUOTA <配额根>，只能查询当前邮箱的配额根
+func (c *imapConn) getQuota(tag string, args []string) string {
+	if len(args) != 1 {
+		return tag + " BAD Expected quota root"
+	}
+	s := c.session
+	if !strings.EqualFold(args[0], s.mailbox.Email) {
+		return statusResponse(tag, noSuchQuotaRootError())
+	}
+	quota, err := s.quotaData(s.mailbox)
+	if err != nil {
+		return statusResponse(tag, err)
+	}
+	return quota + "\r\n" + tag + " OK GETQUOTA completed"
+}
+
+// getQuotaRoot GETQUOTAROOT <文件夹>，返回文件夹所属邮箱的配额根，当前邮箱的配额根同时返回配额
+func (c *imapConn) getQuotaRoot(tag string, args []string) string {
+	if len(args) != 1 {
+		return tag + " BAD Expected mailbox name"
+	}
+	s := c.session
+	name := decodeMailboxName(args[0])
+	folder, _, err := s.lookupFolder(name)
+	if err != nil {
+		return statusResponse(tag, err)
+	}
+	if folder == nil {
+		return statusResponse(tag, noSuchMailboxError())
+	}
+
+	owner, err := s.folderOwner(folder)
+	if err != nil {
+		return statusResponse(tag, err)
+	}
+	lines := []string{"* QUOTAROOT " + c.mailboxName(name) + " " + quoteIMAPString(owner.Email)}
+	if owner.Id == s.mailbox.Id {
+		quota, err := s.quotaData(owner)
+		if err != nil {
+			return statusResponse(tag, err)
+		}
+		lines = append(lines, quota)
+	}
+	return strings.Join(lines, "\r\n") + "\r\n" + tag + " OK GETQUOTAROOT completed"
+}
+
+// setQuota SETQUOTA 不支持，配额由管理员设置
+func (c *imapConn) setQuota(tag string, args []string) string {
+	return statusResponse(tag, noPermError())
+}
+
+// quotaData 返回邮箱配额根的 QUOTA 响应行
+func (s *IMAPSession) quotaData(mailbox *model.Mailbox) (string, error) {
+	quota, _, err := s.storage.mailboxModel.GetQuota(mailbox.Id)
+	if err != nil {
+		return "", err
+	}
+	var resources []string
+	if quota.QuotaBytes > 0 {
+		resources = append(resources, fmt.Sprintf("%s %d %d", imap.QuotaResourceStorage, (quota.UsedBytes+1023)/1024, quota.QuotaBytes/1024))
+	}
+	if quota.QuotaMessages > 0 {
+		resources = append(resources, fmt.Sprintf("%s %d %d", imap.QuotaResourceMessage, quota.UsedMessages, quota.QuotaMessages))
+	}
+	return "* QUOTA " + quoteIMAPString(mailbox.Email) + " (" + strings.Join(resources, " ") + ")", nil
+}
+
+func noSuchQuotaRootError() error {
+	return &imap.Error{
+		Type: imap.StatusResponseTypeNo,
+		Code: imap.ResponseCodeNonExistent,
+		Text: "No such quota root",
+	}
+}
+
+// statusResponse 将错误转换为连接层命令的带标签响应，非IMAP错误只记录日志
+func statusResponse(tag string, err error) string {
+	var imapErr *imap.Error
+	if !errors.As(err, &imapErr) {
+		log.Printf("❌ IMAP命令执行失败: %v", err)
+		return tag + " NO Internal server error"
+	}
+	resp := tag + " " + string(imapErr.Type)
+	if imapErr.Code != "" {
+		resp += " [" + string(imapErr.Code) + "]"
+	}
+	return resp + " " + imapErr.Text
+}
@@ -1,27 +1,34 @@
 package mailserver
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"io"
 	"log"
-	"sort"
 	"strings"
 	"time"
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-sasl"
+	"github.com/rankgice/new-email/internal/blob"
+	"github.com/rankgice/new-email/internal/event"
+	"github.com/rankgice/new-email/internal/localSasl"
 	"github.com/rankgice/new-email/internal/model"
 )
 
 // IMAPSession 实现 imapserver.Session 接口
 type IMAPSession struct {
+	conn           *imapserver.Conn
 	username       string
 	mailbox        *model.Mailbox
 	storage        *MailStorage
 	selectedFolder *model.Folder
+	readOnly       bool   // 通过 EXAMINE 只读打开，或对共享文件夹没有任何写权限
+	selectedRights string // 对选中文件夹的ACL权限
 	authenticated  bool
-	mailboxTracker *imapserver.MailboxTracker
+	sessionTracker *imapserver.SessionTracker // 选中文件夹的更新队列
+	searchRes      imap.UIDSet                // SEARCH RETURN (SAVE) 保存的结果，供 "$" 引用
 }
 
 func noSuchMailboxError() error {
@@ -32,9 +39,35 @@ func noSuchMailboxError() error {
 	}
 }
 
+// tryCreateError COPY/MOVE 目标文件夹不存在时返回，提示客户端先创建
+func tryCreateError() error {
+	return &imap.Error{
+		Type: imap.StatusResponseTypeNo,
+		Code: imap.ResponseCodeTryCreate,
+		Text: "Destination mailbox does not exist",
+	}
+}
+
+func overQuotaError() error {
+	return &imap.Error{
+		Type: imap.StatusResponseTypeNo,
+		Code: imap.ResponseCodeOverQuota,
+		Text: "Quota exceeded",
+	}
+}
+
+func tooBigError() error {
+	return &imap.Error{
+		Type: imap.StatusResponseTypeNo,
+		Code: imap.ResponseCodeTooBig,
+		Text: "Message too big",
+	}
+}
+
 // NewIMAPSession 创建新的 IMAP 会话
-func NewIMAPSession(storage *MailStorage) *IMAPSession {
+func NewIMAPSession(storage *MailStorage, conn *imapserver.Conn) *IMAPSession {
 	return &IMAPSession{
+		conn:          conn,
 		storage:       storage,
 		authenticated: false,
 	}
@@ -43,19 +76,90 @@ func NewIMAPSession(storage *MailStorage) *IMAPSession {
 // Close 关闭会话
 func (s *IMAPSession) Close() error {
 	log.Printf("IMAP会话关闭: %s", s.username)
+	s.closeTracker()
 	return nil
 }
 
+// closeTracker 停止接收当前选中文件夹的更新
+func (s *IMAPSession) closeTracker() {
+	if s.sessionTracker != nil && s.selectedFolder != nil {
+		s.storage.trackers.close(s.selectedFolder.Id, s.sessionTracker)
+	}
+	s.sessionTracker = nil
+}
+
+// clientSeqNum 将当前邮件列表中的序号转换为客户端视图中的序号
+// 客户端尚未收到的新邮件返回0，尚未收到的 EXPUNGE 会使后续序号偏移
+func (s *IMAPSession) clientSeqNum(seqNum uint32) uint32 {
+	if s.sessionTracker == nil {
+		return seqNum
+	}
+	return s.sessionTracker.EncodeSeqNum(seqNum)
+}
+
 // Login 用户登录
 func (s *IMAPSession) Login(username, password string) error {
 	log.Printf("IMAP登录尝试: %s", username)
 
 	// 验证用户凭据
-	if !s.storage.ValidateCredentials(username, password) {
+	if !s.storage.ValidateCredentials(username, password, model.AppPasswordScopeIMAP) {
 		log.Printf("IMAP登录失败: %s", username)
 		return imapserver.ErrAuthFailed
 	}
 
+	return s.loginMailbox(username)
+}
+
+// AuthenticateMechanisms 返回 AUTHENTICATE 支持的SASL机制
+func (s *IMAPSession) AuthenticateMechanisms() []string {
+	return s.storage.saslMechanisms([]string{sasl.Plain}, s.channelBinding())
+}
+
+// Authenticate 处理 AUTHENTICATE 命令，认证成功后会话进入已认证状态
+func (s *IMAPSession) Authenticate(mech string) (sasl.Server, error) {
+	log.Printf("IMAP AUTHENTICATE: %s", mech)
+
+	if mech == sasl.Plain {
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			if identity != "" && identity != username {
+				return &imap.Error{
+					Type: imap.StatusResponseTypeNo,
+					Code: imap.ResponseCodeAuthorizationFailed,
+					Text: "SASL identity not supported",
+				}
+			}
+			return s.Login(username, password)
+		}), nil
+	}
+
+	server := s.storage.newSASLServer(mech, s.channelBinding(), func(email string) error {
+		log.Printf("IMAP %s认证成功: %s", mech, email)
+		return s.loginMailbox(email)
+	})
+	if server == nil {
+		return nil, &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Text: "SASL mechanism not supported",
+		}
+	}
+	return server, nil
+}
+
+// channelBinding 返回当前连接的TLS通道绑定，未启用TLS时返回nil
+func (s *IMAPSession) channelBinding() localSasl.ChannelBinding {
+	if s.conn == nil {
+		return nil
+	}
+	tlsConn, ok := unwrapIMAPConn(s.conn.NetConn()).(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	return tlsChannelBinding(&state)
+}
+
+// loginMailbox 凭据验证通过后加载邮箱并进入已认证状态
+func (s *IMAPSession) loginMailbox(username string) error {
 	// 获取邮箱信息
 	mailbox, err := s.storage.findMailboxByEmail(username)
 	if err != nil {
@@ -84,7 +188,7 @@ func (s *IMAPSession) Select(mailboxName string, options *imap.SelectOptions) (*
 	log.Printf("选择邮箱: %s, 用户: %s", mailboxName, s.username)
 
 	// 获取文件夹
-	folder, err := s.storage.folderModel.GetByMailboxIdAndName(s.mailbox.Id, mailboxName, nil)
+	folder, rights, err := s.lookupFolder(mailboxName)
 	if err != nil {
 		log.Printf("获取文件夹失败: %v", err)
 		return nil, err
@@ -92,18 +196,33 @@ func (s *IMAPSession) Select(mailboxName string, options *imap.SelectOptions) (*
 	if folder == nil {
 		return nil, noSuchMailboxError()
 	}
+	if !model.HasAclRights(rights, model.AclRightRead) {
+		return nil, noPermError()
+	}
 
-	s.selectedFolder = folder
+	// 重新SELECT时先释放之前文件夹的跟踪
+	s.closeTracker()
 
-	// 获取邮件数量
-	mails, err := s.storage.GetMails(s.username, mailboxName, 0)
+	// 获取邮件列表
+	mails, err := s.storage.GetFolderMails(folder, 0)
 	if err != nil {
 		log.Printf("获取邮件数量失败: %v", err)
 		return nil, err
 	}
 
-	numMessages := uint32(len(mails))
-	s.mailboxTracker = imapserver.NewMailboxTracker(numMessages)
+	s.selectedFolder = folder
+	s.selectedRights = rights
+	// 没有任何修改权限时只读（imapserver 只根据 EXAMINE 返回 READ-ONLY，PERMANENTFLAGS 反映实际权限）
+	s.readOnly = (options != nil && options.ReadOnly) || !strings.ContainsAny(rights, "swite")
+	s.searchRes = nil
+
+	// 订阅文件夹更新，邮件数量以跟踪器为准，保证与后续推送的 EXISTS/EXPUNGE 一致
+	uids := make([]uint32, 0, len(mails))
+	for _, mail := range mails {
+		uids = append(uids, mail.UID)
+	}
+	var numMessages uint32
+	s.sessionTracker, numMessages = s.storage.trackers.open(folder.Id, uids)
 
 	// 计算未读邮件数量
 	var numUnseen uint32
@@ -114,15 +233,36 @@ func (s *IMAPSession) Select(mailboxName string, options *imap.SelectOptions) (*
 	}
 
 	selectData := &imap.SelectData{
-		NumMessages: numMessages,
-		UIDNext:     imap.UID(numMessages + 1), // 简化实现
-		UIDValidity: 1,                         // 简化实现
+		Flags:          s.folderFlags(mails),
+		PermanentFlags: permanentFlags(s.folderFlags(mails), rights),
+		NumMessages:    numMessages,
+		UIDNext:        imap.UID(folder.UidNext),
+		UIDValidity:    folder.UidValidity,
 		// NumUnseen 在 v2 中不再是 SelectData 的字段
 	}
 
 	return selectData, nil
 }
 
+// folderFlags 返回文件夹可用的标志：系统标志加上已使用的关键字
+func (s *IMAPSession) folderFlags(mails []*StoredMail) []imap.Flag {
+	flags := make([]imap.Flag, 0, len(model.SystemFlags))
+	seen := make(map[string]bool)
+	for _, flag := range model.SystemFlags {
+		flags = append(flags, imap.Flag(flag))
+		seen[strings.ToLower(flag)] = true
+	}
+	for _, mail := range mails {
+		for _, flag := range mail.Flags {
+			if !seen[strings.ToLower(flag)] {
+				seen[strings.ToLower(flag)] = true
+				flags = append(flags, imap.Flag(flag))
+			}
+		}
+	}
+	return flags
+}
+
 // Create 创建邮箱
 func (s *IMAPSession) Create(mailboxName string, options *imap.CreateOptions) error {
 	if !s.authenticated {
@@ -131,21 +271,65 @@ func (s *IMAPSession) Create(mailboxName string, options *imap.CreateOptions) er
 
 	log.Printf("创建邮箱: %s, 用户: %s", mailboxName, s.username)
 
-	// 检查文件夹是否已存在
-	existingFolder, err := s.storage.folderModel.GetByMailboxIdAndName(s.mailbox.Id, mailboxName, nil)
+	// CREATE-SPECIAL-USE：每个文件夹只保存一个特殊用途属性
+	var specialUse string
+	if options != nil && len(options.SpecialUse) > 0 {
+		if len(options.SpecialUse) > 1 || !model.IsValidSpecialUse(string(options.SpecialUse[0])) {
+			return &imap.Error{
+				Type: imap.StatusResponseTypeNo,
+				Code: imap.ResponseCode("USEATTR"),
+				Text: "Unsupported special-use attribute",
+			}
+		}
+		specialUse = string(options.SpecialUse[0])
+	}
+
+	ref, err := s.parseFolderName(mailboxName)
 	if err != nil {
 		return err
 	}
-	if existingFolder != nil {
-		return errors.New("邮箱已存在")
+	if ref == nil {
+		return &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeCannot,
+			Text: "Invalid mailbox name",
+		}
+	}
+
+	// 共享命名空间下只能在有 k 权限的已有文件夹中创建子文件夹
+	var parent *model.Folder
+	if ref.owner.Id != s.mailbox.Id {
+		if parent, err = s.sharedParent(ref); err != nil {
+			return err
+		}
 	}
 
-	// 创建新文件夹
-	_, err = s.storage.getOrCreateFolder(s.mailbox.Id, mailboxName, nil, false)
+	// 按层级创建文件夹，缺失的上级文件夹一并创建
+	folder, err := s.storage.folderModel.CreatePath(ref.owner.Id, ref.path, specialUse)
 	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrFolderExists):
+			return &imap.Error{
+				Type: imap.StatusResponseTypeNo,
+				Code: imap.ResponseCodeAlreadyExists,
+				Text: "Mailbox already exists",
+			}
+		case errors.Is(err, model.ErrFolderPath):
+			return &imap.Error{
+				Type: imap.StatusResponseTypeNo,
+				Code: imap.ResponseCodeCannot,
+				Text: "Invalid mailbox name",
+			}
+		}
 		log.Printf("创建文件夹失败: %v", err)
 		return err
 	}
+	if parent != nil {
+		if err := s.inheritFolderAcl(parent, folder); err != nil {
+			log.Printf("继承文件夹ACL失败: %v", err)
+			return err
+		}
+	}
 
 	log.Printf("成功创建邮箱: %s", mailboxName)
 	return nil
@@ -159,21 +343,38 @@ func (s *IMAPSession) Delete(mailboxName string) error {
 
 	log.Printf("删除邮箱: %s, 用户: %s", mailboxName, s.username)
 
-	folder, err := s.storage.folderModel.GetByMailboxIdAndName(s.mailbox.Id, mailboxName, nil)
+	folder, rights, err := s.lookupFolder(mailboxName)
 	if err != nil {
 		return err
 	}
 	if folder == nil {
 		return noSuchMailboxError()
 	}
+	if !model.HasAclRights(rights, model.AclRightDelete) {
+		return noPermError()
+	}
 	if folder.IsSystem {
 		return errors.New("不能删除系统邮箱")
 	}
 
-	if err := s.storage.folderModel.Delete(folder.Id); err != nil {
+	// 删除文件夹及其中的邮件，仍有子文件夹时拒绝删除
+	emails, blobKeys, err := s.storage.folderModel.DeleteWithEmails(folder.Id)
+	if err != nil {
+		if errors.Is(err, model.ErrFolderHasChildren) {
+			return &imap.Error{
+				Type: imap.StatusResponseTypeNo,
+				Code: imap.ResponseCodeHasChildren,
+				Text: "Mailbox has children",
+			}
+		}
 		log.Printf("删除邮箱失败: %v", err)
 		return err
 	}
+	s.storage.deleteBlobs(blobKeys)
+	// 从后往前通知，保证每条 EXPUNGE 的序号在发送时有效
+	for i := len(emails) - 1; i >= 0; i-- {
+		s.storage.events.Publish(event.EmailEvent(event.TypeExpunge, emails[i]))
+	}
 
 	log.Printf("成功删除邮箱: %s", mailboxName)
 	return nil
@@ -188,30 +389,54 @@ func (s *IMAPSession) Rename(oldName, newName string, options *imap.RenameOption
 	log.Printf("重命名邮箱: %s -> %s, 用户: %s", oldName, newName, s.username)
 
 	// 获取原文件夹
-	folder, err := s.storage.folderModel.GetByMailboxIdAndName(s.mailbox.Id, oldName, nil)
+	folder, rights, err := s.lookupFolder(oldName)
 	if err != nil {
 		return err
 	}
 	if folder == nil {
 		return noSuchMailboxError()
 	}
+	if !model.HasAclRights(rights, model.AclRightDelete) {
+		return noPermError()
+	}
 	if folder.IsSystem {
 		return errors.New("不能重命名系统邮箱")
 	}
 
-	// 检查新名称是否已存在
-	existingFolder, err := s.storage.folderModel.GetByMailboxIdAndName(s.mailbox.Id, newName, folder.ParentId)
+	// 文件夹只能在所属邮箱内重命名，共享命名空间下的新位置需要上级的 k 权限
+	ref, err := s.parseFolderName(newName)
 	if err != nil {
 		return err
 	}
-	if existingFolder != nil {
-		return errors.New("新邮箱名称已存在")
+	if ref == nil || ref.owner.Id != folder.MailboxId {
+		return &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeCannot,
+			Text: "Cannot rename mailbox to " + newName,
+		}
+	}
+	if ref.owner.Id != s.mailbox.Id {
+		if _, err := s.sharedParent(ref); err != nil {
+			return err
+		}
 	}
 
-	// 更新文件夹名称
-	folder.Name = newName
-	folder.UpdatedAt = time.Now()
-	if err := s.storage.folderModel.Update(folder); err != nil {
+	// 移动到新路径，子文件夹跟随父文件夹一起移动
+	if err := s.storage.folderModel.MoveToPath(folder, ref.path); err != nil {
+		switch {
+		case errors.Is(err, model.ErrFolderExists):
+			return &imap.Error{
+				Type: imap.StatusResponseTypeNo,
+				Code: imap.ResponseCodeAlreadyExists,
+				Text: "Mailbox already exists",
+			}
+		case errors.Is(err, model.ErrFolderPath), errors.Is(err, model.ErrFolderMoveInto):
+			return &imap.Error{
+				Type: imap.StatusResponseTypeNo,
+				Code: imap.ResponseCodeCannot,
+				Text: "Cannot rename mailbox to " + newName,
+			}
+		}
 		log.Printf("重命名邮箱失败: %v", err)
 		return err
 	}
@@ -257,43 +482,56 @@ func (s *IMAPSession) List(w *imapserver.ListWriter, ref string, patterns []stri
 		})
 	}
 
-	folders, err := s.storage.folderModel.GetByMailboxId(s.mailbox.Id)
+	entries, err := s.listEntries()
 	if err != nil {
 		log.Printf("获取文件夹列表失败: %v", err)
 		return err
 	}
 
-	sort.Slice(folders, func(i, j int) bool {
-		return folders[i].Name < folders[j].Name
-	})
+	for _, entry := range entries {
+		if options != nil && options.SelectSpecialUse && (entry.folder == nil || entry.folder.SpecialUse == "") {
+			continue
+		}
 
-	for _, folder := range folders {
 		matched := false
 		for _, pattern := range patterns {
-			if imapserver.MatchList(folder.Name, '/', ref, pattern) {
+			if imapserver.MatchList(entry.name, '/', ref, pattern) {
 				matched = true
 				break
 			}
 		}
+		if !matched {
+			continue
+		}
 
-		if matched {
-			listData := &imap.ListData{
-				Attrs:   []imap.MailboxAttr{},
-				Delim:   '/',
-				Mailbox: folder.Name,
-			}
-			if options != nil && options.ReturnStatus != nil {
-				statusData, err := s.statusData(folder.Name, options.ReturnStatus)
-				if err != nil {
-					log.Printf("构建LIST状态数据失败: %v", err)
-					return err
-				}
-				listData.Status = statusData
-			}
-			if err := w.WriteList(listData); err != nil {
-				log.Printf("写入列表数据失败: %v", err)
+		attrs := []imap.MailboxAttr{imap.MailboxAttrHasNoChildren}
+		if entry.hasChildren {
+			attrs[0] = imap.MailboxAttrHasChildren
+		}
+		if entry.folder == nil {
+			// 命名空间层级不是真实文件夹
+			attrs = append(attrs, imap.MailboxAttrNoSelect)
+		} else if entry.folder.SpecialUse != "" {
+			attrs = append(attrs, imap.MailboxAttr(entry.folder.SpecialUse))
+		}
+
+		listData := &imap.ListData{
+			Attrs:   attrs,
+			Delim:   '/',
+			Mailbox: entry.name,
+		}
+		if options != nil && options.ReturnStatus != nil && entry.folder != nil &&
+			model.HasAclRights(entry.rights, model.AclRightRead) {
+			statusData, err := s.statusData(entry.name, options.ReturnStatus)
+			if err != nil {
+				log.Printf("构建LIST状态数据失败: %v", err)
 				return err
 			}
+			listData.Status = statusData
+		}
+		if err := w.WriteList(listData); err != nil {
+			log.Printf("写入列表数据失败: %v", err)
+			return err
 		}
 	}
 
@@ -312,7 +550,7 @@ func (s *IMAPSession) Status(mailboxName string, options *imap.StatusOptions) (*
 
 func (s *IMAPSession) statusData(mailboxName string, options *imap.StatusOptions) (*imap.StatusData, error) {
 	// 检查邮箱是否存在
-	folder, err := s.storage.folderModel.GetByMailboxIdAndName(s.mailbox.Id, mailboxName, nil)
+	folder, rights, err := s.lookupFolder(mailboxName)
 	if err != nil {
 		log.Printf("获取文件夹失败: %v", err)
 		return nil, err
@@ -321,9 +559,12 @@ func (s *IMAPSession) statusData(mailboxName string, options *imap.StatusOptions
 		log.Printf("邮箱不存在: %s", mailboxName)
 		return nil, noSuchMailboxError()
 	}
+	if !model.HasAclRights(rights, model.AclRightRead) {
+		return nil, noPermError()
+	}
 
 	// 获取邮件列表
-	mails, err := s.storage.GetMails(s.username, mailboxName, 0)
+	mails, err := s.storage.GetFolderMails(folder, 0)
 	if err != nil {
 		log.Printf("获取邮件失败: %v", err)
 		// 返回错误而不是空状态，这样IMAP客户端可以知道出现了问题
@@ -354,11 +595,11 @@ func (s *IMAPSession) statusData(mailboxName string, options *imap.StatusOptions
 		}
 
 		if options.UIDNext {
-			statusData.UIDNext = imap.UID(uint32(len(mails)) + 1)
+			statusData.UIDNext = imap.UID(folder.UidNext)
 		}
 
 		if options.UIDValidity {
-			statusData.UIDValidity = 1
+			statusData.UIDValidity = folder.UidValidity
 		}
 
 		if options.NumRecent {
@@ -367,7 +608,12 @@ func (s *IMAPSession) statusData(mailboxName string, options *imap.StatusOptions
 		}
 
 		if options.NumDeleted {
-			numDeleted := uint32(0)
+			var numDeleted uint32
+			for _, mail := range mails {
+				if mail != nil && mailHasFlag(mail, imap.FlagDeleted) {
+					numDeleted++
+				}
+			}
 			statusData.NumDeleted = &numDeleted
 		}
 
@@ -375,14 +621,19 @@ func (s *IMAPSession) statusData(mailboxName string, options *imap.StatusOptions
 			var totalSize int64
 			for _, mail := range mails {
 				if mail != nil {
-					totalSize += int64(len(mail.Body))
+					totalSize += int64(mail.Size)
 				}
 			}
 			statusData.Size = &totalSize
 		}
 
 		if options.DeletedStorage {
-			deletedStorage := int64(0)
+			var deletedStorage int64
+			for _, mail := range mails {
+				if mail != nil && mailHasFlag(mail, imap.FlagDeleted) {
+					deletedStorage += int64(mail.Size)
+				}
+			}
 			statusData.DeletedStorage = &deletedStorage
 		}
 	} else {
@@ -390,8 +641,8 @@ func (s *IMAPSession) statusData(mailboxName string, options *imap.StatusOptions
 		log.Printf("警告: StatusOptions 为 nil，提供默认状态")
 		numMessages := uint32(len(mails))
 		statusData.NumMessages = &numMessages
-		statusData.UIDNext = imap.UID(numMessages + 1)
-		statusData.UIDValidity = 1
+		statusData.UIDNext = imap.UID(folder.UidNext)
+		statusData.UIDValidity = folder.UidValidity
 	}
 
 	log.Printf("邮箱状态: %s - 请求选项: %+v", mailboxName, options)
@@ -407,77 +658,106 @@ func (s *IMAPSession) Append(mailboxName string, r imap.LiteralReader, options *
 	log.Printf("追加邮件到邮箱: %s, 用户: %s", mailboxName, s.username)
 
 	// 获取目标文件夹
-	folder, err := s.storage.folderModel.GetByMailboxIdAndName(s.mailbox.Id, mailboxName, nil)
+	folder, rights, err := s.lookupFolder(mailboxName)
 	if err != nil {
 		return nil, err
 	}
 	if folder == nil {
 		return nil, noSuchMailboxError()
 	}
+	if !model.HasAclRights(rights, model.AclRightInsert) {
+		return nil, noPermError()
+	}
+
+	// 字面量大小已知，先检查大小上限和配额再接收
+	if r.Size() > maxMessageBytes {
+		return nil, tooBigError()
+	}
+	if err := s.storage.checkQuota(folder.MailboxId, r.Size(), 1); err != nil {
+		if errors.Is(err, model.ErrQuotaExceeded) {
+			return nil, overQuotaError()
+		}
+		return nil, err
+	}
 
-	// 读取邮件内容
-	buf := new(strings.Builder)
-	if _, err := io.Copy(buf, r); err != nil {
+	// 邮件内容流式写入blob，只把邮件头读入内存解析
+	blobKey, size, err := s.storage.blobs.Put(r, maxMessageBytes)
+	if err != nil {
+		if errors.Is(err, blob.ErrTooLarge) {
+			return nil, tooBigError()
+		}
 		log.Printf("读取邮件内容失败: %v", err)
 		return nil, err
 	}
-	rawBody := buf.String()
+	defer s.storage.releaseBlob(blobKey)
+	header, err := s.storage.readBlobHeader(blobKey)
+	if err != nil {
+		log.Printf("读取邮件头失败: %v", err)
+		return nil, err
+	}
 
 	// 解析邮件头部
-	from, to, subject := parseEmailHeaders(rawBody)
+	from, to, subject := parseEmailHeaders(header)
+	inReplyTo, references := rawThreadHeaders(header)
+	messageID := rawMessageID(header)
+	if messageID == "" {
+		messageID = generateMessageID(s.storage.domain)
+		log.Printf("🆔 追加的邮件缺少Message-ID，已生成: %s", messageID)
+	}
 
 	// 创建存储邮件对象
 	storedMail := &StoredMail{
 		From:       from,
 		To:         []string{to},
 		Subject:    subject,
-		Body:       rawBody,
+		InReplyTo:  inReplyTo,
+		References: references,
+		BlobKey:    blobKey,
+		Size:       int(size),
 		Received:   time.Now(),
 		IsRead:     false,
 		FolderId:   folder.Id,
 		FolderName: mailboxName,
-		MailboxID:  s.mailbox.Id,
+		MailboxID:  folder.MailboxId,
 		Username:   s.username,
-		MessageID:  fmt.Sprintf("<%d.%s>", time.Now().UnixNano(), s.storage.domain),
+		MessageID:  messageID,
 	}
 
-	// 如果有标志，设置已读状态
+	// 保存APPEND携带的标志，没有相应权限的标志被忽略
 	if options != nil && options.Flags != nil {
-		for _, flag := range options.Flags {
-			if flag == imap.FlagSeen {
-				storedMail.IsRead = true
-				break
-			}
-		}
+		storedMail.Flags = permittedFlags(flagNames(options.Flags), rights)
 	}
 
 	// 保存邮件
 	if err := s.storage.SaveMail(storedMail); err != nil {
+		if errors.Is(err, model.ErrQuotaExceeded) {
+			return nil, overQuotaError()
+		}
 		log.Printf("保存邮件失败: %v", err)
 		return nil, err
 	}
 
 	log.Printf("成功追加邮件到邮箱: %s", mailboxName)
 
-	// 返回追加数据
+	// 返回追加数据 (APPENDUID)
 	appendData := &imap.AppendData{
-		UID: imap.UID(storedMail.ID),
+		UID:         imap.UID(storedMail.UID),
+		UIDValidity: folder.UidValidity,
 	}
 
 	return appendData, nil
 }
 
-// Poll 轮询更新
+// Poll 轮询更新，发送选中文件夹中排队的 EXISTS/FETCH/EXPUNGE
 func (s *IMAPSession) Poll(w *imapserver.UpdateWriter, allowExpunge bool) error {
 	if !s.authenticated {
 		return errors.New("未认证")
 	}
-	if s.selectedFolder == nil || s.mailboxTracker == nil {
+	if s.selectedFolder == nil || s.sessionTracker == nil {
 		return nil
 	}
 
-	log.Printf("轮询邮箱更新: %s, 用户: %s", s.selectedFolder.Name, s.username)
-	return nil
+	return s.sessionTracker.Poll(w, allowExpunge)
 }
 
 // Idle 空闲模式
@@ -485,15 +765,16 @@ func (s *IMAPSession) Idle(w *imapserver.UpdateWriter, stop <-chan struct{}) err
 	if !s.authenticated {
 		return errors.New("未认证")
 	}
-	if s.selectedFolder == nil || s.mailboxTracker == nil {
+	if s.selectedFolder == nil || s.sessionTracker == nil {
+		// 未选中文件夹时没有可推送的更新
+		<-stop
 		return nil
 	}
 
 	log.Printf("进入空闲模式: %s, 用户: %s", s.selectedFolder.Name, s.username)
+	defer log.Printf("退出空闲模式: %s, 用户: %s", s.selectedFolder.Name, s.username)
 
-	<-stop
-	log.Printf("退出空闲模式: %s, 用户: %s", s.selectedFolder.Name, s.username)
-	return nil
+	return s.sessionTracker.Idle(w, stop)
 }
 
 // Unselect 取消选择邮箱
@@ -503,8 +784,10 @@ func (s *IMAPSession) Unselect() error {
 	}
 
 	log.Printf("取消选择邮箱: %s, 用户: %s", s.selectedFolder.Name, s.username)
+	s.closeTracker()
 	s.selectedFolder = nil
-	s.mailboxTracker = nil
+	s.readOnly = false
+	s.searchRes = nil
 	return nil
 }
 
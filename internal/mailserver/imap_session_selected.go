@@ -5,54 +5,125 @@ import (
 	"io"
 	"log"
 	"strings"
-	"time"
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapserver"
-	"github.com/emersion/go-message"
+	"github.com/rankgice/new-email/internal/event"
+	"github.com/rankgice/new-email/internal/model"
 )
 
-// Expunge 删除标记为删除的邮件
+// selectedMails 获取当前选中文件夹的邮件，按UID升序排列，下标+1即为序号
+func (s *IMAPSession) selectedMails() ([]*StoredMail, error) {
+	return s.storage.GetFolderMails(s.selectedFolder, 0)
+}
+
+// numSetMatcher 将请求中的序号或UID集合解析为匹配函数，"*" 代表客户端视图中的最后一封邮件
+func (s *IMAPSession) numSetMatcher(numSet imap.NumSet, mails []*StoredMail) func(seqNum uint32, uid imap.UID) bool {
+	// "$" 引用最近一次 SEARCH RETURN (SAVE) 的结果
+	if imap.IsSearchRes(numSet) {
+		numSet = s.searchRes
+	}
+	// 客户端尚未收到 EXISTS 的新邮件不参与 "*" 的解析
+	var lastSeqNum, lastUid uint32
+	for i := len(mails) - 1; i >= 0; i-- {
+		if seqNum := s.clientSeqNum(uint32(i + 1)); seqNum != 0 {
+			lastSeqNum, lastUid = seqNum, mails[i].UID
+			break
+		}
+	}
+	switch set := numSet.(type) {
+	case imap.SeqSet:
+		var resolved imap.SeqSet
+		last := lastSeqNum
+		for _, r := range set {
+			start, stop, ok := resolveNumRange(r.Start, r.Stop, last)
+			if ok {
+				resolved.AddRange(start, stop)
+			}
+		}
+		return func(seqNum uint32, _ imap.UID) bool {
+			return resolved.Contains(seqNum)
+		}
+	case imap.UIDSet:
+		var resolved imap.UIDSet
+		last := lastUid
+		for _, r := range set {
+			start, stop, ok := resolveNumRange(uint32(r.Start), uint32(r.Stop), last)
+			if ok {
+				resolved.AddRange(imap.UID(start), imap.UID(stop))
+			}
+		}
+		return func(_ uint32, uid imap.UID) bool {
+			return resolved.Contains(uid)
+		}
+	}
+	return func(uint32, imap.UID) bool { return false }
+}
+
+// resolveNumRange 将范围中的 "*"（0）替换为 last，并保证 start <= stop
+func resolveNumRange(start, stop, last uint32) (uint32, uint32, bool) {
+	if last == 0 {
+		return 0, 0, false
+	}
+	if start == 0 {
+		start = last
+	}
+	if stop == 0 {
+		stop = last
+	}
+	if start > stop {
+		start, stop = stop, start
+	}
+	return start, stop, true
+}
+
+// Expunge 永久删除带 \Deleted 标志的邮件，UID EXPUNGE 时只处理给定UID集合内的邮件
+// EXPUNGE 响应经由文件夹跟踪器排队，在命令结束前的 Poll 中按从大到小的序号发送给所有会话
 func (s *IMAPSession) Expunge(w *imapserver.ExpungeWriter, uids *imap.UIDSet) error {
 	if !s.authenticated || s.selectedFolder == nil {
 		return errors.New("未选择邮箱")
 	}
 
-	log.Printf("删除邮件: 用户=%s, 邮箱=%s", s.username, s.selectedFolder.Name)
+	// 只读打开或没有 e 权限时不删除任何邮件（CLOSE 也会走到这里，不能因此失败）
+	if s.readOnly || !model.HasAclRights(s.selectedRights, model.AclRightExpunge) {
+		return nil
+	}
 
-	// 简化实现：获取所有邮件并检查删除标志
-	mails, err := s.storage.GetMails(s.username, s.selectedFolder.Name, 0)
+	mails, err := s.selectedMails()
 	if err != nil {
 		return err
 	}
 
-	var expungedSeqs []uint32
-	for i, mail := range mails {
-		seqNum := uint32(i + 1)
-		uid := imap.UID(mail.ID)
+	var match func(seqNum uint32, uid imap.UID) bool
+	if uids != nil {
+		match = s.numSetMatcher(*uids, mails)
+	}
 
-		// 如果指定了 UID 集合，只处理在集合中的邮件
-		if uids != nil && !uids.Contains(uid) {
+	var expunged []*StoredMail
+	for i, mail := range mails {
+		if match != nil && !match(uint32(i+1), imap.UID(mail.UID)) {
 			continue
 		}
+		if mailHasFlag(mail, imap.FlagDeleted) {
+			expunged = append(expunged, mail)
+		}
+	}
 
-		// 这里应该检查邮件是否标记为删除
-		// 简化实现：假设所有指定的邮件都要删除
-		// 注意：这里需要根据实际的 emailModel.Delete 方法签名来调用
-		// 假设需要传递邮件对象或ID，这里简化处理
-		log.Printf("删除邮件: %s (简化实现，未实际删除)", mail.MessageID)
+	if len(expunged) == 0 {
+		return nil
+	}
 
-		expungedSeqs = append(expungedSeqs, seqNum)
-		if err := w.WriteExpunge(seqNum); err != nil {
-			return err
-		}
+	if err := s.storage.ExpungeMails(expunged); err != nil {
+		log.Printf("❌ 删除邮件失败: %v", err)
+		return err
 	}
 
-	log.Printf("成功删除 %d 封邮件", len(expungedSeqs))
+	log.Printf("🗑️  已永久删除 %d 封邮件: 用户=%s, 邮箱=%s", len(expunged), s.username, s.selectedFolder.Name)
 	return nil
 }
 
-// Search 搜索邮件
+// Search 搜索邮件，条件转换为SQL在数据库中执行
+// 序号、"*" 和 "$"（SEARCHRES）按当前会话视图预先解析为UID
 func (s *IMAPSession) Search(kind imapserver.NumKind, criteria *imap.SearchCriteria, options *imap.SearchOptions) (*imap.SearchData, error) {
 	if !s.authenticated || s.selectedFolder == nil {
 		return nil, errors.New("未选择邮箱")
@@ -60,113 +131,164 @@ func (s *IMAPSession) Search(kind imapserver.NumKind, criteria *imap.SearchCrite
 
 	log.Printf("搜索邮件: 用户=%s, 邮箱=%s, 条件=%v", s.username, s.selectedFolder.Name, criteria)
 
-	// 获取所有邮件
-	mails, err := s.storage.GetMails(s.username, s.selectedFolder.Name, 0)
+	folderUids, err := s.storage.emailModel.GetUidsByFolderId(s.selectedFolder.Id)
 	if err != nil {
 		return nil, err
 	}
 
-	var results []uint32
-	for i, mail := range mails {
-		seqNum := uint32(i + 1)
-		uid := imap.UID(mail.ID)
-
-		// 简化的搜索实现
-		if s.matchSearchCriteria(mail, criteria) {
-			if kind == imapserver.NumKindSeq {
-				results = append(results, seqNum)
-			} else { // UID
-				results = append(results, uint32(uid))
-			}
+	// 会话当前可见的邮件：客户端序号 -> UID
+	view := make([]searchViewEntry, 0, len(folderUids))
+	seqByUid := make(map[uint32]uint32, len(folderUids))
+	for i, uid := range folderUids {
+		seqNum := s.clientSeqNum(uint32(i + 1))
+		if seqNum == 0 {
+			continue
 		}
+		view = append(view, searchViewEntry{seqNum: seqNum, uid: uid})
+		seqByUid[uid] = seqNum
 	}
 
-	// 转换为 NumSet
-	var searchData *imap.SearchData
-	if kind == imapserver.NumKindSeq {
-		seqSet := make(imap.SeqSet, 0)
-		for _, num := range results {
-			seqSet = append(seqSet, imap.SeqRange{Start: num, Stop: num})
+	var lastUid uint32
+	if len(view) > 0 {
+		lastUid = view[len(view)-1].uid
+	}
+	resolved := s.resolveSearchCriteria(criteria, view, lastUid)
+
+	matched, err := s.storage.emailModel.Search(s.selectedFolder.Id, &resolved, s.storage.contentMatcher())
+	if err != nil {
+		log.Printf("搜索邮件失败: %v", err)
+		return nil, err
+	}
+
+	// 只返回会话已知的邮件，尚未通过 EXISTS 通知的新邮件不出现在结果中
+	var nums, uids []uint32
+	for _, uid := range matched {
+		seqNum, ok := seqByUid[uid]
+		if !ok {
+			continue
 		}
-		searchData = &imap.SearchData{
-			All: seqSet,
+		uids = append(uids, uid)
+		if kind == imapserver.NumKindSeq {
+			nums = append(nums, seqNum)
+		} else {
+			nums = append(nums, uid)
 		}
-	} else {
-		uidSet := make(imap.UIDSet, 0)
-		for _, num := range results {
-			uidSet = append(uidSet, imap.UIDRange{Start: imap.UID(num), Stop: imap.UID(num)})
+	}
+
+	// SORT/THREAD：结果由连接写出，SEARCH 响应留空以便整行替换
+	if ic, req := s.sortCommand(); req != nil {
+		result, err := s.sortResult(req, kind, uids, seqByUid)
+		if err != nil {
+			log.Printf("排序邮件失败: %v", err)
+			return nil, err
 		}
-		searchData = &imap.SearchData{
-			All: uidSet,
+		ic.mu.Lock()
+		req.result = result
+		ic.mu.Unlock()
+		if kind == imapserver.NumKindSeq {
+			return &imap.SearchData{All: imap.SeqSet{}}, nil
 		}
+		return &imap.SearchData{All: imap.UIDSet{}}, nil
 	}
 
-	log.Printf("搜索结果: %d 封邮件", len(results))
+	// SEARCHRES：保存结果供后续命令以 "$" 引用，始终按UID保存
+	if options != nil && options.ReturnSave {
+		s.searchRes = imap.UIDSet{}
+		for _, uid := range uids {
+			s.searchRes.AddNum(imap.UID(uid))
+		}
+	}
+
+	searchData := &imap.SearchData{Count: uint32(len(nums))}
+	if kind == imapserver.NumKindSeq {
+		seqSet := imap.SeqSet{}
+		seqSet.AddNum(nums...)
+		searchData.All = seqSet
+	} else {
+		uidSet := imap.UIDSet{}
+		for _, num := range nums {
+			uidSet.AddNum(imap.UID(num))
+		}
+		searchData.All = uidSet
+	}
+	if len(nums) > 0 {
+		searchData.Min = nums[0]
+		searchData.Max = nums[len(nums)-1]
+	}
+
+	log.Printf("搜索结果: %d 封邮件", len(nums))
 	return searchData, nil
 }
 
-// matchSearchCriteria 简化的搜索条件匹配
-func (s *IMAPSession) matchSearchCriteria(mail *StoredMail, criteria *imap.SearchCriteria) bool {
-	// 简化实现，只检查一些基本条件
-
-	// 检查头部字段
-	if len(criteria.Header) > 0 {
-		for _, headerField := range criteria.Header {
-			switch strings.ToLower(headerField.Key) {
-			case "subject":
-				if !strings.Contains(strings.ToLower(mail.Subject), strings.ToLower(headerField.Value)) {
-					return false
-				}
-			case "from":
-				if !strings.Contains(strings.ToLower(mail.From), strings.ToLower(headerField.Value)) {
-					return false
-				}
-			case "to":
-				found := false
-				searchTo := strings.ToLower(headerField.Value)
-				for _, to := range mail.To {
-					if strings.Contains(strings.ToLower(to), searchTo) {
-						found = true
-						break
-					}
-				}
-				if !found {
-					return false
-				}
+// searchViewEntry 会话视图中的一封邮件
+type searchViewEntry struct {
+	seqNum uint32
+	uid    uint32
+}
+
+// resolveSearchCriteria 将序号集合转换为UID集合，并解析UID集合中的 "*" 和 "$"
+// 结果中的UID集合只包含明确的范围，可直接转换为SQL条件
+func (s *IMAPSession) resolveSearchCriteria(criteria *imap.SearchCriteria, view []searchViewEntry, lastUid uint32) imap.SearchCriteria {
+	resolved := *criteria
+	resolved.SeqNum = nil
+	resolved.UID = nil
+
+	var lastSeq uint32
+	if len(view) > 0 {
+		lastSeq = view[len(view)-1].seqNum
+	}
+	for _, seqSet := range criteria.SeqNum {
+		var ranges imap.SeqSet
+		for _, r := range seqSet {
+			if start, stop, ok := resolveNumRange(r.Start, r.Stop, lastSeq); ok {
+				ranges.AddRange(start, stop)
 			}
 		}
-	}
-
-	// 检查正文
-	if len(criteria.Body) > 0 {
-		for _, bodyText := range criteria.Body {
-			if !strings.Contains(strings.ToLower(mail.Body), strings.ToLower(bodyText)) {
-				return false
+		uidSet := imap.UIDSet{}
+		for _, entry := range view {
+			if ranges.Contains(entry.seqNum) {
+				uidSet.AddNum(imap.UID(entry.uid))
 			}
 		}
+		resolved.UID = append(resolved.UID, uidSet)
 	}
 
-	// 检查文本（主题+正文）
-	if len(criteria.Text) > 0 {
-		for _, text := range criteria.Text {
-			searchText := strings.ToLower(text)
-			if !strings.Contains(strings.ToLower(mail.Subject), searchText) &&
-				!strings.Contains(strings.ToLower(mail.Body), searchText) {
-				return false
+	for _, uidSet := range criteria.UID {
+		if imap.IsSearchRes(uidSet) {
+			resolved.UID = append(resolved.UID, append(imap.UIDSet{}, s.searchRes...))
+			continue
+		}
+		ranges := imap.UIDSet{}
+		for _, r := range uidSet {
+			if start, stop, ok := resolveNumRange(uint32(r.Start), uint32(r.Stop), lastUid); ok {
+				ranges.AddRange(imap.UID(start), imap.UID(stop))
 			}
 		}
+		resolved.UID = append(resolved.UID, ranges)
 	}
 
-	// 检查标志
-	if len(criteria.Flag) > 0 {
-		for _, flag := range criteria.Flag {
-			if flag == imap.FlagSeen && !mail.IsRead {
-				return false
-			}
+	resolved.Not = make([]imap.SearchCriteria, len(criteria.Not))
+	for i := range criteria.Not {
+		resolved.Not[i] = s.resolveSearchCriteria(&criteria.Not[i], view, lastUid)
+	}
+	resolved.Or = make([][2]imap.SearchCriteria, len(criteria.Or))
+	for i := range criteria.Or {
+		resolved.Or[i] = [2]imap.SearchCriteria{
+			s.resolveSearchCriteria(&criteria.Or[i][0], view, lastUid),
+			s.resolveSearchCriteria(&criteria.Or[i][1], view, lastUid),
 		}
 	}
+	return resolved
+}
 
-	return true
+// mailHasFlag 判断邮件是否带有指定标志（不区分大小写）
+func mailHasFlag(mail *StoredMail, flag imap.Flag) bool {
+	for _, f := range mail.Flags {
+		if strings.EqualFold(f, string(flag)) {
+			return true
+		}
+	}
+	return false
 }
 
 // Fetch 获取邮件
@@ -178,39 +300,37 @@ func (s *IMAPSession) Fetch(w *imapserver.FetchWriter, numSet imap.NumSet, optio
 	log.Printf("获取邮件: 用户=%s, 邮箱=%s", s.username, s.selectedFolder.Name)
 
 	// 获取所有邮件
-	mails, err := s.storage.GetMails(s.username, s.selectedFolder.Name, 0)
+	mails, err := s.selectedMails()
 	if err != nil {
 		return err
 	}
+	contains := s.numSetMatcher(numSet, mails)
 
 	// 遍历邮件并处理在 numSet 中的邮件
 	for i, mail := range mails {
-		seqNum := uint32(i + 1)
-		uid := imap.UID(mail.ID)
+		seqNum := s.clientSeqNum(uint32(i + 1))
+		if seqNum == 0 {
+			continue
+		}
+		uid := imap.UID(mail.UID)
 
 		// 检查是否在请求的集合中
-		var contains bool
-		if seqSet, ok := numSet.(imap.SeqSet); ok {
-			contains = seqSet.Contains(seqNum)
-		} else if uidSet, ok := numSet.(imap.UIDSet); ok {
-			contains = uidSet.Contains(uid)
-		}
-		if !contains {
+		if !contains(seqNum, uid) {
 			continue
 		}
 
 		// 创建 FetchWriter 并写入邮件数据
 		fetchData := w.CreateMessage(seqNum)
+		raw := &rawMessageCache{storage: s.storage, mail: mail}
 
 		// 处理请求的项目
 		if options.Envelope {
-			envelope := s.buildEnvelope(mail)
+			envelope := s.buildEnvelope(mail, raw)
 			fetchData.WriteEnvelope(envelope)
 		}
 
 		if options.BodyStructure != nil {
-			bodyStructure := s.buildBodyStructure(mail)
-			fetchData.WriteBodyStructure(bodyStructure)
+			fetchData.WriteBodyStructure(imapserver.ExtractBodyStructure(raw.reader()))
 		}
 
 		if options.Flags {
@@ -223,36 +343,31 @@ func (s *IMAPSession) Fetch(w *imapserver.FetchWriter, numSet imap.NumSet, optio
 		}
 
 		if options.RFC822Size {
-			fetchData.WriteRFC822Size(int64(len(mail.Body)))
+			fetchData.WriteRFC822Size(raw.size())
 		}
 
 		if options.UID {
 			fetchData.WriteUID(uid)
 		}
 
-		// 处理 BodySection
-		if len(options.BodySection) > 0 {
-			// 当客户端请求邮件正文时，自动标记为已读
-			if !mail.IsRead {
-				if err := s.storage.MarkAsRead(s.username, mail.MessageID); err != nil {
-					log.Printf("自动标记邮件已读失败: %v", err)
-				} else {
-					log.Printf("邮件 %s 已自动标记为已读", mail.MessageID)
-					mail.IsRead = true // 更新内存中的状态以反映到flags
-				}
+		// 当客户端请求邮件正文（非BODY.PEEK/BINARY.PEEK）时，自动标记为已读，共享文件夹需要 s 权限，EXAMINE 打开时不修改
+		if !s.readOnly && !mail.IsRead && fetchSetsSeen(options) && model.HasAclRights(s.selectedRights, model.AclRightSeen) {
+			if err := s.storage.emailModel.MarkAsRead(mail.ID); err != nil {
+				log.Printf("自动标记邮件已读失败: %v", err)
+			} else {
+				log.Printf("邮件 %s 已自动标记为已读", mail.MessageID)
+				// 更新内存中的状态以反映到flags
+				mail.IsRead = true
+				mail.Flags = append([]string{model.FlagSeen}, mail.Flags...)
+				// 隐式设置的 \Seen 也需要通知当前会话
+				s.storage.events.Publish(s.storage.mailEvent(event.TypeFlags, mail))
 			}
+		}
 
-			for _, item := range options.BodySection {
-				body := s.buildEmailBody(mail)
-				literal := fetchData.WriteBodySection(item, int64(len(mail.Body)))
-				if _, err := io.Copy(literal, body); err != nil {
-					literal.Close()
-					return err
-				}
-				if err := literal.Close(); err != nil {
-					return err
-				}
-			}
+		err := writeFetchSections(fetchData, options, raw)
+		raw.close()
+		if err != nil {
+			return err
 		}
 
 		if err := fetchData.Close(); err != nil {
@@ -263,65 +378,113 @@ func (s *IMAPSession) Fetch(w *imapserver.FetchWriter, numSet imap.NumSet, optio
 	return nil
 }
 
-// buildEnvelope 构建邮件信封
-func (s *IMAPSession) buildEnvelope(mail *StoredMail) *imap.Envelope {
-	return &imap.Envelope{
-		Date:      mail.Received,
-		Subject:   mail.Subject,
-		From:      s.parseAddressList(mail.From),
-		To:        s.parseAddressListList(mail.To),
-		Cc:        s.parseAddressListList(mail.Cc),
-		Bcc:       s.parseAddressListList(mail.Bcc),
-		MessageID: mail.MessageID,
+// writeFetchSections 写入请求的正文段和 BINARY 段
+func writeFetchSections(fetchData *imapserver.FetchResponseWriter, options *imap.FetchOptions, raw *rawMessageCache) error {
+	for _, item := range options.BodySection {
+		if err := writeBodySection(fetchData, item, raw); err != nil {
+			return err
+		}
 	}
-}
 
-// buildBodyStructure 构建邮件体结构
-func (s *IMAPSession) buildBodyStructure(mail *StoredMail) imap.BodyStructure {
-	r := strings.NewReader(mail.Body)
-	entity, err := message.Read(r)
-	if err != nil {
-		log.Printf("解析邮件实体失败: %v", err)
-		return &imap.BodyStructureSinglePart{
-			Type:    "text",
-			Subtype: "plain",
-			Size:    uint32(len(mail.Body)),
+	// BINARY[] 返回解码 Content-Transfer-Encoding 后的内容
+	for _, item := range options.BinarySection {
+		section := imapserver.ExtractBinarySection(raw.reader(), item)
+		if err := writeFetchLiteral(fetchData.WriteBinarySection(item, int64(len(section))), section); err != nil {
+			return err
 		}
 	}
 
-	mediaType, params, err := entity.Header.ContentType()
-	if err != nil {
-		log.Printf("解析邮件Content-Type失败: %v", err)
-		return &imap.BodyStructureSinglePart{
-			Type:    "text",
-			Subtype: "plain",
-			Size:    uint32(len(mail.Body)),
+	for _, item := range options.BinarySectionSize {
+		fetchData.WriteBinarySectionSize(item, imapserver.ExtractBinarySectionSize(raw.reader(), item))
+	}
+	return nil
+}
+
+// writeBodySection 写入正文段：BODY[] 和 BODY[TEXT] 直接从原文流式输出，
+// 其余段（段号、HEADER.FIELDS 等）按解析结果输出，<partial> 在两种方式下都按字节截取
+func writeBodySection(fetchData *imapserver.FetchResponseWriter, item *imap.FetchItemBodySection, raw *rawMessageCache) error {
+	if len(item.Part) > 0 || (item.Specifier != imap.PartSpecifierNone && item.Specifier != imap.PartSpecifierText) {
+		return writeParsedBodySection(fetchData, item, raw)
+	}
+	var offset int64
+	if item.Specifier == imap.PartSpecifierText {
+		offset = raw.headerSize()
+	}
+
+	size := raw.size() - offset
+	if item.Partial != nil {
+		if item.Partial.Offset > size {
+			offset, size = 0, 0
+		} else {
+			offset += item.Partial.Offset
+			size = min(size-item.Partial.Offset, item.Partial.Size)
 		}
 	}
 
-	mainType, subType, ok := strings.Cut(mediaType, "/")
-	if !ok {
-		log.Printf("无效的Content-Type格式: %s", mediaType)
-		return &imap.BodyStructureSinglePart{
-			Type:    "text",
-			Subtype: "plain",
-			Size:    uint32(len(mail.Body)),
+	r := raw.reader()
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	literal := fetchData.WriteBodySection(item, size)
+	if _, err := io.CopyN(literal, r, size); err != nil {
+		literal.Close()
+		return err
+	}
+	return literal.Close()
+}
+
+// writeParsedBodySection 按段号、HEADER.FIELDS 等解析截取正文段，<partial> 由解析函数处理
+func writeParsedBodySection(fetchData *imapserver.FetchResponseWriter, item *imap.FetchItemBodySection, raw *rawMessageCache) error {
+	section := imapserver.ExtractBodySection(raw.reader(), item)
+	return writeFetchLiteral(fetchData.WriteBodySection(item, int64(len(section))), section)
+}
+
+// fetchSetsSeen 判断 FETCH 是否读取了正文，BODY.PEEK 和 BINARY.PEEK 不设置 \Seen
+func fetchSetsSeen(options *imap.FetchOptions) bool {
+	for _, section := range options.BodySection {
+		if !section.Peek {
+			return true
+		}
+	}
+	for _, section := range options.BinarySection {
+		if !section.Peek {
+			return true
 		}
 	}
+	return false
+}
 
-	return &imap.BodyStructureSinglePart{
-		Type:    mainType,
-		Subtype: subType,
-		Params:  params,
-		Size:    uint32(len(mail.Body)),
+// writeFetchLiteral 写入正文段字面量并关闭
+func writeFetchLiteral(literal io.WriteCloser, data []byte) error {
+	if _, err := literal.Write(data); err != nil {
+		literal.Close()
+		return err
 	}
+	return literal.Close()
+}
+
+// buildEnvelope 构建邮件信封，日期取原文的 Date 邮件头，缺失时退回接收时间
+func (s *IMAPSession) buildEnvelope(mail *StoredMail, raw *rawMessageCache) *imap.Envelope {
+	envelope := &imap.Envelope{
+		Date:      raw.date(),
+		Subject:   mail.Subject,
+		From:      s.parseAddressList(mail.From),
+		To:        s.parseAddressListList(mail.To),
+		Cc:        s.parseAddressListList(mail.Cc),
+		Bcc:       s.parseAddressListList(mail.Bcc),
+		MessageID: mail.MessageID,
+	}
+	if mail.InReplyTo != "" {
+		envelope.InReplyTo = []string{mail.InReplyTo}
+	}
+	return envelope
 }
 
 // buildFlags 构建邮件标志
 func (s *IMAPSession) buildFlags(mail *StoredMail) []imap.Flag {
-	var flags []imap.Flag
-	if mail.IsRead {
-		flags = append(flags, imap.FlagSeen)
+	flags := make([]imap.Flag, 0, len(mail.Flags))
+	for _, flag := range mail.Flags {
+		flags = append(flags, imap.Flag(flag))
 	}
 	return flags
 }
@@ -355,64 +518,73 @@ func (s *IMAPSession) parseAddressListList(emails []string) []imap.Address {
 	return addresses
 }
 
-// buildEmailBody 构建邮件体
-func (s *IMAPSession) buildEmailBody(mail *StoredMail) io.Reader {
-	return strings.NewReader(mail.Body)
-}
-
 // Store 存储邮件标志
 func (s *IMAPSession) Store(w *imapserver.FetchWriter, numSet imap.NumSet, flags *imap.StoreFlags, options *imap.StoreOptions) error {
 	if !s.authenticated || s.selectedFolder == nil {
 		return errors.New("未选择邮箱")
 	}
 
+	// EXAMINE 打开的邮箱只读
+	if s.readOnly {
+		return &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCode("READ-ONLY"),
+			Text: "Mailbox is read-only",
+		}
+	}
+
 	log.Printf("存储邮件标志: 用户=%s, 邮箱=%s", s.username, s.selectedFolder.Name)
 
+	// 没有相应权限的标志被忽略，一个都不能修改时拒绝
+	storeFlags := permittedFlags(flagNames(flags.Flags), s.selectedRights)
+	if len(storeFlags) == 0 && len(flags.Flags) > 0 {
+		return noPermError()
+	}
+
 	// 获取所有邮件
-	mails, err := s.storage.GetMails(s.username, s.selectedFolder.Name, 0)
+	mails, err := s.selectedMails()
 	if err != nil {
 		return err
 	}
+	contains := s.numSetMatcher(numSet, mails)
 
 	// 遍历邮件并处理在 numSet 中的邮件
 	for i, mail := range mails {
-		seqNum := uint32(i + 1)
-		uid := imap.UID(mail.ID)
+		seqNum := s.clientSeqNum(uint32(i + 1))
+		if seqNum == 0 {
+			continue
+		}
+		uid := imap.UID(mail.UID)
 
 		// 检查是否在请求的集合中
-		var contains bool
-		if seqSet, ok := numSet.(imap.SeqSet); ok {
-			contains = seqSet.Contains(seqNum)
-		} else if uidSet, ok := numSet.(imap.UIDSet); ok {
-			contains = uidSet.Contains(uid)
-		}
-		if !contains {
+		if !contains(seqNum, uid) {
 			continue
 		}
 
 		// 处理标志更新
-		if flags != nil {
-			for _, flag := range flags.Flags {
-				if flag == imap.FlagSeen {
-					switch flags.Op {
-					case imap.StoreFlagsSet:
-						// 标记为已读
-						if err := s.storage.MarkAsRead(s.username, mail.MessageID); err != nil {
-							log.Printf("标记邮件已读失败: %v", err)
-						}
-					default:
-						// 其他操作 (简化实现)
-						log.Printf("邮件标志操作: %s (简化实现)", mail.MessageID)
-					}
-				}
-			}
+		email, err := s.storage.emailModel.GetById(mail.ID)
+		if err != nil {
+			log.Printf("获取邮件失败 (ID: %d): %v", mail.ID, err)
+			return err
+		}
+		op := storeFlagOp(flags.Op)
+		if op == model.FlagOpReplace {
+			// 替换时保留没有权限修改的原有标志
+			storeFlags = append(permittedFlags(flagNames(flags.Flags), s.selectedRights), lockedFlags(email.Flags(), s.selectedRights)...)
+		}
+		email.ApplyFlags(op, storeFlags)
+		if err := s.storage.emailModel.UpdateFlags(email); err != nil {
+			log.Printf("更新邮件标志失败 (ID: %d): %v", mail.ID, err)
+			return err
 		}
+		mail.IsRead = email.IsRead
+		mail.Flags = email.Flags()
+		s.publishFlags(mail)
 
 		// 如果需要返回更新后的标志
-		if options != nil && !flags.Silent {
+		if !flags.Silent {
 			fetchData := w.CreateMessage(seqNum)
-			updatedFlags := s.buildFlags(mail)
-			fetchData.WriteFlags(updatedFlags)
+			fetchData.WriteFlags(s.buildFlags(mail))
 			if err := fetchData.Close(); err != nil {
 				return err
 			}
@@ -422,7 +594,46 @@ func (s *IMAPSession) Store(w *imapserver.FetchWriter, numSet imap.NumSet, flags
 	return nil
 }
 
-// Copy 复制邮件
+// publishFlags 通知其他会话邮件标志已变更，当前会话自己的 FETCH 响应已包含新标志
+func (s *IMAPSession) publishFlags(mail *StoredMail) {
+	e := s.storage.mailEvent(event.TypeFlags, mail)
+	e.Origin = s.sessionTracker
+	s.storage.events.Publish(e)
+}
+
+// lockedFlags 返回没有权限修改的标志，替换标志时需要保留
+func lockedFlags(flags []string, rights string) []string {
+	var locked []string
+	for _, flag := range flags {
+		if !model.HasAclRights(rights, flagRight(flag)) {
+			locked = append(locked, flag)
+		}
+	}
+	return locked
+}
+
+// storeFlagOp 将STORE操作转换为标志修改方式
+func storeFlagOp(op imap.StoreFlagsOp) model.FlagOp {
+	switch op {
+	case imap.StoreFlagsAdd:
+		return model.FlagOpAdd
+	case imap.StoreFlagsDel:
+		return model.FlagOpRemove
+	default:
+		return model.FlagOpReplace
+	}
+}
+
+// flagNames 将IMAP标志转换为字符串
+func flagNames(flags []imap.Flag) []string {
+	names := make([]string, 0, len(flags))
+	for _, flag := range flags {
+		names = append(names, string(flag))
+	}
+	return names
+}
+
+// Copy 复制邮件，副本保留原邮件的 Message-ID、标志和内部日期
 func (s *IMAPSession) Copy(numSet imap.NumSet, destMailbox string) (*imap.CopyData, error) {
 	if !s.authenticated || s.selectedFolder == nil {
 		return nil, errors.New("未选择邮箱")
@@ -431,76 +642,173 @@ func (s *IMAPSession) Copy(numSet imap.NumSet, destMailbox string) (*imap.CopyDa
 	log.Printf("复制邮件: 从=%s 到=%s, 用户=%s", s.selectedFolder.Name, destMailbox, s.username)
 
 	// 获取目标文件夹
-	destFolder, err := s.storage.folderModel.GetByMailboxIdAndName(s.mailbox.Id, destMailbox, nil)
+	destFolder, destRights, err := s.lookupFolder(destMailbox)
 	if err != nil {
 		return nil, err
 	}
 	if destFolder == nil {
-		return nil, errors.New("目标邮箱不存在")
+		return nil, tryCreateError()
+	}
+	if !model.HasAclRights(destRights, model.AclRightInsert) {
+		return nil, noPermError()
 	}
 
 	// 获取源邮件
-	sourceMails, err := s.storage.GetMails(s.username, s.selectedFolder.Name, 0)
+	sourceMails, err := s.selectedMails()
 	if err != nil {
 		return nil, err
 	}
+	contains := s.numSetMatcher(numSet, sourceMails)
 
-	var copiedUIDs []imap.UID
-
-	// 遍历并复制符合条件的邮件
+	// 收集符合条件的邮件，整体超出配额时不复制任何邮件
+	var toCopy []*StoredMail
+	var totalSize int64
 	for i, mail := range sourceMails {
-		seqNum := uint32(i + 1)
-		uid := imap.UID(mail.ID)
-
-		// 检查是否在请求的集合中
-		var contains bool
-		if seqSet, ok := numSet.(imap.SeqSet); ok {
-			contains = seqSet.Contains(seqNum)
-		} else if uidSet, ok := numSet.(imap.UIDSet); ok {
-			contains = uidSet.Contains(uid)
-		}
-		if !contains {
+		seqNum := s.clientSeqNum(uint32(i + 1))
+		if seqNum == 0 {
 			continue
 		}
+		if contains(seqNum, imap.UID(mail.UID)) {
+			toCopy = append(toCopy, mail)
+			totalSize += int64(mail.Size)
+		}
+	}
+	if len(toCopy) > 0 {
+		if err := s.storage.checkQuota(destFolder.MailboxId, totalSize, int64(len(toCopy))); err != nil {
+			if errors.Is(err, model.ErrQuotaExceeded) {
+				return nil, overQuotaError()
+			}
+			return nil, err
+		}
+	}
 
+	// 任一封复制失败时撤销已复制的邮件并返回错误，不留下部分复制的结果
+	var sourceUIDs, copiedUIDs []imap.UID
+	var copied []*StoredMail
+	for _, mail := range toCopy {
 		// 创建新的邮件副本
 		copiedMail := &StoredMail{
-			MessageID:   generateMessageID(s.storage.domain),
+			MessageID:   mail.MessageID,
+			InReplyTo:   mail.InReplyTo,
+			References:  mail.References,
 			From:        mail.From,
 			To:          mail.To,
 			Cc:          mail.Cc,
 			Bcc:         mail.Bcc,
 			Subject:     mail.Subject,
 			Body:        mail.Body,
+			BlobKey:     mail.BlobKey,
 			ContentType: mail.ContentType,
 			Size:        mail.Size,
-			Received:    time.Now(),
-			IsRead:      false, // 复制的邮件默认为未读
+			Received:    mail.Received,
+			IsRead:      mail.IsRead && model.HasAclRights(destRights, model.AclRightSeen),
+			Flags:       permittedFlags(mail.Flags, destRights),
 			FolderId:    destFolder.Id,
-			FolderName:  destFolder.Name,
-			MailboxID:   s.mailbox.Id,
+			FolderName:  destMailbox,
+			MailboxID:   destFolder.MailboxId,
 			Username:    s.username,
 		}
 
 		if err := s.storage.SaveMail(copiedMail); err != nil {
-			log.Printf("复制邮件失败: %v", err)
-			continue
+			log.Printf("❌ 复制邮件失败: %v", err)
+			if len(copied) > 0 {
+				if rollbackErr := s.storage.ExpungeMails(copied); rollbackErr != nil {
+					log.Printf("❌ 撤销已复制的 %d 封邮件失败: %v", len(copied), rollbackErr)
+				}
+			}
+			if errors.Is(err, model.ErrQuotaExceeded) {
+				return nil, overQuotaError()
+			}
+			return nil, err
 		}
 
-		copiedUIDs = append(copiedUIDs, imap.UID(copiedMail.ID))
-		log.Printf("成功复制邮件: %s -> %s", mail.MessageID, copiedMail.MessageID)
+		copied = append(copied, copiedMail)
+		sourceUIDs = append(sourceUIDs, imap.UID(mail.UID))
+		copiedUIDs = append(copiedUIDs, imap.UID(copiedMail.UID))
+		log.Printf("成功复制邮件: %s -> %s", mail.MessageID, destFolder.Name)
 	}
 
-	// 构建返回数据
-	copyData := &imap.CopyData{}
+	// 构建返回数据 (COPYUID)
+	copyData := &imap.CopyData{UIDValidity: destFolder.UidValidity}
 	if len(copiedUIDs) > 0 {
-		uidSet := make(imap.UIDSet, 0, len(copiedUIDs))
-		for _, uid := range copiedUIDs {
-			uidSet = append(uidSet, imap.UIDRange{Start: uid, Stop: uid})
-		}
-		copyData.DestUIDs = uidSet
+		copyData.SourceUIDs = imap.UIDSetNum(sourceUIDs...)
+		copyData.DestUIDs = imap.UIDSetNum(copiedUIDs...)
 	}
 
 	log.Printf("成功复制 %d 封邮件", len(copiedUIDs))
 	return copyData, nil
 }
+
+// Move 移动邮件 (RFC 6851)，直接修改邮件所属文件夹并分配新UID，标志保持不变
+// 源文件夹的 EXPUNGE 经由文件夹跟踪器在命令结束前发送
+func (s *IMAPSession) Move(w *imapserver.MoveWriter, numSet imap.NumSet, destMailbox string) error {
+	if !s.authenticated || s.selectedFolder == nil {
+		return errors.New("未选择邮箱")
+	}
+	if s.readOnly {
+		return &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeCannot,
+			Text: "Mailbox is read-only",
+		}
+	}
+
+	log.Printf("移动邮件: 从=%s 到=%s, 用户=%s", s.selectedFolder.Name, destMailbox, s.username)
+
+	// 移出需要源文件夹的 t 和 e 权限，移入需要目标文件夹的 i 权限
+	if !model.HasAclRights(s.selectedRights, model.AclRightDeleteMsg+model.AclRightExpunge) {
+		return noPermError()
+	}
+	destFolder, destRights, err := s.lookupFolder(destMailbox)
+	if err != nil {
+		return err
+	}
+	if destFolder == nil {
+		return tryCreateError()
+	}
+	if !model.HasAclRights(destRights, model.AclRightInsert) {
+		return noPermError()
+	}
+
+	mails, err := s.selectedMails()
+	if err != nil {
+		return err
+	}
+	contains := s.numSetMatcher(numSet, mails)
+
+	var moved []*StoredMail
+	var sourceUIDs []imap.UID
+	for i, mail := range mails {
+		seqNum := s.clientSeqNum(uint32(i + 1))
+		if seqNum == 0 || !contains(seqNum, imap.UID(mail.UID)) {
+			continue
+		}
+		moved = append(moved, mail)
+		sourceUIDs = append(sourceUIDs, imap.UID(mail.UID))
+	}
+
+	if len(moved) == 0 {
+		return nil
+	}
+
+	destUIDs, err := s.storage.MoveMails(moved, destFolder)
+	if err != nil {
+		if errors.Is(err, model.ErrQuotaExceeded) {
+			return overQuotaError()
+		}
+		log.Printf("❌ 移动邮件失败: %v", err)
+		return err
+	}
+
+	copiedUIDs := make([]imap.UID, 0, len(destUIDs))
+	for _, uid := range destUIDs {
+		copiedUIDs = append(copiedUIDs, imap.UID(uid))
+	}
+
+	log.Printf("成功移动 %d 封邮件: %s -> %s", len(moved), s.selectedFolder.Name, destFolder.Name)
+	return w.WriteCopyData(&imap.CopyData{
+		UIDValidity: destFolder.UidValidity,
+		SourceUIDs:  imap.UIDSetNum(sourceUIDs...),
+		DestUIDs:    imap.UIDSetNum(copiedUIDs...),
+	})
+}
@@ -0,0 +1,465 @@
+package mailserver
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/rankgice/new-email/internal/model"
+)
+
+// SORT 和 THREAD（RFC 5256）在连接层改写为 SEARCH：imapserver 照常解析搜索条件并调用 Search，
+// Search 发现当前命令来自 SORT/THREAD 时按排序条件或会话算法组织结果并交给连接，
+// 连接再把 imapserver 写出的 "* SEARCH" 响应替换为 "* SORT"/"* THREAD" 响应。
+
+// sortRequest 改写为 SEARCH 的 SORT/THREAD 命令
+type sortRequest struct {
+	name      string   // SORT 或 THREAD
+	keys      []string // SORT 的排序条件（大写），REVERSE 作用于其后的条件
+	algorithm string   // THREAD 的会话算法（大写）
+	result    string   // Search 生成的响应行，由连接替换 "* SEARCH"
+}
+
+// sortKeys 支持的排序条件
+var sortKeys = map[string]bool{
+	"ARRIVAL": true,
+	"CC":      true,
+	"DATE":    true,
+	"FROM":    true,
+	"SIZE":    true,
+	"SUBJECT": true,
+	"TO":      true,
+}
+
+// parseSortCommand 解析 SORT/THREAD 命令首行，改写为带 CHARSET 的 SEARCH 命令
+// 不是 SORT/THREAD 命令或无法解析时返回nil，原样交给 imapserver 返回 BAD
+func parseSortCommand(line []byte) (*sortRequest, []byte) {
+	tag, rest, ok := strings.Cut(string(line), " ")
+	if !ok {
+		return nil, nil
+	}
+	prefix := tag + " "
+	name, rest, ok := strings.Cut(rest, " ")
+	if !ok {
+		return nil, nil
+	}
+	if strings.EqualFold(name, "UID") {
+		prefix += name + " "
+		if name, rest, ok = strings.Cut(rest, " "); !ok {
+			return nil, nil
+		}
+	}
+
+	req := &sortRequest{name: strings.ToUpper(name)}
+	switch req.name {
+	case "SORT":
+		end := strings.IndexByte(rest, ')')
+		if !strings.HasPrefix(rest, "(") || end < 0 {
+			return nil, nil
+		}
+		req.keys = strings.Fields(strings.ToUpper(rest[1:end]))
+		if !validSortKeys(req.keys) {
+			return nil, nil
+		}
+		rest = strings.TrimPrefix(rest[end+1:], " ")
+	case "THREAD":
+		var algorithm string
+		if algorithm, rest, ok = strings.Cut(rest, " "); !ok {
+			return nil, nil
+		}
+		req.algorithm = strings.ToUpper(algorithm)
+		if req.algorithm != string(imap.ThreadOrderedSubject) && req.algorithm != string(imap.ThreadReferences) {
+			return nil, nil
+		}
+	default:
+		return nil, nil
+	}
+	// 剩余部分为字符集和搜索条件，与 SEARCH CHARSET 的语法相同
+	if strings.TrimSpace(rest) == "" {
+		return nil, nil
+	}
+	return req, []byte(prefix + "SEARCH CHARSET " + rest)
+}
+
+// validSortKeys 排序条件非空，REVERSE 之后必须是排序条件
+func validSortKeys(keys []string) bool {
+	if len(keys) == 0 {
+		return false
+	}
+	for i, key := range keys {
+		if key == "REVERSE" {
+			if i+1 == len(keys) || keys[i+1] == "REVERSE" {
+				return false
+			}
+			continue
+		}
+		if !sortKeys[key] {
+			return false
+		}
+	}
+	return true
+}
+
+// sortCommand 返回当前 SEARCH 对应的 SORT/THREAD 请求，普通 SEARCH 返回nil
+func (s *IMAPSession) sortCommand() (*imapConn, *sortRequest) {
+	if s.conn == nil {
+		return nil, nil
+	}
+	ic, ok := s.conn.NetConn().(*imapConn)
+	if !ok {
+		return nil, nil
+	}
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	return ic, ic.sort
+}
+
+// sortMessage 参与排序或组织会话的邮件
+type sortMessage struct {
+	email   *model.Email
+	num     uint32 // 响应中的序号或UID
+	seqNum  uint32 // 客户端序号，条件相同时按它排序
+	arrival time.Time
+	date    time.Time // 发送日期，缺失时为接收时间
+	subject string    // 基础主题（RFC 5256 2.1）
+}
+
+// sortResult 按 SORT/THREAD 请求组织搜索结果，返回替换 "* SEARCH" 的响应行
+func (s *IMAPSession) sortResult(req *sortRequest, kind imapserver.NumKind, uids []uint32, seqByUid map[uint32]uint32) (string, error) {
+	emails, err := s.storage.emailModel.GetSortFields(s.selectedFolder.Id)
+	if err != nil {
+		return "", err
+	}
+	matched := make(map[uint32]bool, len(uids))
+	for _, uid := range uids {
+		matched[uid] = true
+	}
+
+	// 发送日期需要读取邮件头，只在按日期排序或组织会话时读取
+	needDate := req.name == "THREAD"
+	for _, key := range req.keys {
+		needDate = needDate || key == "DATE"
+	}
+
+	var messages []*sortMessage
+	for _, email := range emails {
+		if !matched[email.Uid] {
+			continue
+		}
+		message := &sortMessage{email: email, num: email.Uid, seqNum: seqByUid[email.Uid], subject: baseSubject(email.Subject)}
+		if kind == imapserver.NumKindSeq {
+			message.num = message.seqNum
+		}
+		message.arrival = email.CreatedAt
+		if email.ReceivedAt != nil {
+			message.arrival = *email.ReceivedAt
+		}
+		message.date = message.arrival
+		if needDate {
+			message.date = s.sentDate(email, message.arrival)
+		}
+		messages = append(messages, message)
+	}
+
+	if req.name == "SORT" {
+		sortMessages(messages, req.keys)
+		var b strings.Builder
+		b.WriteString("* SORT")
+		for _, message := range messages {
+			b.WriteString(" " + strconv.FormatUint(uint64(message.num), 10))
+		}
+		return b.String(), nil
+	}
+
+	sortMessages(messages, []string{"DATE"})
+	var threads [][]*threadNode
+	if req.algorithm == string(imap.ThreadOrderedSubject) {
+		threads = orderedSubjectThreads(messages)
+	} else {
+		threads = referencesThreads(messages)
+	}
+	var b strings.Builder
+	b.WriteString("* THREAD ")
+	for _, roots := range threads {
+		b.WriteByte('(')
+		if len(roots) == 1 {
+			roots[0].format(&b)
+		} else {
+			// 多个根没有共同的父邮件，作为虚拟父节点的子节点输出
+			for _, root := range roots {
+				b.WriteByte('(')
+				root.format(&b)
+				b.WriteByte(')')
+			}
+		}
+		b.WriteByte(')')
+	}
+	return strings.TrimSuffix(b.String(), " "), nil
+}
+
+// sentDate 返回 Date 邮件头的时间，缺失或无法解析时使用到达时间（RFC 5256 的发送日期）
+func (s *IMAPSession) sentDate(email *model.Email, arrival time.Time) time.Time {
+	raw := &rawMessageCache{storage: s.storage, mail: &StoredMail{
+		ID:        email.Id,
+		MessageID: email.MessageId,
+		From:      email.FromEmail,
+		To:        email.ToEmails,
+		Cc:        email.CcEmails,
+		Subject:   email.Subject,
+		Body:      email.Content,
+		BlobKey:   email.BlobKey,
+		Size:      int(email.Size),
+		Received:  arrival,
+	}}
+	defer raw.close()
+	if date := raw.date(); !date.IsZero() {
+		return date
+	}
+	return arrival
+}
+
+// sortMessages 按排序条件稳定排序，条件全部相同时按序号排序
+func sortMessages(messages []*sortMessage, keys []string) {
+	sort.SliceStable(messages, func(i, j int) bool {
+		a, b := messages[i], messages[j]
+		reverse := false
+		for _, key := range keys {
+			if key == "REVERSE" {
+				reverse = true
+				continue
+			}
+			if c := compareSortKey(a, b, key); c != 0 {
+				return (c < 0) != reverse
+			}
+			reverse = false
+		}
+		return a.seqNum < b.seqNum
+	})
+}
+
+// compareSortKey 按单个排序条件比较两封邮件
+func compareSortKey(a, b *sortMessage, key string) int {
+	switch key {
+	case "ARRIVAL":
+		return a.arrival.Compare(b.arrival)
+	case "DATE":
+		return a.date.Compare(b.date)
+	case "FROM":
+		return strings.Compare(addrMailbox(a.email.FromEmail), addrMailbox(b.email.FromEmail))
+	case "TO":
+		return strings.Compare(firstAddrMailbox(a.email.ToEmails), firstAddrMailbox(b.email.ToEmails))
+	case "CC":
+		return strings.Compare(firstAddrMailbox(a.email.CcEmails), firstAddrMailbox(b.email.CcEmails))
+	case "SIZE":
+		switch {
+		case a.email.Size < b.email.Size:
+			return -1
+		case a.email.Size > b.email.Size:
+			return 1
+		}
+	case "SUBJECT":
+		return strings.Compare(a.subject, b.subject)
+	}
+	return 0
+}
+
+// addrMailbox 返回地址的本地部分，按 i;ascii-casemap 比较
+func addrMailbox(address string) string {
+	local, _, _ := strings.Cut(strings.TrimSpace(address), "@")
+	return string(lowerASCII([]byte(local)))
+}
+
+func firstAddrMailbox(addresses []string) string {
+	if len(addresses) == 0 {
+		return ""
+	}
+	return addrMailbox(addresses[0])
+}
+
+// baseSubject 提取基础主题（RFC 5256 2.1）：去掉回复/转发前缀、开头的 [xxx] 和结尾的 (fwd)，
+// 合并空白并按 i;ascii-casemap 转为小写
+func baseSubject(subject string) string {
+	s := strings.Join(strings.Fields(subject), " ")
+	for {
+		for {
+			s = strings.TrimSpace(s)
+			if len(s) < 5 || !strings.EqualFold(s[len(s)-5:], "(fwd)") {
+				break
+			}
+			s = s[:len(s)-5]
+		}
+		for {
+			if rest, ok := trimSubjectLeader(s); ok {
+				s = rest
+				continue
+			}
+			if rest, ok := trimSubjectBlob(s); ok && rest != "" {
+				s = rest
+				continue
+			}
+			break
+		}
+		if len(s) > 6 && strings.EqualFold(s[:5], "[fwd:") && strings.HasSuffix(s, "]") {
+			s = s[5 : len(s)-1]
+			continue
+		}
+		break
+	}
+	return string(lowerASCII([]byte(strings.TrimSpace(s))))
+}
+
+// trimSubjectLeader 去掉开头的 "Re:"、"Fw:"、"Fwd:"（前后可带 [xxx]）或空白
+func trimSubjectLeader(s string) (string, bool) {
+	if strings.HasPrefix(s, " ") {
+		return strings.TrimLeft(s, " "), true
+	}
+	rest := s
+	for {
+		r, ok := trimSubjectBlob(rest)
+		if !ok {
+			break
+		}
+		rest = r
+	}
+	lower := strings.ToLower(rest)
+	switch {
+	case strings.HasPrefix(lower, "re"):
+		rest = rest[2:]
+	case strings.HasPrefix(lower, "fwd"):
+		rest = rest[3:]
+	case strings.HasPrefix(lower, "fw"):
+		rest = rest[2:]
+	default:
+		return s, false
+	}
+	rest = strings.TrimLeft(rest, " ")
+	if r, ok := trimSubjectBlob(rest); ok {
+		rest = r
+	}
+	if !strings.HasPrefix(rest, ":") {
+		return s, false
+	}
+	return rest[1:], true
+}
+
+// trimSubjectBlob 去掉开头的 "[xxx]" 及其后的空白
+func trimSubjectBlob(s string) (string, bool) {
+	if !strings.HasPrefix(s, "[") {
+		return s, false
+	}
+	end := strings.IndexByte(s, ']')
+	if end < 0 || strings.IndexByte(s[1:end], '[') >= 0 {
+		return s, false
+	}
+	return strings.TrimLeft(s[end+1:], " "), true
+}
+
+// threadNode 会话树中的一封邮件
+type threadNode struct {
+	message  *sortMessage
+	parent   *threadNode
+	children []*threadNode
+}
+
+// format 按 RFC 5256 的 thread-list 语法输出节点及其后代：只有一个子节点时直接接在后面，
+// 多个子节点时各自加括号
+func (n *threadNode) format(b *strings.Builder) {
+	b.WriteString(strconv.FormatUint(uint64(n.message.num), 10))
+	switch len(n.children) {
+	case 0:
+	case 1:
+		b.WriteByte(' ')
+		n.children[0].format(b)
+	default:
+		b.WriteByte(' ')
+		for _, child := range n.children {
+			b.WriteByte('(')
+			child.format(b)
+			b.WriteByte(')')
+		}
+	}
+}
+
+// orderedSubjectThreads ORDEREDSUBJECT：按基础主题分组，每组最早的邮件为父节点，其余邮件按日期作为子节点
+// messages 已按发送日期排序，会话按第一封邮件的日期排列
+func orderedSubjectThreads(messages []*sortMessage) [][]*threadNode {
+	var threads [][]*threadNode
+	roots := make(map[string]*threadNode)
+	for _, message := range messages {
+		node := &threadNode{message: message}
+		root, ok := roots[message.subject]
+		if !ok {
+			roots[message.subject] = node
+			threads = append(threads, []*threadNode{node})
+			continue
+		}
+		node.parent = root
+		root.children = append(root.children, node)
+	}
+	return threads
+}
+
+// referencesThreads REFERENCES：按入库时确定的会话ID分组，组内按 References（缺失时 In-Reply-To）
+// 找到最近的、同样在结果中的祖先作为父节点；没有父节点的邮件为根，同组多个根共用一个虚拟父节点
+// messages 已按发送日期排序，兄弟节点和会话均按日期排列
+func referencesThreads(messages []*sortMessage) [][]*threadNode {
+	nodes := make([]*threadNode, len(messages))
+	byMessageId := make(map[string]*threadNode)
+	for i, message := range messages {
+		nodes[i] = &threadNode{message: message}
+		if id := message.email.MessageId; id != "" {
+			if _, ok := byMessageId[id]; !ok {
+				byMessageId[id] = nodes[i]
+			}
+		}
+	}
+
+	for _, node := range nodes {
+		email := node.message.email
+		refs := model.ParseMessageIdList(email.References)
+		if len(refs) == 0 && email.InReplyTo != "" {
+			refs = []string{email.InReplyTo}
+		}
+		for i := len(refs) - 1; i >= 0; i-- {
+			parent := byMessageId[refs[i]]
+			if parent == nil || parent.message.email.ThreadId != email.ThreadId || parent.hasAncestor(node) {
+				continue
+			}
+			node.parent = parent
+			break
+		}
+	}
+
+	var threads [][]*threadNode
+	threadIndex := make(map[int64]int)
+	for _, node := range nodes {
+		if node.parent != nil {
+			node.parent.children = append(node.parent.children, node)
+			continue
+		}
+		threadId := node.message.email.ThreadId
+		if threadId == 0 {
+			threadId = -node.message.email.Id
+		}
+		if i, ok := threadIndex[threadId]; ok {
+			threads[i] = append(threads[i], node)
+			continue
+		}
+		threadIndex[threadId] = len(threads)
+		threads = append(threads, []*threadNode{node})
+	}
+	return threads
+}
+
+// hasAncestor 判断 node 是否为 n 自身或其祖先，用于避免引用关系成环
+func (n *threadNode) hasAncestor(node *threadNode) bool {
+	for p := n; p != nil; p = p.parent {
+		if p == node {
+			return true
+		}
+	}
+	return false
+}
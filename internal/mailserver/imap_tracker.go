@@ -0,0 +1,151 @@
+package mailserver
+
+import (
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/rankgice/new-email/internal/event"
+)
+
+// folderTracker 被选中文件夹在本进程内的状态，uids 按升序保存当前邮件，下标+1即为序号
+type folderTracker struct {
+	tracker *imapserver.MailboxTracker
+	uids    []uint32
+	refs    int
+}
+
+// indexOf 返回UID在列表中的下标，不存在时返回-1
+func (f *folderTracker) indexOf(uid uint32) int {
+	i := sort.Search(len(f.uids), func(i int) bool { return f.uids[i] >= uid })
+	if i < len(f.uids) && f.uids[i] == uid {
+		return i
+	}
+	return -1
+}
+
+// trackerRegistry 管理被选中文件夹的 MailboxTracker，将邮件事件转换为推送给IMAP会话的
+// EXISTS/FETCH/EXPUNGE 更新；没有会话选中的文件夹不保留任何状态
+type trackerRegistry struct {
+	mu      sync.Mutex
+	folders map[int64]*folderTracker
+	// loadUids 从数据库读取文件夹内按升序排列的UID，事件乱序到达时用于重新同步
+	loadUids func(folderId int64) ([]uint32, error)
+}
+
+// newTrackerRegistry 创建文件夹跟踪注册表
+func newTrackerRegistry(loadUids func(folderId int64) ([]uint32, error)) *trackerRegistry {
+	return &trackerRegistry{
+		folders:  make(map[int64]*folderTracker),
+		loadUids: loadUids,
+	}
+}
+
+// open 为会话打开文件夹跟踪，返回会话跟踪器和会话初始看到的邮件数量
+// uids 为调用方从数据库读取的邮件列表，仅在文件夹尚未被跟踪时使用
+func (r *trackerRegistry) open(folderId int64, uids []uint32) (*imapserver.SessionTracker, uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	folder := r.folders[folderId]
+	if folder == nil {
+		folder = &folderTracker{
+			tracker: imapserver.NewMailboxTracker(uint32(len(uids))),
+			uids:    uids,
+		}
+		r.folders[folderId] = folder
+	}
+	folder.refs++
+
+	return folder.tracker.NewSession(), uint32(len(folder.uids))
+}
+
+// close 关闭会话跟踪，最后一个会话离开时释放文件夹状态
+func (r *trackerRegistry) close(folderId int64, session *imapserver.SessionTracker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	session.Close()
+	folder := r.folders[folderId]
+	if folder == nil {
+		return
+	}
+	folder.refs--
+	if folder.refs <= 0 {
+		delete(r.folders, folderId)
+	}
+}
+
+// handle 处理邮件事件，由事件总线同步调用
+func (r *trackerRegistry) handle(e event.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	folder := r.folders[e.FolderId]
+	if folder == nil {
+		return
+	}
+
+	switch e.Type {
+	case event.TypeNew:
+		// 已在列表中说明打开文件夹时已读取到该邮件
+		if folder.indexOf(e.Uid) >= 0 {
+			return
+		}
+		// 事件在事务提交后发布，并发投递时较小的UID可能后到达，此时不能简单追加
+		if n := len(folder.uids); n > 0 && e.Uid < folder.uids[n-1] {
+			r.resync(e.FolderId, folder, e.Uid)
+			return
+		}
+		folder.uids = append(folder.uids, e.Uid)
+		folder.tracker.QueueNumMessages(uint32(len(folder.uids)))
+	case event.TypeExpunge:
+		i := folder.indexOf(e.Uid)
+		if i < 0 {
+			return
+		}
+		folder.uids = append(folder.uids[:i:i], folder.uids[i+1:]...)
+		folder.tracker.QueueExpunge(uint32(i + 1))
+	case event.TypeFlags:
+		i := folder.indexOf(e.Uid)
+		if i < 0 {
+			return
+		}
+		flags := make([]imap.Flag, 0, len(e.Flags))
+		for _, flag := range e.Flags {
+			flags = append(flags, imap.Flag(flag))
+		}
+		source, _ := e.Origin.(*imapserver.SessionTracker)
+		folder.tracker.QueueMessageFlags(uint32(i+1), imap.UID(e.Uid), flags, source)
+	}
+}
+
+// resync 新邮件的UID小于已知的最大UID时按数据库重新同步邮件列表：
+// 数据库中已不存在的邮件先发送 EXPUNGE，再以数据库的列表为准发送 EXISTS
+// 读取失败时把该UID插入到有序位置
+func (r *trackerRegistry) resync(folderId int64, folder *folderTracker, uid uint32) {
+	uids, err := r.loadUids(folderId)
+	if err != nil {
+		log.Printf("⚠️  重新同步文件夹 %d 的邮件列表失败: %v", folderId, err)
+		i := sort.Search(len(folder.uids), func(i int) bool { return folder.uids[i] >= uid })
+		folder.uids = append(folder.uids[:i], append([]uint32{uid}, folder.uids[i:]...)...)
+		folder.tracker.QueueNumMessages(uint32(len(folder.uids)))
+		return
+	}
+
+	current := make(map[uint32]bool, len(uids))
+	for _, u := range uids {
+		current[u] = true
+	}
+	// 从后往前发送 EXPUNGE，保证每个序号在发送时有效
+	for i := len(folder.uids) - 1; i >= 0; i-- {
+		if !current[folder.uids[i]] {
+			folder.uids = append(folder.uids[:i:i], folder.uids[i+1:]...)
+			folder.tracker.QueueExpunge(uint32(i + 1))
+		}
+	}
+	folder.uids = uids
+	folder.tracker.QueueNumMessages(uint32(len(folder.uids)))
+}
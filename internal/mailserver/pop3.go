@@ -0,0 +1,162 @@
+package mailserver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+// POP3Server POP3服务器 (RFC 1939)，供只支持POP3的旧设备收取INBOX中的邮件
+// 明文端口在配置了证书时支持 STLS (RFC 2595)，TLS端口为隐式TLS（通常为995）
+type POP3Server struct {
+	port      int
+	tlsPort   int
+	domain    string
+	storage   *MailStorage
+	tlsConfig *tls.Config
+	proxy     *ProxyProtocolPolicy // PROXY protocol策略，nil表示未启用
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	conns     map[net.Conn]struct{}
+	locked    map[int64]bool // 已被会话锁定的邮箱，RFC 1939 要求同一邮箱同时只有一个会话
+}
+
+// NewPOP3Server 创建POP3服务器
+func NewPOP3Server(config Config, storage *MailStorage) *POP3Server {
+	tlsConfig, _ := loadOptionalTLSConfig("POP3服务器", config.POP3UseTLS, config.POP3TLSCertPath, config.POP3TLSKeyPath)
+	return &POP3Server{
+		port:      config.POP3Port,
+		tlsPort:   config.POP3TLSPort,
+		domain:    config.Domain,
+		storage:   storage,
+		tlsConfig: tlsConfig,
+		conns:     make(map[net.Conn]struct{}),
+		locked:    make(map[int64]bool),
+	}
+}
+
+// Start 启动POP3服务器，阻塞直到上下文取消
+func (s *POP3Server) Start(ctx context.Context) error {
+	if s.port != 0 {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
+		if err != nil {
+			return fmt.Errorf("无法监听端口 %d: %v", s.port, err)
+		}
+		if s.tlsConfig != nil {
+			log.Printf("✅ POP3服务器 (STLS) 启动成功，监听端口: %d", s.port)
+		} else {
+			log.Printf("⚠️ POP3服务器 (非TLS) 启动成功，监听端口: %d", s.port)
+		}
+		s.serve(s.proxy.wrapListener(listener), listener, false)
+	}
+
+	if s.tlsPort != 0 && s.tlsConfig != nil {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.tlsPort))
+		if err != nil {
+			s.Stop()
+			return fmt.Errorf("无法监听端口 %d: %v", s.tlsPort, err)
+		}
+		log.Printf("✅ POP3服务器 (TLS) 启动成功，监听端口: %d", s.tlsPort)
+		// PROXY头位于TLS握手之前，需先于TLS解析
+		s.serve(tls.NewListener(s.proxy.wrapListener(listener), s.tlsConfig), listener, true)
+	}
+
+	// 等待上下文取消
+	<-ctx.Done()
+	log.Printf("POP3服务器收到停止信号")
+
+	if err := s.Stop(); err != nil {
+		log.Printf("关闭POP3服务器失败: %v", err)
+		return err
+	}
+
+	log.Printf("✅ POP3服务器已停止")
+	return nil
+}
+
+// serve 在goroutine中接受连接，raw 为底层监听器，停止时关闭
+func (s *POP3Server) serve(listener net.Listener, raw net.Listener, implicitTLS bool) {
+	s.mu.Lock()
+	s.listeners = append(s.listeners, raw)
+	s.mu.Unlock()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Printf("POP3服务器运行错误: %v", err)
+				}
+				return
+			}
+			go s.handleConn(conn, implicitTLS)
+		}
+	}()
+}
+
+// handleConn 处理单个POP3连接
+func (s *POP3Server) handleConn(conn net.Conn, implicitTLS bool) {
+	s.mu.Lock()
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+
+	session := newPOP3Session(s, conn, implicitTLS)
+	defer func() {
+		session.close()
+		s.mu.Lock()
+		delete(s.conns, session.conn)
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	session.serve()
+}
+
+// trackConn STLS 升级后记录新的连接，停止时一并关闭
+func (s *POP3Server) trackConn(old, conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, old)
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+}
+
+// lock 锁定邮箱，已被其他会话锁定时返回false
+func (s *POP3Server) lock(mailboxId int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.locked[mailboxId] {
+		return false
+	}
+	s.locked[mailboxId] = true
+	return true
+}
+
+// unlock 释放邮箱锁
+func (s *POP3Server) unlock(mailboxId int64) {
+	s.mu.Lock()
+	delete(s.locked, mailboxId)
+	s.mu.Unlock()
+}
+
+// Stop 停止POP3服务器，关闭监听器和仍在进行的会话
+func (s *POP3Server) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var firstErr error
+	for _, listener := range s.listeners {
+		if err := listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.listeners = nil
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return firstErr
+}
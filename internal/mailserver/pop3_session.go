@@ -0,0 +1,505 @@
+package mailserver
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rankgice/new-email/internal/model"
+)
+
+const (
+	pop3IdleTimeout     = 10 * time.Minute // RFC 1939 要求自动注销计时器不少于10分钟
+	pop3MaxLineLength   = 512              // RFC 2449 规定命令行最长512字节
+	pop3MaxAuthFailures = 3                // 认证失败次数达到上限后断开连接
+)
+
+// pop3Capabilities CAPA 返回的能力 (RFC 2449)
+var pop3Capabilities = []string{"TOP", "UIDL", "USER", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING"}
+
+// errPOP3LineTooLong 命令行超过长度限制
+var errPOP3LineTooLong = errors.New("命令行过长")
+
+// pop3Session POP3会话，AUTHORIZATION 状态登录后锁定邮箱的INBOX进入 TRANSACTION 状态，
+// DELE 仅做标记，QUIT 时（UPDATE 状态）才真正删除
+type pop3Session struct {
+	server *POP3Server
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	tls    bool
+
+	username     string
+	authFailures int
+
+	mailbox *model.Mailbox // 登录后为非nil，即进入 TRANSACTION 状态
+	folder  *model.Folder
+	mails   []*StoredMail // 登录时的邮件快照，消息编号在会话内保持不变
+	sizes   []int64       // 各邮件原始报文的大小
+	deleted []bool
+}
+
+func newPOP3Session(server *POP3Server, conn net.Conn, implicitTLS bool) *pop3Session {
+	return &pop3Session{
+		server: server,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+		tls:    implicitTLS,
+	}
+}
+
+// serve 发送问候语并循环处理命令，直到 QUIT 或连接断开
+func (s *pop3Session) serve() {
+	s.ok("%s POP3 server ready", s.server.domain)
+	if err := s.writer.Flush(); err != nil {
+		return
+	}
+
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(pop3IdleTimeout))
+		line, err := s.readLine()
+		if errors.Is(err, errPOP3LineTooLong) {
+			s.err("Line too long")
+			s.writer.Flush()
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("POP3连接读取失败: %v", err)
+			}
+			return
+		}
+
+		cmd, arg, _ := strings.Cut(line, " ")
+		quit := s.handle(strings.ToUpper(cmd), arg)
+		// PIPELINING：客户端一次发送多条命令时合并响应
+		if s.reader.Buffered() == 0 || quit {
+			if err := s.writer.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// readLine 读取一行命令，去掉行尾的CRLF
+func (s *pop3Session) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := s.reader.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if !isPrefix {
+			break
+		}
+		if len(line) > pop3MaxLineLength {
+			// 丢弃本行剩余内容
+			for isPrefix && err == nil {
+				_, isPrefix, err = s.reader.ReadLine()
+			}
+			if err != nil {
+				return "", err
+			}
+			return "", errPOP3LineTooLong
+		}
+	}
+	return string(line), nil
+}
+
+// handle 处理一条命令，返回true表示会话结束
+func (s *pop3Session) handle(cmd, arg string) bool {
+	switch cmd {
+	case "CAPA":
+		s.capa()
+		return false
+	case "QUIT":
+		s.quit()
+		return true
+	}
+
+	if s.mailbox == nil {
+		switch cmd {
+		case "USER":
+			s.user(arg)
+		case "PASS":
+			return s.pass(arg)
+		case "STLS":
+			s.stls()
+		default:
+			s.err("Unknown command or not authenticated")
+		}
+		return false
+	}
+
+	switch cmd {
+	case "STAT":
+		s.stat()
+	case "LIST":
+		s.list(arg)
+	case "UIDL":
+		s.uidl(arg)
+	case "RETR":
+		s.retr(arg)
+	case "TOP":
+		s.top(arg)
+	case "DELE":
+		s.dele(arg)
+	case "RSET":
+		s.rset()
+	case "NOOP":
+		s.ok("")
+	default:
+		s.err("Unknown command")
+	}
+	return false
+}
+
+func (s *pop3Session) ok(format string, args ...interface{}) {
+	if format == "" {
+		s.writer.WriteString("+OK\r\n")
+		return
+	}
+	fmt.Fprintf(s.writer, "+OK "+format+"\r\n", args...)
+}
+
+func (s *pop3Session) err(format string, args ...interface{}) {
+	fmt.Fprintf(s.writer, "-ERR "+format+"\r\n", args...)
+}
+
+// tlsRequired 配置了证书时明文连接必须先 STLS 才能登录
+func (s *pop3Session) tlsRequired() bool {
+	return s.server.tlsConfig != nil && !s.tls
+}
+
+func (s *pop3Session) capa() {
+	s.ok("Capability list follows")
+	for _, capability := range pop3Capabilities {
+		s.writer.WriteString(capability + "\r\n")
+	}
+	if s.mailbox == nil && s.tlsRequired() {
+		s.writer.WriteString("STLS\r\n")
+	}
+	s.writer.WriteString(".\r\n")
+}
+
+// stls 将连接升级为TLS (RFC 2595)，升级后丢弃之前的认证状态
+func (s *pop3Session) stls() {
+	if s.server.tlsConfig == nil {
+		s.err("TLS not available")
+		return
+	}
+	if s.tls {
+		s.err("Already using TLS")
+		return
+	}
+
+	s.ok("Begin TLS negotiation")
+	if err := s.writer.Flush(); err != nil {
+		return
+	}
+	tlsConn := tls.Server(s.conn, s.server.tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(time.Minute))
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("POP3 STLS握手失败: %v", err)
+		s.conn.Close()
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	s.server.trackConn(s.conn, tlsConn)
+	s.conn = tlsConn
+	s.reader = bufio.NewReader(tlsConn)
+	s.writer = bufio.NewWriter(tlsConn)
+	s.tls = true
+	s.username = ""
+}
+
+func (s *pop3Session) user(arg string) {
+	if s.tlsRequired() {
+		s.err("[AUTH] Must issue STLS first")
+		return
+	}
+	if arg == "" {
+		s.err("Missing username")
+		return
+	}
+	s.username = arg
+	s.ok("Send password")
+}
+
+// pass 验证密码并锁定邮箱，认证失败次数达到上限时返回true断开连接
+func (s *pop3Session) pass(password string) bool {
+	if s.tlsRequired() {
+		s.err("[AUTH] Must issue STLS first")
+		return false
+	}
+	if s.username == "" {
+		s.err("USER first")
+		return false
+	}
+
+	username := s.username
+	s.username = ""
+	log.Printf("POP3登录尝试: %s", username)
+
+	if !s.server.storage.ValidateCredentials(username, password, model.AppPasswordScopePOP3) {
+		log.Printf("POP3登录失败: %s", username)
+		s.authFailures++
+		s.err("[AUTH] Invalid username or password")
+		return s.authFailures >= pop3MaxAuthFailures
+	}
+
+	mailbox, err := s.server.storage.findMailboxByEmail(username)
+	if err != nil || mailbox == nil {
+		log.Printf("获取邮箱信息失败: %s, %v", username, err)
+		s.err("[SYS/TEMP] Unable to open maildrop")
+		return false
+	}
+	if !s.server.lock(mailbox.Id) {
+		log.Printf("POP3邮箱已被锁定: %s", username)
+		s.err("[IN-USE] Maildrop already locked")
+		return false
+	}
+	if err := s.load(mailbox); err != nil {
+		s.server.unlock(mailbox.Id)
+		log.Printf("加载POP3邮件失败: %s, %v", username, err)
+		s.err("[SYS/TEMP] Unable to open maildrop")
+		return false
+	}
+
+	s.mailbox = mailbox
+	log.Printf("POP3登录成功: %s", username)
+	count, size := s.stats()
+	s.ok("Maildrop has %d messages (%d octets)", count, size)
+	return false
+}
+
+// load 读取邮箱INBOX的邮件快照
+func (s *pop3Session) load(mailbox *model.Mailbox) error {
+	folder, err := s.server.storage.getOrCreateFolder(mailbox.Id, "INBOX", nil, true)
+	if err != nil {
+		return err
+	}
+	mails, err := s.server.storage.GetFolderMails(folder, 0)
+	if err != nil {
+		return err
+	}
+
+	s.folder = folder
+	s.mails = mails
+	s.sizes = make([]int64, len(mails))
+	for i, mail := range mails {
+		s.sizes[i] = messageSize(mail)
+	}
+	s.deleted = make([]bool, len(mails))
+	return nil
+}
+
+// stats 返回未标记删除的邮件数量和总大小
+func (s *pop3Session) stats() (count int, size int64) {
+	for i, messageSize := range s.sizes {
+		if !s.deleted[i] {
+			count++
+			size += messageSize
+		}
+	}
+	return count, size
+}
+
+// message 解析消息编号，返回下标，编号无效或已标记删除时返回错误响应
+func (s *pop3Session) message(arg string) (int, bool) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || n > len(s.mails) {
+		s.err("No such message")
+		return 0, false
+	}
+	if s.deleted[n-1] {
+		s.err("Message %d already deleted", n)
+		return 0, false
+	}
+	return n - 1, true
+}
+
+// uid 返回邮件的唯一标识：文件夹的 UIDVALIDITY 加邮件的IMAP UID，文件夹重建后不会重复
+func (s *pop3Session) uid(i int) string {
+	return fmt.Sprintf("%d.%d", s.folder.UidValidity, s.mails[i].UID)
+}
+
+func (s *pop3Session) stat() {
+	count, size := s.stats()
+	s.ok("%d %d", count, size)
+}
+
+func (s *pop3Session) list(arg string) {
+	if arg != "" {
+		if i, ok := s.message(arg); ok {
+			s.ok("%d %d", i+1, s.sizes[i])
+		}
+		return
+	}
+	count, size := s.stats()
+	s.ok("%d messages (%d octets)", count, size)
+	for i, size := range s.sizes {
+		if !s.deleted[i] {
+			fmt.Fprintf(s.writer, "%d %d\r\n", i+1, size)
+		}
+	}
+	s.writer.WriteString(".\r\n")
+}
+
+func (s *pop3Session) uidl(arg string) {
+	if arg != "" {
+		if i, ok := s.message(arg); ok {
+			s.ok("%d %s", i+1, s.uid(i))
+		}
+		return
+	}
+	s.ok("")
+	for i := range s.mails {
+		if !s.deleted[i] {
+			fmt.Fprintf(s.writer, "%d %s\r\n", i+1, s.uid(i))
+		}
+	}
+	s.writer.WriteString(".\r\n")
+}
+
+func (s *pop3Session) retr(arg string) {
+	i, ok := s.message(arg)
+	if !ok {
+		return
+	}
+	r, err := s.server.storage.openMessage(s.mails[i])
+	if err != nil {
+		log.Printf("❌ POP3读取邮件原文失败 (ID: %d): %v", s.mails[i].ID, err)
+		s.err("[SYS/TEMP] Unable to read message")
+		return
+	}
+	defer r.Close()
+
+	s.ok("%d octets", s.sizes[i])
+	s.writeMultiline(r, -1)
+}
+
+// top 返回邮件头和正文的前 n 行
+func (s *pop3Session) top(arg string) {
+	msg, lines, _ := strings.Cut(arg, " ")
+	n, err := strconv.Atoi(strings.TrimSpace(lines))
+	if err != nil || n < 0 {
+		s.err("Invalid line count")
+		return
+	}
+	i, ok := s.message(msg)
+	if !ok {
+		return
+	}
+
+	r, err := s.server.storage.openMessage(s.mails[i])
+	if err != nil {
+		log.Printf("❌ POP3读取邮件原文失败 (ID: %d): %v", s.mails[i].ID, err)
+		s.err("[SYS/TEMP] Unable to read message")
+		return
+	}
+	defer r.Close()
+
+	s.ok("")
+	s.writeMultiline(r, n)
+}
+
+// writeMultiline 按 RFC 1939 的多行响应格式从原文流式输出：以点开头的行加一个点，最后以 "." 结束
+// bodyLines 不小于0时只输出邮件头和正文的前 bodyLines 行（TOP）
+func (s *pop3Session) writeMultiline(r io.Reader, bodyLines int) {
+	br := bufio.NewReader(r)
+	inHeader := true
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			line = bytes.TrimRight(line, "\r\n")
+			if !inHeader {
+				if bodyLines == 0 {
+					break
+				}
+				if bodyLines > 0 {
+					bodyLines--
+				}
+			} else if len(line) == 0 {
+				inHeader = false
+			}
+			if len(line) > 0 && line[0] == '.' {
+				s.writer.WriteByte('.')
+			}
+			s.writer.Write(line)
+			s.writer.WriteString("\r\n")
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("❌ POP3读取邮件原文失败: %v", err)
+			}
+			break
+		}
+	}
+	s.writer.WriteString(".\r\n")
+}
+
+func (s *pop3Session) dele(arg string) {
+	i, ok := s.message(arg)
+	if !ok {
+		return
+	}
+	s.deleted[i] = true
+	s.ok("Message %d deleted", i+1)
+}
+
+func (s *pop3Session) rset() {
+	for i := range s.deleted {
+		s.deleted[i] = false
+	}
+	count, size := s.stats()
+	s.ok("Maildrop has %d messages (%d octets)", count, size)
+}
+
+// quit 在 TRANSACTION 状态下进入 UPDATE 状态，删除标记的邮件
+func (s *pop3Session) quit() {
+	if s.mailbox == nil {
+		s.ok("%s POP3 server signing off", s.server.domain)
+		return
+	}
+
+	var expunge []*StoredMail
+	for i, mail := range s.mails {
+		if s.deleted[i] {
+			expunge = append(expunge, mail)
+		}
+	}
+	if len(expunge) > 0 {
+		if err := s.server.storage.ExpungeMails(expunge); err != nil {
+			log.Printf("POP3删除邮件失败: %s, %v", s.mailbox.Email, err)
+			s.err("[SYS/TEMP] Some deleted messages not removed")
+			return
+		}
+		log.Printf("POP3删除了 %d 封邮件: %s", len(expunge), s.mailbox.Email)
+	}
+
+	count, _ := s.stats()
+	s.ok("%s POP3 server signing off (%d messages left)", s.server.domain, count)
+}
+
+// close 释放邮箱锁并关闭连接，未 QUIT 断开时标记的删除不生效
+func (s *pop3Session) close() {
+	if s.mailbox != nil {
+		s.server.unlock(s.mailbox.Id)
+	}
+	s.conn.Close()
+}
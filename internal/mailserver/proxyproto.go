@@ -0,0 +1,273 @@
+package mailserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol 头部相关常量
+const (
+	proxyHeaderTimeout = 5 * time.Second // 读取PROXY头的超时时间
+	proxyV1MaxLength   = 107             // v1头部最大长度（含CRLF）
+)
+
+// proxyV2Signature PROXY protocol v2 固定签名
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocolPolicy PROXY protocol 策略
+// 仅对来自可信网段的连接解析PROXY头，其余连接保持原样
+type ProxyProtocolPolicy struct {
+	trusted []*net.IPNet
+}
+
+// NewProxyProtocolPolicy 根据可信CIDR列表创建PROXY protocol策略
+// 列表为空时返回错误，避免任意来源伪造客户端地址
+func NewProxyProtocolPolicy(trustedCIDRs []string) (*ProxyProtocolPolicy, error) {
+	policy := &ProxyProtocolPolicy{}
+	for _, cidr := range trustedCIDRs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		// 允许直接填写单个IP
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("无效的PROXY可信网段 %q: %v", cidr, err)
+		}
+		policy.trusted = append(policy.trusted, ipNet)
+	}
+	if len(policy.trusted) == 0 {
+		return nil, errors.New("启用PROXY protocol时必须配置可信网段")
+	}
+	return policy, nil
+}
+
+// isTrusted 判断连接来源是否可信
+func (p *ProxyProtocolPolicy) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range p.trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// wrapListener 为监听器套上PROXY protocol解析，policy为nil时原样返回
+func (p *ProxyProtocolPolicy) wrapListener(l net.Listener) net.Listener {
+	if p == nil {
+		return l
+	}
+	return &proxyListener{Listener: l, policy: p}
+}
+
+// proxyListener 解析PROXY protocol头的监听器
+type proxyListener struct {
+	net.Listener
+	policy *ProxyProtocolPolicy
+}
+
+// Accept 接受连接，可信来源的连接在首次读取时解析PROXY头
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.policy.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn 带PROXY头的连接，RemoteAddr/LocalAddr返回头部中的真实地址
+// 头部延迟到首次Read或RemoteAddr时解析，避免阻塞Accept循环
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	once       sync.Once
+	headerErr  error
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+// Read 读取PROXY头之后的数据
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.headerErr != nil {
+		return 0, c.headerErr
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr 返回客户端真实地址
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr 返回客户端连接的原始目标地址
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readHeader 读取并解析PROXY头，失败时关闭连接
+func (c *proxyConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	src, dst, err := readProxyHeader(c.reader)
+	if err != nil {
+		log.Printf("❌ PROXY头解析失败 (来自 %s): %v", c.Conn.RemoteAddr(), err)
+		c.headerErr = err
+		c.Conn.Close()
+		return
+	}
+	c.remoteAddr, c.localAddr = src, dst
+	if src != nil {
+		log.Printf("🔀 PROXY连接: %s 经由 %s", src, c.Conn.RemoteAddr())
+	}
+}
+
+// readProxyHeader 读取v1或v2格式的PROXY头
+// 返回的地址为nil表示头部未携带地址（UNKNOWN/LOCAL），应沿用原连接地址
+func readProxyHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, nil, fmt.Errorf("读取PROXY头失败: %v", err)
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyV1(r)
+	}
+	return nil, nil, errors.New("缺少PROXY头")
+}
+
+// readProxyV1 解析文本格式的PROXY头
+// 格式: PROXY TCP4 源地址 目标地址 源端口 目标端口\r\n
+func readProxyV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("读取PROXY v1头失败: %v", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("PROXY v1头过长或未以CRLF结尾")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("无效的PROXY v1头: %q", line)
+	}
+
+	src, err := parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+// parseProxyV1Addr 解析v1头中的地址和端口
+func parseProxyV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("无效的PROXY地址: %q", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("无效的PROXY端口: %q", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readProxyV2 解析二进制格式的PROXY头
+func readProxyV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, fmt.Errorf("读取PROXY v2头失败: %v", err)
+	}
+
+	verCmd, family := header[12], header[13]
+	if verCmd>>4 != 2 {
+		return nil, nil, fmt.Errorf("不支持的PROXY版本: %d", verCmd>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, fmt.Errorf("读取PROXY v2地址失败: %v", err)
+	}
+
+	// LOCAL命令为负载均衡器自身的健康检查，沿用原连接地址
+	switch verCmd & 0x0F {
+	case 0x0:
+		return nil, nil, nil
+	case 0x1:
+	default:
+		return nil, nil, fmt.Errorf("不支持的PROXY v2命令: %d", verCmd&0x0F)
+	}
+
+	var ipLen int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		// UDP/Unix等地址族不适用于邮件服务，沿用原连接地址
+		return nil, nil, nil
+	}
+
+	if len(payload) < ipLen*2+4 {
+		return nil, nil, errors.New("PROXY v2地址长度不足")
+	}
+	src := &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), payload[:ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(payload[ipLen*2:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), payload[ipLen:ipLen*2]...)),
+		Port: int(binary.BigEndian.Uint16(payload[ipLen*2+2:])),
+	}
+	return src, dst, nil
+}
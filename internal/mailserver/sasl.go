@@ -0,0 +1,164 @@
+package mailserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/emersion/go-sasl"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rankgice/new-email/internal/constant"
+	"github.com/rankgice/new-email/internal/localSasl"
+	"github.com/rankgice/new-email/internal/model"
+	"github.com/rankgice/new-email/pkg/auth"
+)
+
+// saslMechanisms 在协议自带的口令机制之后追加SCRAM和令牌认证机制
+// SCRAM-SHA-256-PLUS 只在TLS连接上提供，令牌认证需要配置JWT密钥
+func (s *MailStorage) saslMechanisms(base []string, binding localSasl.ChannelBinding) []string {
+	mechanisms := append([]string{}, base...)
+	if binding != nil {
+		mechanisms = append(mechanisms, localSasl.ScramSHA256Plus)
+	}
+	mechanisms = append(mechanisms, localSasl.ScramSHA256)
+	if s.jwtSecret != "" {
+		mechanisms = append(mechanisms, sasl.OAuthBearer, localSasl.XOAuth2)
+	}
+	return mechanisms
+}
+
+// newSASLServer 创建SCRAM或令牌认证的SASL服务端，认证成功后以邮箱地址调用 login
+// 不支持的机制返回nil，PLAIN/LOGIN 由各协议自行处理
+func (s *MailStorage) newSASLServer(mech string, binding localSasl.ChannelBinding, login func(email string) error) sasl.Server {
+	switch mech {
+	case localSasl.ScramSHA256, localSasl.ScramSHA256Plus:
+		plus := mech == localSasl.ScramSHA256Plus
+		if plus && binding == nil {
+			return nil
+		}
+		return localSasl.NewScramSHA256Server(s.ScramCredential, login, binding, plus)
+
+	case sasl.OAuthBearer:
+		if s.jwtSecret == "" {
+			return nil
+		}
+		return sasl.NewOAuthBearerServer(func(opts sasl.OAuthBearerOptions) *sasl.OAuthBearerError {
+			if err := s.ValidateToken(opts.Username, opts.Token); err != nil {
+				return &sasl.OAuthBearerError{Status: "invalid_token", Schemes: "bearer"}
+			}
+			if err := login(opts.Username); err != nil {
+				return &sasl.OAuthBearerError{Status: "invalid_token", Schemes: "bearer"}
+			}
+			return nil
+		})
+
+	case localSasl.XOAuth2:
+		if s.jwtSecret == "" {
+			return nil
+		}
+		return localSasl.NewXOAuth2Server(func(username, token string) error {
+			if err := s.ValidateToken(username, token); err != nil {
+				return err
+			}
+			return login(username)
+		})
+	}
+	return nil
+}
+
+// ScramCredential 获取邮箱的SCRAM-SHA-256凭据
+func (s *MailStorage) ScramCredential(email string) (*auth.ScramCredential, error) {
+	mailbox, err := s.findMailboxByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	if mailbox == nil {
+		log.Printf("SCRAM认证失败，邮箱不存在: %s", email)
+		return nil, errors.New("invalid credentials")
+	}
+	if mailbox.ScramSha256 == "" {
+		// 升级前创建的邮箱在下一次口令登录成功后生成验证器
+		log.Printf("SCRAM认证失败，邮箱尚未生成SCRAM凭据: %s", email)
+		return nil, errors.New("invalid credentials")
+	}
+	return auth.ParseScramSHA256(mailbox.ScramSha256)
+}
+
+// ValidateToken 验证Web端签发的JWT，令牌所属用户必须拥有该邮箱
+func (s *MailStorage) ValidateToken(email, token string) error {
+	if email == "" {
+		return errors.New("缺少邮箱地址")
+	}
+
+	claims, err := auth.ParseToken(token, s.jwtSecret)
+	if err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			log.Printf("令牌认证失败，令牌已过期: %s", email)
+		} else {
+			log.Printf("令牌认证失败 %s: %v", email, err)
+		}
+		return errors.New("invalid token")
+	}
+	if claims.IsAdmin {
+		return errors.New("管理员令牌不能用于邮箱登录")
+	}
+
+	mailbox, err := s.findMailboxByEmail(email)
+	if err != nil {
+		return err
+	}
+	if mailbox == nil || mailbox.UserId != claims.UserId {
+		log.Printf("令牌认证失败，邮箱不属于用户 %d: %s", claims.UserId, email)
+		return errors.New("invalid token")
+	}
+
+	user, err := model.NewUserModel(s.db).GetById(claims.UserId)
+	if err != nil {
+		return err
+	}
+	if user == nil || user.Status != constant.StatusEnabled {
+		return fmt.Errorf("用户不存在或已禁用: %d", claims.UserId)
+	}
+
+	log.Printf("✅ 令牌认证成功: %s", email)
+	return nil
+}
+
+// ensureScramVerifier 口令登录成功后为尚无SCRAM凭据的邮箱生成验证器
+func (s *MailStorage) ensureScramVerifier(mailbox *model.Mailbox, password string) {
+	if mailbox.ScramSha256 != "" {
+		return
+	}
+	verifier, err := auth.GenerateScramSHA256(password)
+	if err != nil {
+		log.Printf("生成SCRAM凭据失败 %s: %v", mailbox.Email, err)
+		return
+	}
+	if err := s.mailboxModel.SetScramVerifier(mailbox.Id, verifier); err != nil {
+		log.Printf("保存SCRAM凭据失败 %s: %v", mailbox.Email, err)
+		return
+	}
+	mailbox.ScramSha256 = verifier
+}
+
+// tlsChannelBinding 返回TLS连接的通道绑定数据，非TLS连接返回nil
+// TLS 1.3 使用 tls-exporter (RFC 9266)，TLS 1.2 使用 tls-unique (RFC 5929)
+func tlsChannelBinding(state *tls.ConnectionState) localSasl.ChannelBinding {
+	if state == nil || !state.HandshakeComplete {
+		return nil
+	}
+	return func(cbType string) []byte {
+		switch cbType {
+		case "tls-unique":
+			if len(state.TLSUnique) > 0 {
+				return state.TLSUnique
+			}
+		case "tls-exporter":
+			if data, err := state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32); err == nil {
+				return data
+			}
+		}
+		return nil
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/rankgice/new-email/internal/blob"
+	"github.com/rankgice/new-email/internal/event"
 	"gorm.io/gorm"
 )
 
@@ -24,6 +26,22 @@ type Config struct {
 	IMAPUseTLS      bool   `yaml:"imap_use_tls"`
 	IMAPTLSCertPath string `yaml:"imap_tls_cert_path"` // IMAP TLS证书路径
 	IMAPTLSKeyPath  string `yaml:"imap_tls_key_path"`  // IMAP TLS密钥路径
+	IMAPCompress    bool   `yaml:"imap_compress"`      // IMAP COMPRESS=DEFLATE（RFC 4978）
+	LMTPEnabled     bool   `yaml:"lmtp_enabled"`
+	LMTPAddr        string `yaml:"lmtp_addr"` // LMTP监听地址，TCP如 ":24"，Unix套接字如 "unix:/run/new-email/lmtp.sock"
+	POP3Enabled     bool   `yaml:"pop3_enabled"`
+	POP3Port        int    `yaml:"pop3_port"`     // 110端口 - POP3（支持STLS）
+	POP3TLSPort     int    `yaml:"pop3_tls_port"` // 995端口 - POP3隐式TLS
+	POP3UseTLS      bool   `yaml:"pop3_use_tls"`
+	POP3TLSCertPath string `yaml:"pop3_tls_cert_path"` // POP3 TLS证书路径
+	POP3TLSKeyPath  string `yaml:"pop3_tls_key_path"`  // POP3 TLS密钥路径
+	// ProxyProtocol 启用后所有TCP监听器接受来自可信网段的PROXY protocol v1/v2头
+	ProxyProtocol     bool     `yaml:"proxy_protocol"`
+	ProxyTrustedCIDRs []string `yaml:"proxy_trusted_cidrs"` // 启用PROXY protocol时必须配置
+	// SubaddressSeparators 子地址分隔符（如 "+-"），alice+tag@domain 投递到 alice@domain
+	SubaddressSeparators string `yaml:"subaddress_separators"`
+	// JWTSecret Web端JWT密钥，IMAP/SMTP的OAUTHBEARER和XOAUTH2认证使用Web登录签发的令牌
+	JWTSecret string `yaml:"jwt_secret"`
 }
 
 // MailServer 邮件服务器
@@ -31,20 +49,44 @@ type MailServer struct {
 	config            Config
 	smtpReceiveServer *SMTPServer // 25端口 - 接收外部邮件
 	smtpSubmitServer  *SMTPServer // 587端口 - 用户提交邮件
+	lmtpServer        *SMTPServer // LMTP - 前置MTA投递（可选）
 	imapServer        *IMAPServer
+	pop3Server        *POP3Server // POP3 - 旧设备收信（可选）
 	storage           *MailStorage
 	ctx               context.Context
 	cancel            context.CancelFunc
 	wg                sync.WaitGroup
 }
 
-// NewMailServer 创建邮件服务器
-func NewMailServer(config Config, db *gorm.DB) *MailServer {
+// NewMailServer 创建邮件服务器，events 为与Web端共享的邮件事件总线，blobs 为共享的邮件原文存储
+// PROXY protocol 配置无效时返回错误
+func NewMailServer(config Config, db *gorm.DB, events *event.Bus, blobs blob.BlobStore) (*MailServer, error) {
+	// PROXY protocol（部署在HAProxy/云负载均衡之后时使用）
+	var policy *ProxyProtocolPolicy
+	if config.ProxyProtocol {
+		var err error
+		if policy, err = NewProxyProtocolPolicy(config.ProxyTrustedCIDRs); err != nil {
+			return nil, fmt.Errorf("PROXY protocol配置无效: %v", err)
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
-	storage := NewMailStorage(db, config.Domain)
+	storage := NewMailStorage(db, config.Domain, events, blobs)
+	storage.subaddressSeparators = config.SubaddressSeparators
+	storage.jwtSecret = config.JWTSecret
+
+	var lmtpServer *SMTPServer
+	if config.LMTPEnabled {
+		lmtpServer = NewLMTPServer(config.LMTPAddr, config.Domain, storage)
+	}
 
-	return &MailServer{
+	var pop3Server *POP3Server
+	if config.POP3Enabled {
+		pop3Server = NewPOP3Server(config, storage)
+	}
+
+	server := &MailServer{
 		config:  config,
 		storage: storage,
 		ctx:     ctx,
@@ -53,9 +95,27 @@ func NewMailServer(config Config, db *gorm.DB) *MailServer {
 		smtpReceiveServer: NewSMTPReceiveServer(config.SMTPReceivePort, config.Domain, storage, config.SMTPUseTLS, config.SMTPTLSCertPath, config.SMTPTLSKeyPath),
 		// 创建提交服务器 (587端口 - MSA功能)
 		smtpSubmitServer: NewSMTPSubmitServer(config.SMTPSubmitPort, config.Domain, storage, config.SMTPUseTLS, config.SMTPTLSCertPath, config.SMTPTLSKeyPath),
+		// LMTP服务器
+		lmtpServer: lmtpServer,
 		// IMAP服务器
 		imapServer: NewIMAPServer(config, storage),
+		// POP3服务器
+		pop3Server: pop3Server,
+	}
+
+	if policy != nil {
+		server.smtpReceiveServer.proxy = policy
+		server.smtpSubmitServer.proxy = policy
+		server.imapServer.proxy = policy
+		if lmtpServer != nil {
+			lmtpServer.proxy = policy
+		}
+		if pop3Server != nil {
+			pop3Server.proxy = policy
+		}
 	}
+
+	return server, nil
 }
 
 // Start 启动邮件服务器
@@ -64,6 +124,12 @@ func (s *MailServer) Start() error {
 	log.Printf("📧 SMTP接收服务器 (MTA): localhost:%d - 用于接收外部邮件", s.config.SMTPReceivePort)
 	log.Printf("📤 SMTP提交服务器 (MSA): localhost:%d - 用于用户认证提交", s.config.SMTPSubmitPort)
 	log.Printf("📬 IMAP服务器: localhost:%d", s.config.IMAPPort)
+	if s.lmtpServer != nil {
+		log.Printf("📮 LMTP服务器: %s", s.config.LMTPAddr)
+	}
+	if s.pop3Server != nil {
+		log.Printf("📥 POP3服务器: localhost:%d (TLS: %d)", s.config.POP3Port, s.config.POP3TLSPort)
+	}
 	log.Printf("🌐 域名: %s", s.config.Domain)
 	log.Printf("⚠️  外部邮件应连接到端口%d，用户提交应连接到端口%d", s.config.SMTPReceivePort, s.config.SMTPSubmitPort)
 
@@ -85,6 +151,17 @@ func (s *MailServer) Start() error {
 		}
 	}()
 
+	// 启动LMTP服务器（可选）
+	if s.lmtpServer != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if err := s.lmtpServer.Start(s.ctx); err != nil {
+				log.Printf("❌ LMTP服务器启动失败: %v", err)
+			}
+		}()
+	}
+
 	// 启动IMAP服务器
 	s.wg.Add(1)
 	go func() {
@@ -94,6 +171,17 @@ func (s *MailServer) Start() error {
 		}
 	}()
 
+	// 启动POP3服务器（可选）
+	if s.pop3Server != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if err := s.pop3Server.Start(s.ctx); err != nil {
+				log.Printf("❌ POP3服务器启动失败: %v", err)
+			}
+		}()
+	}
+
 	// 等待服务器启动
 	time.Sleep(200 * time.Millisecond)
 
@@ -2,8 +2,12 @@ package mailserver
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/emersion/go-smtp"
@@ -15,8 +19,24 @@ type SMTPServerType int
 const (
 	SMTPServerTypeReceive SMTPServerType = iota // MTA - 接收外部邮件 (25端口)
 	SMTPServerTypeSubmit                        // MSA - 用户提交邮件 (587端口)
+	SMTPServerTypeLMTP                          // LMTP - 前置MTA（如Postfix）投递本地邮件
 )
 
+// maxMessageBytes 投递到邮箱的单封邮件大小上限，MTA、LMTP 和 IMAP APPEND 共用
+const maxMessageBytes = 50 * 1024 * 1024
+
+// label 返回用于日志的服务器类型名称
+func (t SMTPServerType) label() string {
+	switch t {
+	case SMTPServerTypeSubmit:
+		return "MSA(提交)"
+	case SMTPServerTypeLMTP:
+		return "LMTP(投递)"
+	default:
+		return "MTA(接收)"
+	}
+}
+
 // SMTPServer SMTP服务器
 type SMTPServer struct {
 	port       int
@@ -25,6 +45,7 @@ type SMTPServer struct {
 	server     *smtp.Server
 	serverType SMTPServerType // 服务器类型
 	useTLS     bool
+	proxy      *ProxyProtocolPolicy // PROXY protocol策略，nil表示未启用
 }
 
 // NewSMTPReceiveServer 创建SMTP接收服务器 (MTA - 25端口)
@@ -36,7 +57,7 @@ func NewSMTPReceiveServer(port int, domain string, storage *MailStorage, useTLS
 	server.Domain = domain
 	server.WriteTimeout = 30 * time.Second
 	server.ReadTimeout = 30 * time.Second
-	server.MaxMessageBytes = 50 * 1024 * 1024 // 50MB for external emails
+	server.MaxMessageBytes = maxMessageBytes // 50MB for external emails
 	server.MaxRecipients = 100
 	server.AllowInsecureAuth = true // MTA可以接受非加密连接
 
@@ -91,6 +112,43 @@ func NewSMTPSubmitServer(port int, domain string, storage *MailStorage, useTLS b
 	}
 }
 
+// NewLMTPServer 创建LMTP服务器 (RFC 2033)
+// addr 为TCP地址（如 ":24"）或 "unix:/path/to/lmtp.sock" 形式的Unix套接字
+func NewLMTPServer(addr string, domain string, storage *MailStorage) *SMTPServer {
+	backend := NewSMTPBackend(domain, storage, SMTPServerTypeLMTP)
+
+	server := smtp.NewServer(backend)
+	server.LMTP = true
+	server.Network, server.Addr = parseLMTPAddr(addr)
+	server.Domain = domain
+	server.WriteTimeout = 30 * time.Second
+	server.ReadTimeout = 30 * time.Second
+	server.MaxMessageBytes = maxMessageBytes // 与MTA保持一致
+	server.MaxRecipients = 100
+	server.AllowInsecureAuth = true // LMTP由前置MTA在可信网络内连接，不做认证
+
+	return &SMTPServer{
+		domain:     domain,
+		storage:    storage,
+		server:     server,
+		serverType: SMTPServerTypeLMTP,
+	}
+}
+
+// parseLMTPAddr 解析LMTP监听地址，返回网络类型和地址
+func parseLMTPAddr(addr string) (string, string) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return "unix", path
+	}
+	if strings.HasPrefix(addr, "/") {
+		return "unix", addr
+	}
+	if addr == "" {
+		addr = ":24"
+	}
+	return "tcp", addr
+}
+
 // SMTPBackend 实现 smtp.Backend 接口
 type SMTPBackend struct {
 	domain     string
@@ -109,10 +167,7 @@ func NewSMTPBackend(domain string, storage *MailStorage, serverType SMTPServerTy
 
 // NewSession 创建新的SMTP会话
 func (b *SMTPBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
-	serverTypeStr := "MTA(接收)"
-	if b.serverType == SMTPServerTypeSubmit {
-		serverTypeStr = "MSA(提交)"
-	}
+	serverTypeStr := b.serverType.label()
 	log.Printf("📧 新SMTP连接来自: %s [%s]", c.Conn().RemoteAddr(), serverTypeStr)
 
 	session := &SMTPSession{
@@ -128,12 +183,13 @@ func (b *SMTPBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
 		log.Printf("🔒 MSA服务器要求认证")
 	} else {
 		session.requireAuth = false
-		log.Printf("🌐 MTA服务器可接受未认证连接")
+		log.Printf("🌐 %s服务器可接受未认证连接", serverTypeStr)
 	}
 
 	// 验证session实现了必要的接口
 	var _ smtp.Session = session
 	var _ smtp.AuthSession = session // 确保实现了AuthSession接口
+	var _ smtp.LMTPSession = session // LMTP模式下按收件人返回状态
 
 	log.Printf("✅ 会话创建成功，支持认证接口: %t", true)
 
@@ -144,20 +200,44 @@ func (b *SMTPBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
 // Start 启动SMTP服务器
 func (s *SMTPServer) Start(ctx context.Context) error {
 	serverTypeStr := "接收服务器(MTA)"
-	if s.serverType == SMTPServerTypeSubmit {
+	switch s.serverType {
+	case SMTPServerTypeSubmit:
 		serverTypeStr = "提交服务器(MSA)"
+	case SMTPServerTypeLMTP:
+		serverTypeStr = "投递服务器(LMTP)"
 	}
 
-	if s.useTLS {
+	if s.serverType == SMTPServerTypeLMTP {
+		// Unix套接字需要先清理上次运行残留的文件
+		if s.server.Network == "unix" {
+			if err := os.Remove(s.server.Addr); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("清理LMTP套接字失败: %v", err)
+			}
+		}
+		log.Printf("✅ %s 启动成功，监听: %s %s", serverTypeStr, s.server.Network, s.server.Addr)
+	} else if s.useTLS {
 		log.Printf("✅ SMTP%s (TLS) 启动成功，监听端口: %d", serverTypeStr, s.port)
 	} else {
 		log.Printf("⚠️ SMTP%s (非TLS) 启动成功，监听端口: %d", serverTypeStr, s.port)
 	}
 	log.Printf("🌐 SMTP域名: %s", s.domain)
 
+	network := s.server.Network
+	if network == "" {
+		network = "tcp"
+	}
+	listener, err := net.Listen(network, s.server.Addr)
+	if err != nil {
+		return fmt.Errorf("无法监听 %s: %v", s.server.Addr, err)
+	}
+	// PROXY protocol仅适用于TCP监听
+	if network == "tcp" {
+		listener = s.proxy.wrapListener(listener)
+	}
+
 	// 在goroutine中启动服务器
 	go func() {
-		if err := s.server.ListenAndServe(); err != nil {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, smtp.ErrServerClosed) {
 			log.Printf("❌ SMTP%s错误: %v", serverTypeStr, err)
 		}
 	}()
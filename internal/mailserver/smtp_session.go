@@ -1,7 +1,10 @@
 package mailserver
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -12,17 +15,31 @@ import (
 	"time"
 
 	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-sasl"
 	gosmtp "github.com/emersion/go-smtp"
+	"github.com/rankgice/new-email/internal/blob"
 	"github.com/rankgice/new-email/internal/localSasl"
+	"github.com/rankgice/new-email/internal/model"
 )
 
+// errRecipientNotFound 收件人邮箱不存在
+var errRecipientNotFound = errors.New("recipient mailbox not found")
+
+// mailboxFullError 收件人邮箱超出存储配额 (RFC 3463 5.2.2)
+var mailboxFullError = &gosmtp.SMTPError{
+	Code:         552,
+	EnhancedCode: gosmtp.EnhancedCode{5, 2, 2},
+	Message:      "Mailbox full",
+}
+
 // SMTPSession 实现 smtp.Session 和 smtp.AuthSession 接口
 type SMTPSession struct {
 	backend       *SMTPBackend
 	conn          *gosmtp.Conn
 	from          string
 	to            []string
+	size          int64          // MAIL FROM 声明的邮件大小（SIZE参数），未声明时为0
 	serverType    SMTPServerType // 服务器类型
 	authenticated bool           // 认证状态
 	requireAuth   bool           // 是否要求认证
@@ -31,13 +48,9 @@ type SMTPSession struct {
 
 // AuthMechanisms 返回支持的认证机制
 func (s *SMTPSession) AuthMechanisms() []string {
-	serverTypeStr := "MTA(接收)"
-	if s.serverType == SMTPServerTypeSubmit {
-		serverTypeStr = "MSA(提交)"
-	}
+	serverTypeStr := s.serverType.label()
 
-	// 目前只支持PLAIN认证机制
-	mechanisms := []string{"PLAIN", "LOGIN"}
+	mechanisms := s.backend.storage.saslMechanisms([]string{sasl.Plain, sasl.Login}, s.channelBinding())
 
 	log.Printf("🔐 AuthMechanisms被调用 [%s]: 返回支持的认证机制 %v", serverTypeStr, mechanisms)
 	return mechanisms
@@ -45,10 +58,7 @@ func (s *SMTPSession) AuthMechanisms() []string {
 
 // Auth 处理指定的认证机制
 func (s *SMTPSession) Auth(mech string) (sasl.Server, error) {
-	serverTypeStr := "MTA(接收)"
-	if s.serverType == SMTPServerTypeSubmit {
-		serverTypeStr = "MSA(提交)"
-	}
+	serverTypeStr := s.serverType.label()
 
 	log.Printf("🔐 Auth方法被调用 [%s]: 请求认证机制 %s", serverTypeStr, mech)
 
@@ -65,7 +75,7 @@ func (s *SMTPSession) Auth(mech string) (sasl.Server, error) {
 			}
 
 			// 使用存储层验证凭据
-			if !s.backend.storage.ValidatePassword(username, password) {
+			if !s.backend.storage.ValidatePassword(username, password, model.AppPasswordScopeSMTP) {
 				log.Printf("❌ 认证失败: 用户名或密码错误 %s [%s]", username, serverTypeStr)
 				return fmt.Errorf("invalid credentials")
 			}
@@ -82,7 +92,7 @@ func (s *SMTPSession) Auth(mech string) (sasl.Server, error) {
 		log.Printf("🔐 使用LOGIN认证机制 [%s]", serverTypeStr)
 		return localSasl.NewLoginServer(func(username, password string) error {
 			// 验证用户名和密码
-			if !s.backend.storage.ValidateCredentials(username, password) {
+			if !s.backend.storage.ValidateCredentials(username, password, model.AppPasswordScopeSMTP) {
 				log.Printf("❌ LOGIN认证失败: %s [%s]", username, serverTypeStr)
 				return fmt.Errorf("invalid credentials")
 			}
@@ -95,17 +105,34 @@ func (s *SMTPSession) Auth(mech string) (sasl.Server, error) {
 		}), nil
 
 	default:
+		// SCRAM-SHA-256(-PLUS)、OAUTHBEARER、XOAUTH2
+		mech = strings.ToUpper(mech)
+		server := s.backend.storage.newSASLServer(mech, s.channelBinding(), func(email string) error {
+			s.authenticated = true
+			s.authUser = email
+			log.Printf("✅ %s认证成功: %s [%s]", mech, email, serverTypeStr)
+			return nil
+		})
+		if server != nil {
+			return server, nil
+		}
 		log.Printf("❌ 不支持的认证机制: %s [%s]", mech, serverTypeStr)
 		return nil, fmt.Errorf("unsupported authentication mechanism: %s", mech)
 	}
 }
 
+// channelBinding 返回当前连接的TLS通道绑定，未启用TLS时返回nil
+func (s *SMTPSession) channelBinding() localSasl.ChannelBinding {
+	state, ok := s.conn.TLSConnectionState()
+	if !ok {
+		return nil
+	}
+	return tlsChannelBinding(&state)
+}
+
 // Mail 处理MAIL FROM命令
 func (s *SMTPSession) Mail(from string, opts *gosmtp.MailOptions) error {
-	serverTypeStr := "MTA(接收)"
-	if s.serverType == SMTPServerTypeSubmit {
-		serverTypeStr = "MSA(提交)"
-	}
+	serverTypeStr := s.serverType.label()
 	log.Printf("📤 MAIL FROM: %s [%s]", from, serverTypeStr)
 
 	// MSA服务器必须要求认证
@@ -129,6 +156,10 @@ func (s *SMTPSession) Mail(from string, opts *gosmtp.MailOptions) error {
 
 	s.from = from
 	s.to = []string{} // 重置收件人列表
+	s.size = 0
+	if opts != nil {
+		s.size = opts.Size
+	}
 
 	log.Printf("✅ 发件人设置成功: %s [%s]", from, serverTypeStr)
 	return nil
@@ -136,10 +167,7 @@ func (s *SMTPSession) Mail(from string, opts *gosmtp.MailOptions) error {
 
 // Rcpt 处理RCPT TO命令
 func (s *SMTPSession) Rcpt(to string, opts *gosmtp.RcptOptions) error {
-	serverTypeStr := "MTA(接收)"
-	if s.serverType == SMTPServerTypeSubmit {
-		serverTypeStr = "MSA(提交)"
-	}
+	serverTypeStr := s.serverType.label()
 	log.Printf("📥 RCPT TO: %s [%s]", to, serverTypeStr)
 
 	// MSA服务器必须要求认证
@@ -164,10 +192,31 @@ func (s *SMTPSession) Rcpt(to string, opts *gosmtp.RcptOptions) error {
 		log.Printf("✅ MTA确认本地域名邮箱: %s", to)
 	}
 
+	// LMTP由前置MTA投递，收件人邮箱必须存在，否则由前置MTA生成退信
+	if s.serverType == SMTPServerTypeLMTP {
+		if !s.backend.storage.isMailboxExists(to) {
+			log.Printf("❌ LMTP收件人邮箱不存在: %s", to)
+			return &gosmtp.SMTPError{
+				Code:         550,
+				EnhancedCode: gosmtp.EnhancedCode{5, 1, 1},
+				Message:      "Mailbox does not exist",
+			}
+		}
+		log.Printf("✅ LMTP确认本地邮箱: %s", to)
+	}
+
+	// 投递给本地邮箱前检查存储配额，已满的邮箱直接拒绝该收件人
+	if s.serverType != SMTPServerTypeSubmit {
+		if err := s.checkRecipientQuota(to); err != nil {
+			log.Printf("❌ 收件人邮箱超出存储配额: %s [%s]", to, serverTypeStr)
+			return err
+		}
+	}
+
 	// 检查是否超过最大收件人数量
 	maxRecipients := 50
-	if s.serverType == SMTPServerTypeReceive {
-		maxRecipients = 100 // MTA可以接受更多收件人
+	if s.serverType != SMTPServerTypeSubmit {
+		maxRecipients = 100 // MTA/LMTP可以接受更多收件人
 	}
 
 	if len(s.to) >= maxRecipients {
@@ -180,43 +229,121 @@ func (s *SMTPSession) Rcpt(to string, opts *gosmtp.RcptOptions) error {
 	return nil
 }
 
-// Data 处理DATA命令
-func (s *SMTPSession) Data(r io.Reader) error {
-	serverTypeStr := "MTA(接收)"
-	if s.serverType == SMTPServerTypeSubmit {
-		serverTypeStr = "MSA(提交)"
+// checkRecipientQuota 按 MAIL FROM 声明的大小检查收件人邮箱配额，超出时返回552
+// 收件人不存在或查询失败时不在此拒绝，由投递阶段处理
+func (s *SMTPSession) checkRecipientQuota(to string) error {
+	mailbox, _, err := s.backend.storage.resolveRecipient(to)
+	if err != nil || mailbox == nil {
+		return nil
 	}
-	log.Printf("📨 开始接收邮件数据... [%s]", serverTypeStr)
+	if err := s.backend.storage.checkQuota(mailbox.Id, s.size, 1); errors.Is(err, model.ErrQuotaExceeded) {
+		return mailboxFullError
+	}
+	return nil
+}
+
+// incomingMessage DATA阶段解析得到的邮件，原始报文保存在blob中，内存中只有邮件头
+type incomingMessage struct {
+	header     message.Header
+	blobKey    string // 原始报文在blob存储中的键
+	size       int64  // 原始报文大小
+	subject    string
+	messageID  string
+	inReplyTo  string // In-Reply-To 中的消息ID
+	references string // References 中的消息ID，空格分隔
+}
+
+// readIncoming 解析DATA阶段的邮件头，并将完整报文流式写入blob存储
+// 调用方处理完毕后需调用 releaseBlob 清理没有被任何邮件引用的原文
+func (s *SMTPSession) readIncoming(r io.Reader) (*incomingMessage, error) {
+	serverTypeStr := s.serverType.label()
 
 	if s.from == "" {
-		return fmt.Errorf("no sender specified")
+		return nil, fmt.Errorf("no sender specified")
 	}
 
 	if len(s.to) == 0 {
-		return fmt.Errorf("no recipients specified")
+		return nil, fmt.Errorf("no recipients specified")
 	}
 
-	// 解析邮件
-	msg, err := message.Read(r)
+	// 解析邮件头，正文留在连接中
+	br := bufio.NewReader(r)
+	rawHeader, err := textproto.ReadHeader(br)
 	if err != nil {
 		log.Printf("❌ 解析邮件失败: %v [%s]", err, serverTypeStr)
-		return fmt.Errorf("failed to parse message: %v", err)
+		return nil, fmt.Errorf("failed to parse message: %v", err)
 	}
+	header := message.Header{Header: rawHeader}
 
-	// 读取邮件正文
-	body, err := io.ReadAll(msg.Body)
+	// MIME 头解码器， 解码标题
+	decoder := new(mime.WordDecoder)
+	subject, err := decoder.DecodeHeader(header.Get("Subject"))
 	if err != nil {
-		log.Printf("❌ 读取邮件正文失败: %v [%s]", err, serverTypeStr)
-		return fmt.Errorf("failed to read message body: %v", err)
+		subject = header.Get("Subject") // 解码失败就用原文
 	}
-	log.Printf("📊 邮件数据大小: %d 字节 [%s]", len(body), serverTypeStr)
 
-	// MIME 头解码器， 解码标题
-	decoder := new(mime.WordDecoder)
-	subject, err := decoder.DecodeHeader(msg.Header.Get("Subject"))
+	// 保留发件人的Message-ID，缺失时才生成，并写回邮件头以便保存和转发时携带
+	messageID := strings.TrimSpace(header.Get("Message-Id"))
+	if messageID == "" {
+		messageID = generateMessageID(s.backend.domain)
+		header.Set("Message-Id", messageID)
+		log.Printf("🆔 邮件缺少Message-ID，已生成: %s [%s]", messageID, serverTypeStr)
+	}
+
+	// 邮件头写回后接上剩余正文，整体流式写入blob，大小上限与服务器的 MaxMessageBytes 一致
+	var head bytes.Buffer
+	if err := textproto.WriteHeader(&head, header.Header); err != nil {
+		return nil, fmt.Errorf("failed to write message header: %v", err)
+	}
+	blobKey, size, err := s.backend.storage.blobs.Put(io.MultiReader(&head, br), s.conn.Server().MaxMessageBytes)
+	if errors.Is(err, blob.ErrTooLarge) {
+		log.Printf("❌ 邮件超过大小上限 %d 字节 [%s]", s.conn.Server().MaxMessageBytes, serverTypeStr)
+		return nil, gosmtp.ErrDataTooLarge
+	}
+	if err != nil {
+		log.Printf("❌ 保存邮件原文失败: %v [%s]", err, serverTypeStr)
+		return nil, err
+	}
+	log.Printf("📊 邮件数据大小: %d 字节 [%s]", size, serverTypeStr)
+
+	inReplyTo, references := threadHeaders(header.Get)
+
+	return &incomingMessage{
+		header:     header,
+		blobKey:    blobKey,
+		size:       size,
+		subject:    subject,
+		messageID:  messageID,
+		inReplyTo:  inReplyTo,
+		references: references,
+	}, nil
+}
+
+// openBody 打开blob中的原始报文并跳过邮件头，返回正文读取器
+func (s *SMTPSession) openBody(in *incomingMessage) (io.Reader, io.Closer, error) {
+	r, err := s.backend.storage.blobs.Open(in.blobKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	br := bufio.NewReader(r)
+	if _, err := textproto.ReadHeader(br); err != nil {
+		r.Close()
+		return nil, nil, err
+	}
+	return br, r, nil
+}
+
+// Data 处理DATA命令
+func (s *SMTPSession) Data(r io.Reader) error {
+	serverTypeStr := s.serverType.label()
+	log.Printf("📨 开始接收邮件数据... [%s]", serverTypeStr)
+
+	in, err := s.readIncoming(r)
 	if err != nil {
-		subject = msg.Header.Get("Subject") // 解码失败就用原文
+		return err
 	}
+	defer s.backend.storage.releaseBlob(in.blobKey)
+	subject, messageID := in.subject, in.messageID
 
 	// 根据服务器类型进行不同处理
 	if s.serverType == SMTPServerTypeSubmit {
@@ -257,44 +384,59 @@ func (s *SMTPSession) Data(r io.Reader) error {
 		log.Printf("📬 本地收件人: %v", localRecipients)
 		log.Printf("🌐 外部收件人: %v", externalRecipients)
 
+		// 发件人自己的"Sent"文件夹存储一份已发送副本
+		sentMail := &StoredMail{
+			MessageID:   messageID,
+			InReplyTo:   in.inReplyTo,
+			References:  in.references,
+			From:        s.from,
+			To:          s.to, // 存储所有收件人，包括外部的，因为这是已发送邮件的副本
+			Subject:     subject,
+			BlobKey:     in.blobKey,
+			ContentType: in.header.Get("Content-Type"),
+			Size:        int(in.size),
+			Received:    time.Now(),
+			IsRead:      true, // 已发送邮件默认为已读
+			FolderId:    sentFolder.Id,
+			FolderName:  sentFolder.Name,
+			MailboxID:   mailbox.Id,
+			Username:    s.authUser,
+			Direction:   "sent",
+		}
+		sentStored, err := s.backend.storage.StoreMail(sentMail)
+		if err != nil {
+			log.Printf("❌ 存储已发送邮件失败: %v [%s]", err, serverTypeStr)
+			return fmt.Errorf("failed to store sent message: %v", err)
+		}
+
 		// 处理外部收件人 - 转发到外部邮件服务器
+		// 信封发件人使用VERP地址，退信可直接关联到已发送邮件
 		if len(externalRecipients) > 0 {
+			envelopeFrom := s.backend.storage.verpAddress(s.from, sentMail.ID)
 			log.Printf("🚀 开始转发邮件到外部服务器，收件人: %v", externalRecipients)
-			if err := s.relayToExternal(s.from, externalRecipients, msg, body); err != nil {
+			if err := s.relayToExternal(envelopeFrom, externalRecipients, in); err != nil {
 				log.Printf("❌ 外部邮件转发失败: %v [%s]", err, serverTypeStr)
 				// 根据策略决定是否返回错误
 				// 选项1: 返回错误，整个邮件发送失败
 				// 选项2: 只记录日志，本地邮件仍然成功
 				// 这里我们选择返回错误，确保用户知道外部邮件发送失败
+				// 撤销本次新建的已发送副本，避免客户端重试时被当作重复邮件
+				if sentStored {
+					if err := s.backend.storage.ExpungeMails([]*StoredMail{sentMail}); err != nil {
+						log.Printf("❌ 撤销已发送副本失败: %v [%s]", err, serverTypeStr)
+					}
+				}
 				return fmt.Errorf("failed to relay external message: %v", err)
 			}
 			log.Printf("✅ 外部邮件转发成功，收件人: %v", externalRecipients)
 		}
 
-		// 处理本地收件人 - 存储到本地邮箱 (包括发件人自己的"Sent"文件夹)
-		// 即使没有本地收件人，发件人自己的"Sent"文件夹也应该存储
-		if len(localRecipients) > 0 || s.authenticated {
-			localMail := &StoredMail{
-				MessageID:   generateMessageID(s.backend.domain),
-				From:        s.from,
-				To:          s.to, // 存储所有收件人，包括外部的，因为这是已发送邮件的副本
-				Subject:     subject,
-				Body:        string(body),
-				ContentType: msg.Header.Get("Content-Type"),
-				Size:        len(body),
-				Received:    time.Now(),
-				IsRead:      true, // 已发送邮件默认为已读
-				FolderId:    sentFolder.Id,
-				FolderName:  sentFolder.Name,
-				MailboxID:   mailbox.Id,
-				Username:    s.authUser,
-			}
-
-			if err := s.backend.storage.StoreMail(localMail); err != nil {
-				log.Printf("❌ 存储本地邮件失败: %v [%s]", err, serverTypeStr)
-				return fmt.Errorf("failed to store local message: %v", err)
+		// 处理本地收件人 - 每个收件人邮箱只投递一份
+		delivered := make(map[int64]bool)
+		for _, recipient := range localRecipients {
+			if err := s.deliverToRecipient(recipient, in, delivered); err != nil {
+				log.Printf("❌ 投递本地收件人失败 %s: %v [%s]", recipient, err, serverTypeStr)
 			}
-			log.Printf("✅ 本地邮件存储成功: %s", localMail.MessageID)
 		}
 
 		log.Printf("✅ 邮件处理完成 [%s] - 本地:%d, 外部:%d", serverTypeStr, len(localRecipients), len(externalRecipients))
@@ -306,74 +448,171 @@ func (s *SMTPSession) Data(r io.Reader) error {
 		log.Printf("📥 处理接收邮件: %s", subject)
 		// TODO: 垃圾邮件检查、病毒扫描等
 
-		// 为每个本地收件人存储邮件
+		s.handleDeliveryReport(in)
+
+		// 为每个本地收件人邮箱存储一份邮件
+		delivered := make(map[int64]bool)
+		overQuota := 0
 		for _, toAddr := range s.to {
-			mailbox, err := s.backend.storage.findMailboxByEmail(toAddr)
-			if err != nil {
-				log.Printf("查找收件人邮箱失败 %s: %v", toAddr, err)
-				continue
-			}
-			if mailbox == nil {
-				log.Printf("收件人邮箱不存在: %s", toAddr)
-				continue
+			if err := s.deliverToRecipient(toAddr, in, delivered); err != nil {
+				// 这里不返回错误，尝试为其他收件人存储
+				log.Printf("❌ 存储邮件失败 %s: %v [%s]", toAddr, err, serverTypeStr)
+				if errors.Is(err, model.ErrQuotaExceeded) {
+					overQuota++
+				}
 			}
+		}
+		// 所有收件人都因配额不足无法投递时拒绝整封邮件，由发送方生成退信
+		if overQuota > 0 && overQuota == len(s.to) {
+			return mailboxFullError
+		}
+		return nil
+	}
+}
 
-			// 获取或创建INBOX文件夹
-			inboxFolder, err := s.backend.storage.getOrCreateFolder(mailbox.Id, "INBOX", nil, true)
-			if err != nil {
-				log.Printf("为邮箱 %s 获取或创建INBOX文件夹失败: %v", toAddr, err)
-				continue
-			}
+// deliverToRecipient 将邮件投递到单个本地收件人的邮箱
+// delivered 记录本次会话已投递的邮箱，多个地址（如子地址）指向同一邮箱时只投递一份
+func (s *SMTPSession) deliverToRecipient(toAddr string, in *incomingMessage, delivered map[int64]bool) error {
+	mailbox, tag, err := s.backend.storage.resolveRecipient(toAddr)
+	if err != nil {
+		return fmt.Errorf("查找收件人邮箱失败: %v", err)
+	}
+	if mailbox == nil {
+		return fmt.Errorf("%w: %s", errRecipientNotFound, toAddr)
+	}
+	if delivered[mailbox.Id] {
+		log.Printf("⏭️  邮箱 %s 已投递过该邮件，跳过收件人 %s", mailbox.Email, toAddr)
+		return nil
+	}
 
-			// 创建存储邮件对象
-			storedMail := &StoredMail{
-				MessageID:   generateMessageID(s.backend.domain),
-				From:        s.from,
-				To:          s.to,
-				Subject:     subject,
-				Body:        string(body),
-				ContentType: msg.Header.Get("Content-Type"),
-				Size:        len(body),
-				Received:    time.Now(),
-				IsRead:      false,
-				FolderId:    inboxFolder.Id,
-				FolderName:  inboxFolder.Name,
-				MailboxID:   mailbox.Id,
-				Username:    toAddr, // 收件人作为邮件所属用户
-			}
+	// VERP退信标签不作为子地址归档
+	if isVERPTag(tag) {
+		tag = ""
+	}
+
+	// 获取或创建投递文件夹（默认INBOX，子地址归档时为标签同名文件夹）
+	folder, err := s.backend.storage.deliveryFolder(mailbox, tag)
+	if err != nil {
+		return fmt.Errorf("获取或创建投递文件夹失败: %v", err)
+	}
 
-			log.Printf("📧 准备存储邮件: From=%s, To=%v, Subject=%s, FolderId=%d, MailboxId=%d",
-				s.from, s.to, subject, inboxFolder.Id, mailbox.Id)
+	if err := s.backend.storage.checkQuota(mailbox.Id, in.size, 1); err != nil {
+		return fmt.Errorf("%w: %s", err, mailbox.Email)
+	}
 
-			// 存储邮件
-			if err := s.backend.storage.StoreMail(storedMail); err != nil {
-				log.Printf("❌ 存储邮件失败: %v [%s]", err, serverTypeStr)
-				// 这里不返回错误，尝试为其他收件人存储
-			} else {
-				log.Printf("✅ 邮件存储成功: %s [%s] 到邮箱 %s (ID: %d), 文件夹 %s (ID: %d)", storedMail.MessageID, serverTypeStr, toAddr, mailbox.Id, inboxFolder.Name, inboxFolder.Id)
-			}
+	storedMail := &StoredMail{
+		MessageID:   in.messageID,
+		InReplyTo:   in.inReplyTo,
+		References:  in.references,
+		From:        s.from,
+		To:          s.to,
+		Subject:     in.subject,
+		BlobKey:     in.blobKey,
+		ContentType: in.header.Get("Content-Type"),
+		Size:        int(in.size),
+		Received:    time.Now(),
+		IsRead:      false,
+		FolderId:    folder.Id,
+		FolderName:  folder.Name,
+		MailboxID:   mailbox.Id,
+		Username:    mailbox.Email, // 收件人作为邮件所属用户
+		Direction:   "received",
+	}
+
+	log.Printf("📧 准备存储邮件: From=%s, To=%s, Subject=%s, FolderId=%d, MailboxId=%d",
+		s.from, toAddr, in.subject, folder.Id, mailbox.Id)
+
+	if _, err := s.backend.storage.StoreMail(storedMail); err != nil {
+		return err
+	}
+	delivered[mailbox.Id] = true
+
+	log.Printf("✅ 邮件投递完成: %s 到邮箱 %s (ID: %d), 文件夹 %s (ID: %d)", in.messageID, toAddr, mailbox.Id, folder.Name, folder.Id)
+	return nil
+}
+
+// handleDeliveryReport 识别退信(DSN)和投诉(ARF)报告并关联到原始已发送邮件
+// 报告本身仍按普通邮件投递给收件人
+func (s *SMTPSession) handleDeliveryReport(in *incomingMessage) {
+	mediaType, _, _ := in.header.ContentType()
+	if mediaType != "multipart/report" {
+		return
+	}
+	body, closer, err := s.openBody(in)
+	if err != nil {
+		log.Printf("⚠️  读取报告邮件失败: %v", err)
+		return
+	}
+	defer closer.Close()
+
+	report := parseDeliveryReport(in.header, body)
+	if report == nil {
+		return
+	}
+	log.Printf("📑 收到投递报告: 投诉=%t, 原始Message-ID=%s [%s]", report.feedback, report.originalMessageID, s.serverType.label())
+	s.backend.storage.processDeliveryReport(s.to, report)
+}
+
+// LMTPData 处理LMTP的DATA命令，为每个收件人单独返回投递状态 (RFC 2033)
+func (s *SMTPSession) LMTPData(r io.Reader, status gosmtp.StatusCollector) error {
+	serverTypeStr := s.serverType.label()
+	log.Printf("📨 开始接收LMTP邮件数据... [%s]", serverTypeStr)
+
+	in, err := s.readIncoming(r)
+	if err != nil {
+		return err
+	}
+	defer s.backend.storage.releaseBlob(in.blobKey)
+
+	s.handleDeliveryReport(in)
+
+	// 复用MTA的投递逻辑，逐个收件人设置状态
+	delivered := make(map[int64]bool)
+	for _, toAddr := range s.to {
+		err := s.deliverToRecipient(toAddr, in, delivered)
+		if err != nil {
+			log.Printf("❌ LMTP投递失败 %s: %v [%s]", toAddr, err, serverTypeStr)
 		}
+		status.SetStatus(toAddr, lmtpRecipientStatus(err))
+	}
+
+	return nil
+}
+
+// lmtpRecipientStatus 将投递错误转换为LMTP收件人状态
+func lmtpRecipientStatus(err error) error {
+	if err == nil {
 		return nil
 	}
+	if errors.Is(err, errRecipientNotFound) {
+		return &gosmtp.SMTPError{
+			Code:         550,
+			EnhancedCode: gosmtp.EnhancedCode{5, 1, 1},
+			Message:      "Mailbox does not exist",
+		}
+	}
+	if errors.Is(err, model.ErrQuotaExceeded) {
+		return mailboxFullError
+	}
+	return &gosmtp.SMTPError{
+		Code:         451,
+		EnhancedCode: gosmtp.EnhancedCode{4, 3, 0},
+		Message:      "Temporary local delivery failure",
+	}
 }
 
 // Reset 重置会话状态
 func (s *SMTPSession) Reset() {
-	serverTypeStr := "MTA(接收)"
-	if s.serverType == SMTPServerTypeSubmit {
-		serverTypeStr = "MSA(提交)"
-	}
+	serverTypeStr := s.serverType.label()
 	log.Printf("🔄 重置SMTP会话状态 [%s]", serverTypeStr)
 	s.from = ""
 	s.to = []string{}
+	s.size = 0
 }
 
 // Logout 处理会话注销
 func (s *SMTPSession) Logout() error {
-	serverTypeStr := "MTA(接收)"
-	if s.serverType == SMTPServerTypeSubmit {
-		serverTypeStr = "MSA(提交)"
-	}
+	serverTypeStr := s.serverType.label()
 	log.Printf("👋 SMTP会话注销 [%s]", serverTypeStr)
 	return nil
 }
@@ -421,8 +660,8 @@ func formatHeaders(header mail.Header) string {
 	return strings.Join(headers, "\n")
 }
 
-// relayToExternal 转发邮件到外部邮件服务器
-func (s *SMTPSession) relayToExternal(from string, recipients []string, originalMsg *message.Entity, body []byte) error {
+// relayToExternal 转发邮件到外部邮件服务器，from 仅用作信封发件人（MAIL FROM）
+func (s *SMTPSession) relayToExternal(from string, recipients []string, in *incomingMessage) error {
 	log.Printf("🚀 开始转发邮件到外部服务器...")
 	log.Printf("   发件人: %s", from)
 	log.Printf("   收件人: %v", recipients)
@@ -441,7 +680,7 @@ func (s *SMTPSession) relayToExternal(from string, recipients []string, original
 
 	// 为每个域名组转发邮件
 	for domain, domainRecipients := range domainGroups {
-		if err := s.relayToDomain(domain, from, domainRecipients, originalMsg, body); err != nil {
+		if err := s.relayToDomain(domain, from, domainRecipients, in); err != nil {
 			log.Printf("❌ 转发到域名 %s 失败: %v", domain, err)
 			return fmt.Errorf("failed to relay to domain %s: %v", domain, err)
 		}
@@ -452,7 +691,7 @@ func (s *SMTPSession) relayToExternal(from string, recipients []string, original
 }
 
 // relayToDomain 转发邮件到指定域名的邮件服务器
-func (s *SMTPSession) relayToDomain(domain string, from string, recipients []string, originalMsg *message.Entity, body []byte) error {
+func (s *SMTPSession) relayToDomain(domain string, from string, recipients []string, in *incomingMessage) error {
 	// 查找域名的MX记录
 	mxHost, err := s.lookupMX(domain)
 	if err != nil {
@@ -532,8 +771,14 @@ func (s *SMTPSession) relayToDomain(domain string, from string, recipients []str
 	}
 	defer dataWriter.Close()
 
-	// 重建完整的邮件内容（包括头部和正文）
-	if err := s.writeCompleteMessage(dataWriter, originalMsg, body, from, successfulRecipients); err != nil {
+	// 重建完整的邮件内容（包括头部和正文），正文从blob流式读取
+	body, closer, err := s.openBody(in)
+	if err != nil {
+		return fmt.Errorf("failed to open message: %v", err)
+	}
+	defer closer.Close()
+	// from 为信封发件人（可能是VERP地址），邮件头的 From 保持会话发件人
+	if err := s.writeCompleteMessage(dataWriter, in.header, body, s.from, successfulRecipients); err != nil {
 		return fmt.Errorf("failed to write message: %v", err)
 	}
 
@@ -591,13 +836,13 @@ func (s *SMTPSession) lookupMX(domain string) (string, error) {
 }
 
 // writeCompleteMessage 写入完整的邮件消息
-func (s *SMTPSession) writeCompleteMessage(writer io.Writer, originalMsg *message.Entity, body []byte, from string, recipients []string) error {
+func (s *SMTPSession) writeCompleteMessage(writer io.Writer, header message.Header, body io.Reader, from string, recipients []string) error {
 	// 添加必要的邮件头
 	fmt.Fprintf(writer, "From: %s\r\n", from)
 	fmt.Fprintf(writer, "To: %s\r\n", strings.Join(recipients, ", "))
 
 	// 复制原始邮件头（除了From和To）
-	fields := originalMsg.Header.Fields()
+	fields := header.Fields()
 	for fields.Next() {
 		key := fields.Key()
 		value := fields.Value()
@@ -615,6 +860,6 @@ func (s *SMTPSession) writeCompleteMessage(writer io.Writer, originalMsg *messag
 	fmt.Fprintf(writer, "\r\n")
 
 	// 写入邮件正文
-	_, err := writer.Write(body)
+	_, err := io.Copy(writer, body)
 	return err
 }
@@ -1,12 +1,16 @@
 package mailserver
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
 	"time"
 
-	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"github.com/rankgice/new-email/internal/blob"
+	"github.com/rankgice/new-email/internal/event"
 	"github.com/rankgice/new-email/internal/model"
 	"github.com/rankgice/new-email/pkg/auth"
 	"gorm.io/gorm"
@@ -14,31 +18,47 @@ import (
 
 // MailStorage 邮件存储
 type MailStorage struct {
-	emailModel   *model.EmailModel
-	mailboxModel *model.MailboxModel
-	domainModel  *model.DomainModel
-	folderModel  *model.FolderModel // 新增
-	domain       string
+	db               *gorm.DB
+	emailModel       *model.EmailModel
+	mailboxModel     *model.MailboxModel
+	domainModel      *model.DomainModel
+	folderModel      *model.FolderModel // 新增
+	appPasswordModel *model.AppPasswordModel
+	folderAclModel   *model.FolderAclModel
+	domain           string
+
+	events   *event.Bus       // 邮件事件总线，所有写入路径在变更后发布事件
+	trackers *trackerRegistry // 被IMAP会话选中的文件夹跟踪
+	blobs    blob.BlobStore   // 邮件原文和附件存储
+
+	subaddressSeparators string // 子地址分隔符，为空时默认使用 "+"
+	jwtSecret            string // Web端JWT密钥，用于OAUTHBEARER/XOAUTH2认证，为空时不支持令牌认证
 }
 
 // StoredMail 存储的邮件
 type StoredMail struct {
 	ID          int64     `json:"id"`
+	UID         uint32    `json:"uid"` // 文件夹内的IMAP UID
 	MessageID   string    `json:"message_id"`
+	InReplyTo   string    `json:"in_reply_to"` // 所回复邮件的消息ID
+	References  string    `json:"references"`  // 引用的消息ID，空格分隔
 	From        string    `json:"from"`
 	To          []string  `json:"to"`
 	Cc          []string  `json:"cc"`
 	Bcc         []string  `json:"bcc"`
 	Subject     string    `json:"subject"`
-	Body        string    `json:"body"`
+	Body        string    `json:"body"`     // 直接存库的邮件内容，原文保存在blob中时为空
+	BlobKey     string    `json:"blob_key"` // 原始报文在blob存储中的键
 	ContentType string    `json:"content_type"`
 	Size        int       `json:"size"`
 	Received    time.Time `json:"received"`
 	IsRead      bool      `json:"is_read"`
+	Flags       []string  `json:"flags"`       // IMAP标志（系统标志和关键字）
 	FolderId    int64     `json:"folder_id"`   // 文件夹ID
 	FolderName  string    `json:"folder_name"` // 文件夹名称
 	MailboxID   int64     `json:"mailbox_id"`
 	Username    string    `json:"username"`
+	Direction   string    `json:"direction"` // 方向：sent发送 received接收，为空时视为接收
 }
 
 func normalizeStoredMessageID(raw string) string {
@@ -49,20 +69,107 @@ func normalizeStoredMessageID(raw string) string {
 	return normalized
 }
 
-// NewMailStorage 创建邮件存储
-func NewMailStorage(db *gorm.DB, domain string) *MailStorage {
-	s := &MailStorage{
-		emailModel:   model.NewEmailModel(db),
-		mailboxModel: model.NewMailboxModel(db),
-		domainModel:  model.NewDomainModel(db),
-		folderModel:  model.NewFolderModel(db),
-		domain:       domain,
+// threadHeaders 从邮件头提取会话相关的消息ID：In-Reply-To 取第一个，References 以空格分隔
+func threadHeaders(get func(key string) string) (inReplyTo, references string) {
+	if ids := model.ParseMessageIdList(get("In-Reply-To")); len(ids) > 0 {
+		inReplyTo = ids[0]
+	}
+	references = strings.Join(model.ParseMessageIdList(get("References")), " ")
+	return
+}
+
+// rawThreadHeaders 从原始邮件中提取会话相关的消息ID，用于APPEND等只有原文的场景
+func rawThreadHeaders(raw string) (inReplyTo, references string) {
+	header, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		return "", ""
+	}
+	return threadHeaders(header.Get)
+}
+
+// rawMessageID 从原始邮件头中提取 Message-Id，不存在时返回空字符串
+func rawMessageID(raw string) string {
+	header, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(header.Get("Message-Id"))
+}
+
+// NewMailStorage 创建邮件存储，events 为nil时使用独立的事件总线
+func NewMailStorage(db *gorm.DB, domain string, events *event.Bus, blobs blob.BlobStore) *MailStorage {
+	if events == nil {
+		events = event.NewBus()
 	}
+	s := &MailStorage{
+		db:               db,
+		emailModel:       model.NewEmailModel(db),
+		mailboxModel:     model.NewMailboxModel(db),
+		domainModel:      model.NewDomainModel(db),
+		folderModel:      model.NewFolderModel(db),
+		appPasswordModel: model.NewAppPasswordModel(db),
+		folderAclModel:   model.NewFolderAclModel(db),
+		domain:           domain,
+		events:           events,
+		blobs:            blobs,
+	}
+	// 邮件变更推送给选中相应文件夹的IMAP会话
+	s.trackers = newTrackerRegistry(s.emailModel.GetUidsByFolderId)
+	events.Subscribe(s.trackers.handle)
+	// 为升级前的数据补齐IMAP UID
+	s.assignMissingUIDs()
 	// 确保系统文件夹存在
 	s.ensureSystemFoldersExist(db)
+	// 按邮件表校准配额用量，补齐升级前邮件的大小
+	if err := model.RecalculateUsage(db); err != nil {
+		log.Printf("统计存储用量失败: %v", err)
+	}
+	// 升级前的邮件各自作为独立会话
+	if err := model.AssignMissingThreads(db); err != nil {
+		log.Printf("补齐邮件会话失败: %v", err)
+	}
 	return s
 }
 
+// assignMissingUIDs 为升级前创建的文件夹和邮件补齐UIDVALIDITY和UID
+func (s *MailStorage) assignMissingUIDs() {
+	folders, err := s.folderModel.GetWithoutUidValidity()
+	if err != nil {
+		log.Printf("查询待分配UID的文件夹失败: %v", err)
+		return
+	}
+
+	for _, folder := range folders {
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			emails, err := model.NewEmailModel(tx).GetWithoutUid(folder.Id)
+			if err != nil {
+				return err
+			}
+
+			uid := folder.UidNext
+			if uid == 0 {
+				uid = 1
+			}
+			for _, email := range emails {
+				if err := tx.Model(&model.Email{}).Where("id = ?", email.Id).UpdateColumn("uid", uid).Error; err != nil {
+					return err
+				}
+				uid++
+			}
+
+			return tx.Model(&model.Folder{}).Where("id = ?", folder.Id).UpdateColumns(map[string]interface{}{
+				"uid_validity": uint32(time.Now().Unix()),
+				"uid_next":     uid,
+			}).Error
+		})
+		if err != nil {
+			log.Printf("为文件夹 %s (ID: %d) 分配UID失败: %v", folder.Name, folder.Id, err)
+			continue
+		}
+		log.Printf("🔢 文件夹 %s (ID: %d) 已补齐UID", folder.Name, folder.Id)
+	}
+}
+
 // ensureSystemFoldersExist 确保每个邮箱都有默认的系统文件夹
 func (s *MailStorage) ensureSystemFoldersExist(db *gorm.DB) {
 	mailboxes, _, err := s.mailboxModel.List(model.MailboxListParams{})
@@ -71,13 +178,20 @@ func (s *MailStorage) ensureSystemFoldersExist(db *gorm.DB) {
 		return
 	}
 
-	systemFolders := []string{"INBOX", "Sent", "Drafts", "Trash"}
-
 	for _, mailbox := range mailboxes {
-		for _, folderName := range systemFolders {
-			_, err := s.getOrCreateFolder(mailbox.Id, folderName, nil, true)
+		for _, folderName := range model.SystemFolderNames {
+			folder, err := s.getOrCreateFolder(mailbox.Id, folderName, nil, true)
 			if err != nil {
 				log.Printf("为邮箱 %s 创建系统文件夹 %s 失败: %v", mailbox.Email, folderName, err)
+				continue
+			}
+
+			// 旧版本创建的系统文件夹没有特殊用途属性，补齐
+			specialUse := model.SystemFolderSpecialUse(folderName)
+			if folder.SpecialUse == "" && specialUse != "" {
+				if err := s.folderModel.SetSpecialUse(folder.Id, specialUse); err != nil {
+					log.Printf("为文件夹 %s (ID: %d) 设置特殊用途失败: %v", folderName, folder.Id, err)
+				}
 			}
 		}
 	}
@@ -105,30 +219,65 @@ func (s *MailStorage) getOrCreateFolder(mailboxId int64, name string, parentId *
 	return folder, nil
 }
 
+// checkQuota 检查邮箱能否再存入 messages 封共 bytes 字节的邮件
+func (s *MailStorage) checkQuota(mailboxId int64, bytes, messages int64) error {
+	return s.mailboxModel.CheckQuota(mailboxId, bytes, messages)
+}
+
+// getOrCreateFolderPath 按 "/" 分隔的完整路径获取文件夹，不存在时连同上级一起创建
+func (s *MailStorage) getOrCreateFolderPath(mailboxId int64, path string) (*model.Folder, error) {
+	folder, err := s.folderModel.GetByPath(mailboxId, path)
+	if err != nil || folder != nil {
+		return folder, err
+	}
+	folder, err = s.folderModel.CreatePath(mailboxId, path, "")
+	if errors.Is(err, model.ErrFolderExists) {
+		return s.folderModel.GetByPath(mailboxId, path)
+	}
+	return folder, err
+}
+
 // SaveMail (用于APPEND)
+// 调用方已解析出文件夹ID时邮件存入该文件夹所属的邮箱（可能是其他邮箱共享的文件夹），
+// 否则按路径在 mail.Username 邮箱中获取或创建文件夹
 func (s *MailStorage) SaveMail(mail *StoredMail) error {
-	// 1. 根据用户名查找邮箱
-	mailbox, err := s.findMailboxByEmail(mail.Username)
+	// 1. 获取目标文件夹和所属邮箱
+	var mailbox *model.Mailbox
+	var folder *model.Folder
+	var err error
+	if mail.FolderId != 0 {
+		folder, err = s.folderModel.GetById(mail.FolderId)
+		if err == nil && folder != nil {
+			mailbox, err = s.mailboxModel.GetById(folder.MailboxId)
+		}
+	} else {
+		mailbox, err = s.findMailboxByEmail(mail.Username)
+		if err == nil && mailbox == nil {
+			log.Printf("APPEND时邮箱不存在: %s", mail.Username)
+			return fmt.Errorf("邮箱 %s 不存在", mail.Username)
+		}
+		if err == nil {
+			folder, err = s.getOrCreateFolderPath(mailbox.Id, mail.FolderName)
+		}
+	}
 	if err != nil {
-		log.Printf("为APPEND查找邮箱失败 %s: %v", mail.Username, err)
+		log.Printf("为APPEND获取或创建文件夹失败 %s/%s: %v", mail.Username, mail.FolderName, err)
 		return err
 	}
-	if mailbox == nil {
-		log.Printf("APPEND时邮箱不存在: %s", mail.Username)
-		return fmt.Errorf("邮箱 %s 不存在", mail.Username)
+	if folder == nil {
+		return fmt.Errorf("文件夹不存在: %s", mail.FolderName)
 	}
 
 	// 2. 确定邮件方向
 	direction := "received"
-	// 如果发件人是自己，则认为是已发送邮件
-	if mail.From == mail.Username {
+	// 如果发件人是邮箱自己，则认为是已发送邮件
+	if mail.From == mailbox.Email {
 		direction = "sent"
 	}
 
-	// 3. 获取或创建目标文件夹
-	folder, err := s.getOrCreateFolder(mailbox.Id, mail.FolderName, nil, false) // 假设APPEND的文件夹不是系统文件夹
-	if err != nil {
-		log.Printf("为APPEND获取或创建文件夹失败 %s/%s: %v", mail.Username, mail.FolderName, err)
+	// 3. 检查存储配额
+	if err := s.checkQuota(mailbox.Id, int64(mail.Size), 1); err != nil {
+		log.Printf("APPEND超出存储配额: %s", mailbox.Email)
 		return err
 	}
 
@@ -138,13 +287,17 @@ func (s *MailStorage) SaveMail(mail *StoredMail) error {
 		UserId:      mailbox.UserId,
 		MailboxId:   mailbox.Id,
 		MessageId:   messageID,
+		InReplyTo:   mail.InReplyTo,
+		References:  mail.References,
 		Subject:     mail.Subject,
 		FromEmail:   mail.From,
 		ToEmails:    mail.To,
 		CcEmails:    mail.Cc,
 		BccEmails:   mail.Bcc,
 		Content:     mail.Body, // 存储原始邮件体
+		BlobKey:     mail.BlobKey,
 		ContentType: mail.ContentType,
+		Size:        int64(mail.Size),
 		IsRead:      mail.IsRead,
 		IsStarred:   false,
 		FolderId:    folder.Id, // 使用文件夹ID
@@ -154,72 +307,116 @@ func (s *MailStorage) SaveMail(mail *StoredMail) error {
 		UpdatedAt:   time.Now(),
 	}
 
-	// 5. 保存到数据库
+	// APPEND携带的标志
+	email.ApplyFlags(model.FlagOpAdd, mail.Flags)
+
+	// 5. 保存到数据库，UID在插入时分配
 	if err := s.emailModel.Create(email); err != nil {
 		log.Printf("APPEND存储邮件失败: %v", err)
 		return err
 	}
+	mail.ID = email.Id
+	mail.UID = email.Uid
+	mail.FolderId = folder.Id
+	mail.MailboxID = mailbox.Id
+	s.events.Publish(event.EmailEvent(event.TypeNew, email))
 
-	log.Printf("✅ 邮件已通过APPEND存储到邮箱: %s, 文件夹: %s (ID: %d)", mail.Username, mail.FolderName, folder.Id)
+	log.Printf("✅ 邮件已通过APPEND存储到邮箱: %s, 文件夹: %s (ID: %d)", mailbox.Email, mail.FolderName, folder.Id)
 	return nil
 }
 
-// StoreMail 存储邮件
-func (s *MailStorage) StoreMail(mail *StoredMail) error {
-	log.Printf("🎯 StoreMail: 开始存储邮件, From=%s, To=%v, Subject=%s", mail.From, mail.To, mail.Subject)
+// StoreMail 存储邮件到 mail.MailboxID 邮箱的 mail.FolderId 文件夹
+// 同一邮箱中相同 Message-ID 且方向相同的邮件只保留一份，重复投递时返回 false
+// 并发投递同一封邮件时由唯一索引保证只有一份写入成功
+func (s *MailStorage) StoreMail(mail *StoredMail) (bool, error) {
+	log.Printf("🎯 StoreMail: 开始存储邮件, From=%s, To=%v, Subject=%s, MailboxId=%d", mail.From, mail.To, mail.Subject, mail.MailboxID)
 
-	// 查找目标邮箱
-	for _, toAddr := range mail.To {
-		log.Printf("🔍 处理收件人: %s", toAddr)
-		mailbox, err := s.findMailboxByEmail(toAddr)
-		if err != nil {
-			log.Printf("❌ 查找邮箱失败 %s: %v", toAddr, err)
-			continue
-		}
-		if mailbox == nil {
-			log.Printf("❌ 邮箱不存在: %s", toAddr)
-			continue
-		}
-		log.Printf("✅ 找到收件人邮箱: ID=%d, Email=%s, UserId=%d", mailbox.Id, mailbox.Email, mailbox.UserId)
+	direction := mail.Direction
+	if direction == "" {
+		direction = "received"
+	}
+
+	mailbox, err := s.mailboxModel.GetById(mail.MailboxID)
+	if err != nil {
+		log.Printf("❌ 查找邮箱失败 (ID: %d): %v", mail.MailboxID, err)
+		return false, err
+	}
+
+	messageID := normalizeStoredMessageID(mail.MessageID)
+	stored := false
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		emailModel := model.NewEmailModel(tx)
 
-		// 获取或创建INBOX文件夹
-		inboxFolder, err := s.getOrCreateFolder(mailbox.Id, "INBOX", nil, true)
+		// 按 Message-ID + 邮箱 去重，避免同一封邮件重复投递
+		existing, err := emailModel.GetByMailboxIdMessageIdAndDirection(mailbox.Id, messageID, direction)
 		if err != nil {
-			log.Printf("为邮箱 %s 获取或创建INBOX文件夹失败: %v", toAddr, err)
-			continue
+			return err
+		}
+		if existing != nil {
+			mail.ID = existing.Id
+			mail.UID = existing.Uid
+			return nil
 		}
 
-		// 创建邮件记录
-		messageID := normalizeStoredMessageID(mail.MessageID)
 		email := &model.Email{
-			UserId:      mailbox.UserId, // 添加用户ID
+			UserId:      mailbox.UserId,
 			MailboxId:   mailbox.Id,
 			MessageId:   messageID,
+			DeliveryId:  messageID,
+			InReplyTo:   mail.InReplyTo,
+			References:  mail.References,
 			Subject:     mail.Subject,
 			FromEmail:   mail.From,
 			ToEmails:    mail.To,
 			CcEmails:    mail.Cc,
 			BccEmails:   mail.Bcc,
 			Content:     mail.Body,
+			BlobKey:     mail.BlobKey,
 			ContentType: mail.ContentType,
-			IsRead:      false,
+			Size:        int64(mail.Size),
+			IsRead:      mail.IsRead,
 			IsStarred:   false,
-			FolderId:    inboxFolder.Id, // 存储到INBOX文件夹
-			Direction:   "received",
+			FolderId:    mail.FolderId,
+			Direction:   direction,
 			ReceivedAt:  &mail.Received,
 			CreatedAt:   time.Now(),
 			UpdatedAt:   time.Now(),
 		}
+		if direction == "sent" {
+			email.SentAt = &mail.Received
+		}
 
-		if err := s.emailModel.Create(email); err != nil {
-			log.Printf("存储邮件失败: %v", err)
+		if err := emailModel.Create(email); err != nil {
 			return err
 		}
+		mail.ID = email.Id
+		mail.UID = email.Uid
+		stored = true
+		return nil
+	})
+	if errors.Is(err, model.ErrDuplicateDelivery) {
+		// 并发投递的另一份已先写入，事务已回滚
+		if existing, findErr := s.emailModel.GetByMailboxIdMessageIdAndDirection(mailbox.Id, messageID, direction); findErr == nil && existing != nil {
+			mail.ID = existing.Id
+			mail.UID = existing.Uid
+		}
+		err = nil
+	}
+	if err == nil && stored {
+		s.events.Publish(s.mailEvent(event.TypeNew, mail))
+	}
+	if err != nil {
+		log.Printf("存储邮件失败: %v", err)
+		return false, err
+	}
 
-		log.Printf("✅ 邮件已存储到邮箱: %s (ID: %d), 文件夹: %s (ID: %d)", toAddr, mailbox.Id, inboxFolder.Name, inboxFolder.Id)
+	if !stored {
+		log.Printf("⏭️  邮件已存在，跳过重复投递: %s -> 邮箱 %s", messageID, mailbox.Email)
+		return false, nil
 	}
 
-	return nil
+	log.Printf("✅ 邮件已存储到邮箱: %s (ID: %d), 文件夹: %s (ID: %d)", mailbox.Email, mailbox.Id, mail.FolderName, mail.FolderId)
+	return true, nil
 }
 
 // GetMails 获取邮件列表
@@ -237,7 +434,7 @@ func (s *MailStorage) GetMails(mailboxEmail string, folderName string, limit int
 	}
 	log.Printf("✅ 找到邮箱: ID=%d, Email=%s", mailbox.Id, mailbox.Email)
 
-	folder, err := s.folderModel.GetByMailboxIdAndName(mailbox.Id, folderName, nil)
+	folder, err := s.folderModel.GetByPath(mailbox.Id, folderName)
 	if err != nil {
 		log.Printf("❌ 查找文件夹失败: %v", err)
 		return nil, err
@@ -248,6 +445,11 @@ func (s *MailStorage) GetMails(mailboxEmail string, folderName string, limit int
 	}
 	log.Printf("✅ 找到文件夹: ID=%d, Name=%s", folder.Id, folder.Name)
 
+	return s.GetFolderMails(folder, limit)
+}
+
+// GetFolderMails 获取指定文件夹的邮件列表，按UID升序排列
+func (s *MailStorage) GetFolderMails(folder *model.Folder, limit int) ([]*StoredMail, error) {
 	emails, err := s.emailModel.GetByFolderId(folder.Id, limit)
 	if err != nil {
 		log.Printf("❌ 查询邮件失败: %v", err)
@@ -264,17 +466,22 @@ func (s *MailStorage) GetMails(mailboxEmail string, folderName string, limit int
 
 		mail := &StoredMail{
 			ID:          email.Id,
+			UID:         email.Uid,
 			MessageID:   email.MessageId,
+			InReplyTo:   email.InReplyTo,
+			References:  email.References,
 			From:        email.FromEmail,
 			To:          email.ToEmails,
 			Cc:          email.CcEmails,
 			Bcc:         email.BccEmails,
 			Subject:     email.Subject,
 			Body:        email.Content,
+			BlobKey:     email.BlobKey,
 			ContentType: email.ContentType,
-			Size:        len(email.Content), // 使用内容长度作为大小
+			Size:        storedSize(email),
 			Received:    receivedAt,
 			IsRead:      email.IsRead,
+			Flags:       email.Flags(),
 			FolderId:    email.FolderId,
 			FolderName:  folder.Name, // 从获取到的文件夹对象中获取名称
 			MailboxID:   email.MailboxId,
@@ -285,6 +492,14 @@ func (s *MailStorage) GetMails(mailboxEmail string, folderName string, limit int
 	return mails, nil
 }
 
+// storedSize 邮件大小：原文保存在blob中时为原文大小，否则为内容长度
+func storedSize(email *model.Email) int {
+	if email.BlobKey != "" {
+		return int(email.Size)
+	}
+	return len(email.Content)
+}
+
 // GetMail 获取单个邮件
 func (s *MailStorage) GetMail(mailboxEmail string, messageID string) (*StoredMail, error) {
 	mailbox, err := s.findMailboxByEmail(mailboxEmail)
@@ -326,17 +541,22 @@ func (s *MailStorage) GetMail(mailboxEmail string, messageID string) (*StoredMai
 
 	mail := &StoredMail{
 		ID:          email.Id,
+		UID:         email.Uid,
 		MessageID:   messageID,
+		InReplyTo:   email.InReplyTo,
+		References:  email.References,
 		From:        email.FromEmail,
 		To:          email.ToEmails,
 		Cc:          email.CcEmails,
 		Bcc:         email.BccEmails,
 		Subject:     email.Subject,
 		Body:        email.Content,
+		BlobKey:     email.BlobKey,
 		ContentType: email.ContentType,
-		Size:        len(email.Content), // 使用内容长度作为大小
+		Size:        storedSize(email),
 		Received:    receivedAt,
 		IsRead:      email.IsRead,
+		Flags:       email.Flags(),
 		FolderId:    email.FolderId,
 		FolderName:  folderName,
 		MailboxID:   email.MailboxId,
@@ -345,65 +565,141 @@ func (s *MailStorage) GetMail(mailboxEmail string, messageID string) (*StoredMai
 	return mail, nil
 }
 
-// SearchMails 根据IMAP搜索条件搜索邮件
-func (s *MailStorage) SearchMails(mailboxId int64, folderId int64, criteria *imap.SearchCriteria) ([]*StoredMail, error) {
-	emails, err := s.emailModel.Search(mailboxId, folderId, criteria)
+// MarkAsRead 标记邮件为已读
+func (s *MailStorage) MarkAsRead(mailboxEmail string, messageID string) error {
+	mail, err := s.GetMail(mailboxEmail, messageID)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var mails []*StoredMail
-	for _, email := range emails {
-		receivedAt := time.Now()
-		if email.ReceivedAt != nil {
-			receivedAt = *email.ReceivedAt
+	if mail.IsRead {
+		return nil
+	}
+	if err := s.emailModel.MarkAsRead(mail.ID); err != nil {
+		return err
+	}
+	mail.IsRead = true
+	mail.Flags = append([]string{model.FlagSeen}, mail.Flags...)
+	s.events.Publish(s.mailEvent(event.TypeFlags, mail))
+	return nil
+}
+
+// ExpungeMails 永久删除邮件，清理附件文件并通知IMAP会话
+func (s *MailStorage) ExpungeMails(mails []*StoredMail) error {
+	ids := make([]int64, 0, len(mails))
+	for _, mail := range mails {
+		ids = append(ids, mail.ID)
+	}
+
+	blobKeys, err := s.emailModel.Expunge(ids)
+	if err != nil {
+		return err
+	}
+	s.deleteBlobs(blobKeys)
+
+	// 从后往前通知，保证每条 EXPUNGE 的序号在发送时有效
+	for i := len(mails) - 1; i >= 0; i-- {
+		s.events.Publish(s.mailEvent(event.TypeExpunge, mails[i]))
+	}
+	return nil
+}
+
+// deleteBlobs 删除不再被引用的邮件原文和附件，删除前在对象键的锁内重新确认没有引用
+func (s *MailStorage) deleteBlobs(keys []string) {
+	for _, key := range keys {
+		if err := s.blobs.DeleteUnreferenced(key, s.emailModel.BlobReferenced); err != nil {
+			log.Printf("⚠️  清理邮件原文失败: %s, %v", key, err)
 		}
+	}
+}
 
-		folder, err := s.folderModel.GetById(email.FolderId)
-		if err != nil {
-			log.Printf("搜索邮件时获取文件夹失败 (ID: %d): %v", email.FolderId, err)
-			continue
+// readBlobHeader 读取blob中原始报文的邮件头
+func (s *MailStorage) readBlobHeader(key string) (string, error) {
+	r, err := s.blobs.Open(key)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return readMessageHeader(r)
+}
+
+// releaseBlob 投递或追加结束后调用，释放 Put 的占用，没有任何邮件或附件引用该原文（存储失败或重复投递）时删除
+func (s *MailStorage) releaseBlob(key string) {
+	s.blobs.Release(key)
+	s.deleteBlobs([]string{key})
+}
+
+// MoveMails 将邮件原子地移动到目标文件夹，保留标志，返回按顺序对应的新UID
+// 目标文件夹属于其他邮箱（共享文件夹）时邮件归属和用量一并转移，并检查目标邮箱配额
+func (s *MailStorage) MoveMails(mails []*StoredMail, dest *model.Folder) ([]uint32, error) {
+	var transferBytes, transferMessages int64
+	for _, mail := range mails {
+		if mail.MailboxID != dest.MailboxId {
+			transferBytes += int64(mail.Size)
+			transferMessages++
+		}
+	}
+	var owner *model.Mailbox
+	if transferMessages > 0 {
+		var err error
+		if owner, err = s.mailboxModel.GetById(dest.MailboxId); err != nil {
+			return nil, err
 		}
-		folderName := "Unknown"
-		if folder != nil {
-			folderName = folder.Name
+		if err := s.checkQuota(owner.Id, transferBytes, transferMessages); err != nil {
+			return nil, err
 		}
+	}
 
-		mail := &StoredMail{
-			ID:          email.Id,
-			MessageID:   fmt.Sprintf("<%d@%s>", email.Id, "localhost"),
-			From:        email.FromEmail,
-			To:          email.ToEmails,
-			Cc:          email.CcEmails,
-			Bcc:         email.BccEmails,
-			Subject:     email.Subject,
-			Body:        email.Content,
-			ContentType: email.ContentType,
-			Size:        len(email.Content),
-			Received:    receivedAt,
-			IsRead:      email.IsRead,
-			FolderId:    email.FolderId,
-			FolderName:  folderName,
-			MailboxID:   email.MailboxId,
+	destUIDs := make([]uint32, 0, len(mails))
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		emailModel := model.NewEmailModel(tx)
+		for _, mail := range mails {
+			if mail.MailboxID != dest.MailboxId {
+				if err := emailModel.TransferOwner(mail.ID, owner.Id, owner.UserId); err != nil {
+					return err
+				}
+			}
+			uid, err := emailModel.MoveToFolder(mail.ID, dest.Id)
+			if err != nil {
+				return err
+			}
+			destUIDs = append(destUIDs, uid)
 		}
-		mails = append(mails, mail)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return mails, nil
+	// 源文件夹从后往前通知移除，目标文件夹按新UID通知新增
+	for i := len(mails) - 1; i >= 0; i-- {
+		s.events.Publish(s.mailEvent(event.TypeExpunge, mails[i]))
+	}
+	for i, mail := range mails {
+		moved := *mail
+		moved.FolderId = dest.Id
+		moved.FolderName = dest.Name
+		moved.MailboxID = dest.MailboxId
+		moved.UID = destUIDs[i]
+		s.events.Publish(s.mailEvent(event.TypeNew, &moved))
+	}
+	return destUIDs, nil
 }
 
-// MarkAsRead 标记邮件为已读
-func (s *MailStorage) MarkAsRead(mailboxEmail string, messageID string) error {
-	mail, err := s.GetMail(mailboxEmail, messageID)
-	if err != nil {
-		return err
+// mailEvent 根据已存储的邮件构建事件
+func (s *MailStorage) mailEvent(eventType event.Type, mail *StoredMail) event.Event {
+	return event.Event{
+		Type:      eventType,
+		MailboxId: mail.MailboxID,
+		FolderId:  mail.FolderId,
+		EmailId:   mail.ID,
+		Uid:       mail.UID,
+		Flags:     mail.Flags,
 	}
-
-	return s.emailModel.MarkAsRead(mail.ID)
 }
 
 // ValidatePassword 验证邮箱密码
-func (s *MailStorage) ValidatePassword(email, password string) bool {
+func (s *MailStorage) ValidatePassword(email, password, protocol string) bool {
 	mailbox, err := s.findMailboxByEmail(email)
 	if err != nil {
 		log.Printf("验证凭据失败: %v", err)
@@ -416,16 +712,21 @@ func (s *MailStorage) ValidatePassword(email, password string) bool {
 
 	// 使用安全的密码验证
 	if err := auth.CheckPassword(password, mailbox.Password); err != nil {
+		if s.checkAppPassword(mailbox, password, protocol) {
+			log.Printf("✅ 应用专用密码验证成功: %s (%s)", email, protocol)
+			return true
+		}
 		log.Printf("密码验证失败 %s: %v", email, err)
 		return false
 	}
+	s.ensureScramVerifier(mailbox, password)
 
 	log.Printf("✅ 邮箱凭据验证成功: %s", email)
 	return true
 }
 
 // ValidateCredentials 验证邮箱凭据
-func (s *MailStorage) ValidateCredentials(email, password string) bool {
+func (s *MailStorage) ValidateCredentials(email, password, protocol string) bool {
 	mailbox, err := s.findMailboxByEmail(email)
 	if err != nil {
 		log.Printf("验证凭据失败: %v", err)
@@ -438,22 +739,132 @@ func (s *MailStorage) ValidateCredentials(email, password string) bool {
 
 	// 使用安全的密码验证
 	if err := auth.CheckPassword(password, mailbox.Password); err != nil {
+		if s.checkAppPassword(mailbox, password, protocol) {
+			log.Printf("✅ 应用专用密码验证成功: %s (%s)", email, protocol)
+			return true
+		}
 		log.Printf("密码验证失败 %s: %v", email, err)
 		return false
 	}
+	s.ensureScramVerifier(mailbox, password)
 
 	log.Printf("✅ 邮箱凭据验证成功: %s", email)
 	return true
 }
 
+// checkAppPassword 使用邮箱的应用专用密码验证，protocol 为 imap、pop3 或 smtp，成功时记录使用时间
+func (s *MailStorage) checkAppPassword(mailbox *model.Mailbox, password, protocol string) bool {
+	appPasswords, err := s.appPasswordModel.GetByMailboxId(mailbox.Id)
+	if err != nil {
+		log.Printf("获取应用专用密码失败 %s: %v", mailbox.Email, err)
+		return false
+	}
+
+	password = model.NormalizeAppPassword(password)
+	for _, appPassword := range appPasswords {
+		if !appPassword.Allows(protocol) {
+			continue
+		}
+		if auth.CheckPassword(password, appPassword.PasswordHash) != nil {
+			continue
+		}
+		if err := s.appPasswordModel.UpdateLastUsed(appPassword.Id); err != nil {
+			log.Printf("更新应用专用密码使用时间失败: %v", err)
+		}
+		return true
+	}
+	return false
+}
+
 // findMailboxByEmail 根据邮箱地址查找邮箱
 func (s *MailStorage) findMailboxByEmail(email string) (*model.Mailbox, error) {
 	return s.mailboxModel.GetByEmail(email)
 }
 
-// isMailboxExists 检查邮箱是否存在
+// splitSubaddress 拆分子地址，alice+github@domain 返回 alice@domain 和标签 github
+func (s *MailStorage) splitSubaddress(address string) (string, string, bool) {
+	separators := s.subaddressSeparators
+	if separators == "" {
+		separators = "+"
+	}
+
+	at := strings.LastIndex(address, "@")
+	if at <= 0 {
+		return address, "", false
+	}
+	local, domain := address[:at], address[at:]
+
+	idx := strings.IndexAny(local, separators)
+	if idx <= 0 {
+		return address, "", false
+	}
+
+	return local[:idx] + domain, local[idx+1:], true
+}
+
+// resolveRecipient 解析收件人邮箱，精确匹配失败时剥离子地址标签后重试
+// 返回匹配到的邮箱和子地址标签（精确匹配时标签为空）
+func (s *MailStorage) resolveRecipient(address string) (*model.Mailbox, string, error) {
+	mailbox, err := s.findMailboxByEmail(address)
+	if err != nil || mailbox != nil {
+		return mailbox, "", err
+	}
+
+	base, tag, ok := s.splitSubaddress(address)
+	if !ok {
+		return nil, "", nil
+	}
+
+	mailbox, err = s.findMailboxByEmail(base)
+	if err != nil || mailbox == nil {
+		return nil, "", err
+	}
+
+	log.Printf("📮 子地址解析: %s -> %s (标签: %s)", address, base, tag)
+	return mailbox, tag, nil
+}
+
+// deliveryFolder 确定投递文件夹，邮箱开启子地址归档时按标签投递到同名文件夹
+func (s *MailStorage) deliveryFolder(mailbox *model.Mailbox, tag string) (*model.Folder, error) {
+	if tag != "" && mailbox.SubaddressFolder {
+		if name := sanitizeSubaddressFolder(tag); name != "" {
+			// 已有的文件夹忽略大小写复用，系统或特殊用途文件夹不能由外部发件人通过标签投递
+			folder, err := s.folderModel.GetTopLevelByNameFold(mailbox.Id, name)
+			if err != nil {
+				return nil, err
+			}
+			if folder == nil {
+				return s.getOrCreateFolder(mailbox.Id, name, nil, false)
+			}
+			if !folder.IsSystem && folder.SpecialUse == "" {
+				return folder, nil
+			}
+		}
+	}
+	return s.getOrCreateFolder(mailbox.Id, "INBOX", nil, true)
+}
+
+// subaddressFolderMaxRunes 子地址文件夹名称的最大字符数
+const subaddressFolderMaxRunes = 64
+
+// sanitizeSubaddressFolder 将子地址标签转换为可用的文件夹名称，与系统文件夹同名（忽略大小写）时返回空字符串
+func sanitizeSubaddressFolder(tag string) string {
+	name := strings.TrimSpace(tag)
+	name = strings.Trim(strings.ReplaceAll(name, "/", "-"), ".-")
+	for _, system := range model.SystemFolderNames {
+		if strings.EqualFold(name, system) {
+			return ""
+		}
+	}
+	if runes := []rune(name); len(runes) > subaddressFolderMaxRunes {
+		name = string(runes[:subaddressFolderMaxRunes])
+	}
+	return name
+}
+
+// isMailboxExists 检查邮箱是否存在（支持子地址）
 func (s *MailStorage) isMailboxExists(email string) bool {
-	mailbox, err := s.findMailboxByEmail(email)
+	mailbox, _, err := s.resolveRecipient(email)
 	if err != nil {
 		log.Printf("检查邮箱存在性时出错: %v", err)
 		return false
@@ -0,0 +1,102 @@
+package model
+
+import (
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 应用专用密码的使用范围
+const (
+	AppPasswordScopeAll  = ""     // IMAP、POP3和SMTP均可使用
+	AppPasswordScopeIMAP = "imap" // 仅IMAP
+	AppPasswordScopePOP3 = "pop3" // 仅POP3
+	AppPasswordScopeSMTP = "smtp" // 仅SMTP
+)
+
+// AppPassword 应用专用密码模型，供邮件客户端代替邮箱主密码登录IMAP/SMTP
+type AppPassword struct {
+	Id           int64      `gorm:"primaryKey;autoIncrement" json:"id"`       // 密码ID
+	MailboxId    int64      `gorm:"not null;index" json:"mailbox_id"`         // 邮箱ID
+	UserId       int64      `gorm:"not null;index" json:"user_id"`            // 用户ID
+	Label        string     `gorm:"size:100;not null" json:"label"`           // 标签，如 "iPhone 邮件"
+	PasswordHash string     `gorm:"size:255;not null" json:"-"`               // 密码哈希
+	Hint         string     `gorm:"size:8" json:"hint"`                       // 密码末4位，便于用户辨认
+	Scope        string     `gorm:"size:10;not null;default:''" json:"scope"` // 使用范围：空为不限，imap、pop3 或 smtp
+	LastUsedAt   *time.Time `json:"last_used_at"`                             // 最后使用时间
+	CreatedAt    time.Time  `json:"created_at"`                               // 创建时间
+	UpdatedAt    time.Time  `json:"updated_at"`                               // 更新时间
+}
+
+// TableName 指定表名
+func (AppPassword) TableName() string {
+	return "app_password"
+}
+
+// IsValidAppPasswordScope 判断使用范围是否合法
+func IsValidAppPasswordScope(scope string) bool {
+	switch scope {
+	case AppPasswordScopeAll, AppPasswordScopeIMAP, AppPasswordScopePOP3, AppPasswordScopeSMTP:
+		return true
+	}
+	return false
+}
+
+// Allows 判断应用专用密码能否用于指定协议
+func (p *AppPassword) Allows(protocol string) bool {
+	return p.Scope == AppPasswordScopeAll || p.Scope == protocol
+}
+
+// NormalizeAppPassword 去掉用户输入时保留的分组空格和连字符，生成与验证时统一使用
+func NormalizeAppPassword(password string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(password))
+}
+
+// AppPasswordModel 应用专用密码模型
+type AppPasswordModel struct {
+	db *gorm.DB
+}
+
+// NewAppPasswordModel 创建应用专用密码模型
+func NewAppPasswordModel(db *gorm.DB) *AppPasswordModel {
+	return &AppPasswordModel{
+		db: db,
+	}
+}
+
+// Create 创建应用专用密码
+func (m *AppPasswordModel) Create(appPassword *AppPassword) error {
+	return m.db.Create(appPassword).Error
+}
+
+// GetById 根据ID获取应用专用密码
+func (m *AppPasswordModel) GetById(id int64) (*AppPassword, error) {
+	var appPassword AppPassword
+	if err := m.db.First(&appPassword, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &appPassword, nil
+}
+
+// GetByMailboxId 获取邮箱的应用专用密码列表
+func (m *AppPasswordModel) GetByMailboxId(mailboxId int64) ([]*AppPassword, error) {
+	var appPasswords []*AppPassword
+	if err := m.db.Where("mailbox_id = ?", mailboxId).Order("created_at DESC").Find(&appPasswords).Error; err != nil {
+		return nil, err
+	}
+	return appPasswords, nil
+}
+
+// Delete 吊销应用专用密码
+func (m *AppPasswordModel) Delete(appPassword *AppPassword) error {
+	return m.db.Delete(appPassword).Error
+}
+
+// UpdateLastUsed 更新最后使用时间
+func (m *AppPasswordModel) UpdateLastUsed(id int64) error {
+	return m.db.Model(&AppPassword{}).Where("id = ?", id).UpdateColumn("last_used_at", time.Now()).Error
+}
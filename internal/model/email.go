@@ -1,38 +1,56 @@
 package model
 
 import (
+	"bufio"
 	"errors"
 	"strings"
 	"time"
 
-	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-message/textproto"
 	"gorm.io/gorm"
 )
 
+// ErrDuplicateDelivery 同一邮箱中已存在相同 Message-ID 且方向相同的投递
+var ErrDuplicateDelivery = errors.New("邮件已投递")
+
 // Email 邮件模型
 type Email struct {
-	Id          int64          `gorm:"primaryKey;autoIncrement" json:"id"`                                         // 邮件ID
-	UserId      int64          `gorm:"not null;index" json:"user_id"`                                              // 用户ID
-	MailboxId   int64          `gorm:"not null;index" json:"mailbox_id"`                                           // 邮箱ID
-	MessageId   string         `gorm:"size:255;index" json:"message_id"`                                           // 邮件消息ID
-	Subject     string         `gorm:"size:500" json:"subject"`                                                    // 邮件主题
-	FromEmail   string         `gorm:"size:100;index" json:"from_email"`                                           // 发件人邮箱
-	FromName    string         `gorm:"size:100" json:"from_name"`                                                  // 发件人姓名
-	ToEmails    []string       `gorm:"type:json;serializer:json" json:"to_emails"`                                 // 收件人列表（JSON格式）
-	CcEmails    []string       `gorm:"type:json;serializer:json" json:"cc_emails"`                                 // 抄送列表（JSON格式）
-	BccEmails   []string       `gorm:"type:json;serializer:json" json:"bcc_emails"`                                // 密送列表（JSON格式）
-	ReplyTo     string         `gorm:"size:100" json:"reply_to"`                                                   // 回复地址
-	ContentType string         `gorm:"size:20;default:html" json:"content_type"`                                   // 内容类型：html text
-	Content     string         `gorm:"type:longtext" json:"content"`                                               // 邮件内容
-	IsRead      bool           `gorm:"default:false" json:"is_read"`                                               // 是否已读
-	IsStarred   bool           `gorm:"default:false" json:"is_starred"`                                            // 是否标星
-	Direction   string         `gorm:"size:10;not null" json:"direction"`                                          // 方向：sent发送 received接收
-	FolderId    int64          `gorm:"column:folder_id;type:bigint;not null;index:idx_folder_id" json:"folder_id"` // 文件夹ID
-	SentAt      *time.Time     `json:"sent_at"`                                                                    // 发送时间
-	ReceivedAt  *time.Time     `json:"received_at"`                                                                // 接收时间
-	CreatedAt   time.Time      `json:"created_at"`                                                                 // 创建时间
-	UpdatedAt   time.Time      `json:"updated_at"`                                                                 // 更新时间
-	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`                                                             // 软删除时间
+	Id             int64          `gorm:"primaryKey;autoIncrement" json:"id"`                                                                         // 邮件ID
+	UserId         int64          `gorm:"not null;index" json:"user_id"`                                                                              // 用户ID
+	MailboxId      int64          `gorm:"not null;index;uniqueIndex:idx_email_delivery,priority:1" json:"mailbox_id"`                                 // 邮箱ID
+	MessageId      string         `gorm:"size:255;index" json:"message_id"`                                                                           // 邮件消息ID
+	DeliveryId     string         `gorm:"size:255;uniqueIndex:idx_email_delivery,priority:2,where:delivery_id <> '' AND deleted_at IS NULL" json:"-"` // 投递去重键：SMTP/LMTP投递时为Message-ID，复制、追加等其他来源为空
+	InReplyTo      string         `gorm:"size:255;index" json:"in_reply_to"`                                                                          // 所回复邮件的消息ID（In-Reply-To）
+	References     string         `gorm:"column:reference_ids;type:text" json:"references"`                                                           // 引用的消息ID（References），空格分隔
+	ThreadId       int64          `gorm:"not null;default:0;index" json:"thread_id"`                                                                  // 会话ID，插入时根据 In-Reply-To/References 确定
+	Subject        string         `gorm:"size:500" json:"subject"`                                                                                    // 邮件主题
+	FromEmail      string         `gorm:"size:100;index" json:"from_email"`                                                                           // 发件人邮箱
+	FromName       string         `gorm:"size:100" json:"from_name"`                                                                                  // 发件人姓名
+	ToEmails       []string       `gorm:"type:json;serializer:json" json:"to_emails"`                                                                 // 收件人列表（JSON格式）
+	CcEmails       []string       `gorm:"type:json;serializer:json" json:"cc_emails"`                                                                 // 抄送列表（JSON格式）
+	BccEmails      []string       `gorm:"type:json;serializer:json" json:"bcc_emails"`                                                                // 密送列表（JSON格式）
+	ReplyTo        string         `gorm:"size:100" json:"reply_to"`                                                                                   // 回复地址
+	ContentType    string         `gorm:"size:20;default:html" json:"content_type"`                                                                   // 内容类型：html text
+	Content        string         `gorm:"type:longtext" json:"content"`                                                                               // 邮件内容，原文保存在blob中时为空
+	BlobKey        string         `gorm:"size:100;index" json:"-"`                                                                                    // 原始报文在blob存储中的键，SMTP/LMTP/APPEND收到的邮件流式写入blob
+	Size           int64          `gorm:"not null;default:0" json:"size"`                                                                             // 邮件大小（字节），计入存储配额
+	IsRead         bool           `gorm:"default:false" json:"is_read"`                                                                               // 是否已读
+	IsStarred      bool           `gorm:"default:false" json:"is_starred"`                                                                            // 是否标星
+	IsAnswered     bool           `gorm:"default:false" json:"is_answered"`                                                                           // 是否已回复（IMAP \Answered）
+	IsDraft        bool           `gorm:"default:false" json:"is_draft"`                                                                              // 是否为草稿（IMAP \Draft）
+	IsDeleted      bool           `gorm:"default:false" json:"is_deleted"`                                                                            // 是否标记删除（IMAP \Deleted，等待EXPUNGE，与软删除无关）
+	Keywords       []string       `gorm:"type:json;serializer:json" json:"keywords"`                                                                  // IMAP用户关键字（JSON格式），如 $Forwarded
+	Direction      string         `gorm:"size:10;not null;uniqueIndex:idx_email_delivery,priority:3" json:"direction"`                                // 方向：sent发送 received接收
+	DeliveryStatus string         `gorm:"size:20;index" json:"delivery_status"`                                                                       // 投递状态：空为正常 bounced退信 complained投诉
+	FolderId       int64          `gorm:"column:folder_id;type:bigint;not null;index:idx_folder_id;index:idx_folder_uid,priority:1" json:"folder_id"` // 文件夹ID
+	Uid            uint32         `gorm:"column:uid;not null;default:0;index:idx_folder_uid,priority:2" json:"uid"`                                   // 文件夹内的IMAP UID，插入时分配
+	ModSeq         int64          `gorm:"column:modseq;not null;default:0" json:"modseq"`                                                             // 最后一次修改时分配的文件夹修改序号
+	SentAt         *time.Time     `json:"sent_at"`                                                                                                    // 发送时间
+	ReceivedAt     *time.Time     `json:"received_at"`                                                                                                // 接收时间
+	CreatedAt      time.Time      `json:"created_at"`                                                                                                 // 创建时间
+	UpdatedAt      time.Time      `json:"updated_at"`                                                                                                 // 更新时间
+	DeletedAt      gorm.DeletedAt `gorm:"index" json:"-"`                                                                                             // 软删除时间
 }
 
 // TableName 指定表名
@@ -40,6 +58,39 @@ func (Email) TableName() string {
 	return "email"
 }
 
+// BeforeCreate 插入邮件时在所属文件夹内分配严格递增的UID和修改序号
+func (e *Email) BeforeCreate(tx *gorm.DB) error {
+	if e.Size == 0 {
+		e.Size = int64(len(e.Content))
+	}
+	if e.FolderId == 0 {
+		return nil
+	}
+	tx = tx.Session(&gorm.Session{NewDB: true})
+	if e.Uid == 0 {
+		uid, err := AllocateFolderUid(tx, e.FolderId)
+		if err != nil {
+			return err
+		}
+		e.Uid = uid
+	}
+	modSeq, err := AllocateFolderModSeq(tx, e.FolderId)
+	if err != nil {
+		return err
+	}
+	e.ModSeq = modSeq
+	return nil
+}
+
+// AfterCreate 插入邮件后计入邮箱和用户的用量，并归入会话
+func (e *Email) AfterCreate(tx *gorm.DB) error {
+	tx = tx.Session(&gorm.Session{NewDB: true})
+	if err := adjustUsage(tx, e.MailboxId, e.UserId, e.Size, 1); err != nil {
+		return err
+	}
+	return assignThread(tx, e)
+}
+
 // EmailModel 邮件模型
 type EmailModel struct {
 	db *gorm.DB
@@ -53,8 +104,18 @@ func NewEmailModel(db *gorm.DB) *EmailModel {
 }
 
 // Create 创建邮件
+// 设置了 DeliveryId 且同一邮箱已投递过相同方向的邮件时返回 ErrDuplicateDelivery
 func (m *EmailModel) Create(email *Email) error {
-	return m.db.Create(email).Error
+	err := m.db.Create(email).Error
+	if err != nil && email.DeliveryId != "" && isUniqueViolation(err) {
+		return ErrDuplicateDelivery
+	}
+	return err
+}
+
+// isUniqueViolation 判断是否违反唯一索引
+func isUniqueViolation(err error) bool {
+	return errors.Is(err, gorm.ErrDuplicatedKey) || strings.Contains(err.Error(), "UNIQUE constraint failed")
 }
 
 // GetById 根据ID获取邮件
@@ -66,6 +127,16 @@ func (m *EmailModel) GetById(id int64) (*Email, error) {
 	return &email, nil
 }
 
+// GetByMailboxIdAndIds 批量获取邮箱中的邮件，不属于该邮箱的ID被忽略
+func (m *EmailModel) GetByMailboxIdAndIds(mailboxId int64, ids []int64) ([]*Email, error) {
+	var emails []*Email
+	if len(ids) == 0 {
+		return emails, nil
+	}
+	err := m.db.Where("mailbox_id = ? AND id IN ?", mailboxId, ids).Find(&emails).Error
+	return emails, err
+}
+
 // GetByMailboxIdAndMessageId 根据邮箱和消息ID获取邮件
 func (m *EmailModel) GetByMailboxIdAndMessageId(mailboxId int64, messageId string) (*Email, error) {
 	if messageId == "" {
@@ -84,6 +155,24 @@ func (m *EmailModel) GetByMailboxIdAndMessageId(mailboxId int64, messageId strin
 	return &email, nil
 }
 
+// GetByMailboxIdMessageIdAndDirection 根据邮箱、消息ID和方向获取邮件，用于投递去重
+func (m *EmailModel) GetByMailboxIdMessageIdAndDirection(mailboxId int64, messageId string, direction string) (*Email, error) {
+	if messageId == "" {
+		return nil, nil
+	}
+
+	var email Email
+	err := m.db.Where("mailbox_id = ? AND message_id = ? AND direction = ?", mailboxId, messageId, direction).First(&email).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &email, nil
+}
+
 // List 获取邮件列表
 func (m *EmailModel) List(params EmailListParams) ([]*Email, int64, error) {
 	var emails []*Email
@@ -134,6 +223,14 @@ func (m *EmailModel) List(params EmailListParams) ([]*Email, int64, error) {
 	if !params.UpdatedAtEnd.IsZero() {
 		db = db.Where("updated_at <= ?", params.UpdatedAtEnd)
 	}
+	if params.ThreadId != 0 {
+		db = db.Where("thread_id = ?", params.ThreadId)
+	}
+	if params.Conversation {
+		// 按会话列出时每个会话只返回符合条件的最新一封邮件
+		latest := db.Session(&gorm.Session{}).Select("MAX(id)").Group("thread_id")
+		db = m.db.Model(&Email{}).Where("id IN (?)", latest)
+	}
 
 	// 分页查询
 	if params.Page > 0 && params.PageSize > 0 {
@@ -155,9 +252,38 @@ func (m *EmailModel) List(params EmailListParams) ([]*Email, int64, error) {
 	return emails, total, nil
 }
 
+// GetWithoutUid 获取文件夹中尚未分配UID的邮件（升级前写入的邮件），按写入顺序排列
+func (m *EmailModel) GetWithoutUid(folderId int64) ([]*Email, error) {
+	var emails []*Email
+	err := m.db.Unscoped().Where("folder_id = ? AND uid = 0", folderId).Order("id ASC").Find(&emails).Error
+	return emails, err
+}
+
+// UpdateFlags 保存邮件的全部标志
+func (m *EmailModel) UpdateFlags(email *Email) error {
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(email).
+			Select("is_read", "is_starred", "is_answered", "is_draft", "is_deleted", "keywords").
+			Updates(email).Error; err != nil {
+			return err
+		}
+		return touchEmails(tx, "id = ?", email.Id)
+	})
+}
+
+// UpdateDeliveryStatus 更新已发送邮件的投递状态
+func (m *EmailModel) UpdateDeliveryStatus(id int64, status string) error {
+	return m.db.Model(&Email{}).Where("id = ?", id).Update("delivery_status", status).Error
+}
+
 // Update 更新邮件
 func (m *EmailModel) Update(email *Email) error {
-	return m.db.Updates(email).Error
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Updates(email).Error; err != nil {
+			return err
+		}
+		return touchEmails(tx, "id = ?", email.Id)
+	})
 }
 
 // MapUpdate 使用map更新邮件
@@ -166,17 +292,191 @@ func (m *EmailModel) MapUpdate(tx *gorm.DB, id int64, data map[string]interface{
 	if tx != nil {
 		db = tx
 	}
-	return db.Model(&Email{}).Where("id = ?", id).Updates(data).Error
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Email{}).Where("id = ?", id).Updates(data).Error; err != nil {
+			return err
+		}
+		return touchEmails(tx, "id = ?", id)
+	})
 }
 
 // Delete 删除邮件
 func (m *EmailModel) Delete(email *Email) error {
-	return m.db.Delete(email).Error
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		if err := releaseEmailUsage(tx, "id = ?", email.Id); err != nil {
+			return err
+		}
+		if err := buryEmails(tx, "id = ?", email.Id); err != nil {
+			return err
+		}
+		return tx.Delete(email).Error
+	})
+}
+
+// MoveToMailbox 将邮件移动到同一用户的另一个邮箱，用量随之转移
+func (m *EmailModel) MoveToMailbox(email *Email, mailboxId int64) error {
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		if err := adjustUsage(tx, email.MailboxId, 0, -email.Size, -1); err != nil {
+			return err
+		}
+		if err := adjustUsage(tx, mailboxId, 0, email.Size, 1); err != nil {
+			return err
+		}
+		if err := buryEmails(tx, "id = ?", email.Id); err != nil {
+			return err
+		}
+		// 投递去重键只对原邮箱有效，移出后清空，避免与目标邮箱已投递的同一封邮件冲突
+		email.MailboxId, email.DeliveryId = mailboxId, ""
+		return tx.Model(&Email{}).Where("id = ?", email.Id).UpdateColumns(map[string]interface{}{
+			"mailbox_id":  mailboxId,
+			"delivery_id": "",
+		}).Error
+	})
+}
+
+// TransferOwner 将邮件转移到另一个邮箱（可属于其他用户，如移入共享文件夹），邮箱和用户用量随之转移
+// 文件夹由调用方随后通过 MoveToFolder 修改
+func (m *EmailModel) TransferOwner(id int64, mailboxId, userId int64) error {
+	var email Email
+	if err := m.db.Select("id, mailbox_id, user_id, size").First(&email, id).Error; err != nil {
+		return err
+	}
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		if err := adjustUsage(tx, email.MailboxId, email.UserId, -email.Size, -1); err != nil {
+			return err
+		}
+		if err := adjustUsage(tx, mailboxId, userId, email.Size, 1); err != nil {
+			return err
+		}
+		return tx.Model(&Email{}).Where("id = ?", id).UpdateColumns(map[string]interface{}{
+			"mailbox_id":  mailboxId,
+			"user_id":     userId,
+			"delivery_id": "", // 投递去重键只对原邮箱有效
+		}).Error
+	})
+}
+
+// MoveToFolder 将邮件移动到目标文件夹并在目标文件夹内分配新的UID和修改序号，返回新UID
+func (m *EmailModel) MoveToFolder(id int64, folderId int64) (uint32, error) {
+	var uid uint32
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		if err := buryEmails(tx, "id = ?", id); err != nil {
+			return err
+		}
+		var err error
+		if uid, err = AllocateFolderUid(tx, folderId); err != nil {
+			return err
+		}
+		modSeq, err := AllocateFolderModSeq(tx, folderId)
+		if err != nil {
+			return err
+		}
+		return tx.Model(&Email{}).Where("id = ?", id).Updates(map[string]interface{}{
+			"folder_id": folderId,
+			"uid":       uid,
+			"modseq":    modSeq,
+		}).Error
+	})
+	return uid, err
+}
+
+// Expunge 永久删除邮件及其附件记录（不经过软删除），返回不再被任何邮件或附件引用的blob键
+func (m *EmailModel) Expunge(ids []int64) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	var blobKeys []string
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		blobKeys, err = expungeEmails(tx, ids)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return blobKeys, nil
+}
+
+// expungeEmails 在事务中永久删除邮件及其附件记录，返回不再被引用的blob键
+func expungeEmails(tx *gorm.DB, ids []int64) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	var blobKeys, attachmentKeys []string
+	if err := tx.Model(&EmailAttachment{}).
+		Where("email_id IN ? AND file_path <> ''", ids).
+		Distinct().Pluck("file_path", &attachmentKeys).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Model(&Email{}).Unscoped().
+		Where("id IN ? AND blob_key <> ''", ids).
+		Distinct().Pluck("blob_key", &blobKeys).Error; err != nil {
+		return nil, err
+	}
+	blobKeys = append(blobKeys, attachmentKeys...)
+	if err := tx.Where("email_id IN ?", ids).Delete(&EmailAttachment{}).Error; err != nil {
+		return nil, err
+	}
+	if err := releaseEmailUsage(tx, "id IN ?", ids); err != nil {
+		return nil, err
+	}
+	if err := buryEmails(tx, "id IN ?", ids); err != nil {
+		return nil, err
+	}
+	if err := tx.Unscoped().Where("id IN ?", ids).Delete(&Email{}).Error; err != nil {
+		return nil, err
+	}
+	return unreferencedBlobKeys(tx, blobKeys)
+}
+
+// BlobReferenced 判断blob键是否仍被邮件（含软删除的邮件）原文或附件引用
+// 对象按内容寻址，同一个键可能同时被多封邮件和附件引用
+func (m *EmailModel) BlobReferenced(key string) (bool, error) {
+	unused, err := unreferencedBlobKeys(m.db, []string{key})
+	return len(unused) == 0, err
+}
+
+func unreferencedBlobKeys(tx *gorm.DB, keys []string) ([]string, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	var referenced, attached []string
+	if err := tx.Model(&Email{}).Unscoped().
+		Where("blob_key IN ?", keys).
+		Distinct().Pluck("blob_key", &referenced).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Model(&EmailAttachment{}).
+		Where("file_path IN ?", keys).
+		Distinct().Pluck("file_path", &attached).Error; err != nil {
+		return nil, err
+	}
+	inUse := make(map[string]bool, len(referenced)+len(attached))
+	for _, key := range append(referenced, attached...) {
+		inUse[key] = true
+	}
+	var unused []string
+	for _, key := range keys {
+		if !inUse[key] {
+			inUse[key] = true // 去重
+			unused = append(unused, key)
+		}
+	}
+	return unused, nil
 }
 
 // BatchDelete 批量删除邮件
 func (m *EmailModel) BatchDelete(ids []int64) error {
-	return m.db.Where("id IN ?", ids).Delete(&Email{}).Error
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		if err := releaseEmailUsage(tx, "id IN ?", ids); err != nil {
+			return err
+		}
+		if err := buryEmails(tx, "id IN ?", ids); err != nil {
+			return err
+		}
+		return tx.Where("id IN ?", ids).Delete(&Email{}).Error
+	})
 }
 
 // GetStatistics 获取邮件统计信息
@@ -214,7 +514,7 @@ func (m *EmailModel) GetStatistics() (map[string]interface{}, error) {
 
 // MarkAsRead 标记邮件为已读
 func (m *EmailModel) MarkAsRead(id int64) error {
-	return m.db.Model(&Email{}).Where("id = ?", id).Update("is_read", true).Error
+	return m.MapUpdate(nil, id, map[string]interface{}{"is_read": true})
 }
 
 // CountByMailboxId 根据邮箱ID统计邮件数量
@@ -224,11 +524,11 @@ func (m *EmailModel) CountByMailboxId(mailboxId int64) (int, error) {
 	return int(count), err
 }
 
-// GetByFolderId 根据文件夹ID获取邮件列表
+// GetByFolderId 根据文件夹ID获取邮件列表，按UID升序排列（即IMAP序号顺序）
 func (m *EmailModel) GetByFolderId(folderId int64, limit int) ([]*Email, error) {
 	var emails []*Email
 	query := m.db.Where("folder_id = ?", folderId).
-		Order("received_at DESC")
+		Order("uid ASC, id ASC")
 
 	if limit > 0 {
 		query = query.Limit(limit)
@@ -254,17 +554,17 @@ func (m *EmailModel) GetByUserId(userId int64, limit int) ([]*Email, error) {
 
 // MarkAsUnread 标记邮件为未读
 func (m *EmailModel) MarkAsUnread(id int64) error {
-	return m.db.Model(&Email{}).Where("id = ?", id).Update("is_read", false).Error
+	return m.MapUpdate(nil, id, map[string]interface{}{"is_read": false})
 }
 
 // MarkAsStarred 标记邮件为星标
 func (m *EmailModel) MarkAsStarred(id int64) error {
-	return m.db.Model(&Email{}).Where("id = ?", id).Update("is_starred", true).Error
+	return m.MapUpdate(nil, id, map[string]interface{}{"is_starred": true})
 }
 
 // UnmarkAsStarred 取消邮件星标
 func (m *EmailModel) UnmarkAsStarred(id int64) error {
-	return m.db.Model(&Email{}).Where("id = ?", id).Update("is_starred", false).Error
+	return m.MapUpdate(nil, id, map[string]interface{}{"is_starred": false})
 }
 
 // Count 获取邮件总数
@@ -305,83 +605,336 @@ func (m *EmailModel) CountByUserId(userId int64) (int64, error) {
 	return count, nil
 }
 
-// Search 根据IMAP搜索条件搜索邮件
-func (m *EmailModel) Search(mailboxId int64, folderId int64, criteria *imap.SearchCriteria) ([]*Email, error) {
-	db := m.db.Model(&Email{}).
-		Where("mailbox_id = ?", mailboxId).
-		Where("folder_id = ?", folderId)
-
-	// 处理各种搜索条件
-	if len(criteria.Header) > 0 {
-		for key, values := range criteria.Header { // 遍历Header map
-			for _, value := range values {
-				switch strings.ToLower(key) {
-				case "from":
-					db = db.Where("from_email LIKE ?", "%"+value+"%")
-				case "to":
-					db = db.Where("to_emails LIKE ?", "%\""+value+"\"%")
-				case "subject":
-					db = db.Where("subject LIKE ?", "%"+value+"%")
-				case "body":
-					db = db.Where("content LIKE ?", "%"+value+"%")
-				case "text":
-					db = db.Where("subject LIKE ? OR content LIKE ? OR from_email LIKE ? OR to_emails LIKE ?",
-						"%"+value+"%", "%"+value+"%", "%"+value+"%", "%\""+value+"\"%")
-				}
-			}
+// SearchContentMatcher 扫描 keys 中各邮件保存在blob中的原文，返回原文依次包含各片段（ASCII不区分大小写）的邮件ID
+// 这些邮件的 content 为空，原文相关的搜索条件由它补充匹配
+type SearchContentMatcher func(keys map[int64]string, parts ...string) ([]int64, error)
+
+// searchContentFunc 在已限定范围的blob邮件中匹配原文
+type searchContentFunc func(parts ...string) ([]int64, error)
+
+// Search 在文件夹内按IMAP搜索条件查询邮件，返回升序排列的UID
+// 序号条件需由调用方按会话视图转换为UID条件，UID集合中的 "*" 也需预先解析
+// matcher 为nil时原文相关的条件只匹配 content 列
+func (m *EmailModel) Search(folderId int64, criteria *imap.SearchCriteria, matcher SearchContentMatcher) ([]uint32, error) {
+	var content searchContentFunc
+	if matcher != nil && searchUsesContent(criteria) {
+		keys, err := m.searchBlobKeys(folderId, criteria)
+		if err != nil {
+			return nil, err
+		}
+		content = func(parts ...string) ([]int64, error) {
+			return matcher(keys, parts...)
 		}
 	}
+	cond, args, err := searchCondition(criteria, content)
+	if err != nil {
+		return nil, err
+	}
+
+	var uids []uint32
+	err = m.db.Model(&Email{}).
+		Where("folder_id = ?", folderId).
+		Where(cond, args...).
+		Order("uid ASC").
+		Pluck("uid", &uids).Error
+	return uids, err
+}
+
+// searchBlobKeys 获取原文保存在blob中、且满足搜索条件中与原文无关部分的邮件，返回邮件ID到blob键的映射
+// 不满足这些条件的邮件无论原文是否匹配都不会出现在结果中，无需扫描
+func (m *EmailModel) searchBlobKeys(folderId int64, criteria *imap.SearchCriteria) (map[int64]string, error) {
+	prefilter := searchPrefilter(criteria)
+	cond, args, err := searchCondition(&prefilter, nil)
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		Id      int64
+		BlobKey string
+	}
+	err = m.db.Model(&Email{}).
+		Select("id, blob_key").
+		Where("folder_id = ? AND blob_key <> ''", folderId).
+		Where(cond, args...).
+		Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[int64]string, len(rows))
+	for _, row := range rows {
+		keys[row.Id] = row.BlobKey
+	}
+	return keys, nil
+}
 
-	// 处理 WithFlags (例如 \Seen, \Flagged)
-	for _, flag := range criteria.WithFlags {
-		switch flag {
-		case imap.SeenFlag:
-			db = db.Where("is_read = ?", true)
-		case imap.FlaggedFlag:
-			db = db.Where("is_starred = ?", true)
-			// TODO: 其他标志，如 \Answered, \Draft, \Deleted, \Recent
+// searchUsesContent 搜索条件（含 NOT/OR 子条件）是否需要匹配原文
+func searchUsesContent(criteria *imap.SearchCriteria) bool {
+	if len(criteria.Body) > 0 || len(criteria.Text) > 0 {
+		return true
+	}
+	for _, header := range criteria.Header {
+		if _, ok := searchHeaderColumns[strings.ToLower(header.Key)]; !ok {
+			return true
+		}
+	}
+	for i := range criteria.Not {
+		if searchUsesContent(&criteria.Not[i]) {
+			return true
+		}
+	}
+	for i := range criteria.Or {
+		if searchUsesContent(&criteria.Or[i][0]) || searchUsesContent(&criteria.Or[i][1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// searchPrefilter 去掉需要匹配原文的条件，只保留顶层与原文无关的部分，满足原条件的邮件必然满足它
+func searchPrefilter(criteria *imap.SearchCriteria) imap.SearchCriteria {
+	prefilter := *criteria
+	prefilter.Body, prefilter.Text = nil, nil
+	prefilter.Header, prefilter.Not, prefilter.Or = nil, nil, nil
+	for _, header := range criteria.Header {
+		if _, ok := searchHeaderColumns[strings.ToLower(header.Key)]; ok {
+			prefilter.Header = append(prefilter.Header, header)
+		}
+	}
+	for _, not := range criteria.Not {
+		if !searchUsesContent(&not) {
+			prefilter.Not = append(prefilter.Not, not)
+		}
+	}
+	for _, or := range criteria.Or {
+		if !searchUsesContent(&or[0]) && !searchUsesContent(&or[1]) {
+			prefilter.Or = append(prefilter.Or, or)
 		}
 	}
+	return prefilter
+}
+
+// GetUidsByFolderId 获取文件夹内全部邮件的UID，按升序排列
+func (m *EmailModel) GetUidsByFolderId(folderId int64) ([]uint32, error) {
+	var uids []uint32
+	err := m.db.Model(&Email{}).
+		Where("folder_id = ?", folderId).
+		Order("uid ASC").
+		Pluck("uid", &uids).Error
+	return uids, err
+}
+
+// 搜索使用的日期字段：内部日期为接收时间，发送日期缺失时退回接收时间
+const (
+	searchInternalDate = "COALESCE(received_at, created_at)"
+	searchSentDate     = "COALESCE(sent_at, received_at, created_at)"
+)
 
-	// 处理 WithoutFlags (例如 \Unseen, \Unflagged)
-	for _, flag := range criteria.WithoutFlags {
-		switch flag {
-		case imap.SeenFlag: // \Unseen
-			db = db.Where("is_read = ?", false)
-		case imap.FlaggedFlag: // \Unflagged
-			db = db.Where("is_starred = ?", false)
+// searchHeaderColumns 有独立字段的邮件头，其他邮件头在原始邮件内容中匹配
+var searchHeaderColumns = map[string][]string{
+	"from":       {"from_email", "from_name"},
+	"to":         {"to_emails"},
+	"cc":         {"cc_emails"},
+	"bcc":        {"bcc_emails"},
+	"subject":    {"subject"},
+	"reply-to":   {"reply_to"},
+	"message-id": {"message_id"},
+}
+
+// searchTextColumns TEXT 条件匹配的字段
+var searchTextColumns = []string{"subject", "from_email", "from_name", "to_emails", "cc_emails", "content"}
+
+// searchFlagColumns 系统标志对应的字段
+var searchFlagColumns = map[string]string{
+	`\seen`:     "is_read",
+	`\flagged`:  "is_starred",
+	`\answered`: "is_answered",
+	`\draft`:    "is_draft",
+	`\deleted`:  "is_deleted",
+}
+
+// searchCondition 将搜索条件转换为SQL条件，各条件之间为AND关系
+func searchCondition(criteria *imap.SearchCriteria, content searchContentFunc) (string, []interface{}, error) {
+	var conds []string
+	var args []interface{}
+	add := func(cond string, condArgs ...interface{}) {
+		conds = append(conds, cond)
+		args = append(args, condArgs...)
+	}
+	// addContent 在 cond 之外再匹配原文中依次包含 parts 的blob邮件
+	addContent := func(cond string, condArgs []interface{}, parts ...string) error {
+		if content == nil {
+			add(cond, condArgs...)
+			return nil
+		}
+		ids, err := content(parts...)
+		if err != nil {
+			return err
 		}
+		add("("+cond+" OR id IN ?)", append(condArgs, ids)...)
+		return nil
 	}
 
+	if len(criteria.SeqNum) > 0 {
+		return "", nil, errors.New("序号搜索条件需先转换为UID")
+	}
+	for _, uidSet := range criteria.UID {
+		var ranges []string
+		var rangeArgs []interface{}
+		for _, r := range uidSet {
+			if r.Start == 0 || r.Stop == 0 {
+				return "", nil, errors.New("UID搜索条件中的 * 需先解析")
+			}
+			start, stop := r.Start, r.Stop
+			if start > stop {
+				start, stop = stop, start
+			}
+			ranges = append(ranges, "uid BETWEEN ? AND ?")
+			rangeArgs = append(rangeArgs, uint32(start), uint32(stop))
+		}
+		if len(ranges) == 0 {
+			add("1 = 0")
+			continue
+		}
+		add("("+strings.Join(ranges, " OR ")+")", rangeArgs...)
+	}
+
+	// 日期只比较日，忽略时间和时区
 	if !criteria.Since.IsZero() {
-		db = db.Where("received_at >= ?", criteria.Since)
+		add(searchInternalDate+" >= ?", searchDay(criteria.Since))
 	}
 	if !criteria.Before.IsZero() {
-		db = db.Where("received_at < ?", criteria.Before)
+		add(searchInternalDate+" < ?", searchDay(criteria.Before))
 	}
-	if criteria.Larger != 0 {
-		db = db.Where("size > ?", criteria.Larger)
+	if !criteria.SentSince.IsZero() {
+		add(searchSentDate+" >= ?", searchDay(criteria.SentSince))
 	}
-	if criteria.Smaller != 0 {
-		db = db.Where("size < ?", criteria.Smaller)
+	if !criteria.SentBefore.IsZero() {
+		add(searchSentDate+" < ?", searchDay(criteria.SentBefore))
 	}
-	if criteria.Uid != nil && len(criteria.Uid.Set) > 0 {
-		var uids []int64
-		for _, seqRange := range criteria.Uid.Set { // 遍历 SeqRange
-			for i := seqRange.Start; i <= seqRange.Stop; i++ {
-				uids = append(uids, int64(i))
-			}
+
+	for _, header := range criteria.Header {
+		key := strings.ToLower(header.Key)
+		if columns, ok := searchHeaderColumns[key]; ok {
+			add(searchLikeAny(columns), searchLikeArgs(len(columns), header.Value)...)
+			continue
+		}
+		// 其他邮件头按 "名称: 值" 在原始邮件中近似匹配，值为空时只要求邮件头存在
+		cond := "COALESCE(content, '') LIKE ? ESCAPE '\\'"
+		pattern := "%" + escapeLike(header.Key) + ":%" + escapeLike(header.Value) + "%"
+		if err := addContent(cond, []interface{}{pattern}, header.Key+":", header.Value); err != nil {
+			return "", nil, err
+		}
+	}
+	for _, body := range criteria.Body {
+		if err := addContent(searchLikeAny([]string{"content"}), searchLikeArgs(1, body), body); err != nil {
+			return "", nil, err
 		}
-		if len(uids) > 0 {
-			db = db.Where("id IN (?)", uids)
+	}
+	for _, text := range criteria.Text {
+		if err := addContent(searchLikeAny(searchTextColumns), searchLikeArgs(len(searchTextColumns), text), text); err != nil {
+			return "", nil, err
 		}
 	}
-	// TODO: 更多IMAP搜索条件，如 ON, SENTBEFORE, SENTSINCE等
 
-	var emails []*Email
-	if err := db.Order("received_at DESC").Find(&emails).Error; err != nil {
-		return nil, err
+	for _, flag := range criteria.Flag {
+		cond, condArgs := searchFlagCondition(flag)
+		add(cond, condArgs...)
+	}
+	for _, flag := range criteria.NotFlag {
+		cond, condArgs := searchFlagCondition(flag)
+		add("NOT ("+cond+")", condArgs...)
+	}
+
+	if criteria.Larger > 0 {
+		add("size > ?", criteria.Larger)
+	}
+	if criteria.Smaller > 0 {
+		add("size < ?", criteria.Smaller)
+	}
+
+	for i := range criteria.Not {
+		cond, condArgs, err := searchCondition(&criteria.Not[i], content)
+		if err != nil {
+			return "", nil, err
+		}
+		add("NOT ("+cond+")", condArgs...)
+	}
+	for i := range criteria.Or {
+		left, leftArgs, err := searchCondition(&criteria.Or[i][0], content)
+		if err != nil {
+			return "", nil, err
+		}
+		right, rightArgs, err := searchCondition(&criteria.Or[i][1], content)
+		if err != nil {
+			return "", nil, err
+		}
+		add("(("+left+") OR ("+right+"))", append(leftArgs, rightArgs...)...)
+	}
+
+	if len(conds) == 0 {
+		return "1 = 1", nil, nil
+	}
+	return strings.Join(conds, " AND "), args, nil
+}
+
+// searchFlagCondition 标志条件，系统标志对应独立字段，其他为关键字
+func searchFlagCondition(flag imap.Flag) (string, []interface{}) {
+	name := strings.ToLower(string(flag))
+	if column, ok := searchFlagColumns[name]; ok {
+		return "COALESCE(" + column + ", ?) = ?", []interface{}{false, true}
+	}
+	if name == `\recent` {
+		// 不支持 \Recent，没有邮件带有该标志
+		return "1 = 0", nil
+	}
+	return "COALESCE(keywords, '') LIKE ? ESCAPE '\\'", []interface{}{`%"` + escapeLike(string(flag)) + `"%`}
+}
+
+// searchLikeAny 任一字段包含指定文本（SQLite 的 LIKE 对ASCII字符不区分大小写）
+func searchLikeAny(columns []string) string {
+	likes := make([]string, 0, len(columns))
+	for _, column := range columns {
+		likes = append(likes, "COALESCE("+column+", '') LIKE ? ESCAPE '\\'")
+	}
+	return "(" + strings.Join(likes, " OR ") + ")"
+}
+
+// searchLikeArgs 为 searchLikeAny 生成参数
+func searchLikeArgs(n int, value string) []interface{} {
+	pattern := "%" + escapeLike(value) + "%"
+	args := make([]interface{}, n)
+	for i := range args {
+		args[i] = pattern
 	}
+	return args
+}
+
+// escapeLike 转义 LIKE 中的通配符
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// searchDay 取日期当天零点（本地时区，与存储的时间一致）
+func searchDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+}
 
-	return emails, nil
+// rawHeaderFields 判断存储内容是否为完整邮件时识别的头字段，避免把形如 "Note: xxx" 的正文误判为邮件头
+var rawHeaderFields = []string{
+	"From", "Date", "Message-Id", "Mime-Version", "Content-Type",
+	"Received", "Return-Path", "Subject", "To",
+}
+
+// HasRawHeader 判断存储内容是否以原始报文的邮件头开始，Web端发送的邮件只保存正文
+func HasRawHeader(content string) bool {
+	header, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(content)))
+	if err != nil {
+		return false
+	}
+	for _, key := range rawHeaderFields {
+		if header.Has(key) {
+			return true
+		}
+	}
+	return false
 }
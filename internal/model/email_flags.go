@@ -0,0 +1,125 @@
+package model
+
+import (
+	"sort"
+	"strings"
+)
+
+// IMAP系统标志
+const (
+	FlagSeen     = `\Seen`
+	FlagAnswered = `\Answered`
+	FlagFlagged  = `\Flagged`
+	FlagDeleted  = `\Deleted`
+	FlagDraft    = `\Draft`
+)
+
+// SystemFlags 支持永久保存的系统标志
+var SystemFlags = []string{FlagSeen, FlagAnswered, FlagFlagged, FlagDeleted, FlagDraft}
+
+// FlagOp 标志修改方式
+type FlagOp string
+
+const (
+	FlagOpAdd     FlagOp = "add"     // 添加标志
+	FlagOpRemove  FlagOp = "remove"  // 移除标志
+	FlagOpReplace FlagOp = "replace" // 替换为给定标志
+)
+
+// Flags 返回邮件的全部标志：系统标志在前，关键字在后
+func (e *Email) Flags() []string {
+	var flags []string
+	if e.IsRead {
+		flags = append(flags, FlagSeen)
+	}
+	if e.IsAnswered {
+		flags = append(flags, FlagAnswered)
+	}
+	if e.IsStarred {
+		flags = append(flags, FlagFlagged)
+	}
+	if e.IsDeleted {
+		flags = append(flags, FlagDeleted)
+	}
+	if e.IsDraft {
+		flags = append(flags, FlagDraft)
+	}
+	return append(flags, e.Keywords...)
+}
+
+// ApplyFlags 按 op 修改邮件标志，未知的系统标志（如 \Recent）被忽略
+func (e *Email) ApplyFlags(op FlagOp, flags []string) {
+	if op == FlagOpReplace {
+		e.IsRead, e.IsAnswered, e.IsStarred, e.IsDeleted, e.IsDraft = false, false, false, false, false
+		e.Keywords = nil
+	}
+
+	value := op != FlagOpRemove
+	for _, flag := range flags {
+		flag = strings.TrimSpace(flag)
+		switch {
+		case strings.EqualFold(flag, FlagSeen):
+			e.IsRead = value
+		case strings.EqualFold(flag, FlagAnswered):
+			e.IsAnswered = value
+		case strings.EqualFold(flag, FlagFlagged):
+			e.IsStarred = value
+		case strings.EqualFold(flag, FlagDeleted):
+			e.IsDeleted = value
+		case strings.EqualFold(flag, FlagDraft):
+			e.IsDraft = value
+		case IsValidKeyword(flag):
+			if value {
+				e.Keywords = addKeyword(e.Keywords, flag)
+			} else {
+				e.Keywords = removeKeyword(e.Keywords, flag)
+			}
+		}
+	}
+}
+
+// HasFlag 判断邮件是否带有指定标志，关键字不区分大小写
+func (e *Email) HasFlag(flag string) bool {
+	for _, f := range e.Flags() {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsValidKeyword 判断是否为合法的IMAP关键字（atom，且不以反斜杠开头）
+func IsValidKeyword(keyword string) bool {
+	if keyword == "" || strings.HasPrefix(keyword, `\`) {
+		return false
+	}
+	for _, r := range keyword {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune(`(){%*"\]`, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// addKeyword 添加关键字，已存在（不区分大小写）时保持不变
+func addKeyword(keywords []string, keyword string) []string {
+	for _, k := range keywords {
+		if strings.EqualFold(k, keyword) {
+			return keywords
+		}
+	}
+	keywords = append(keywords, keyword)
+	sort.Strings(keywords)
+	return keywords
+}
+
+// removeKeyword 移除关键字（不区分大小写）
+func removeKeyword(keywords []string, keyword string) []string {
+	var result []string
+	for _, k := range keywords {
+		if !strings.EqualFold(k, keyword) {
+			result = append(result, k)
+		}
+	}
+	return result
+}
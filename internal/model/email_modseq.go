@@ -0,0 +1,235 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrModSeqState 同步状态中的文件夹不属于该邮箱
+var ErrModSeqState = errors.New("无效的同步状态")
+
+// EmailTombstone 邮件离开文件夹（删除、EXPUNGE、移出）的记录，增量同步据此返回已删除的邮件
+type EmailTombstone struct {
+	Id        int64     `gorm:"primaryKey;autoIncrement" json:"id"`
+	FolderId  int64     `gorm:"not null;index:idx_email_tombstone_folder_modseq,priority:1" json:"folder_id"`            // 邮件离开的文件夹ID
+	ModSeq    int64     `gorm:"column:modseq;not null;index:idx_email_tombstone_folder_modseq,priority:2" json:"modseq"` // 离开时分配的文件夹修改序号
+	EmailId   int64     `gorm:"not null" json:"email_id"`                                                                // 邮件ID
+	Uid       uint32    `gorm:"not null;default:0" json:"uid"`                                                           // 邮件在该文件夹内的UID
+	CreatedAt time.Time `json:"created_at"`                                                                              // 创建时间
+}
+
+// TableName 指定表名
+func (EmailTombstone) TableName() string {
+	return "email_tombstone"
+}
+
+// AllocateFolderModSeq 递增文件夹的修改序号并返回新值，需在修改邮件的同一事务中调用
+// 已软删除的文件夹仍可分配，删除文件夹时先记录其中邮件的墓碑
+func AllocateFolderModSeq(db *gorm.DB, folderId int64) (int64, error) {
+	res := db.Model(&Folder{}).Unscoped().Where("id = ?", folderId).
+		UpdateColumn("highest_modseq", gorm.Expr("highest_modseq + 1"))
+	if res.Error != nil {
+		return 0, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return 0, fmt.Errorf("文件夹不存在: %d", folderId)
+	}
+
+	var modSeq int64
+	if err := db.Model(&Folder{}).Unscoped().Where("id = ?", folderId).Pluck("highest_modseq", &modSeq).Error; err != nil {
+		return 0, err
+	}
+	return modSeq, nil
+}
+
+// emailFolderRow 邮件所在文件夹
+type emailFolderRow struct {
+	Id       int64
+	FolderId int64
+	Uid      uint32
+}
+
+// emailsByFolder 查询满足条件的邮件，按文件夹分组，文件夹ID升序
+func emailsByFolder(tx *gorm.DB, query interface{}, args ...interface{}) ([]int64, map[int64][]emailFolderRow, error) {
+	var rows []emailFolderRow
+	if err := tx.Model(&Email{}).Where(query, args...).Select("id, folder_id, uid").Scan(&rows).Error; err != nil {
+		return nil, nil, err
+	}
+
+	groups := make(map[int64][]emailFolderRow)
+	var folderIds []int64
+	for _, row := range rows {
+		if row.FolderId == 0 {
+			continue
+		}
+		if _, ok := groups[row.FolderId]; !ok {
+			folderIds = append(folderIds, row.FolderId)
+		}
+		groups[row.FolderId] = append(groups[row.FolderId], row)
+	}
+	sort.Slice(folderIds, func(i, j int) bool { return folderIds[i] < folderIds[j] })
+	return folderIds, groups, nil
+}
+
+// touchEmails 邮件修改后为其分配所在文件夹的新修改序号，同一文件夹内的邮件共用一个序号
+func touchEmails(tx *gorm.DB, query interface{}, args ...interface{}) error {
+	folderIds, groups, err := emailsByFolder(tx, query, args...)
+	if err != nil {
+		return err
+	}
+	for _, folderId := range folderIds {
+		modSeq, err := AllocateFolderModSeq(tx, folderId)
+		if err != nil {
+			return err
+		}
+		ids := make([]int64, 0, len(groups[folderId]))
+		for _, row := range groups[folderId] {
+			ids = append(ids, row.Id)
+		}
+		if err := tx.Model(&Email{}).Where("id IN ?", ids).UpdateColumn("modseq", modSeq).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buryEmails 邮件删除或移出文件夹前记录墓碑，已软删除的邮件不再重复记录
+func buryEmails(tx *gorm.DB, query interface{}, args ...interface{}) error {
+	folderIds, groups, err := emailsByFolder(tx, query, args...)
+	if err != nil {
+		return err
+	}
+	for _, folderId := range folderIds {
+		modSeq, err := AllocateFolderModSeq(tx, folderId)
+		if err != nil {
+			return err
+		}
+		tombstones := make([]*EmailTombstone, 0, len(groups[folderId]))
+		for _, row := range groups[folderId] {
+			tombstones = append(tombstones, &EmailTombstone{
+				FolderId: folderId,
+				ModSeq:   modSeq,
+				EmailId:  row.Id,
+				Uid:      row.Uid,
+			})
+		}
+		if err := tx.Create(&tombstones).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EmailChange 邮件在文件夹中的一次变更
+type EmailChange struct {
+	EmailId   int64
+	FolderId  int64
+	ModSeq    int64
+	Destroyed bool // 邮件已离开该文件夹
+}
+
+// FolderModSeqs 获取邮箱各文件夹当前的修改序号
+func (m *FolderModel) FolderModSeqs(mailboxId int64) (map[int64]int64, error) {
+	var rows []struct {
+		Id            int64
+		HighestModSeq int64 `gorm:"column:highest_modseq"`
+	}
+	if err := m.db.Model(&Folder{}).Where("mailbox_id = ?", mailboxId).
+		Select("id, highest_modseq").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	modSeqs := make(map[int64]int64, len(rows))
+	for _, row := range rows {
+		modSeqs[row.Id] = row.HighestModSeq
+	}
+	return modSeqs, nil
+}
+
+// Changes 获取邮箱各文件夹修改序号在 (since, until] 范围内的变更，按文件夹ID和修改序号升序排列
+// since 中的文件夹可能已被删除，此时只有墓碑且不设上限；until 中新出现的文件夹从0开始
+func (m *EmailModel) Changes(mailboxId int64, since, until map[int64]int64) ([]*EmailChange, error) {
+	if len(since) > 0 {
+		ids := make([]int64, 0, len(since))
+		for folderId := range since {
+			ids = append(ids, folderId)
+		}
+		var count int64
+		if err := m.db.Model(&Folder{}).Unscoped().
+			Where("id IN ? AND mailbox_id = ?", ids, mailboxId).Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if int(count) != len(ids) {
+			return nil, ErrModSeqState
+		}
+	}
+
+	folderIds := make([]int64, 0, len(until))
+	for folderId := range until {
+		folderIds = append(folderIds, folderId)
+	}
+	for folderId := range since {
+		if _, ok := until[folderId]; !ok {
+			folderIds = append(folderIds, folderId)
+		}
+	}
+	sort.Slice(folderIds, func(i, j int) bool { return folderIds[i] < folderIds[j] })
+
+	var changes []*EmailChange
+	for _, folderId := range folderIds {
+		upper, live := until[folderId]
+		var rows []*EmailChange
+		if live {
+			if err := m.db.Model(&Email{}).
+				Where("folder_id = ? AND modseq > ? AND modseq <= ?", folderId, since[folderId], upper).
+				Select("id AS email_id, folder_id, modseq AS mod_seq").
+				Scan(&rows).Error; err != nil {
+				return nil, err
+			}
+		}
+
+		var tombstones []*EmailChange
+		db := m.db.Model(&EmailTombstone{}).Where("folder_id = ? AND modseq > ?", folderId, since[folderId])
+		if live {
+			db = db.Where("modseq <= ?", upper)
+		}
+		if err := db.Select("email_id, folder_id, modseq AS mod_seq").Scan(&tombstones).Error; err != nil {
+			return nil, err
+		}
+		for _, tombstone := range tombstones {
+			tombstone.Destroyed = true
+		}
+
+		rows = append(rows, tombstones...)
+		sort.SliceStable(rows, func(i, j int) bool { return rows[i].ModSeq < rows[j].ModSeq })
+		changes = append(changes, rows...)
+	}
+	return changes, nil
+}
+
+// MaxId 获取邮箱已分配的最大邮件ID（含已删除的邮件），邮件ID递增，大于该值的邮件为之后新增
+// 只统计该邮箱，其他邮箱收到新邮件不会改变其同步状态
+func (m *EmailModel) MaxId(mailboxId int64) (int64, error) {
+	var maxId int64
+	err := m.db.Model(&Email{}).Unscoped().Where("mailbox_id = ?", mailboxId).Select("COALESCE(MAX(id), 0)").Scan(&maxId).Error
+	return maxId, err
+}
+
+// ExistingIds 获取仍属于邮箱的邮件ID
+func (m *EmailModel) ExistingIds(mailboxId int64, ids []int64) (map[int64]bool, error) {
+	existing := make(map[int64]bool, len(ids))
+	if len(ids) == 0 {
+		return existing, nil
+	}
+	var found []int64
+	if err := m.db.Model(&Email{}).Where("mailbox_id = ? AND id IN ?", mailboxId, ids).Pluck("id", &found).Error; err != nil {
+		return nil, err
+	}
+	for _, id := range found {
+		existing[id] = true
+	}
+	return existing, nil
+}
@@ -0,0 +1,215 @@
+package model
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+)
+
+// 查询条件组合方式
+const (
+	EmailFilterAnd = "AND"
+	EmailFilterOr  = "OR"
+	EmailFilterNot = "NOT"
+)
+
+// ErrEmailFilter 查询条件或排序字段不受支持
+var ErrEmailFilter = errors.New("不支持的查询条件")
+
+// EmailFilter 邮件查询条件
+// Operator 非空时为 Conditions 的组合，NOT 表示所有子条件均不满足；否则各字段之间为AND关系
+type EmailFilter struct {
+	Operator   string
+	Conditions []*EmailFilter
+
+	InFolder     int64     // 所在文件夹
+	NotInFolders []int64   // 不在这些文件夹中
+	Before       time.Time // 接收时间早于
+	After        time.Time // 接收时间不早于
+	MinSize      int64     // 大小不小于
+	MaxSize      int64     // 大小小于
+	From         string
+	To           string
+	Cc           string
+	Bcc          string
+	Subject      string
+	Body         string
+	Text         string // 主题、地址或正文包含
+	HasFlag      string // 带有标志（IMAP名称，如 \Seen 或关键字）
+	NotFlag      string // 不带有标志
+}
+
+// EmailSort 邮件排序，Property 为 EmailSortProperties 中的名称
+type EmailSort struct {
+	Property  string
+	Ascending bool
+}
+
+// EmailSortProperties 支持的排序字段
+var EmailSortProperties = map[string]string{
+	"receivedAt": searchInternalDate,
+	"sentAt":     searchSentDate,
+	"size":       "size",
+	"from":       "from_email",
+	"to":         "to_emails",
+	"subject":    "subject",
+}
+
+// EmailRef 查询结果中的邮件ID及其会话
+type EmailRef struct {
+	Id       int64
+	ThreadId int64
+}
+
+// Query 按条件查询邮箱中的邮件，返回排序后的全部邮件ID，未指定排序时按接收时间倒序
+func (m *EmailModel) Query(mailboxId int64, filter *EmailFilter, sorts []EmailSort) ([]EmailRef, error) {
+	db := m.db.Model(&Email{}).Where("mailbox_id = ?", mailboxId)
+	if filter != nil {
+		cond, args, err := filterCondition(filter)
+		if err != nil {
+			return nil, err
+		}
+		db = db.Where(cond, args...)
+	}
+
+	if len(sorts) == 0 {
+		sorts = []EmailSort{{Property: "receivedAt"}}
+	}
+	for _, sort := range sorts {
+		column, ok := EmailSortProperties[sort.Property]
+		if !ok {
+			return nil, ErrEmailFilter
+		}
+		if sort.Ascending {
+			db = db.Order(column + " ASC")
+		} else {
+			db = db.Order(column + " DESC")
+		}
+	}
+
+	var refs []EmailRef
+	err := db.Order("id DESC").Select("id, thread_id").Scan(&refs).Error
+	return refs, err
+}
+
+// filterCondition 将查询条件转换为SQL条件
+func filterCondition(filter *EmailFilter) (string, []interface{}, error) {
+	if filter.Operator != "" {
+		var conds []string
+		var args []interface{}
+		for _, sub := range filter.Conditions {
+			cond, condArgs, err := filterCondition(sub)
+			if err != nil {
+				return "", nil, err
+			}
+			conds = append(conds, "("+cond+")")
+			args = append(args, condArgs...)
+		}
+		switch filter.Operator {
+		case EmailFilterAnd:
+			if len(conds) == 0 {
+				return "1 = 1", nil, nil
+			}
+			return strings.Join(conds, " AND "), args, nil
+		case EmailFilterOr:
+			if len(conds) == 0 {
+				return "1 = 0", nil, nil
+			}
+			return strings.Join(conds, " OR "), args, nil
+		case EmailFilterNot:
+			if len(conds) == 0 {
+				return "1 = 1", nil, nil
+			}
+			return "NOT (" + strings.Join(conds, " OR ") + ")", args, nil
+		}
+		return "", nil, ErrEmailFilter
+	}
+
+	var conds []string
+	var args []interface{}
+	add := func(cond string, condArgs ...interface{}) {
+		conds = append(conds, cond)
+		args = append(args, condArgs...)
+	}
+
+	if filter.InFolder != 0 {
+		add("folder_id = ?", filter.InFolder)
+	}
+	if len(filter.NotInFolders) > 0 {
+		add("folder_id NOT IN ?", filter.NotInFolders)
+	}
+	if !filter.Before.IsZero() {
+		add(searchInternalDate+" < ?", filter.Before)
+	}
+	if !filter.After.IsZero() {
+		add(searchInternalDate+" >= ?", filter.After)
+	}
+	if filter.MinSize > 0 {
+		add("size >= ?", filter.MinSize)
+	}
+	if filter.MaxSize > 0 {
+		add("size < ?", filter.MaxSize)
+	}
+	for _, header := range [][2]string{
+		{"from", filter.From},
+		{"to", filter.To},
+		{"cc", filter.Cc},
+		{"bcc", filter.Bcc},
+		{"subject", filter.Subject},
+	} {
+		if header[1] != "" {
+			columns := searchHeaderColumns[header[0]]
+			add(searchLikeAny(columns), searchLikeArgs(len(columns), header[1])...)
+		}
+	}
+	if filter.Body != "" {
+		add(searchLikeAny([]string{"content"}), searchLikeArgs(1, filter.Body)...)
+	}
+	if filter.Text != "" {
+		add(searchLikeAny(searchTextColumns), searchLikeArgs(len(searchTextColumns), filter.Text)...)
+	}
+	if filter.HasFlag != "" {
+		cond, condArgs := searchFlagCondition(imap.Flag(filter.HasFlag))
+		add(cond, condArgs...)
+	}
+	if filter.NotFlag != "" {
+		cond, condArgs := searchFlagCondition(imap.Flag(filter.NotFlag))
+		add("NOT ("+cond+")", condArgs...)
+	}
+
+	if len(conds) == 0 {
+		return "1 = 1", nil, nil
+	}
+	return strings.Join(conds, " AND "), args, nil
+}
+
+// FolderCount 文件夹的邮件和会话数量
+type FolderCount struct {
+	FolderId      int64
+	Total         int64
+	Unread        int64
+	Threads       int64
+	UnreadThreads int64
+}
+
+// FolderCounts 统计邮箱各文件夹的邮件数、未读数及对应的会话数
+func (m *EmailModel) FolderCounts(mailboxId int64) (map[int64]*FolderCount, error) {
+	var rows []*FolderCount
+	if err := m.db.Model(&Email{}).
+		Select("folder_id, COUNT(*) AS total, "+
+			"SUM(CASE WHEN is_read THEN 0 ELSE 1 END) AS unread, "+
+			"COUNT(DISTINCT thread_id) AS threads, "+
+			"COUNT(DISTINCT CASE WHEN is_read THEN NULL ELSE thread_id END) AS unread_threads").
+		Where("mailbox_id = ?", mailboxId).
+		Group("folder_id").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	counts := make(map[int64]*FolderCount, len(rows))
+	for _, row := range rows {
+		counts[row.FolderId] = row
+	}
+	return counts, nil
+}
@@ -0,0 +1,126 @@
+package model
+
+import (
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// ParseMessageIdList 解析 In-Reply-To/References 头中的消息ID列表，去掉尖括号，按出现顺序去重
+// 不含尖括号的旧格式按空白分隔
+func ParseMessageIdList(value string) []string {
+	var ids []string
+	seen := make(map[string]bool)
+	add := func(id string) {
+		id = strings.TrimSpace(id)
+		if id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	if !strings.Contains(value, "<") {
+		for _, id := range strings.Fields(value) {
+			add(id)
+		}
+		return ids
+	}
+	for {
+		start := strings.IndexByte(value, '<')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(value[start:], '>')
+		if end < 0 {
+			break
+		}
+		add(value[start+1 : start+end])
+		value = value[start+end+1:]
+	}
+	return ids
+}
+
+// assignThread 为新插入的邮件确定会话ID（RFC 5256 REFERENCES 的思路，范围为同一邮箱）：
+// 引用的邮件已存在时加入其会话；先到达的回复引用了这封邮件时把这些会话合并进来。
+// 会话ID取会话中最早的邮件ID，合并时统一改为最小值
+func assignThread(tx *gorm.DB, e *Email) error {
+	var threadIds []int64
+	if parents := append(ParseMessageIdList(e.References), ParseMessageIdList(e.InReplyTo)...); len(parents) > 0 {
+		if err := tx.Model(&Email{}).
+			Where("mailbox_id = ? AND message_id IN ? AND thread_id <> 0", e.MailboxId, parents).
+			Distinct().Pluck("thread_id", &threadIds).Error; err != nil {
+			return err
+		}
+	}
+	if e.MessageId != "" {
+		// reference_ids 以空格分隔，前后补空格后按完整的消息ID匹配
+		var childThreadIds []int64
+		if err := tx.Model(&Email{}).
+			Where("mailbox_id = ? AND id <> ? AND thread_id <> 0 AND (in_reply_to = ? OR ' ' || reference_ids || ' ' LIKE ? ESCAPE '\\')",
+				e.MailboxId, e.Id, e.MessageId, "% "+escapeLike(e.MessageId)+" %").
+			Distinct().Pluck("thread_id", &childThreadIds).Error; err != nil {
+			return err
+		}
+		threadIds = append(threadIds, childThreadIds...)
+	}
+
+	threadId := e.Id
+	for _, id := range threadIds {
+		if id < threadId {
+			threadId = id
+		}
+	}
+	if len(threadIds) > 0 {
+		// 会话ID变化的邮件需要分配新的修改序号，增量同步才能看到
+		if err := touchEmails(tx, "mailbox_id = ? AND thread_id IN ? AND thread_id <> ?", e.MailboxId, threadIds, threadId); err != nil {
+			return err
+		}
+		if err := tx.Model(&Email{}).Unscoped().
+			Where("mailbox_id = ? AND thread_id IN ?", e.MailboxId, threadIds).
+			UpdateColumn("thread_id", threadId).Error; err != nil {
+			return err
+		}
+	}
+
+	e.ThreadId = threadId
+	return tx.Model(&Email{}).Unscoped().Where("id = ?", e.Id).UpdateColumn("thread_id", threadId).Error
+}
+
+// AssignMissingThreads 升级前的邮件没有会话ID，各自作为独立会话
+func AssignMissingThreads(db *gorm.DB) error {
+	return db.Model(&Email{}).Unscoped().Where("thread_id = 0").UpdateColumn("thread_id", gorm.Expr("id")).Error
+}
+
+// ThreadCounts 统计会话中的邮件数量
+func (m *EmailModel) ThreadCounts(threadIds []int64) (map[int64]int64, error) {
+	counts := make(map[int64]int64, len(threadIds))
+	if len(threadIds) == 0 {
+		return counts, nil
+	}
+
+	var rows []struct {
+		ThreadId int64
+		Count    int64
+	}
+	if err := m.db.Model(&Email{}).
+		Select("thread_id, COUNT(*) AS count").
+		Where("thread_id IN ?", threadIds).
+		Group("thread_id").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		counts[row.ThreadId] = row.Count
+	}
+	return counts, nil
+}
+
+// GetSortFields 获取文件夹内全部邮件用于 IMAP SORT/THREAD 的字段
+func (m *EmailModel) GetSortFields(folderId int64) ([]*Email, error) {
+	var emails []*Email
+	err := m.db.Model(&Email{}).
+		Select("id, uid, message_id, in_reply_to, reference_ids, thread_id, subject, from_email, to_emails, cc_emails, content, blob_key, size, sent_at, received_at, created_at").
+		Where("folder_id = ?", folderId).
+		Find(&emails).Error
+	return emails, err
+}
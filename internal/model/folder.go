@@ -2,6 +2,8 @@ package model
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
@@ -9,14 +11,112 @@ import (
 
 // Folder 邮箱文件夹模型
 type Folder struct {
-	Id        int64          `gorm:"column:id;primaryKey;autoIncrement;comment:文件夹ID"`
-	MailboxId int64          `gorm:"column:mailbox_id;type:bigint;not null;index:idx_mailbox_id_name_parent_id;comment:所属邮箱ID"`
-	Name      string         `gorm:"column:name;type:varchar(255);not null;index:idx_mailbox_id_name_parent_id;comment:文件夹名称"`
-	ParentId  *int64         `gorm:"column:parent_id;type:bigint;index:idx_mailbox_id_name_parent_id;comment:父文件夹ID"`
-	IsSystem  bool           `gorm:"column:is_system;type:boolean;not null;default:false;comment:是否为系统预设文件夹"`
-	CreatedAt time.Time      `gorm:"column:created_at;type:datetime;not null;comment:创建时间"`
-	UpdatedAt time.Time      `gorm:"column:updated_at;type:datetime;not null;comment:更新时间"`
-	DeletedAt gorm.DeletedAt `gorm:"column:deleted_at;type:datetime;index;comment:删除时间"`
+	Id            int64          `gorm:"column:id;primaryKey;autoIncrement;comment:文件夹ID"`
+	MailboxId     int64          `gorm:"column:mailbox_id;type:bigint;not null;index:idx_mailbox_id_name_parent_id;comment:所属邮箱ID"`
+	Name          string         `gorm:"column:name;type:varchar(255);not null;index:idx_mailbox_id_name_parent_id;comment:文件夹名称"`
+	ParentId      *int64         `gorm:"column:parent_id;type:bigint;index:idx_mailbox_id_name_parent_id;comment:父文件夹ID"`
+	IsSystem      bool           `gorm:"column:is_system;type:boolean;not null;default:false;comment:是否为系统预设文件夹"`
+	SpecialUse    string         `gorm:"column:special_use;type:varchar(20);not null;default:'';comment:RFC 6154 特殊用途属性，如 \\Sent"`
+	UidValidity   uint32         `gorm:"column:uid_validity;not null;default:0;comment:IMAP UIDVALIDITY，文件夹重建时变化"`
+	UidNext       uint32         `gorm:"column:uid_next;not null;default:1;comment:下一封邮件分配的IMAP UID"`
+	HighestModSeq int64          `gorm:"column:highest_modseq;not null;default:0;comment:文件夹内最大的修改序号，邮件新增、修改或移出时递增"`
+	CreatedAt     time.Time      `gorm:"column:created_at;type:datetime;not null;comment:创建时间"`
+	UpdatedAt     time.Time      `gorm:"column:updated_at;type:datetime;not null;comment:更新时间"`
+	DeletedAt     gorm.DeletedAt `gorm:"column:deleted_at;type:datetime;index;comment:删除时间"`
+}
+
+// FolderDelimiter 文件夹层级分隔符，"a/b" 表示 a 下的子文件夹 b
+const FolderDelimiter = "/"
+
+// RFC 6154 特殊用途属性
+const (
+	SpecialUseSent    = `\Sent`
+	SpecialUseDrafts  = `\Drafts`
+	SpecialUseTrash   = `\Trash`
+	SpecialUseJunk    = `\Junk`
+	SpecialUseArchive = `\Archive`
+)
+
+// SystemFolderNames 每个邮箱默认创建的顶层系统文件夹
+var SystemFolderNames = []string{"INBOX", "Sent", "Drafts", "Trash", "Junk", "Archive"}
+
+// systemFolderSpecialUse 系统文件夹对应的特殊用途
+var systemFolderSpecialUse = map[string]string{
+	"Sent":    SpecialUseSent,
+	"Drafts":  SpecialUseDrafts,
+	"Trash":   SpecialUseTrash,
+	"Junk":    SpecialUseJunk,
+	"Archive": SpecialUseArchive,
+}
+
+var (
+	ErrFolderExists      = errors.New("文件夹已存在")
+	ErrFolderNotFound    = errors.New("文件夹不存在")
+	ErrFolderPath        = errors.New("无效的文件夹名称")
+	ErrFolderHasChildren = errors.New("文件夹包含子文件夹")
+	ErrFolderMoveInto    = errors.New("不能移动到自身或其子文件夹下")
+)
+
+// SystemFolderSpecialUse 返回顶层系统文件夹默认的特殊用途，其他名称返回空字符串
+func SystemFolderSpecialUse(name string) string {
+	return systemFolderSpecialUse[name]
+}
+
+// IsValidSpecialUse 判断是否为支持的特殊用途属性
+func IsValidSpecialUse(attr string) bool {
+	for _, specialUse := range systemFolderSpecialUse {
+		if attr == specialUse {
+			return true
+		}
+	}
+	return false
+}
+
+// SplitFolderPath 将 "a/b/c" 拆分为各级名称，忽略末尾分隔符，顶层 INBOX 不区分大小写
+// 路径为空或包含空层级时返回nil
+func SplitFolderPath(path string) []string {
+	path = strings.TrimSuffix(path, FolderDelimiter)
+	if path == "" {
+		return nil
+	}
+	names := strings.Split(path, FolderDelimiter)
+	for _, name := range names {
+		if strings.TrimSpace(name) == "" {
+			return nil
+		}
+	}
+	if strings.EqualFold(names[0], "INBOX") {
+		names[0] = "INBOX"
+	}
+	return names
+}
+
+// FolderPaths 根据同一邮箱的文件夹列表计算每个文件夹的完整路径
+func FolderPaths(folders []*Folder) map[int64]string {
+	byId := make(map[int64]*Folder, len(folders))
+	for _, folder := range folders {
+		byId[folder.Id] = folder
+	}
+
+	paths := make(map[int64]string, len(folders))
+	var pathOf func(folder *Folder, depth int) string
+	pathOf = func(folder *Folder, depth int) string {
+		if path, ok := paths[folder.Id]; ok {
+			return path
+		}
+		path := folder.Name
+		if folder.ParentId != nil && depth < len(folders) {
+			if parent, ok := byId[*folder.ParentId]; ok {
+				path = pathOf(parent, depth+1) + FolderDelimiter + folder.Name
+			}
+		}
+		paths[folder.Id] = path
+		return path
+	}
+	for _, folder := range folders {
+		pathOf(folder, 0)
+	}
+	return paths
 }
 
 // TableName Folder 表名
@@ -24,6 +124,53 @@ func (*Folder) TableName() string {
 	return "folders"
 }
 
+// BeforeCreate 新建文件夹时分配UIDVALIDITY
+// 同一邮箱内严格递增，删除后重建的同名文件夹不会复用旧值
+func (f *Folder) BeforeCreate(tx *gorm.DB) error {
+	if f.UidNext == 0 {
+		f.UidNext = 1
+	}
+	if f.SpecialUse == "" && f.IsSystem && f.ParentId == nil {
+		f.SpecialUse = SystemFolderSpecialUse(f.Name)
+	}
+	if f.UidValidity != 0 {
+		return nil
+	}
+
+	var maxValidity uint32
+	err := tx.Session(&gorm.Session{NewDB: true}).Unscoped().Model(&Folder{}).
+		Where("mailbox_id = ?", f.MailboxId).
+		Select("COALESCE(MAX(uid_validity), 0)").
+		Scan(&maxValidity).Error
+	if err != nil {
+		return err
+	}
+
+	f.UidValidity = uint32(time.Now().Unix())
+	if f.UidValidity <= maxValidity {
+		f.UidValidity = maxValidity + 1
+	}
+	return nil
+}
+
+// AllocateFolderUid 在文件夹内分配下一个UID，需在插入邮件的同一事务中调用
+func AllocateFolderUid(db *gorm.DB, folderId int64) (uint32, error) {
+	res := db.Model(&Folder{}).Where("id = ?", folderId).
+		UpdateColumn("uid_next", gorm.Expr("uid_next + 1"))
+	if res.Error != nil {
+		return 0, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return 0, fmt.Errorf("文件夹不存在: %d", folderId)
+	}
+
+	var uidNext uint32
+	if err := db.Model(&Folder{}).Where("id = ?", folderId).Pluck("uid_next", &uidNext).Error; err != nil {
+		return 0, err
+	}
+	return uidNext - 1, nil
+}
+
 // FolderModel 文件夹模型操作
 type FolderModel struct {
 	db *gorm.DB
@@ -73,6 +220,199 @@ func (m *FolderModel) GetByMailboxIdAndName(mailboxId int64, name string, parent
 	return &folder, nil
 }
 
+// GetTopLevelByNameFold 忽略大小写获取顶层文件夹
+func (m *FolderModel) GetTopLevelByNameFold(mailboxId int64, name string) (*Folder, error) {
+	var folder Folder
+	err := m.db.Where("mailbox_id = ? AND parent_id IS NULL AND LOWER(name) = LOWER(?)", mailboxId, name).
+		Order("id ASC").First(&folder).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &folder, nil
+}
+
+// GetByPath 根据 "/" 分隔的完整路径获取文件夹
+func (m *FolderModel) GetByPath(mailboxId int64, path string) (*Folder, error) {
+	names := SplitFolderPath(path)
+	if names == nil {
+		return nil, nil
+	}
+
+	var folder *Folder
+	var parentId *int64
+	for _, name := range names {
+		var err error
+		folder, err = m.GetByMailboxIdAndName(mailboxId, name, parentId)
+		if err != nil || folder == nil {
+			return nil, err
+		}
+		parentId = &folder.Id
+	}
+	return folder, nil
+}
+
+// CreatePath 按完整路径创建文件夹，自动创建缺失的上级文件夹，最后一级已存在时返回 ErrFolderExists
+func (m *FolderModel) CreatePath(mailboxId int64, path string, specialUse string) (*Folder, error) {
+	names := SplitFolderPath(path)
+	if names == nil {
+		return nil, ErrFolderPath
+	}
+
+	var folder *Folder
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		folderModel := NewFolderModel(tx)
+		parent, err := folderModel.ensurePath(mailboxId, names[:len(names)-1])
+		if err != nil {
+			return err
+		}
+
+		var parentId *int64
+		if parent != nil {
+			parentId = &parent.Id
+		}
+		name := names[len(names)-1]
+		existing, err := folderModel.GetByMailboxIdAndName(mailboxId, name, parentId)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return ErrFolderExists
+		}
+
+		folder = &Folder{
+			MailboxId:  mailboxId,
+			Name:       name,
+			ParentId:   parentId,
+			SpecialUse: specialUse,
+		}
+		return folderModel.Create(folder)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return folder, nil
+}
+
+// ensurePath 获取或创建各级文件夹，返回最后一级，names为空时返回nil（顶层）
+func (m *FolderModel) ensurePath(mailboxId int64, names []string) (*Folder, error) {
+	var folder *Folder
+	var parentId *int64
+	for _, name := range names {
+		next, err := m.GetByMailboxIdAndName(mailboxId, name, parentId)
+		if err != nil {
+			return nil, err
+		}
+		if next == nil {
+			next = &Folder{MailboxId: mailboxId, Name: name, ParentId: parentId}
+			if err := m.Create(next); err != nil {
+				return nil, err
+			}
+		}
+		folder = next
+		parentId = &folder.Id
+	}
+	return folder, nil
+}
+
+// MoveToPath 将文件夹重命名/移动到新的完整路径，子文件夹随之移动
+func (m *FolderModel) MoveToPath(folder *Folder, path string) error {
+	names := SplitFolderPath(path)
+	if names == nil {
+		return ErrFolderPath
+	}
+
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		folderModel := NewFolderModel(tx)
+		parent, err := folderModel.ensurePath(folder.MailboxId, names[:len(names)-1])
+		if err != nil {
+			return err
+		}
+
+		var parentId *int64
+		if parent != nil {
+			// 新的上级不能是文件夹自身或其子孙
+			for ancestor := parent; ancestor != nil; {
+				if ancestor.Id == folder.Id {
+					return ErrFolderMoveInto
+				}
+				if ancestor.ParentId == nil {
+					break
+				}
+				if ancestor, err = folderModel.GetById(*ancestor.ParentId); err != nil {
+					return err
+				}
+			}
+			parentId = &parent.Id
+		}
+
+		name := names[len(names)-1]
+		existing, err := folderModel.GetByMailboxIdAndName(folder.MailboxId, name, parentId)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return ErrFolderExists
+		}
+
+		folder.Name = name
+		folder.ParentId = parentId
+		folder.UpdatedAt = time.Now()
+		return folderModel.Update(folder)
+	})
+}
+
+// HasChildren 判断文件夹是否有子文件夹
+func (m *FolderModel) HasChildren(id int64) (bool, error) {
+	var count int64
+	err := m.db.Model(&Folder{}).Where("parent_id = ?", id).Count(&count).Error
+	return count > 0, err
+}
+
+// DeleteWithEmails 删除没有子文件夹的文件夹并永久删除其中的邮件
+// 返回被删除的邮件（按UID排序，用于发布事件）和不再被引用的blob键
+func (m *FolderModel) DeleteWithEmails(id int64) ([]*Email, []string, error) {
+	hasChildren, err := m.HasChildren(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if hasChildren {
+		return nil, nil, ErrFolderHasChildren
+	}
+
+	var emails []*Email
+	var blobKeys []string
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("folder_id = ?", id).Order("uid ASC").Find(&emails).Error; err != nil {
+			return err
+		}
+		// 已软删除的邮件一并清除，避免残留指向已删除文件夹的记录
+		var ids []int64
+		if err := tx.Model(&Email{}).Unscoped().Where("folder_id = ?", id).Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		var err error
+		if blobKeys, err = expungeEmails(tx, ids); err != nil {
+			return err
+		}
+		if err := tx.Where("folder_id = ?", id).Delete(&FolderAcl{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&Folder{}, id).Error
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return emails, blobKeys, nil
+}
+
+// SetSpecialUse 设置文件夹的特殊用途属性
+func (m *FolderModel) SetSpecialUse(id int64, specialUse string) error {
+	return m.db.Model(&Folder{}).Where("id = ?", id).UpdateColumn("special_use", specialUse).Error
+}
+
 // GetByMailboxId 获取邮箱下的所有文件夹
 func (m *FolderModel) GetByMailboxId(mailboxId int64) ([]*Folder, error) {
 	var folders []*Folder
@@ -83,9 +423,16 @@ func (m *FolderModel) GetByMailboxId(mailboxId int64) ([]*Folder, error) {
 	return folders, nil
 }
 
-// Update 更新文件夹
+// Update 更新文件夹，UID计数器和修改序号只通过 AllocateFolderUid、AllocateFolderModSeq 修改
 func (m *FolderModel) Update(folder *Folder) error {
-	return m.db.Save(folder).Error
+	return m.db.Omit("uid_validity", "uid_next", "highest_modseq").Save(folder).Error
+}
+
+// GetWithoutUidValidity 获取尚未分配UIDVALIDITY的文件夹（升级前创建的文件夹）
+func (m *FolderModel) GetWithoutUidValidity() ([]*Folder, error) {
+	var folders []*Folder
+	err := m.db.Where("uid_validity = 0").Find(&folders).Error
+	return folders, err
 }
 
 // Delete 删除文件夹
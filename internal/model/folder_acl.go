@@ -0,0 +1,155 @@
+package model
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ACL权限（RFC 4314）
+const (
+	AclRightLookup     = "l" // LIST/LSUB 可见
+	AclRightRead       = "r" // SELECT、FETCH、SEARCH、COPY 源、STATUS
+	AclRightSeen       = "s" // 保留 \Seen 标志
+	AclRightWrite      = "w" // 设置 \Seen 和 \Deleted 以外的标志
+	AclRightInsert     = "i" // APPEND、COPY/MOVE 目标
+	AclRightPost       = "p" // 向文件夹投递邮件，仅保存不校验
+	AclRightCreate     = "k" // 创建子文件夹、重命名到其下
+	AclRightDelete     = "x" // 删除、重命名文件夹
+	AclRightDeleteMsg  = "t" // 设置或清除 \Deleted 标志、MOVE 源
+	AclRightExpunge    = "e" // EXPUNGE、MOVE 源
+	AclRightAdminister = "a" // 管理ACL
+)
+
+// AclAllRights 全部权限，按RFC 4314规定的顺序排列，文件夹所属邮箱始终拥有全部权限
+const AclAllRights = "lrswipkxtea"
+
+// AclAnyone 授权给服务器上所有邮箱的标识符
+const AclAnyone = "anyone"
+
+// ErrAclRights 权限字符串包含未知权限
+var ErrAclRights = errors.New("无效的ACL权限")
+
+// FolderAcl 文件夹访问控制条目，将文件夹的权限授予其他邮箱
+type FolderAcl struct {
+	Id         int64     `gorm:"primaryKey;autoIncrement" json:"id"`                                                         // 条目ID
+	FolderId   int64     `gorm:"not null;uniqueIndex:idx_folder_acl_identifier,priority:1" json:"folder_id"`                 // 文件夹ID
+	Identifier string    `gorm:"size:100;not null;uniqueIndex:idx_folder_acl_identifier,priority:2;index" json:"identifier"` // 被授权的邮箱地址，anyone 表示所有邮箱
+	Rights     string    `gorm:"size:20;not null" json:"rights"`                                                             // 权限，如 lrs
+	CreatedAt  time.Time `json:"created_at"`                                                                                 // 创建时间
+	UpdatedAt  time.Time `json:"updated_at"`                                                                                 // 更新时间
+}
+
+// TableName 指定表名
+func (FolderAcl) TableName() string {
+	return "folder_acl"
+}
+
+// NormalizeAclRights 校验权限字符串并按标准顺序去重
+// 兼容RFC 2086的旧权限：c 视为 k，d 视为 te
+func NormalizeAclRights(rights string) (string, error) {
+	rights = strings.NewReplacer("c", AclRightCreate, "d", AclRightDeleteMsg+AclRightExpunge).Replace(rights)
+	for _, r := range rights {
+		if !strings.ContainsRune(AclAllRights, r) {
+			return "", ErrAclRights
+		}
+	}
+	return MergeAclRights(rights), nil
+}
+
+// MergeAclRights 合并多组权限，按标准顺序去重
+func MergeAclRights(rights ...string) string {
+	all := strings.Join(rights, "")
+	var b strings.Builder
+	for _, r := range AclAllRights {
+		if strings.ContainsRune(all, r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// HasAclRights 判断 rights 是否包含 need 中的全部权限
+func HasAclRights(rights, need string) bool {
+	for _, r := range need {
+		if !strings.ContainsRune(rights, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// FolderAclModel 文件夹ACL模型
+type FolderAclModel struct {
+	db *gorm.DB
+}
+
+// NewFolderAclModel 创建文件夹ACL模型
+func NewFolderAclModel(db *gorm.DB) *FolderAclModel {
+	return &FolderAclModel{
+		db: db,
+	}
+}
+
+// GetByFolderId 获取文件夹的全部ACL条目
+func (m *FolderAclModel) GetByFolderId(folderId int64) ([]*FolderAcl, error) {
+	var acls []*FolderAcl
+	if err := m.db.Where("folder_id = ?", folderId).Order("identifier").Find(&acls).Error; err != nil {
+		return nil, err
+	}
+	return acls, nil
+}
+
+// Set 设置标识符在文件夹上的权限，权限为空时删除条目
+func (m *FolderAclModel) Set(folderId int64, identifier, rights string) error {
+	if rights == "" {
+		return m.Delete(folderId, identifier)
+	}
+
+	var acl FolderAcl
+	err := m.db.Where("folder_id = ? AND identifier = ?", folderId, identifier).First(&acl).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return m.db.Create(&FolderAcl{FolderId: folderId, Identifier: identifier, Rights: rights}).Error
+	}
+	if err != nil {
+		return err
+	}
+	return m.db.Model(&acl).Update("rights", rights).Error
+}
+
+// Delete 删除标识符在文件夹上的ACL条目
+func (m *FolderAclModel) Delete(folderId int64, identifier string) error {
+	return m.db.Where("folder_id = ? AND identifier = ?", folderId, identifier).Delete(&FolderAcl{}).Error
+}
+
+// DeleteByIdentifier 删除授予某个邮箱的全部ACL条目，邮箱删除时调用，避免同名新邮箱继承授权
+func (m *FolderAclModel) DeleteByIdentifier(identifier string) error {
+	return m.db.Where("identifier = ?", identifier).Delete(&FolderAcl{}).Error
+}
+
+// Rights 获取邮箱在文件夹上被直接授予的权限和通过 anyone 获得的权限
+func (m *FolderAclModel) Rights(folderId int64, email string) (direct string, anyone string, err error) {
+	var acls []*FolderAcl
+	if err = m.db.Where("folder_id = ? AND identifier IN ?", folderId, []string{email, AclAnyone}).Find(&acls).Error; err != nil {
+		return
+	}
+	for _, acl := range acls {
+		if acl.Identifier == AclAnyone {
+			anyone = acl.Rights
+		} else {
+			direct = acl.Rights
+		}
+	}
+	return
+}
+
+// GetGranted 获取授予该邮箱（含 anyone）的全部ACL条目
+func (m *FolderAclModel) GetGranted(email string) ([]*FolderAcl, error) {
+	var acls []*FolderAcl
+	if err := m.db.Where("identifier IN ?", []string{email, AclAnyone}).Find(&acls).Error; err != nil {
+		return nil, err
+	}
+	return acls, nil
+}
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"errors"
 	"time"
 
 	"github.com/rankgice/new-email/internal/constant"
@@ -9,18 +10,22 @@ import (
 
 // Mailbox 邮箱模型
 type Mailbox struct {
-	Id          int64          `gorm:"primaryKey;autoIncrement" json:"id"`         // 邮箱ID
-	UserId      int64          `gorm:"not null;index" json:"user_id"`              // 用户ID
-	DomainId    int64          `gorm:"not null;index" json:"domain_id"`            // 域名ID（自建邮箱关联域名）
-	Email       string         `gorm:"uniqueIndex;size:100;not null" json:"email"` // 邮箱地址
-	Password    string         `gorm:"size:255;not null" json:"-"`                 // 邮箱密码（加密存储）
-	Type        string         `gorm:"size:20;not null;default:imap" json:"type"`  // 邮箱类型：imap, pop3
-	Status      int            `gorm:"default:1" json:"status"`                    // 状态：1启用 0禁用
-	AutoReceive bool           `gorm:"default:true" json:"auto_receive"`           // 是否自动收信
-	LastSyncAt  *time.Time     `json:"last_sync_at"`                               // 最后同步时间
-	CreatedAt   time.Time      `json:"created_at"`                                 // 创建时间
-	UpdatedAt   time.Time      `json:"updated_at"`                                 // 更新时间
-	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`                             // 软删除时间
+	Id               int64          `gorm:"primaryKey;autoIncrement" json:"id"`         // 邮箱ID
+	UserId           int64          `gorm:"not null;index" json:"user_id"`              // 用户ID
+	DomainId         int64          `gorm:"not null;index" json:"domain_id"`            // 域名ID（自建邮箱关联域名）
+	Email            string         `gorm:"uniqueIndex;size:100;not null" json:"email"` // 邮箱地址
+	Password         string         `gorm:"size:255;not null" json:"-"`                 // 邮箱密码（加密存储）
+	ScramSha256      string         `gorm:"column:scram_sha256;size:255" json:"-"`      // SCRAM-SHA-256验证器（RFC 5803格式），由密码派生
+	Type             string         `gorm:"size:20;not null;default:imap" json:"type"`  // 邮箱类型：imap, pop3
+	Status           int            `gorm:"default:1" json:"status"`                    // 状态：1启用 0禁用
+	AutoReceive      bool           `gorm:"default:true" json:"auto_receive"`           // 是否自动收信
+	SubaddressFolder bool           `gorm:"default:false" json:"subaddress_folder"`     // 子地址邮件是否自动归档到同名文件夹
+	LastSyncAt       *time.Time     `json:"last_sync_at"`                               // 最后同步时间
+	CreatedAt        time.Time      `json:"created_at"`                                 // 创建时间
+	UpdatedAt        time.Time      `json:"updated_at"`                                 // 更新时间
+	DeletedAt        gorm.DeletedAt `gorm:"index" json:"-"`                             // 软删除时间
+
+	Quota // 存储配额和用量
 }
 
 // TableName 指定表名
@@ -110,9 +115,40 @@ func (m *MailboxModel) List(params MailboxListParams) ([]*Mailbox, int64, error)
 	return mailboxes, total, nil
 }
 
-// Update 更新邮箱
+// Update 更新邮箱，用量只由邮件增删维护
 func (m *MailboxModel) Update(mailbox *Mailbox) error {
-	return m.db.Updates(mailbox).Error
+	return m.db.Omit(usageColumns...).Updates(mailbox).Error
+}
+
+// GetQuota 获取邮箱及其所属用户的配额和用量
+func (m *MailboxModel) GetQuota(mailboxId int64) (mailboxQuota Quota, userQuota Quota, err error) {
+	var mailbox Mailbox
+	if err = m.db.Where("id = ?", mailboxId).First(&mailbox).Error; err != nil {
+		return
+	}
+	var user User
+	err = m.db.Where("id = ?", mailbox.UserId).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = nil
+	}
+	return mailbox.Quota, user.Quota, err
+}
+
+// CheckQuota 检查邮箱及其所属用户能否再存入 messages 封共 bytes 字节的邮件，超出时返回 ErrQuotaExceeded
+func (m *MailboxModel) CheckQuota(mailboxId int64, bytes, messages int64) error {
+	mailboxQuota, userQuota, err := m.GetQuota(mailboxId)
+	if err != nil {
+		return err
+	}
+	if !mailboxQuota.Allows(bytes, messages) || !userQuota.Allows(bytes, messages) {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// SetScramVerifier 保存邮箱的SCRAM-SHA-256验证器
+func (m *MailboxModel) SetScramVerifier(id int64, verifier string) error {
+	return m.db.Model(&Mailbox{}).Where("id = ?", id).UpdateColumn("scram_sha256", verifier).Error
 }
 
 // Delete 删除邮箱
@@ -0,0 +1,98 @@
+package model
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+// ErrQuotaExceeded 邮箱或用户超出存储配额
+var ErrQuotaExceeded = errors.New("超出存储配额")
+
+// usageColumns 用量字段，只由邮件增删维护，更新邮箱/用户信息时需排除
+var usageColumns = []string{"used_bytes", "used_messages"}
+
+// Quota 存储配额和当前用量，配额为0表示不限制
+type Quota struct {
+	QuotaBytes    int64 `gorm:"column:quota_bytes;not null;default:0" json:"quota_bytes"`       // 存储字节配额
+	QuotaMessages int64 `gorm:"column:quota_messages;not null;default:0" json:"quota_messages"` // 邮件数量配额
+	UsedBytes     int64 `gorm:"column:used_bytes;not null;default:0" json:"used_bytes"`         // 已用字节数
+	UsedMessages  int64 `gorm:"column:used_messages;not null;default:0" json:"used_messages"`   // 已存邮件数
+}
+
+// Allows 判断能否再存入 messages 封共 bytes 字节的邮件
+func (q Quota) Allows(bytes, messages int64) bool {
+	if q.QuotaBytes > 0 && q.UsedBytes+bytes > q.QuotaBytes {
+		return false
+	}
+	if q.QuotaMessages > 0 && q.UsedMessages+messages > q.QuotaMessages {
+		return false
+	}
+	return true
+}
+
+// adjustUsage 调整邮箱及其所属用户的用量
+func adjustUsage(tx *gorm.DB, mailboxId, userId, bytes, messages int64) error {
+	if bytes == 0 && messages == 0 {
+		return nil
+	}
+	usage := map[string]interface{}{
+		"used_bytes":    gorm.Expr("used_bytes + ?", bytes),
+		"used_messages": gorm.Expr("used_messages + ?", messages),
+	}
+	if mailboxId != 0 {
+		if err := tx.Model(&Mailbox{}).Where("id = ?", mailboxId).UpdateColumns(usage).Error; err != nil {
+			return err
+		}
+	}
+	if userId != 0 {
+		if err := tx.Model(&User{}).Where("id = ?", userId).UpdateColumns(usage).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseEmailUsage 删除邮件前扣减其占用的用量，已软删除的邮件不再重复扣减
+func releaseEmailUsage(tx *gorm.DB, query interface{}, args ...interface{}) error {
+	var rows []struct {
+		MailboxId int64
+		UserId    int64
+		Bytes     int64
+		Messages  int64
+	}
+	err := tx.Model(&Email{}).Where(query, args...).
+		Select("mailbox_id, user_id, COALESCE(SUM(size), 0) AS bytes, COUNT(*) AS messages").
+		Group("mailbox_id, user_id").
+		Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if err := adjustUsage(tx, row.MailboxId, row.UserId, -row.Bytes, -row.Messages); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecalculateUsage 补齐历史邮件的大小并根据邮件表重新统计所有邮箱和用户的用量
+func RecalculateUsage(db *gorm.DB) error {
+	if err := db.Model(&Email{}).Unscoped().
+		Where("size = 0 AND content <> ''").
+		UpdateColumn("size", gorm.Expr("LENGTH(CAST(content AS BLOB))")).Error; err != nil {
+		return err
+	}
+
+	global := db.Session(&gorm.Session{AllowGlobalUpdate: true})
+	if err := global.Model(&Mailbox{}).UpdateColumns(map[string]interface{}{
+		"used_bytes":    gorm.Expr("(SELECT COALESCE(SUM(size), 0) FROM email WHERE email.mailbox_id = mailbox.id AND email.deleted_at IS NULL)"),
+		"used_messages": gorm.Expr("(SELECT COUNT(*) FROM email WHERE email.mailbox_id = mailbox.id AND email.deleted_at IS NULL)"),
+	}).Error; err != nil {
+		return err
+	}
+	return global.Model(&User{}).UpdateColumns(map[string]interface{}{
+		"used_bytes":    gorm.Expr("(SELECT COALESCE(SUM(size), 0) FROM email WHERE email.user_id = user.id AND email.deleted_at IS NULL)"),
+		"used_messages": gorm.Expr("(SELECT COUNT(*) FROM email WHERE email.user_id = user.id AND email.deleted_at IS NULL)"),
+	}).Error
+}
@@ -0,0 +1,65 @@
+package model
+
+import (
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Suppression 发信抑制列表，记录用户不应再发送的收件人地址
+type Suppression struct {
+	Id        int64     `gorm:"primaryKey;autoIncrement" json:"id"`                           // 记录ID
+	UserId    int64     `gorm:"not null;uniqueIndex:idx_user_id_email" json:"user_id"`        // 用户ID
+	Email     string    `gorm:"size:255;not null;uniqueIndex:idx_user_id_email" json:"email"` // 被抑制的收件人地址（小写）
+	Reason    string    `gorm:"size:20;not null" json:"reason"`                               // 抑制原因：hard_bounce永久退信
+	Detail    string    `gorm:"size:500" json:"detail"`                                       // 退信状态码及诊断信息
+	EmailId   int64     `gorm:"index" json:"email_id"`                                        // 触发抑制的已发送邮件ID
+	CreatedAt time.Time `json:"created_at"`                                                   // 创建时间
+	UpdatedAt time.Time `json:"updated_at"`                                                   // 更新时间
+}
+
+// TableName 指定表名
+func (Suppression) TableName() string {
+	return "suppression"
+}
+
+// SuppressionModel 抑制列表模型
+type SuppressionModel struct {
+	db *gorm.DB
+}
+
+// NewSuppressionModel 创建抑制列表模型
+func NewSuppressionModel(db *gorm.DB) *SuppressionModel {
+	return &SuppressionModel{
+		db: db,
+	}
+}
+
+// Add 添加抑制记录，地址已存在时更新原因和详情
+func (m *SuppressionModel) Add(suppression *Suppression) error {
+	suppression.Email = strings.ToLower(strings.TrimSpace(suppression.Email))
+	return m.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "email"}},
+		DoUpdates: clause.AssignmentColumns([]string{"reason", "detail", "email_id", "updated_at"}),
+	}).Create(suppression).Error
+}
+
+// GetSuppressedEmails 返回给定地址中已被用户抑制的地址
+func (m *SuppressionModel) GetSuppressedEmails(userId int64, emails []string) ([]string, error) {
+	if len(emails) == 0 {
+		return nil, nil
+	}
+
+	normalized := make([]string, 0, len(emails))
+	for _, email := range emails {
+		normalized = append(normalized, strings.ToLower(strings.TrimSpace(email)))
+	}
+
+	var suppressed []string
+	err := m.db.Model(&Suppression{}).
+		Where("user_id = ? AND email IN ?", userId, normalized).
+		Pluck("email", &suppressed).Error
+	return suppressed, err
+}
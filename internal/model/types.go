@@ -59,16 +59,18 @@ type MailboxListParams struct {
 type EmailListParams struct {
 	BaseListParams
 	BaseTimeRangeParams
-	UserId      int64  `json:"userId" form:"userId"`           // 用户ID
-	MailboxId   int64  `json:"mailboxId" form:"mailboxId"`     // 邮箱ID
-	MessageId   string `json:"messageId" form:"messageId"`     // 消息ID
-	Subject     string `json:"subject" form:"subject"`         // 主题
-	FromEmail   string `json:"fromEmail" form:"fromEmail"`     // 发件人
-	ToEmails    string `json:"toEmails" form:"toEmails"`       // 收件人
-	Direction   string `json:"direction" form:"direction"`     // 方向
-	IsRead      *bool  `json:"isRead" form:"isRead"`           // 是否已读
-	IsStarred   *bool  `json:"isStarred" form:"isStarred"`     // 是否标星
-	ContentType string `json:"contentType" form:"contentType"` // 内容类型
+	UserId       int64  `json:"userId" form:"userId"`             // 用户ID
+	MailboxId    int64  `json:"mailboxId" form:"mailboxId"`       // 邮箱ID
+	MessageId    string `json:"messageId" form:"messageId"`       // 消息ID
+	Subject      string `json:"subject" form:"subject"`           // 主题
+	FromEmail    string `json:"fromEmail" form:"fromEmail"`       // 发件人
+	ToEmails     string `json:"toEmails" form:"toEmails"`         // 收件人
+	Direction    string `json:"direction" form:"direction"`       // 方向
+	IsRead       *bool  `json:"isRead" form:"isRead"`             // 是否已读
+	IsStarred    *bool  `json:"isStarred" form:"isStarred"`       // 是否标星
+	ContentType  string `json:"contentType" form:"contentType"`   // 内容类型
+	ThreadId     int64  `json:"threadId" form:"threadId"`         // 会话ID
+	Conversation bool   `json:"conversation" form:"conversation"` // 按会话列出，每个会话只返回最新一封
 }
 
 // EmailAttachmentListParams 邮件附件列表查询参数
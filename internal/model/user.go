@@ -20,6 +20,8 @@ type User struct {
 	LastLoginIp string    `gorm:"size:45" json:"last_login_ip"`                 // 最后登录IP
 	CreatedAt   time.Time `json:"created_at"`                                   // 创建时间
 	UpdatedAt   time.Time `json:"updated_at"`                                   // 更新时间
+
+	Quota // 存储配额和用量（该用户所有邮箱合计）
 }
 
 // TableName 指定表名
@@ -50,7 +52,15 @@ func (m *UserModel) Update(tx *gorm.DB, user *User) error {
 	if tx != nil {
 		db = tx
 	}
-	return db.Updates(user).Error
+	return db.Omit(usageColumns...).Updates(user).Error
+}
+
+// SetQuota 设置用户的存储配额，0表示不限制
+func (m *UserModel) SetQuota(id int64, quotaBytes, quotaMessages int64) error {
+	return m.db.Model(&User{}).Where("id = ?", id).UpdateColumns(map[string]interface{}{
+		"quota_bytes":    quotaBytes,
+		"quota_messages": quotaMessages,
+	}).Error
 }
 
 // Save 保存用户
@@ -59,7 +69,7 @@ func (m *UserModel) Save(tx *gorm.DB, user *User) error {
 	if tx != nil {
 		db = tx
 	}
-	return db.Save(user).Error
+	return db.Omit(usageColumns...).Save(user).Error
 }
 
 // Delete 删除用户
@@ -74,10 +74,13 @@ func SetupRouter(r *gin.Engine, svcCtx *svc.ServiceContext) {
 	adminHandler := handler.NewAdminHandler(svcCtx)
 	commonHandler := handler.NewCommonHandler(svcCtx)
 	mailboxHandler := handler.NewMailboxHandler(svcCtx)
+	folderHandler := handler.NewFolderHandler(svcCtx)
+	appPasswordHandler := handler.NewAppPasswordHandler(svcCtx)
 	emailHandler := handler.NewEmailHandler(svcCtx)
 	apiKeyHandler := handler.NewApiKeyHandler(svcCtx)
 	domainHandler := handler.NewDomainHandler(svcCtx)
 	apiHandler := handler.NewApiHandler(svcCtx)
+	jmapHandler := handler.NewJmapHandler(svcCtx)
 
 	// API路由组
 	api := r.Group("/api")
@@ -116,6 +119,23 @@ func SetupRouter(r *gin.Engine, svcCtx *svc.ServiceContext) {
 				mailbox.GET("/:id", mailboxHandler.GetById)
 				mailbox.POST("/:id/test", mailboxHandler.TestConnection)
 				mailbox.POST("/:id/sync", mailboxHandler.Sync)
+
+				// 应用专用密码，供邮件客户端登录IMAP/SMTP
+				mailbox.GET("/:id/app-passwords", appPasswordHandler.List)
+				mailbox.POST("/:id/app-passwords", appPasswordHandler.Create)
+				mailbox.DELETE("/:id/app-passwords/:passwordId", appPasswordHandler.Delete)
+			}
+
+			// 文件夹管理，路径以 / 分隔层级
+			folders := user.Group("/folders")
+			{
+				folders.GET("", folderHandler.List)
+				folders.POST("", folderHandler.Create)
+				folders.PUT("/:id", folderHandler.Update)
+				folders.DELETE("/:id", folderHandler.Delete)
+				folders.GET("/:id/acl", folderHandler.ListAcl)
+				folders.PUT("/:id/acl", folderHandler.SetAcl)
+				folders.DELETE("/:id/acl/:identifier", folderHandler.DeleteAcl)
 			}
 
 			// 邮件管理
@@ -126,10 +146,12 @@ func SetupRouter(r *gin.Engine, svcCtx *svc.ServiceContext) {
 				email.POST("/send", emailHandler.Send)
 				email.PUT("/:id/read", emailHandler.MarkRead)
 				email.PUT("/:id/star", emailHandler.MarkStar)
+				email.PUT("/:id/flags", emailHandler.UpdateFlags)
 				email.DELETE("/:id", emailHandler.Delete)
 				email.POST("/batch", emailHandler.BatchOperation)
 				email.GET("/export", emailHandler.Export)
 				email.GET("/download/:filename", emailHandler.Download)
+				email.GET("/:id/attachments/:attachmentId", emailHandler.DownloadAttachment)
 			}
 
 			// API密钥管理
@@ -211,6 +233,18 @@ func SetupRouter(r *gin.Engine, svcCtx *svc.ServiceContext) {
 		}
 	}
 
+	// JMAP (RFC 8620/8621)，使用用户令牌认证
+	r.GET("/.well-known/jmap", jmapHandler.WellKnown)
+	jmap := r.Group("/jmap")
+	jmap.Use(middleware.AuthMiddleware(svcCtx))
+	{
+		jmap.GET("/session", jmapHandler.Session)
+		jmap.POST("/api", jmapHandler.Api)
+		jmap.GET("/download/:accountId/:blobId/:name", jmapHandler.Download)
+		jmap.POST("/upload/:accountId/", jmapHandler.Upload)
+		jmap.GET("/eventsource", jmapHandler.EventSource)
+	}
+
 	// 404处理
 	r.NoRoute(func(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{
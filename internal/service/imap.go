@@ -37,6 +37,7 @@ func NewIMAPService(config IMAPConfig) *IMAPService {
 type IMAPEmail struct {
 	UID         uint32           `json:"uid"`
 	MessageID   string           `json:"messageId"`
+	InReplyTo   string           `json:"inReplyTo"`
 	Subject     string           `json:"subject"`
 	From        string           `json:"from"`
 	To          []string         `json:"to"`
@@ -206,6 +207,7 @@ func (s *IMAPService) FetchEmails(mailbox string, limit uint32) ([]*IMAPEmail, e
 		if msg.Envelope.MessageId != "" {
 			email.MessageID = msg.Envelope.MessageId
 		}
+		email.InReplyTo = msg.Envelope.InReplyTo
 
 		emails = append(emails, email)
 	}
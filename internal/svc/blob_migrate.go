@@ -0,0 +1,220 @@
+package svc
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rankgice/new-email/internal/blob"
+	"github.com/rankgice/new-email/internal/model"
+	"gorm.io/gorm"
+)
+
+// blobMigration 一次对象迁移的来源和目标
+type blobMigration struct {
+	db     *gorm.DB
+	source blob.BlobStore
+	target blob.BlobStore
+	same   bool // 来源与目标为同一存储，只需为旧键重新寻址
+
+	legacyRoot string // 旧版本本地上传目录，只读取和删除该目录下的文件
+}
+
+// MigrateBlobs 将邮件原文和附件从 sourceType（local 或 s3）类型的存储迁移到当前配置的存储，
+// 键统一为按 SHA-256 寻址；旧版本直接保存在 content 中的原始报文也一并移入存储
+// 迁移可重复执行，已迁移的对象会被跳过
+func MigrateBlobs(svcCtx *ServiceContext, sourceType string) error {
+	c := svcCtx.Config
+	m := &blobMigration{
+		db:     svcCtx.DB,
+		target: svcCtx.BlobStore,
+		same:   isS3Storage(sourceType) == isS3Storage(c.Storage.Type),
+	}
+	if c.Storage.BasePath != "" {
+		root, err := resolvePath(c.Storage.BasePath)
+		if err != nil {
+			return fmt.Errorf("解析上传目录失败: %v", err)
+		}
+		m.legacyRoot = root
+	}
+	if m.same {
+		m.source = svcCtx.BlobStore
+	} else {
+		minioClient := svcCtx.minioClient
+		if isS3Storage(sourceType) && minioClient == nil {
+			var err error
+			if minioClient, err = initMinio(c); err != nil {
+				return fmt.Errorf("初始化minio失败: %v", err)
+			}
+		}
+		source, err := initBlobStore(c, sourceType, minioClient)
+		if err != nil {
+			return err
+		}
+		m.source = source
+	}
+
+	log.Printf("🔄 开始迁移对象存储: %s → %s", sourceType, c.Storage.Type)
+	moved, err := m.migrateKeys()
+	if err != nil {
+		return err
+	}
+	inlined, err := m.migrateContent()
+	if err != nil {
+		return err
+	}
+	log.Printf("✅ 对象存储迁移完成: 迁移对象 %d 个，移出数据库的邮件原文 %d 封", moved, inlined)
+	return nil
+}
+
+// migrateKeys 迁移邮件原文和附件引用的全部对象
+func (m *blobMigration) migrateKeys() (int, error) {
+	var emailKeys, attachmentKeys []string
+	if err := m.db.Model(&model.Email{}).Unscoped().
+		Where("blob_key <> ''").
+		Distinct().Pluck("blob_key", &emailKeys).Error; err != nil {
+		return 0, err
+	}
+	if err := m.db.Model(&model.EmailAttachment{}).
+		Where("file_path <> ''").
+		Distinct().Pluck("file_path", &attachmentKeys).Error; err != nil {
+		return 0, err
+	}
+
+	seen := make(map[string]bool)
+	moved := 0
+	for _, key := range append(emailKeys, attachmentKeys...) {
+		if seen[key] || (m.same && blob.IsContentKey(key)) {
+			continue
+		}
+		seen[key] = true
+		if err := m.migrateKey(key); err != nil {
+			return moved, fmt.Errorf("迁移对象 %s 失败: %v", key, err)
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// migrateKey 复制对象到目标存储并更新引用，成功后删除来源对象
+func (m *blobMigration) migrateKey(key string) error {
+	r, legacyPath, err := m.openSource(key)
+	if err != nil {
+		return err
+	}
+	newKey, _, err := m.target.Put(r, 0)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	defer m.target.Release(newKey)
+
+	if newKey != key {
+		err := m.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&model.Email{}).Unscoped().
+				Where("blob_key = ?", key).
+				UpdateColumn("blob_key", newKey).Error; err != nil {
+				return err
+			}
+			return tx.Model(&model.EmailAttachment{}).
+				Where("file_path = ?", key).
+				UpdateColumn("file_path", newKey).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case legacyPath != "":
+		err = os.Remove(legacyPath)
+	case m.same && newKey == key:
+	default:
+		err = m.source.Delete(key)
+	}
+	if err != nil {
+		log.Printf("⚠️  删除已迁移的来源对象失败: %s, %v", key, err)
+	}
+	return nil
+}
+
+// openSource 打开来源对象；旧版本的附件记录保存的是本地文件路径，来源存储中不存在时按路径打开，
+// 此时返回解析后的文件路径
+func (m *blobMigration) openSource(key string) (io.ReadCloser, string, error) {
+	r, err := m.source.Open(key)
+	if err == nil {
+		return r, "", nil
+	}
+	path, ok := m.legacyPath(key)
+	if !ok {
+		return nil, "", err
+	}
+	file, fileErr := os.Open(path)
+	if fileErr != nil {
+		return nil, "", err
+	}
+	return file, path, nil
+}
+
+// legacyPath 解析旧版本附件记录中的本地路径，只接受位于上传目录内的文件
+func (m *blobMigration) legacyPath(key string) (string, bool) {
+	if m.legacyRoot == "" {
+		return "", false
+	}
+	path, err := resolvePath(key)
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(m.legacyRoot, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		log.Printf("⚠️  拒绝访问上传目录之外的文件: %s", key)
+		return "", false
+	}
+	return path, true
+}
+
+// resolvePath 返回路径的绝对形式，并展开其中的符号链接
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if os.IsNotExist(err) {
+		return abs, nil
+	}
+	return resolved, err
+}
+
+// migrateContent 将 content 中的原始报文移入目标存储并清空 content
+func (m *blobMigration) migrateContent() (int, error) {
+	var emails []model.Email
+	inlined := 0
+	result := m.db.Model(&model.Email{}).Unscoped().
+		Select("id", "content").
+		Where("blob_key = '' AND content <> ''").
+		FindInBatches(&emails, 100, func(tx *gorm.DB, batch int) error {
+			for _, email := range emails {
+				if !model.HasRawHeader(email.Content) {
+					continue
+				}
+				key, _, err := m.target.Put(strings.NewReader(email.Content), 0)
+				if err != nil {
+					return fmt.Errorf("迁移邮件 %d 的原文失败: %v", email.Id, err)
+				}
+				err = m.db.Model(&model.Email{}).Unscoped().
+					Where("id = ?", email.Id).
+					UpdateColumns(map[string]interface{}{"blob_key": key, "content": ""}).Error
+				m.target.Release(key)
+				if err != nil {
+					return err
+				}
+				inlined++
+			}
+			return nil
+		})
+	return inlined, result.Error
+}
@@ -6,11 +6,14 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/rankgice/new-email/internal/blob"
 	"github.com/rankgice/new-email/internal/config"
+	"github.com/rankgice/new-email/internal/event"
 	"github.com/rankgice/new-email/internal/model"
 	"github.com/rankgice/new-email/internal/service"
 	"github.com/rankgice/new-email/pkg/auth"
@@ -28,6 +31,12 @@ type ServiceContext struct {
 	// 服务管理器
 	ServiceManager *service.ServiceManager
 
+	// 邮件事件总线，Web端和邮件服务器共享，IMAP会话据此推送更新
+	EventBus *event.Bus
+
+	// 邮件原文和附件存储，Web端和邮件服务器共享
+	BlobStore blob.BlobStore
+
 	minioClient *minio.Client
 	// Model层实例
 	UserModel            *model.UserModel
@@ -37,6 +46,10 @@ type ServiceContext struct {
 	EmailModel           *model.EmailModel
 	EmailAttachmentModel *model.EmailAttachmentModel
 	ApiKeyModel          *model.ApiKeyModel
+	SuppressionModel     *model.SuppressionModel
+	FolderModel          *model.FolderModel
+	AppPasswordModel     *model.AppPasswordModel
+	FolderAclModel       *model.FolderAclModel
 }
 
 // NewServiceContext 创建服务上下文
@@ -54,10 +67,19 @@ func NewServiceContext(c config.Config) *ServiceContext {
 		log.Printf("初始化默认数据失败: %v", err)
 	}
 
-	// 初始化minio
-	minioClient, err := initMinio(c)
+	// 初始化minio，仅在使用S3兼容存储时需要
+	var minioClient *minio.Client
+	if isS3Storage(c.Storage.Type) {
+		var err error
+		if minioClient, err = initMinio(c); err != nil {
+			log.Fatalln("初始化minio失败", "error", err.Error())
+		}
+	}
+
+	// 初始化邮件原文和附件存储
+	blobStore, err := initBlobStore(c, c.Storage.Type, minioClient)
 	if err != nil {
-		log.Fatalln("初始化minio失败", "error", err.Error())
+		log.Fatalln("初始化对象存储失败", "error", err.Error())
 	}
 
 	// 初始化服务管理器
@@ -68,6 +90,8 @@ func NewServiceContext(c config.Config) *ServiceContext {
 		Config:         c,
 		DB:             db,
 		ServiceManager: serviceManager,
+		EventBus:       event.NewBus(),
+		BlobStore:      blobStore,
 
 		minioClient: minioClient,
 		// 初始化所有Model实例
@@ -78,6 +102,10 @@ func NewServiceContext(c config.Config) *ServiceContext {
 		EmailModel:           model.NewEmailModel(db),
 		EmailAttachmentModel: model.NewEmailAttachmentModel(db),
 		ApiKeyModel:          model.NewApiKeyModel(db),
+		SuppressionModel:     model.NewSuppressionModel(db),
+		FolderModel:          model.NewFolderModel(db),
+		AppPasswordModel:     model.NewAppPasswordModel(db),
+		FolderAclModel:       model.NewFolderAclModel(db),
 	}
 }
 
@@ -93,7 +121,8 @@ func initMinio(c config.Config) (*minio.Client, error) {
 	// 初始化桶
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
 	defer cancel()
-	for _, bucketName := range c.Minio.Buckets {
+	buckets := append([]string{blobBucket(c)}, c.Minio.Buckets...)
+	for _, bucketName := range buckets {
 		if exists, err := minioClient.BucketExists(ctx, bucketName); err != nil {
 			return nil, err
 		} else if !exists {
@@ -134,6 +163,37 @@ func initDatabase(c config.Config) *gorm.DB {
 	return db
 }
 
+// isS3Storage 存储类型是否使用S3兼容的对象存储
+func isS3Storage(storageType string) bool {
+	switch strings.ToLower(storageType) {
+	case "s3", "oss", "minio":
+		return true
+	}
+	return false
+}
+
+// blobBucket 保存邮件原文和附件的桶，未配置时使用 mail
+func blobBucket(c config.Config) string {
+	if c.Minio.BlobBucket != "" {
+		return c.Minio.BlobBucket
+	}
+	return "mail"
+}
+
+// initBlobStore 按存储类型初始化邮件原文和附件存储，本地存储未配置目录时使用 ./data/blobs
+func initBlobStore(c config.Config, storageType string, minioClient *minio.Client) (blob.BlobStore, error) {
+	dir := c.Storage.BlobPath
+	if dir == "" {
+		dir = "./data/blobs"
+	}
+	if isS3Storage(storageType) {
+		log.Printf("✅ 对象存储: S3 %s/%s", c.Minio.Endpoint, blobBucket(c))
+		return blob.NewS3Store(minioClient, blobBucket(c), filepath.Join(dir, "tmp"))
+	}
+	log.Printf("✅ 对象存储: 本地目录 %s", dir)
+	return blob.NewLocalStore(dir)
+}
+
 // initServiceManager 初始化服务管理器
 func initServiceManager(c config.Config) *service.ServiceManager {
 	// 构建服务配置
@@ -200,6 +260,10 @@ func autoMigrate(db *gorm.DB) error {
 		&model.Email{},
 		&model.EmailAttachment{},
 		&model.ApiKey{},
+		&model.Suppression{},
+		&model.AppPassword{},
+		&model.FolderAcl{},
+		&model.EmailTombstone{},
 	)
 
 	if err != nil {
@@ -281,12 +345,17 @@ func initDefaultData(db *gorm.DB, c config.Config) error {
 		if err != nil {
 			return fmt.Errorf("密码加密失败: %v", err)
 		}
+		scramVerifier, err := auth.GenerateScramSHA256("test123")
+		if err != nil {
+			return fmt.Errorf("生成SCRAM凭据失败: %v", err)
+		}
 
 		testMailbox := &model.Mailbox{
 			UserId:      1, // 假设用户ID为1
 			DomainId:    defaultDomainId,
 			Email:       "test@email.host",
 			Password:    hashedPassword,
+			ScramSha256: scramVerifier,
 			Type:        "imap",
 			Status:      1, // 启用
 			AutoReceive: true,
@@ -140,22 +140,26 @@ type AdminBatchOperationReq struct {
 
 // UserCreateReq 创建用户请求
 type UserCreateReq struct {
-	Username string `json:"username" binding:"required,min=3,max=50"`  // 用户名
-	Email    string `json:"email" binding:"required,email"`            // 邮箱
-	Password string `json:"password" binding:"required,min=6,max=100"` // 密码
-	Nickname string `json:"nickname" binding:"max=100"`                // 昵称
-	Avatar   string `json:"avatar" binding:"max=500"`                  // 头像URL
-	Status   int    `json:"status" binding:"oneof=0 1"`                // 状态：0禁用 1启用
+	Username      string `json:"username" binding:"required,min=3,max=50"`  // 用户名
+	Email         string `json:"email" binding:"required,email"`            // 邮箱
+	Password      string `json:"password" binding:"required,min=6,max=100"` // 密码
+	Nickname      string `json:"nickname" binding:"max=100"`                // 昵称
+	Avatar        string `json:"avatar" binding:"max=500"`                  // 头像URL
+	Status        int    `json:"status" binding:"oneof=0 1"`                // 状态：0禁用 1启用
+	QuotaBytes    int64  `json:"quotaBytes" binding:"min=0"`                // 存储字节配额，0不限制
+	QuotaMessages int64  `json:"quotaMessages" binding:"min=0"`             // 邮件数量配额，0不限制
 }
 
 // UserUpdateReq 更新用户请求
 type UserUpdateReq struct {
-	Username string `json:"username" binding:"required,min=3,max=50"` // 用户名
-	Email    string `json:"email" binding:"required,email"`           // 邮箱
-	Password string `json:"password" binding:"max=100"`               // 密码（可选）
-	Nickname string `json:"nickname" binding:"max=100"`               // 昵称
-	Avatar   string `json:"avatar" binding:"max=500"`                 // 头像URL
-	Status   int    `json:"status" binding:"oneof=0 1"`               // 状态：0禁用 1启用
+	Username      string `json:"username" binding:"required,min=3,max=50"` // 用户名
+	Email         string `json:"email" binding:"required,email"`           // 邮箱
+	Password      string `json:"password" binding:"max=100"`               // 密码（可选）
+	Nickname      string `json:"nickname" binding:"max=100"`               // 昵称
+	Avatar        string `json:"avatar" binding:"max=500"`                 // 头像URL
+	Status        int    `json:"status" binding:"oneof=0 1"`               // 状态：0禁用 1启用
+	QuotaBytes    *int64 `json:"quotaBytes" binding:"omitempty,min=0"`     // 存储字节配额，0不限制，不传则不修改
+	QuotaMessages *int64 `json:"quotaMessages" binding:"omitempty,min=0"`  // 邮件数量配额，0不限制，不传则不修改
 }
 
 // UserListReq 用户列表请求
@@ -177,6 +181,7 @@ type UserResp struct {
 	Avatar      string    `json:"avatar"`      // 头像URL
 	Status      int       `json:"status"`      // 状态
 	LastLoginAt time.Time `json:"lastLoginAt"` // 最后登录时间
+	Quota       QuotaResp `json:"quota"`       // 存储配额和用量（所有邮箱合计）
 	CreatedAt   time.Time `json:"createdAt"`   // 创建时间
 	UpdatedAt   time.Time `json:"updatedAt"`   // 更新时间
 }
@@ -0,0 +1,31 @@
+package types
+
+import "time"
+
+// AppPasswordCreateReq 创建应用专用密码请求
+type AppPasswordCreateReq struct {
+	Label string `json:"label" binding:"required,max=100"`               // 标签，如 "iPhone 邮件"
+	Scope string `json:"scope" binding:"omitempty,oneof=imap pop3 smtp"` // 使用范围：空为不限，imap、pop3 或 smtp
+}
+
+// AppPasswordResp 应用专用密码响应
+type AppPasswordResp struct {
+	Id         int64      `json:"id"`         // 密码ID
+	MailboxId  int64      `json:"mailboxId"`  // 邮箱ID
+	Label      string     `json:"label"`      // 标签
+	Hint       string     `json:"hint"`       // 密码末4位
+	Scope      string     `json:"scope"`      // 使用范围
+	LastUsedAt *time.Time `json:"lastUsedAt"` // 最后使用时间
+	CreatedAt  time.Time  `json:"createdAt"`  // 创建时间
+}
+
+// AppPasswordCreateResp 创建应用专用密码响应
+type AppPasswordCreateResp struct {
+	Id        int64     `json:"id"`        // 密码ID
+	MailboxId int64     `json:"mailboxId"` // 邮箱ID
+	Label     string    `json:"label"`     // 标签
+	Password  string    `json:"password"`  // 密码（完整，仅创建时返回）
+	Hint      string    `json:"hint"`      // 密码末4位
+	Scope     string    `json:"scope"`     // 使用范围
+	CreatedAt time.Time `json:"createdAt"` // 创建时间
+}
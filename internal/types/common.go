@@ -30,7 +30,7 @@ type ChangePasswordReq struct {
 
 // UploadResp 上传响应
 type UploadResp struct {
-	Url      string `json:"url"`      // 文件URL
+	Url      string `json:"url"`      // 文件在对象存储中的键
 	Filename string `json:"filename"` // 文件名
 	Size     int64  `json:"size"`     // 文件大小
 	Type     string `json:"type"`     // 上传类型
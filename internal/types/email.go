@@ -28,26 +28,43 @@ type EmailListReq struct {
 	Type           string    `json:"type" form:"type"`                     // 邮件类型
 	CreatedAtStart time.Time `json:"createdAtStart" form:"createdAtStart"` // 创建时间开始
 	CreatedAtEnd   time.Time `json:"createdAtEnd" form:"createdAtEnd"`     // 创建时间结束
+	ThreadId       int64     `json:"threadId" form:"threadId"`             // 会话ID，只列出该会话的邮件
+	Conversation   bool      `json:"conversation" form:"conversation"`     // 按会话列出，每个会话只返回最新一封邮件
 	PageReq
 }
 
 // EmailResp 邮件响应
 type EmailResp struct {
-	Id          int64     `json:"id"`          // 邮件ID
-	UserId      int64     `json:"userId"`      // 用户ID
-	MailboxId   int64     `json:"mailboxId"`   // 邮箱ID
-	Subject     string    `json:"subject"`     // 邮件主题
-	FromEmail   string    `json:"fromEmail"`   // 发件人邮箱
-	ToEmail     []string  `json:"toEmail"`     // 收件人邮箱
-	CcEmail     []string  `json:"ccEmail"`     // 抄送邮箱
-	BccEmail    []string  `json:"bccEmail"`    // 密送邮箱
-	Content     string    `json:"content"`     // 邮件内容
-	ContentType string    `json:"contentType"` // 内容类型
-	Attachments string    `json:"attachments"` // 附件信息
-	Status      int       `json:"status"`      // 状态
-	Type        string    `json:"type"`        // 邮件类型
-	CreatedAt   time.Time `json:"createdAt"`   // 创建时间
-	UpdatedAt   time.Time `json:"updatedAt"`   // 更新时间
+	Id             int64     `json:"id"`             // 邮件ID
+	UserId         int64     `json:"userId"`         // 用户ID
+	MailboxId      int64     `json:"mailboxId"`      // 邮箱ID
+	Subject        string    `json:"subject"`        // 邮件主题
+	FromEmail      string    `json:"fromEmail"`      // 发件人邮箱
+	ToEmail        []string  `json:"toEmail"`        // 收件人邮箱
+	CcEmail        []string  `json:"ccEmail"`        // 抄送邮箱
+	BccEmail       []string  `json:"bccEmail"`       // 密送邮箱
+	Content        string    `json:"content"`        // 邮件内容
+	ContentType    string    `json:"contentType"`    // 内容类型
+	Attachments    string    `json:"attachments"`    // 附件信息
+	Status         int       `json:"status"`         // 状态
+	Type           string    `json:"type"`           // 邮件类型
+	DeliveryStatus string    `json:"deliveryStatus"` // 投递状态：bounced退信 complained投诉
+	Flags          []string  `json:"flags"`          // IMAP标志，如 \Seen、\Flagged、$Forwarded
+	ThreadId       int64     `json:"threadId"`       // 会话ID
+	ThreadCount    int64     `json:"threadCount"`    // 会话中的邮件数量，仅按会话列出时返回
+	CreatedAt      time.Time `json:"createdAt"`      // 创建时间
+	UpdatedAt      time.Time `json:"updatedAt"`      // 更新时间
+}
+
+// EmailFlagsReq 修改邮件标志请求
+type EmailFlagsReq struct {
+	Op    string   `json:"op" binding:"required,oneof=add remove replace"` // 修改方式：add添加 remove移除 replace替换
+	Flags []string `json:"flags"`                                          // 系统标志（\Seen \Answered \Flagged \Deleted \Draft）或关键字
+}
+
+// EmailFlagsResp 修改邮件标志响应
+type EmailFlagsResp struct {
+	Flags []string `json:"flags"` // 修改后的全部标志
 }
 
 // EmailSendReq 发送邮件请求
@@ -60,6 +77,8 @@ type EmailSendReq struct {
 	Content     string           `json:"content" binding:"required"`            // 邮件内容
 	ContentType string           `json:"contentType" binding:"oneof=text html"` // 内容类型：text, html
 	Attachments []AttachmentData `json:"attachments"`                           // 附件信息
+	// IgnoreSuppression 为true时忽略抑制列表，强制发送给已退信的地址
+	IgnoreSuppression bool `json:"ignoreSuppression"`
 }
 
 // AttachmentData 附件数据
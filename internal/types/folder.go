@@ -0,0 +1,47 @@
+package types
+
+import "time"
+
+// FolderListReq 文件夹列表请求
+type FolderListReq struct {
+	MailboxId int64 `json:"mailboxId" form:"mailboxId" binding:"required"` // 邮箱ID
+}
+
+// FolderCreateReq 创建文件夹请求
+type FolderCreateReq struct {
+	MailboxId  int64  `json:"mailboxId" binding:"required"` // 邮箱ID
+	Path       string `json:"path" binding:"required"`      // 完整路径，以 / 分隔层级，缺失的上级文件夹会自动创建
+	SpecialUse string `json:"specialUse"`                   // 特殊用途属性，如 \Sent、\Archive
+}
+
+// FolderUpdateReq 重命名/移动文件夹请求
+type FolderUpdateReq struct {
+	Path string `json:"path" binding:"required"` // 新的完整路径，子文件夹随之移动
+}
+
+// FolderResp 文件夹响应
+type FolderResp struct {
+	Id         int64     `json:"id"`                 // 文件夹ID
+	MailboxId  int64     `json:"mailboxId"`          // 邮箱ID
+	Name       string    `json:"name"`               // 文件夹名称
+	Path       string    `json:"path"`               // 完整路径
+	ParentId   *int64    `json:"parentId,omitempty"` // 父文件夹ID
+	IsSystem   bool      `json:"isSystem"`           // 是否系统文件夹
+	SpecialUse string    `json:"specialUse"`         // 特殊用途属性
+	CreatedAt  time.Time `json:"createdAt"`          // 创建时间
+	UpdatedAt  time.Time `json:"updatedAt"`          // 更新时间
+}
+
+// FolderAclSetReq 设置文件夹授权请求
+type FolderAclSetReq struct {
+	Identifier string `json:"identifier" binding:"required"` // 被授权的邮箱地址，anyone 表示所有邮箱
+	Rights     string `json:"rights"`                        // RFC 4314 权限，如 lrs；为空时收回授权
+}
+
+// FolderAclResp 文件夹授权响应
+type FolderAclResp struct {
+	Identifier string    `json:"identifier"` // 被授权的邮箱地址或 anyone
+	Rights     string    `json:"rights"`     // 权限
+	CreatedAt  time.Time `json:"createdAt"`  // 创建时间
+	UpdatedAt  time.Time `json:"updatedAt"`  // 更新时间
+}
@@ -0,0 +1,343 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// JMAP (RFC 8620/8621) 协议对象，字段名和取值遵循协议定义
+
+// JMAP 能力标识
+const (
+	JmapCapabilityCore       = "urn:ietf:params:jmap:core"
+	JmapCapabilityMail       = "urn:ietf:params:jmap:mail"
+	JmapCapabilitySubmission = "urn:ietf:params:jmap:submission"
+)
+
+// JmapSession 会话资源 (RFC 8620 2)
+type JmapSession struct {
+	Capabilities    map[string]interface{}  `json:"capabilities"`    // 服务器能力
+	Accounts        map[string]*JmapAccount `json:"accounts"`        // 可访问的账户
+	PrimaryAccounts map[string]string       `json:"primaryAccounts"` // 各能力的主账户
+	Username        string                  `json:"username"`        // 登录用户名
+	ApiUrl          string                  `json:"apiUrl"`          // API地址
+	DownloadUrl     string                  `json:"downloadUrl"`     // 下载地址模板
+	UploadUrl       string                  `json:"uploadUrl"`       // 上传地址模板
+	EventSourceUrl  string                  `json:"eventSourceUrl"`  // 推送地址模板
+	State           string                  `json:"state"`           // 会话状态
+}
+
+// JmapCoreCapability urn:ietf:params:jmap:core 能力
+type JmapCoreCapability struct {
+	MaxSizeUpload         int64    `json:"maxSizeUpload"`
+	MaxConcurrentUpload   int64    `json:"maxConcurrentUpload"`
+	MaxSizeRequest        int64    `json:"maxSizeRequest"`
+	MaxConcurrentRequests int64    `json:"maxConcurrentRequests"`
+	MaxCallsInRequest     int64    `json:"maxCallsInRequest"`
+	MaxObjectsInGet       int64    `json:"maxObjectsInGet"`
+	MaxObjectsInSet       int64    `json:"maxObjectsInSet"`
+	CollationAlgorithms   []string `json:"collationAlgorithms"`
+}
+
+// JmapMailCapability urn:ietf:params:jmap:mail 账户能力
+type JmapMailCapability struct {
+	MaxMailboxesPerEmail       *int64   `json:"maxMailboxesPerEmail"`
+	MaxMailboxDepth            *int64   `json:"maxMailboxDepth"`
+	MaxSizeMailboxName         int64    `json:"maxSizeMailboxName"`
+	MaxSizeAttachmentsPerEmail int64    `json:"maxSizeAttachmentsPerEmail"`
+	EmailQuerySortOptions      []string `json:"emailQuerySortOptions"`
+	MayCreateTopLevelMailbox   bool     `json:"mayCreateTopLevelMailbox"`
+}
+
+// JmapSubmissionCapability urn:ietf:params:jmap:submission 账户能力
+type JmapSubmissionCapability struct {
+	MaxDelayedSend       int64               `json:"maxDelayedSend"`
+	SubmissionExtensions map[string][]string `json:"submissionExtensions"`
+}
+
+// JmapAccount 账户，对应用户的一个邮箱
+type JmapAccount struct {
+	Name                string                 `json:"name"`
+	IsPersonal          bool                   `json:"isPersonal"`
+	IsReadOnly          bool                   `json:"isReadOnly"`
+	AccountCapabilities map[string]interface{} `json:"accountCapabilities"`
+}
+
+// JmapRequest API请求 (RFC 8620 3.3)
+type JmapRequest struct {
+	Using       []string          `json:"using"`
+	MethodCalls []JmapInvocation  `json:"methodCalls"`
+	CreatedIds  map[string]string `json:"createdIds,omitempty"`
+}
+
+// JmapResponse API响应 (RFC 8620 3.4)
+type JmapResponse struct {
+	MethodResponses []JmapInvocation  `json:"methodResponses"`
+	CreatedIds      map[string]string `json:"createdIds,omitempty"`
+	SessionState    string            `json:"sessionState"`
+}
+
+// JmapInvocation 方法调用或响应，序列化为 [name, arguments, callId]
+type JmapInvocation struct {
+	Name   string
+	Args   json.RawMessage
+	CallId string
+}
+
+// MarshalJSON 序列化为三元组
+func (i JmapInvocation) MarshalJSON() ([]byte, error) {
+	args := i.Args
+	if len(args) == 0 {
+		args = json.RawMessage("{}")
+	}
+	return json.Marshal([]interface{}{i.Name, args, i.CallId})
+}
+
+// UnmarshalJSON 解析三元组
+func (i *JmapInvocation) UnmarshalJSON(data []byte) error {
+	var parts []json.RawMessage
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+	if len(parts) != 3 {
+		return fmt.Errorf("方法调用应为3个元素，实际为%d个", len(parts))
+	}
+	if err := json.Unmarshal(parts[0], &i.Name); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(parts[2], &i.CallId); err != nil {
+		return err
+	}
+	i.Args = parts[1]
+	return nil
+}
+
+// JmapProblem 请求级错误 (RFC 7807)
+type JmapProblem struct {
+	Type   string `json:"type"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+	Limit  string `json:"limit,omitempty"`
+}
+
+// JmapMethodError 方法级错误
+type JmapMethodError struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+// JmapResultReference 引用之前方法调用的结果 (RFC 8620 3.7)
+type JmapResultReference struct {
+	ResultOf string `json:"resultOf"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+}
+
+// JmapSetError 单个对象创建、更新或删除失败的原因
+type JmapSetError struct {
+	Type        string   `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Properties  []string `json:"properties,omitempty"`
+}
+
+// JmapGetReq /get 请求
+type JmapGetReq struct {
+	AccountId  string    `json:"accountId"`
+	Ids        *[]string `json:"ids"`        // 为null时返回全部
+	Properties []string  `json:"properties"` // 为null时返回默认属性
+}
+
+// JmapEmailGetReq Email/get 请求
+type JmapEmailGetReq struct {
+	JmapGetReq
+	BodyProperties      []string `json:"bodyProperties"`
+	FetchTextBodyValues bool     `json:"fetchTextBodyValues"`
+	FetchHTMLBodyValues bool     `json:"fetchHTMLBodyValues"`
+	FetchAllBodyValues  bool     `json:"fetchAllBodyValues"`
+	MaxBodyValueBytes   int      `json:"maxBodyValueBytes"`
+}
+
+// JmapGetResp /get 响应
+type JmapGetResp struct {
+	AccountId string        `json:"accountId"`
+	State     string        `json:"state"`
+	List      []interface{} `json:"list"`
+	NotFound  []string      `json:"notFound"`
+}
+
+// JmapChangesReq /changes 请求
+type JmapChangesReq struct {
+	AccountId  string `json:"accountId"`
+	SinceState string `json:"sinceState"`
+	MaxChanges int    `json:"maxChanges"`
+}
+
+// JmapChangesResp /changes 响应
+type JmapChangesResp struct {
+	AccountId      string   `json:"accountId"`
+	OldState       string   `json:"oldState"`
+	NewState       string   `json:"newState"`
+	HasMoreChanges bool     `json:"hasMoreChanges"`
+	Created        []string `json:"created"`
+	Updated        []string `json:"updated"`
+	Destroyed      []string `json:"destroyed"`
+}
+
+// JmapComparator /query 排序条件
+type JmapComparator struct {
+	Property    string `json:"property"`
+	IsAscending *bool  `json:"isAscending"` // 默认为true
+	Collation   string `json:"collation"`
+}
+
+// JmapEmailQueryReq Email/query 请求
+type JmapEmailQueryReq struct {
+	AccountId       string           `json:"accountId"`
+	Filter          json.RawMessage  `json:"filter"`
+	Sort            []JmapComparator `json:"sort"`
+	Position        int              `json:"position"`
+	Anchor          string           `json:"anchor"`
+	AnchorOffset    int              `json:"anchorOffset"`
+	Limit           *int             `json:"limit"`
+	CalculateTotal  bool             `json:"calculateTotal"`
+	CollapseThreads bool             `json:"collapseThreads"`
+}
+
+// JmapQueryResp /query 响应
+type JmapQueryResp struct {
+	AccountId           string   `json:"accountId"`
+	QueryState          string   `json:"queryState"`
+	CanCalculateChanges bool     `json:"canCalculateChanges"`
+	Position            int      `json:"position"`
+	Ids                 []string `json:"ids"`
+	Total               *int     `json:"total,omitempty"`
+	Limit               *int     `json:"limit,omitempty"`
+}
+
+// JmapSetReq /set 请求
+type JmapSetReq struct {
+	AccountId string                                `json:"accountId"`
+	IfInState string                                `json:"ifInState"`
+	Create    map[string]json.RawMessage            `json:"create"`
+	Update    map[string]map[string]json.RawMessage `json:"update"` // 值为 PatchObject
+	Destroy   []string                              `json:"destroy"`
+}
+
+// JmapSetResp /set 响应
+type JmapSetResp struct {
+	AccountId    string                   `json:"accountId"`
+	OldState     string                   `json:"oldState"`
+	NewState     string                   `json:"newState"`
+	Created      map[string]interface{}   `json:"created"`
+	Updated      map[string]interface{}   `json:"updated"`
+	Destroyed    []string                 `json:"destroyed"`
+	NotCreated   map[string]*JmapSetError `json:"notCreated"`
+	NotUpdated   map[string]*JmapSetError `json:"notUpdated"`
+	NotDestroyed map[string]*JmapSetError `json:"notDestroyed"`
+}
+
+// JmapEmailSubmissionSetReq EmailSubmission/set 请求
+type JmapEmailSubmissionSetReq struct {
+	JmapSetReq
+	OnSuccessUpdateEmail  map[string]map[string]json.RawMessage `json:"onSuccessUpdateEmail"`
+	OnSuccessDestroyEmail []string                              `json:"onSuccessDestroyEmail"`
+}
+
+// JmapMailbox Mailbox 对象，对应文件夹
+type JmapMailbox struct {
+	Id            string            `json:"id"`
+	Name          string            `json:"name"`
+	ParentId      *string           `json:"parentId"`
+	Role          *string           `json:"role"`
+	SortOrder     int               `json:"sortOrder"`
+	TotalEmails   int64             `json:"totalEmails"`
+	UnreadEmails  int64             `json:"unreadEmails"`
+	TotalThreads  int64             `json:"totalThreads"`
+	UnreadThreads int64             `json:"unreadThreads"`
+	MyRights      JmapMailboxRights `json:"myRights"`
+	IsSubscribed  bool              `json:"isSubscribed"`
+}
+
+// JmapMailboxRights 当前用户对 Mailbox 的权限
+type JmapMailboxRights struct {
+	MayReadItems   bool `json:"mayReadItems"`
+	MayAddItems    bool `json:"mayAddItems"`
+	MayRemoveItems bool `json:"mayRemoveItems"`
+	MaySetSeen     bool `json:"maySetSeen"`
+	MaySetKeywords bool `json:"maySetKeywords"`
+	MayCreateChild bool `json:"mayCreateChild"`
+	MayRename      bool `json:"mayRename"`
+	MayDelete      bool `json:"mayDelete"`
+	MaySubmit      bool `json:"maySubmit"`
+}
+
+// JmapEmailAddress 邮件地址
+type JmapEmailAddress struct {
+	Name  *string `json:"name"`
+	Email string  `json:"email"`
+}
+
+// JmapEmailBodyPart 邮件正文部分
+type JmapEmailBodyPart struct {
+	PartId      *string `json:"partId"`
+	BlobId      *string `json:"blobId"`
+	Size        int64   `json:"size"`
+	Name        *string `json:"name"`
+	Type        string  `json:"type"`
+	Charset     *string `json:"charset"`
+	Disposition *string `json:"disposition"`
+}
+
+// JmapEmailBodyValue 正文部分的文本内容
+type JmapEmailBodyValue struct {
+	Value             string `json:"value"`
+	IsEncodingProblem bool   `json:"isEncodingProblem"`
+	IsTruncated       bool   `json:"isTruncated"`
+}
+
+// JmapEmailCreate Email/set 创建邮件（草稿）的属性
+type JmapEmailCreate struct {
+	MailboxIds  map[string]bool               `json:"mailboxIds"`
+	Keywords    map[string]bool               `json:"keywords"`
+	From        []JmapEmailAddress            `json:"from"`
+	To          []JmapEmailAddress            `json:"to"`
+	Cc          []JmapEmailAddress            `json:"cc"`
+	Bcc         []JmapEmailAddress            `json:"bcc"`
+	ReplyTo     []JmapEmailAddress            `json:"replyTo"`
+	Subject     string                        `json:"subject"`
+	SentAt      *time.Time                    `json:"sentAt"`
+	ReceivedAt  *time.Time                    `json:"receivedAt"`
+	MessageId   []string                      `json:"messageId"`
+	InReplyTo   []string                      `json:"inReplyTo"`
+	References  []string                      `json:"references"`
+	BodyValues  map[string]JmapEmailBodyValue `json:"bodyValues"`
+	TextBody    []JmapEmailBodyPart           `json:"textBody"`
+	HtmlBody    []JmapEmailBodyPart           `json:"htmlBody"`
+	Attachments []JmapEmailBodyPart           `json:"attachments"`
+}
+
+// JmapEmailSubmissionCreate EmailSubmission/set 创建提交的属性
+type JmapEmailSubmissionCreate struct {
+	IdentityId string          `json:"identityId"`
+	EmailId    string          `json:"emailId"`
+	Envelope   json.RawMessage `json:"envelope"`
+}
+
+// JmapIdentity 发件身份，每个邮箱一个
+type JmapIdentity struct {
+	Id            string             `json:"id"`
+	Name          string             `json:"name"`
+	Email         string             `json:"email"`
+	ReplyTo       []JmapEmailAddress `json:"replyTo"`
+	Bcc           []JmapEmailAddress `json:"bcc"`
+	TextSignature string             `json:"textSignature"`
+	HtmlSignature string             `json:"htmlSignature"`
+	MayDelete     bool               `json:"mayDelete"`
+}
+
+// JmapStateChange EventSource 推送的状态变更 (RFC 8620 7.1)
+type JmapStateChange struct {
+	Type    string                       `json:"@type"`
+	Changed map[string]map[string]string `json:"changed"`
+}
@@ -4,21 +4,27 @@ import "time"
 
 // MailboxCreateReq 创建邮箱请求
 type MailboxCreateReq struct {
-	DomainId    int64  `json:"domainId"`                       // 域名ID（可选，使用默认域名）
-	Email       string `json:"email" binding:"required,email"` // 邮箱地址
-	Password    string `json:"password" binding:"required"`    // 邮箱密码
-	AutoReceive bool   `json:"autoReceive"`                    // 是否自动收信
-	Status      int    `json:"status" binding:"oneof=0 1"`     // 状态
+	DomainId         int64  `json:"domainId"`                       // 域名ID（可选，使用默认域名）
+	Email            string `json:"email" binding:"required,email"` // 邮箱地址
+	Password         string `json:"password" binding:"required"`    // 邮箱密码
+	AutoReceive      bool   `json:"autoReceive"`                    // 是否自动收信
+	Status           int    `json:"status" binding:"oneof=0 1"`     // 状态
+	SubaddressFolder bool   `json:"subaddressFolder"`               // 子地址邮件自动归档到同名文件夹
+	QuotaBytes       int64  `json:"quotaBytes" binding:"min=0"`     // 存储字节配额，0不限制
+	QuotaMessages    int64  `json:"quotaMessages" binding:"min=0"`  // 邮件数量配额，0不限制
 }
 
 // MailboxUpdateReq 更新邮箱请求
 type MailboxUpdateReq struct {
-	Id          int64  `json:"id" binding:"required"`      // 邮箱ID
-	DomainId    int64  `json:"domainId"`                   // 域名ID（自建邮箱）
-	Email       string `json:"email" binding:"email"`      // 邮箱地址
-	Password    string `json:"password"`                   // 邮箱密码
-	AutoReceive bool   `json:"autoReceive"`                // 是否自动收信
-	Status      int    `json:"status" binding:"oneof=0 1"` // 状态
+	Id               int64  `json:"id" binding:"required"`                   // 邮箱ID
+	DomainId         int64  `json:"domainId"`                                // 域名ID（自建邮箱）
+	Email            string `json:"email" binding:"email"`                   // 邮箱地址
+	Password         string `json:"password"`                                // 邮箱密码
+	AutoReceive      bool   `json:"autoReceive"`                             // 是否自动收信
+	Status           int    `json:"status" binding:"oneof=0 1"`              // 状态
+	SubaddressFolder bool   `json:"subaddressFolder"`                        // 子地址邮件自动归档到同名文件夹
+	QuotaBytes       *int64 `json:"quotaBytes" binding:"omitempty,min=0"`    // 存储字节配额，0不限制，不传则不修改
+	QuotaMessages    *int64 `json:"quotaMessages" binding:"omitempty,min=0"` // 邮件数量配额，0不限制，不传则不修改
 }
 
 // MailboxListReq 邮箱列表请求
@@ -34,15 +40,32 @@ type MailboxListReq struct {
 
 // MailboxResp 邮箱响应
 type MailboxResp struct {
-	Id          int64      `json:"id"`                   // 邮箱ID
-	UserId      int64      `json:"userId"`               // 用户ID
-	DomainId    int64      `json:"domainId"`             // 域名ID
-	Email       string     `json:"email"`                // 邮箱地址
-	AutoReceive bool       `json:"autoReceive"`          // 是否自动收信
-	Status      int        `json:"status"`               // 状态
-	LastSyncAt  *time.Time `json:"lastSyncAt,omitempty"` // 最后同步时间
-	CreatedAt   time.Time  `json:"createdAt"`            // 创建时间
-	UpdatedAt   time.Time  `json:"updatedAt"`            // 更新时间
+	Id               int64      `json:"id"`                   // 邮箱ID
+	UserId           int64      `json:"userId"`               // 用户ID
+	DomainId         int64      `json:"domainId"`             // 域名ID
+	Email            string     `json:"email"`                // 邮箱地址
+	AutoReceive      bool       `json:"autoReceive"`          // 是否自动收信
+	Status           int        `json:"status"`               // 状态
+	SubaddressFolder bool       `json:"subaddressFolder"`     // 子地址邮件自动归档到同名文件夹
+	LastSyncAt       *time.Time `json:"lastSyncAt,omitempty"` // 最后同步时间
+	Quota            QuotaResp  `json:"quota"`                // 存储配额和用量
+	CreatedAt        time.Time  `json:"createdAt"`            // 创建时间
+	UpdatedAt        time.Time  `json:"updatedAt"`            // 更新时间
+}
+
+// QuotaResp 存储配额和用量，配额为0表示不限制
+type QuotaResp struct {
+	QuotaBytes    int64 `json:"quotaBytes"`    // 存储字节配额
+	QuotaMessages int64 `json:"quotaMessages"` // 邮件数量配额
+	UsedBytes     int64 `json:"usedBytes"`     // 已用字节数
+	UsedMessages  int64 `json:"usedMessages"`  // 已存邮件数
+}
+
+// MailboxUsageResp 单个邮箱的存储用量
+type MailboxUsageResp struct {
+	Id    int64     `json:"id"`    // 邮箱ID
+	Email string    `json:"email"` // 邮箱地址
+	Quota QuotaResp `json:"quota"` // 存储配额和用量
 }
 
 // MailboxSyncReq 同步邮箱请求
@@ -73,6 +96,8 @@ type MailboxConnectionTestResp struct {
 
 // MailboxStatsResp 邮箱统计响应
 type MailboxStatsResp struct {
-	TotalMailboxes  int64 `json:"totalMailboxes"`  // 总邮箱数
-	ActiveMailboxes int64 `json:"activeMailboxes"` // 活跃邮箱数
+	TotalMailboxes  int64              `json:"totalMailboxes"`  // 总邮箱数
+	ActiveMailboxes int64              `json:"activeMailboxes"` // 活跃邮箱数
+	Quota           QuotaResp          `json:"quota"`           // 用户的存储配额和用量（所有邮箱合计）
+	Mailboxes       []MailboxUsageResp `json:"mailboxes"`       // 各邮箱的存储配额和用量
 }
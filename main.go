@@ -17,6 +17,7 @@ import (
 )
 
 var configFile = flag.String("f", "etc/config.yaml", "配置文件路径")
+var migrateBlobs = flag.String("migrate-blobs", "", "将邮件原文和附件从指定类型的存储（local 或 s3）迁移到当前配置的存储后退出")
 
 func main() {
 	flag.Parse()
@@ -38,6 +39,14 @@ func main() {
 	svcCtx := svc.NewServiceContext(c)
 	log.Println("✅ 服务上下文初始化成功")
 
+	// 迁移对象存储后退出，不启动服务
+	if *migrateBlobs != "" {
+		if err := svc.MigrateBlobs(svcCtx, *migrateBlobs); err != nil {
+			log.Fatal("对象存储迁移失败：", err)
+		}
+		return
+	}
+
 	// 设置路由
 	router.SetupRouter(r, svcCtx)
 	log.Println("✅ 路由设置完成")
@@ -57,8 +66,27 @@ func main() {
 		IMAPUseTLS:      c.IMAP.UseTLS,
 		IMAPTLSCertPath: c.IMAP.TLSCertPath,
 		IMAPTLSKeyPath:  c.IMAP.TLSKeyPath,
+		IMAPCompress:    c.IMAP.Compress,
+		LMTPEnabled:     c.LMTP.Enabled,
+		LMTPAddr:        c.LMTP.Addr,
+		POP3Enabled:     c.POP3.Enabled,
+		POP3Port:        c.POP3.Port,
+		POP3TLSPort:     c.POP3.TLSPort,
+		POP3UseTLS:      c.POP3.UseTLS,
+		POP3TLSCertPath: c.POP3.TLSCertPath,
+		POP3TLSKeyPath:  c.POP3.TLSKeyPath,
+
+		ProxyProtocol:     c.Proxy.Enabled,
+		ProxyTrustedCIDRs: c.Proxy.TrustedCIDRs,
+
+		SubaddressSeparators: c.SMTP.SubaddressSeparators,
+
+		JWTSecret: c.JWT.Secret,
+	}
+	mailServer, err := mailserver.NewMailServer(mailServerConfig, svcCtx.DB, svcCtx.EventBus, svcCtx.BlobStore)
+	if err != nil {
+		log.Fatal("邮件服务器初始化失败：", err)
 	}
-	mailServer := mailserver.NewMailServer(mailServerConfig, svcCtx.DB)
 	if err := mailServer.Start(); err != nil {
 		log.Fatal("邮件服务器启动失败：", err)
 	}